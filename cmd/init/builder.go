@@ -121,7 +121,10 @@ func (b *Builder) translateAndRun(args []string, environment map[string]string)
 	return true, nil
 }
 
-func (b *Builder) execCommand(args []string, env map[string]string) error {
+// The maximum amount of output from a script included in the error if it fails.
+const SCRIPT_OUTPUT_LIMIT = 8 * 1024
+
+func (b *Builder) execCommand(args []string, env map[string]string, output io.Writer) error {
 	if b.translateShell {
 		fatal, err := b.translateAndRun(args, env)
 		if err != nil {
@@ -139,7 +142,7 @@ func (b *Builder) execCommand(args []string, env map[string]string) error {
 
 	start := time.Now()
 
-	if err := common.ExecCommand(args, env); err != nil {
+	if err := common.ExecCommandWithOutput(args, env, output); err != nil {
 		return fmt.Errorf("failed to run command: %s", err)
 	}
 
@@ -158,7 +161,22 @@ type BuilderScript struct {
 	Environment map[string]string `json:"env"`
 }
 
+// runScript runs a single script. If it fails the error includes the tail of it's output.
 func (b *Builder) runScript(script BuilderScript) error {
+	output := &common.TailBuffer{Limit: SCRIPT_OUTPUT_LIMIT}
+
+	if err := b.runScriptWithOutput(script, output); err != nil {
+		if out := output.String(); out != "" {
+			return fmt.Errorf("%s %s: %w\n--- last %d bytes of output ---\n%s", script.Kind, script.Exec, err, len(out), out)
+		}
+
+		return fmt.Errorf("%s %s: %w", script.Kind, script.Exec, err)
+	}
+
+	return nil
+}
+
+func (b *Builder) runScriptWithOutput(script BuilderScript, output io.Writer) error {
 	switch script.Kind {
 	case "trigger_on":
 		start := time.Now()
@@ -180,6 +198,7 @@ func (b *Builder) runScript(script BuilderScript) error {
 		if err := b.execCommand(
 			append([]string{script.Exec}, args...),
 			script.Environment,
+			output,
 		); err != nil {
 			return err
 		}
@@ -197,6 +216,7 @@ func (b *Builder) runScript(script BuilderScript) error {
 		if err := b.execCommand(
 			append([]string{script.Exec}, script.Arguments...),
 			script.Environment,
+			output,
 		); err != nil {
 			return err
 		}
@@ -257,6 +277,13 @@ func (b *Builder) RunScripts(filename string) error {
 	return nil
 }
 
+const (
+	// Outputs which upload an archive of the files changed by the last command.
+	changedArchiveOutput = "/init/changed.archive"
+	// Like changedArchiveOutput but deleted files are recorded as whiteout entries.
+	layerArchiveOutput = "/init/layer.archive"
+)
+
 type changeTracker struct {
 	// unix microseconds since epoch. 0 if this is a directory.
 	ModTime  int64                     `json:"m"`
@@ -340,7 +367,9 @@ func (builder *Builder) writeChangeTracker(outputFilename string) error {
 	return nil
 }
 
-func (builder *Builder) uploadChangedArchive(hostAddress string, changeTrackerFilename string) error {
+// uploadChangedArchive uploads the files changed since the change tracker was written.
+// If whiteouts is true the files that were deleted are included as whiteout entries.
+func (builder *Builder) uploadChangedArchive(hostAddress string, changeTrackerFilename string, whiteouts bool) error {
 	mountList, err := common.GetMounts()
 	if err != nil {
 		return err
@@ -368,7 +397,10 @@ func (builder *Builder) uploadChangedArchive(hostAddress string, changeTrackerFi
 
 	var enumerate func(tracker *changeTracker, filename string) error
 
-	var changedFiles []string
+	var (
+		changedFiles []string
+		deletedFiles []string
+	)
 
 	enumerate = func(tracker *changeTracker, filename string) error {
 		mount, ok := mounts[filename]
@@ -400,12 +432,30 @@ func (builder *Builder) uploadChangedArchive(hostAddress string, changeTrackerFi
 		}
 
 		// Assume this is a directory.
+		info, err := os.Lstat(filename)
+		if err != nil {
+			return err
+		}
+
+		// Either the directory was replaced by a file or this is a file with a zero modification time.
+		if !info.IsDir() {
+			if tracker.Children != nil || info.ModTime().UnixMicro() > 0 {
+				changedFiles = append(changedFiles, filename)
+			}
+
+			return nil
+		}
+
 		ents, err := os.ReadDir(filename)
 		if err != nil {
 			return err
 		}
 
+		present := make(map[string]bool)
+
 		for _, ent := range ents {
+			present[ent.Name()] = true
+
 			child := tracker.Children[ent.Name()]
 
 			if err := enumerate(child, filepath.Join(filename, ent.Name())); err != nil {
@@ -413,6 +463,14 @@ func (builder *Builder) uploadChangedArchive(hostAddress string, changeTrackerFi
 			}
 		}
 
+		if whiteouts {
+			for name := range tracker.Children {
+				if !present[name] {
+					deletedFiles = append(deletedFiles, filepath.Join(filename, name))
+				}
+			}
+		}
+
 		return nil
 	}
 
@@ -541,6 +599,18 @@ func (builder *Builder) uploadChangedArchive(hostAddress string, changeTrackerFi
 				return
 			}
 		}
+
+		for _, file := range deletedFiles {
+			dir, name := filepath.Split(file)
+
+			if err := ark.WriteEntry(&filesystem.CacheEntry{
+				CTypeflag: filesystem.TypeRegular,
+				CName:     filepath.Join(dir, filesystem.WhiteoutPrefix+name),
+			}, nil); err != nil {
+				errors <- err
+				return
+			}
+		}
 	}()
 
 	go func() {
@@ -570,6 +640,10 @@ func builderRunWithConfig(cfg config.BuilderConfig) error {
 		common.SetDefaultInteractive(cfg.DefaultInteractive)
 	}
 
+	if cfg.FallbackShell {
+		common.FallbackShell = []string{"/init", "-shell"}
+	}
+
 	builder := &Builder{}
 
 	for _, env := range cfg.Environment {
@@ -582,7 +656,7 @@ func builderRunWithConfig(cfg config.BuilderConfig) error {
 	for i, cmd := range cfg.Commands {
 		// Check if this is the last command.
 		if i == len(cfg.Commands)-1 {
-			if cfg.OutputFilename == "/init/changed.archive" {
+			if cfg.OutputFilename == changedArchiveOutput || cfg.OutputFilename == layerArchiveOutput {
 				// take a snapshot of the filesystem and store it locally.
 
 				if err := builder.writeChangeTracker("/init.changed"); err != nil {
@@ -601,8 +675,8 @@ func builderRunWithConfig(cfg config.BuilderConfig) error {
 		return unix.Exec(cfg.ExecInit, []string{cfg.ExecInit}, os.Environ())
 	}
 
-	if cfg.OutputFilename == "/init/changed.archive" {
-		if err := builder.uploadChangedArchive(cfg.HostAddress, "/init.changed"); err != nil {
+	if cfg.OutputFilename == changedArchiveOutput || cfg.OutputFilename == layerArchiveOutput {
+		if err := builder.uploadChangedArchive(cfg.HostAddress, "/init.changed", cfg.OutputFilename == layerArchiveOutput); err != nil {
 			return err
 		}
 	} else if cfg.OutputFilename != "" {
@@ -0,0 +1,111 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/client4"
+	"github.com/insomniacslk/dhcp/netboot"
+	"go.starlark.net/starlark"
+)
+
+// How long to wait for each reply before starting the exchange again.
+const dhcpRetryInterval = 2 * time.Second
+
+// requestDhcpLease runs a DHCPv4 exchange on ifname until a lease is acknowledged or timeout passes.
+func requestDhcpLease(ifname string, timeout time.Duration) (*dhcpv4.DHCPv4, error) {
+	if _, err := net.InterfaceByName(ifname); err != nil {
+		return nil, fmt.Errorf("failed to get interface: %v", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	var lastErr error
+
+	for attempt := 1; time.Now().Before(deadline); attempt++ {
+		start := time.Now()
+
+		client := client4.NewClient()
+		client.ReadTimeout = min(time.Until(deadline), dhcpRetryInterval)
+
+		slog.Debug("sending dhcp request", "ifname", ifname, "attempt", attempt)
+
+		conversation, err := client.Exchange(ifname)
+		if err == nil {
+			for _, msg := range conversation {
+				if msg.MessageType() == dhcpv4.MessageTypeAck {
+					return msg, nil
+				}
+			}
+
+			err = fmt.Errorf("no ACK received")
+		}
+
+		lastErr = err
+
+		// Don't retry straight away if the exchange failed without waiting for a reply.
+		time.Sleep(min(time.Until(deadline), time.Until(start.Add(client.ReadTimeout))))
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("timed out")
+	}
+
+	return nil, fmt.Errorf("no DHCP lease obtained on %s after %s: %v", ifname, timeout, lastErr)
+}
+
+// configureDhcp requests a lease on ifname and applies the address, default route, and DNS
+// servers from it. It returns the lease as a dict.
+func configureDhcp(ifname string, timeout time.Duration) (starlark.Value, error) {
+	ack, err := requestDhcpLease(ifname, timeout)
+	if err != nil {
+		return starlark.None, err
+	}
+
+	netConf, err := netboot.GetNetConfFromPacketv4(ack)
+	if err != nil {
+		return starlark.None, fmt.Errorf("failed to read dhcp response: %v", err)
+	}
+
+	if err := netboot.ConfigureInterface(ifname, netConf); err != nil {
+		return starlark.None, fmt.Errorf("failed to configure interface: %v", err)
+	}
+
+	slog.Debug("configured networking with dhcp", "addresses", netConf.Addresses)
+
+	prefix, _ := ack.SubnetMask().Size()
+
+	gateway := ""
+	if len(netConf.Routers) > 0 {
+		gateway = netConf.Routers[0].String()
+	}
+
+	var dnsServers []starlark.Value
+	for _, server := range netConf.DNSServers {
+		dnsServers = append(dnsServers, starlark.String(server.String()))
+	}
+
+	ret := starlark.NewDict(5)
+
+	for _, field := range []struct {
+		key   string
+		value starlark.Value
+	}{
+		{"ip", starlark.String(ack.YourIPAddr.String())},
+		{"prefix_length", starlark.MakeInt(prefix)},
+		{"gateway", starlark.String(gateway)},
+		{"dns", starlark.NewList(dnsServers)},
+		{"lease_time", starlark.MakeInt64(int64(ack.IPAddressLeaseTime(0).Seconds()))},
+	} {
+		if err := ret.SetKey(starlark.String(field.key), field.value); err != nil {
+			return starlark.None, err
+		}
+	}
+
+	return ret, nil
+}
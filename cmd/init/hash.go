@@ -0,0 +1,42 @@
+//go:build linux
+
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+var hashAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha1":   sha1.New,
+	"md5":    md5.New,
+}
+
+// hashFile returns the hex digest of the file at path. The file is streamed
+// through the hash so large files aren't read into memory.
+func hashFile(path string, algo string) (string, error) {
+	newHash, ok := hashAlgorithms[algo]
+	if !ok {
+		return "", fmt.Errorf("unknown hash algorithm %q (supported: sha256, sha1, md5)", algo)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("hash_file: %w", err)
+	}
+	defer f.Close()
+
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("hash_file: failed to read %s: %w", path, err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
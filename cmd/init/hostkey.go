@@ -0,0 +1,61 @@
+//go:build linux
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"golang.org/x/crypto/ssh"
+)
+
+// hostKey is a SSH host key that can be passed to run_ssh_server.
+type hostKey struct {
+	signer ssh.Signer
+}
+
+// generateHostKey derives a ed25519 host key from seed. The same seed always
+// gives the same key so anyone who knows the seed can impersonate the guest.
+// It's only meant for tests that pin the host key.
+func generateHostKey(seed string) (*hostKey, error) {
+	keySeed := sha256.Sum256([]byte(seed))
+
+	signer, err := ssh.NewSignerFromKey(ed25519.NewKeyFromSeed(keySeed[:]))
+	if err != nil {
+		return nil, err
+	}
+
+	return &hostKey{signer: signer}, nil
+}
+
+// Attr implements starlark.HasAttrs.
+func (k *hostKey) Attr(name string) (starlark.Value, error) {
+	if name == "public_key" {
+		return starlark.String(strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(k.signer.PublicKey())), "\n")), nil
+	} else if name == "fingerprint" {
+		return starlark.String(ssh.FingerprintSHA256(k.signer.PublicKey())), nil
+	} else {
+		return nil, nil
+	}
+}
+
+// AttrNames implements starlark.HasAttrs.
+func (k *hostKey) AttrNames() []string {
+	return []string{"public_key", "fingerprint"}
+}
+
+func (k *hostKey) String() string {
+	return fmt.Sprintf("HostKey{%s}", ssh.FingerprintSHA256(k.signer.PublicKey()))
+}
+func (*hostKey) Type() string          { return "HostKey" }
+func (*hostKey) Hash() (uint32, error) { return 0, fmt.Errorf("HostKey is not hashable") }
+func (*hostKey) Truth() starlark.Bool  { return starlark.True }
+func (*hostKey) Freeze()               {}
+
+var (
+	_ starlark.Value    = &hostKey{}
+	_ starlark.HasAttrs = &hostKey{}
+)
@@ -7,9 +7,11 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -18,6 +20,8 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
 	"strings"
 	"syscall"
 	"time"
@@ -28,6 +32,7 @@ import (
 	"github.com/insomniacslk/dhcp/netboot"
 	"github.com/jsimonetti/rtnetlink/rtnl"
 	"github.com/schollz/progressbar/v3"
+	"github.com/tinyrange/tinyrange/pkg/buildinfo"
 	"github.com/tinyrange/tinyrange/pkg/common"
 	"github.com/tinyrange/tinyrange/pkg/config"
 	starlarkjson "go.starlark.net/lib/json"
@@ -86,6 +91,15 @@ func SetWinsize(fd uintptr, w, h uint32) error {
 type sshServer struct {
 	callable starlark.Callable
 	command  []string
+	banner   string
+	motd     string
+	hostKey  *hostKey
+	// Only accept this username if it's set.
+	username string
+	// Extra environment variables for the connection set by the callable with set_env.
+	env []string
+	// The port to listen on. Defaults to 2222.
+	port int
 }
 
 // Attr implements starlark.HasAttrs.
@@ -114,6 +128,29 @@ func (s *sshServer) Attr(name string) (starlark.Value, error) {
 				return starlark.None, err
 			}
 
+			return starlark.None, nil
+		}), nil
+	} else if name == "set_env" {
+		return starlark.NewBuiltin("SSHServer.set_env", func(
+			thread *starlark.Thread,
+			fn *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			var (
+				key   string
+				value string
+			)
+
+			if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
+				"key", &key,
+				"value", &value,
+			); err != nil {
+				return starlark.None, err
+			}
+
+			s.env = append(s.env, key+"="+value)
+
 			return starlark.None, nil
 		}), nil
 	} else {
@@ -123,37 +160,114 @@ func (s *sshServer) Attr(name string) (starlark.Value, error) {
 
 // AttrNames implements starlark.HasAttrs.
 func (s *sshServer) AttrNames() []string {
-	return []string{"run"}
+	return []string{"run", "set_env"}
 }
 
-func (s *sshServer) attachShell(conn ssh.Conn, connection ssh.Channel, env []string, resizes <-chan []byte) error {
-	if s.callable != nil {
-		if _, err := starlark.Call(&starlark.Thread{}, s.callable, starlark.Tuple{s}, []starlark.Tuple{}); err != nil {
-			return err
-		}
+// callableAcceptsInfo checks if callable can be called with the connection info as a second argument.
+func callableAcceptsInfo(callable starlark.Callable) bool {
+	fn, ok := callable.(*starlark.Function)
+	if !ok {
+		return false
 	}
 
-	shell := exec.Command(s.command[0], s.command[1:]...)
+	if fn.HasVarargs() {
+		return true
+	}
 
-	shell.Env = env
+	positional := fn.NumParams() - fn.NumKwonlyParams()
+	if fn.HasKwargs() {
+		positional -= 1
+	}
+
+	return positional >= 2
+}
+
+// connect calls the callable for a new shell or command on conn. command is empty for shells.
+// The callable gets its own copy of the server so run and set_env only affect this connection.
+func (s *sshServer) connect(conn ssh.Conn, command string) (*sshServer, error) {
+	session := *s
+	session.env = nil
+
+	// Servers without a callable (like the fallback server) run the command they were created with.
+	if s.callable == nil {
+		return &session, nil
+	}
+
+	// Otherwise the callable chooses the command with run.
+	session.command = nil
+
+	args := starlark.Tuple{&session}
+
+	if callableAcceptsInfo(s.callable) {
+		info := starlark.NewDict(4)
 
-	close := func() {
-		if shell.Process != nil {
-			if ps, err := shell.Process.Wait(); err != nil && ps != nil {
-				slog.Warn("failed to exit shell", "error", err)
+		for _, field := range []struct {
+			key   string
+			value string
+		}{
+			{"remote_address", conn.RemoteAddr().String()},
+			{"username", conn.User()},
+			{"command", command},
+			{"client_version", string(conn.ClientVersion())},
+		} {
+			if err := info.SetKey(starlark.String(field.key), starlark.String(field.value)); err != nil {
+				return nil, err
 			}
 		}
 
-		connection.Close()
+		args = append(args, info)
+	} else if command != "" {
+		// Callables that don't take the connection info only handle shells.
+		return &session, nil
+	}
+
+	if _, err := starlark.Call(&starlark.Thread{}, s.callable, args, []starlark.Tuple{}); err != nil {
+		return nil, err
 	}
 
+	return &session, nil
+}
+
+func (s *sshServer) attachShell(conn ssh.Conn, connection ssh.Channel, env []string, resizes <-chan []byte) error {
+	session, err := s.connect(conn, "")
+	if err != nil {
+		return err
+	}
+
+	if len(session.command) == 0 {
+		return fmt.Errorf("the SSH server callable did not call run with a command")
+	}
+
+	shell := exec.Command(session.command[0], session.command[1:]...)
+
+	return s.attachPty(connection, shell, append(slices.Clone(env), session.env...), resizes, true)
+}
+
+// attachPty runs shell with a PTY connected to connection. If showMotd is set
+// the message of the day is printed before any output from the shell.
+func (s *sshServer) attachPty(connection ssh.Channel, shell *exec.Cmd, env []string, resizes <-chan []byte, showMotd bool) error {
+	shell.Env = env
+
 	//start a shell for this channel's connection
 	shellf, err := pty.Start(shell)
 	if err != nil {
-		close()
+		connection.Close()
 		return fmt.Errorf("could not start pty: %s", err)
 	}
 
+	// Closed once the shell has exited and status is set.
+	exited := make(chan struct{})
+	status := 0
+
+	// Print the message of the day before any output from the shell.
+	if showMotd && s.motd != "" {
+		if motd, err := os.ReadFile(s.motd); err == nil {
+			_, _ = connection.Write([]byte(strings.ReplaceAll(string(motd), "\n", "\r\n")))
+		} else if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("failed to read motd", "filename", s.motd, "error", err)
+		}
+	}
+
 	//dequeue resizes
 	go func() {
 		for payload := range resizes {
@@ -169,30 +283,121 @@ func (s *sshServer) attachShell(conn ssh.Conn, connection ssh.Channel, env []str
 			slog.Warn("proxy failed", "error", err)
 		}
 
-		close()
+		// The client uses the exit status as the result of the session so it's sent before the channel is closed.
+		<-exited
+
+		_, _ = connection.SendRequest("exit-status", false, ssh.Marshal(&struct{ Status uint32 }{uint32(status)}))
+
+		connection.Close()
 	}()
 
 	go func() {
 		// Start proactively listening for process death, for those ptys that
 		// don't signal on EOF.
-		if shell.Process != nil {
-			if ps, err := shell.Process.Wait(); err != nil && ps != nil {
-				slog.Warn("failed to exit shell", "error", err)
-			}
+		status = exitStatus(shell.Wait())
+		close(exited)
 
-			// It appears that closing the pty is an idempotent operation
-			// therefore making this call ensures that the other two coroutines
-			// will fall through and exit, and there is no downside.
+		// It appears that closing the pty is an idempotent operation
+		// therefore making this call ensures that the other two coroutines
+		// will fall through and exit, and there is no downside.
 
-			// Well it does have a downside. Closing immediately will prevent
-			// the remaining IO from flushing.
-			// This is currently a bad hack and I should do something more
-			// intelligent here.
-			time.Sleep(50 * time.Millisecond)
+		// Well it does have a downside. Closing immediately will prevent
+		// the remaining IO from flushing.
+		// This is currently a bad hack and I should do something more
+		// intelligent here.
+		time.Sleep(50 * time.Millisecond)
 
-			shellf.Close()
+		shellf.Close()
+	}()
+	return nil
+}
+
+// exitStatus converts the result of waiting for a command into the status sent to SSH clients.
+// Commands killed by a signal get 128 plus the signal number like in a shell.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		if ws, ok := exit.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int(ws.Signal())
 		}
+
+		if exit.ExitCode() >= 0 {
+			return exit.ExitCode()
+		}
+	}
+
+	slog.Warn("failed to wait for command", "error", err)
+
+	return 255
+}
+
+// commandFromExec builds the command for an exec request. The command line is
+// given to /bin/sh so pipes and quoting behave like OpenSSH. Guests without a
+// shell have the command split into words and run directly.
+func commandFromExec(command string) (*exec.Cmd, error) {
+	// Like scripts "interactive" runs the guest's shell, which might not be /bin/sh.
+	if command == "interactive" {
+		args, err := common.InteractiveCommand()
+		if err != nil {
+			return nil, err
+		}
+
+		return exec.Command(args[0], args[1:]...), nil
+	}
+
+	if _, err := os.Stat("/bin/sh"); err == nil {
+		return exec.Command("/bin/sh", "-lc", command), nil
+	}
+
+	args, err := shlex.Split(command, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse command %q: %w", command, err)
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+
+	return exec.Command(args[0], args[1:]...), nil
+}
+
+// execCommand runs command without a PTY. Once it exits the exit status is sent
+// to the client and the channel is closed.
+func (s *sshServer) execCommand(connection ssh.Channel, env []string, command string) error {
+	cmd, err := commandFromExec(command)
+	if err != nil {
+		return err
+	}
+
+	cmd.Env = env
+	cmd.Stdout = connection
+	cmd.Stderr = connection.Stderr()
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	go func() {
+		_, _ = io.Copy(stdin, connection)
+		stdin.Close()
 	}()
+
+	go func() {
+		status := exitStatus(cmd.Wait())
+
+		_, _ = connection.SendRequest("exit-status", false, ssh.Marshal(&struct{ Status uint32 }{uint32(status)}))
+
+		connection.Close()
+	}()
+
 	return nil
 }
 
@@ -219,6 +424,9 @@ func (s *sshServer) handleRequests(conn ssh.Conn, connection ssh.Channel, reques
 
 	defer close(resizes)
 
+	// Commands are run with a terminal if the client asked for one (like ssh -t).
+	hasPty := false
+
 	// Sessions have out-of-band requests such as "shell", "pty-req" and "env"
 	for req := range requests {
 		switch req.Type {
@@ -231,6 +439,7 @@ func (s *sshServer) handleRequests(conn ssh.Conn, connection ssh.Channel, reques
 			env = append(env, fmt.Sprintf("TERM=%s", term))
 
 			resizes <- req.Payload[termLen+4:]
+			hasPty = true
 			// Responding true (OK) here will let the client
 			// know we have a pty ready
 			_ = req.Reply(true, nil)
@@ -249,8 +458,47 @@ func (s *sshServer) handleRequests(conn ssh.Conn, connection ssh.Channel, reques
 			}
 
 			_ = req.Reply(err == nil, nil)
+		case "env":
+			var payload struct {
+				Name  string
+				Value string
+			}
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+
+			env = append(env, fmt.Sprintf("%s=%s", payload.Name, payload.Value))
+
+			_ = req.Reply(true, nil)
 		case "exec":
-			slog.Debug("ignored exec", "payload", req.Payload)
+			var payload struct {
+				Command string
+			}
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+
+			session, err := s.connect(conn, payload.Command)
+			if err == nil {
+				cmdEnv := append(slices.Clone(env), session.env...)
+
+				if hasPty {
+					var cmd *exec.Cmd
+					cmd, err = commandFromExec(payload.Command)
+					if err == nil {
+						err = s.attachPty(connection, cmd, cmdEnv, resizes, false)
+					}
+				} else {
+					err = s.execCommand(connection, cmdEnv, payload.Command)
+				}
+			}
+			if err != nil {
+				slog.Warn("failed to exec command", "error", err)
+			}
+
+			_ = req.Reply(err == nil, nil)
 		default:
 			slog.Debug("unknown request", "type", req.Type, "reply", req.WantReply, "data", req.Payload)
 		}
@@ -282,36 +530,93 @@ func (s *sshServer) handleClient(nConn net.Conn, config *ssh.ServerConfig) error
 	return nil
 }
 
-func (s *sshServer) run(password string, callable starlark.Callable) error {
+// parseAuthorizedKeys parses public keys in the OpenSSH authorized_keys format.
+// Blank lines and comments are skipped.
+func parseAuthorizedKeys(contents string) ([]ssh.PublicKey, error) {
+	var ret []ssh.PublicKey
+
+	rest := []byte(contents)
+	for len(bytes.TrimSpace(rest)) > 0 {
+		key, _, _, next, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse authorized keys: %w", err)
+		}
+
+		ret = append(ret, key)
+		rest = next
+	}
+
+	return ret, nil
+}
+
+// run starts the SSH server. Clients can authenticate with password unless it's empty or with
+// any of authorizedKeys.
+func (s *sshServer) run(password string, authorizedKeys []ssh.PublicKey, callable starlark.Callable) error {
 	s.callable = callable
 
-	listener, err := net.Listen("tcp", "0.0.0.0:2222")
+	if password == "" && len(authorizedKeys) == 0 {
+		return fmt.Errorf("ssh: refusing to start without a password or authorized keys")
+	}
+
+	port := s.port
+	if port == 0 {
+		port = config.DefaultSshPort
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", port))
 	if err != nil {
 		return fmt.Errorf("ssh: failed to listen for connection: %v", err)
 	}
 
 	config := &ssh.ServerConfig{
-		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-			// Should use constant-time compare (or better, salt+hash) in
-			// a production setting.
-			if string(pass) == password {
+		BannerCallback: func(conn ssh.ConnMetadata) string {
+			return s.banner
+		},
+	}
+
+	if password != "" {
+		config.PasswordCallback = func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if s.username != "" && c.User() != s.username {
+				return nil, fmt.Errorf("username rejected for %q", c.User())
+			}
+
+			if subtle.ConstantTimeCompare(pass, []byte(password)) == 1 {
 				return nil, nil
 			}
 			return nil, fmt.Errorf("password rejected for %q", c.User())
-		},
+		}
 	}
 
-	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		return fmt.Errorf("ssh: failed to generate key: %v", err)
-	}
+	if len(authorizedKeys) > 0 {
+		config.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if s.username != "" && c.User() != s.username {
+				return nil, fmt.Errorf("username rejected for %q", c.User())
+			}
 
-	hostSigner, err := ssh.NewSignerFromKey(privateKey)
-	if err != nil {
-		return fmt.Errorf("ssh: failed to make signer: %v", err)
+			for _, authorized := range authorizedKeys {
+				if subtle.ConstantTimeCompare(key.Marshal(), authorized.Marshal()) == 1 {
+					return nil, nil
+				}
+			}
+			return nil, fmt.Errorf("public key rejected for %q", c.User())
+		}
 	}
 
-	config.AddHostKey(hostSigner)
+	if s.hostKey != nil {
+		config.AddHostKey(s.hostKey.signer)
+	} else {
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return fmt.Errorf("ssh: failed to generate key: %v", err)
+		}
+
+		hostSigner, err := ssh.NewSignerFromKey(privateKey)
+		if err != nil {
+			return fmt.Errorf("ssh: failed to make signer: %v", err)
+		}
+
+		config.AddHostKey(hostSigner)
+	}
 
 	for {
 		nConn, err := listener.Accept()
@@ -340,6 +645,7 @@ var (
 
 type mountOptions struct {
 	Readonly bool
+	Data     string
 }
 
 func mount(kind string, mountName string, mountPoint string, opts mountOptions) error {
@@ -347,7 +653,7 @@ func mount(kind string, mountName string, mountPoint string, opts mountOptions)
 	if opts.Readonly {
 		flags |= unix.MS_RDONLY
 	}
-	err := unix.Mount(mountName, mountPoint, kind, flags, "")
+	err := unix.Mount(mountName, mountPoint, kind, flags, opts.Data)
 	if err != nil {
 		return fmt.Errorf("failed mounting %s(%s) on %s: %v", mountName, kind, mountPoint, err)
 	}
@@ -379,10 +685,32 @@ var (
 	translateScripts = flag.Bool("translate-scripts", false, "translate scripts into starlark before running them")
 	runConfig        = flag.String("run-config", "", "run a JSON file with a given builder config")
 	dumpFs           = flag.String("dump-fs", "", "dump all filesystem metadata to a CSV file")
+	printVersion     = flag.Bool("version", false, "print the version and build metadata of init")
+	requestRestart   = flag.Bool("restart", false, "ask the host to recreate the virtual machine from a fresh state")
 )
 
 func initMain() error {
 	flag.Parse()
+	if *printVersion {
+		fmt.Printf("%s\n", buildinfo.Current())
+
+		return nil
+	}
+
+	if *requestRestart {
+		resp, err := http.Post(RESTART_URL, "", nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("host refused restart: %s", resp.Status)
+		}
+
+		return nil
+	}
+
 	if *execShell {
 		return shellMain()
 	}
@@ -395,7 +723,7 @@ func initMain() error {
 
 		sshServer := &sshServer{command: cmd}
 
-		return sshServer.run("insecurepassword", nil)
+		return sshServer.run(config.DefaultSshPassword, nil, nil)
 	}
 
 	if *downloadFile != "" {
@@ -441,8 +769,14 @@ func initMain() error {
 		}
 
 		for _, script := range scripts {
-			if err := common.RunCommand(script); err != nil {
-				return err
+			output := &common.TailBuffer{Limit: SCRIPT_OUTPUT_LIMIT}
+
+			if err := common.RunCommandWithOutput(script, output); err != nil {
+				if out := output.String(); out != "" {
+					return fmt.Errorf("%s: %w\n--- last %d bytes of output ---\n%s", script, err, len(out), out)
+				}
+
+				return fmt.Errorf("%s: %w", script, err)
 			}
 		}
 
@@ -474,6 +808,8 @@ func initMain() error {
 		return fmt.Errorf("/init must be run as root")
 	}
 
+	currentPhase = "args"
+
 	var args starlark.Value = starlark.NewDict(0)
 
 	if ok, _ := common.Exists("/init.json"); ok {
@@ -580,6 +916,54 @@ func initMain() error {
 		return starlark.String(router), nil
 	})
 
+	globals["network_interface_dhcp"] = starlark.NewBuiltin("network_interface_dhcp", func(
+		thread *starlark.Thread,
+		fn *starlark.Builtin,
+		args starlark.Tuple,
+		kwargs []starlark.Tuple,
+	) (starlark.Value, error) {
+		var (
+			ifname  string
+			timeout int = 10
+		)
+
+		if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
+			"ifname", &ifname,
+			"timeout?", &timeout,
+		); err != nil {
+			return starlark.None, err
+		}
+
+		if timeout <= 0 {
+			return starlark.None, fmt.Errorf("%s: timeout must be a positive number of seconds", fn.Name())
+		}
+
+		return configureDhcp(ifname, time.Duration(timeout)*time.Second)
+	})
+
+	globals["net_probe"] = starlark.NewBuiltin("net_probe", func(
+		thread *starlark.Thread,
+		fn *starlark.Builtin,
+		args starlark.Tuple,
+		kwargs []starlark.Tuple,
+	) (starlark.Value, error) {
+		var (
+			host      string
+			timeoutMs int = 1000
+			port      int = 80
+		)
+
+		if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
+			"host", &host,
+			"timeout_ms?", &timeoutMs,
+			"port?", &port,
+		); err != nil {
+			return starlark.None, err
+		}
+
+		return netProbe(host, port, time.Duration(timeoutMs)*time.Millisecond), nil
+	})
+
 	globals["fetch_http"] = starlark.NewBuiltin("fetch_http", func(
 		thread *starlark.Thread,
 		fn *starlark.Builtin,
@@ -588,28 +972,100 @@ func initMain() error {
 	) (starlark.Value, error) {
 		var (
 			urlString string
+			timeoutMs int
+			maxBytes  int64
 		)
 
 		if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
 			"url", &urlString,
+			"timeout_ms?", &timeoutMs,
+			"max_bytes?", &maxBytes,
 		); err != nil {
 			return starlark.None, err
 		}
 
-		resp, err := http.Get(urlString)
+		// A timeout or max_bytes of 0 means no limit.
+		client := &http.Client{Timeout: time.Duration(timeoutMs) * time.Millisecond}
+
+		resp, err := client.Get(urlString)
 		if err != nil {
 			return starlark.None, err
 		}
 		defer resp.Body.Close()
 
-		contents, err := io.ReadAll(resp.Body)
+		var body io.Reader = resp.Body
+		if maxBytes > 0 {
+			// Read one extra byte to tell a body of exactly maxBytes from a larger one.
+			body = io.LimitReader(resp.Body, maxBytes+1)
+		}
+
+		contents, err := io.ReadAll(body)
 		if err != nil {
 			return starlark.None, err
 		}
 
+		if maxBytes > 0 && int64(len(contents)) > maxBytes {
+			return starlark.None, fmt.Errorf("fetch_http: response from %s is larger than %d bytes", urlString, maxBytes)
+		}
+
 		return starlark.String(contents), nil
 	})
 
+	globals["load_secrets"] = starlark.NewBuiltin("load_secrets", func(
+		thread *starlark.Thread,
+		fn *starlark.Builtin,
+		args starlark.Tuple,
+		kwargs []starlark.Tuple,
+	) (starlark.Value, error) {
+		var (
+			dir string
+		)
+
+		if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
+			"dir", &dir,
+		); err != nil {
+			return starlark.None, err
+		}
+
+		if err := loadSecrets(dir); err != nil {
+			return starlark.None, err
+		}
+
+		return starlark.None, nil
+	})
+
+	globals["fetch_ssh_credentials"] = starlark.NewBuiltin("fetch_ssh_credentials", func(
+		thread *starlark.Thread,
+		fn *starlark.Builtin,
+		args starlark.Tuple,
+		kwargs []starlark.Tuple,
+	) (starlark.Value, error) {
+		if err := starlark.UnpackArgs(fn.Name(), args, kwargs); err != nil {
+			return starlark.None, err
+		}
+
+		credentials, err := fetchSshCredentials()
+		if err != nil {
+			return starlark.None, err
+		}
+
+		var password starlark.Value = starlark.None
+		if credentials.Password != "" {
+			password = starlark.String(credentials.Password)
+		}
+
+		ret := starlark.NewDict(2)
+
+		if err := ret.SetKey(starlark.String("password"), password); err != nil {
+			return starlark.None, err
+		}
+		if err := ret.SetKey(starlark.String("authorized_keys"), starlark.String(credentials.AuthorizedKeys)); err != nil {
+			return starlark.None, err
+		}
+
+		return ret, nil
+	})
+
 	globals["run"] = starlark.NewBuiltin("run", func(
 		thread *starlark.Thread,
 		fn *starlark.Builtin,
@@ -703,6 +1159,58 @@ func initMain() error {
 		return starlark.None, nil
 	})
 
+	globals["mount_overlay"] = starlark.NewBuiltin("mount_overlay", func(
+		thread *starlark.Thread,
+		fn *starlark.Builtin,
+		args starlark.Tuple,
+		kwargs []starlark.Tuple,
+	) (starlark.Value, error) {
+		var (
+			lower       string
+			upper       string
+			work        string
+			target      string
+			ensurePaths bool
+		)
+
+		if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
+			"lower", &lower,
+			"upper", &upper,
+			"work", &work,
+			"target", &target,
+			"ensure_paths?", &ensurePaths,
+		); err != nil {
+			return starlark.None, err
+		}
+
+		// The lower directory is the read-only base so it always has to exist.
+		if ok, err := common.Exists(lower); err != nil {
+			return starlark.None, err
+		} else if !ok {
+			return starlark.None, fmt.Errorf("overlay lower directory %s does not exist", lower)
+		}
+
+		for _, path := range []string{upper, work, target} {
+			if ensurePaths {
+				if err := common.Ensure(path, os.ModePerm); err != nil {
+					return starlark.None, err
+				}
+			} else if ok, err := common.Exists(path); err != nil {
+				return starlark.None, err
+			} else if !ok {
+				return starlark.None, fmt.Errorf("overlay directory %s does not exist", path)
+			}
+		}
+
+		if err := mount("overlay", "overlay", target, mountOptions{
+			Data: fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work),
+		}); err != nil {
+			return starlark.None, err
+		}
+
+		return starlark.None, nil
+	})
+
 	globals["path_ensure"] = starlark.NewBuiltin("path_ensure", func(
 		thread *starlark.Thread,
 		fn *starlark.Builtin,
@@ -775,6 +1283,64 @@ func initMain() error {
 		return starlark.String(contents), nil
 	})
 
+	globals["os_release"] = starlark.NewBuiltin("os_release", func(
+		thread *starlark.Thread,
+		fn *starlark.Builtin,
+		args starlark.Tuple,
+		kwargs []starlark.Tuple,
+	) (starlark.Value, error) {
+		if err := starlark.UnpackArgs(fn.Name(), args, kwargs); err != nil {
+			return starlark.None, err
+		}
+
+		return osRelease()
+	})
+
+	globals["statfs"] = starlark.NewBuiltin("statfs", func(
+		thread *starlark.Thread,
+		fn *starlark.Builtin,
+		args starlark.Tuple,
+		kwargs []starlark.Tuple,
+	) (starlark.Value, error) {
+		var (
+			path string
+		)
+
+		if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
+			"path", &path,
+		); err != nil {
+			return starlark.None, err
+		}
+
+		return statfs(path)
+	})
+
+	globals["hash_file"] = starlark.NewBuiltin("hash_file", func(
+		thread *starlark.Thread,
+		fn *starlark.Builtin,
+		args starlark.Tuple,
+		kwargs []starlark.Tuple,
+	) (starlark.Value, error) {
+		var (
+			path string
+			algo string = "sha256"
+		)
+
+		if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
+			"path", &path,
+			"algo?", &algo,
+		); err != nil {
+			return starlark.None, err
+		}
+
+		digest, err := hashFile(path, algo)
+		if err != nil {
+			return starlark.None, err
+		}
+
+		return starlark.String(digest), nil
+	})
+
 	globals["file_write"] = starlark.NewBuiltin("file_write", func(
 		thread *starlark.Thread,
 		fn *starlark.Builtin,
@@ -800,6 +1366,29 @@ func initMain() error {
 		return starlark.None, nil
 	})
 
+	globals["apply_nftables"] = starlark.NewBuiltin("apply_nftables", func(
+		thread *starlark.Thread,
+		fn *starlark.Builtin,
+		args starlark.Tuple,
+		kwargs []starlark.Tuple,
+	) (starlark.Value, error) {
+		var (
+			ruleset string
+		)
+
+		if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
+			"ruleset", &ruleset,
+		); err != nil {
+			return starlark.None, err
+		}
+
+		if err := applyNftables(ruleset); err != nil {
+			return starlark.None, err
+		}
+
+		return starlark.None, nil
+	})
+
 	globals["insmod"] = starlark.NewBuiltin("insmod", func(
 		thread *starlark.Thread,
 		fn *starlark.Builtin,
@@ -887,6 +1476,36 @@ func initMain() error {
 		return starlark.None, nil
 	})
 
+	globals["generate_host_key"] = starlark.NewBuiltin("generate_host_key", func(
+		thread *starlark.Thread,
+		fn *starlark.Builtin,
+		args starlark.Tuple,
+		kwargs []starlark.Tuple,
+	) (starlark.Value, error) {
+		var (
+			seed string
+		)
+
+		if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
+			"seed", &seed,
+		); err != nil {
+			return starlark.None, err
+		}
+
+		if seed == "" {
+			return starlark.None, fmt.Errorf("generate_host_key needs a non-empty seed")
+		}
+
+		slog.Warn("using a deterministic SSH host key, this is insecure outside of tests")
+
+		key, err := generateHostKey(seed)
+		if err != nil {
+			return starlark.None, err
+		}
+
+		return key, nil
+	})
+
 	globals["run_ssh_server"] = starlark.NewBuiltin("run_ssh_server", func(
 		thread *starlark.Thread,
 		fn *starlark.Builtin,
@@ -894,18 +1513,73 @@ func initMain() error {
 		kwargs []starlark.Tuple,
 	) (starlark.Value, error) {
 		var (
-			callable starlark.Callable
+			callable       starlark.Callable
+			banner         string
+			motd           string         = "/etc/motd"
+			key            starlark.Value = starlark.None
+			username       string
+			password       starlark.Value = starlark.None
+			authorizedKeys string
+			port           int = config.DefaultSshPort
 		)
 
 		if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
 			"callable", &callable,
+			"banner?", &banner,
+			"motd?", &motd,
+			"host_key?", &key,
+			"username?", &username,
+			"password?", &password,
+			"authorized_keys?", &authorizedKeys,
+			"port?", &port,
 		); err != nil {
 			return starlark.None, err
 		}
 
-		sshServer := &sshServer{}
+		if port < 1 || port > 65535 {
+			return starlark.None, fmt.Errorf("run_ssh_server: port must be between 1 and 65535, got %d", port)
+		}
+
+		keys, err := parseAuthorizedKeys(authorizedKeys)
+		if err != nil {
+			return starlark.None, err
+		}
+
+		// Password authentication is disabled when keys are given unless a password is also passed.
+		sshPassword := ""
+		if password == starlark.None {
+			if authorizedKeys == "" {
+				sshPassword = config.DefaultSshPassword
+			}
+		} else if str, ok := starlark.AsString(password); ok {
+			if str == "" {
+				return starlark.None, fmt.Errorf("run_ssh_server needs a non-empty password")
+			}
+
+			sshPassword = str
+		} else {
+			return starlark.None, fmt.Errorf("expected password to be a string got %s", password.Type())
+		}
+
+		if authorizedKeys != "" && len(keys) == 0 && sshPassword == "" {
+			return starlark.None, fmt.Errorf("run_ssh_server got no authorized keys and no password")
+		}
 
-		err := sshServer.run("insecurepassword", callable)
+		// banner is sent to clients before authentication. motd is the filename
+		// of a message printed after the shell attaches (usually /etc/motd).
+		sshServer := &sshServer{banner: banner, motd: motd, username: username, port: port}
+
+		// A random host key is generated unless one is passed.
+		if key != starlark.None {
+			hostKey, ok := key.(*hostKey)
+			if !ok {
+				return starlark.None, fmt.Errorf("expected HostKey got %s", key.Type())
+			}
+
+			sshServer.hostKey = hostKey
+		}
+
+		err = sshServer.run(sshPassword, keys, callable)
 		if err != nil {
 			return starlark.None, err
 		}
@@ -942,6 +1616,20 @@ func initMain() error {
 				if err := common.SetExperimental(strings.Split(flags, ",")); err != nil {
 					return starlark.None, err
 				}
+			} else if arg == "tinyrange.secrets=on" {
+				if err := os.Setenv("TINYRANGE_LOAD_SECRETS", "on"); err != nil {
+					return starlark.None, err
+				}
+			} else if arg == "tinyrange.ssh_credentials=on" {
+				if err := os.Setenv("TINYRANGE_SSH_CREDENTIALS", "on"); err != nil {
+					return starlark.None, err
+				}
+			} else if strings.HasPrefix(arg, "tinyrange.network=") {
+				network := strings.TrimPrefix(arg, "tinyrange.network=")
+
+				if err := os.Setenv("TINYRANGE_NETWORK", network); err != nil {
+					return starlark.None, err
+				}
 			} else if strings.HasPrefix(arg, "tinyrange.interaction=") {
 				interaction := strings.TrimPrefix(arg, "tinyrange.interaction=")
 
@@ -1031,7 +1719,39 @@ func initMain() error {
 
 	thread := &starlark.Thread{Name: "init"}
 
-	decls, err := starlark.ExecFileOptions(&syntax.FileOptions{Set: true, While: true, TopLevelControl: true}, thread, "/init.star", nil, globals)
+	fileOptions := &syntax.FileOptions{Set: true, While: true, TopLevelControl: true}
+
+	// Run any scripts in /init.d in lexical order before /init.star.
+	// Top level declarations from each script are shared with the scripts run after it.
+	initScripts, err := filepath.Glob("/init.d/*.star")
+	if err != nil {
+		return err
+	}
+
+	for _, filename := range initScripts {
+		currentPhase = filename
+
+		decls, err := starlark.ExecFileOptions(fileOptions, thread, filename, nil, globals)
+		if err != nil {
+			return fmt.Errorf("failed to run %s: %w", filename, err)
+		}
+
+		if setup, ok := decls["setup"]; ok {
+			if _, err := starlark.Call(thread, setup, starlark.Tuple{}, []starlark.Tuple{}); err != nil {
+				return fmt.Errorf("failed to run setup in %s: %w", filename, err)
+			}
+
+			delete(decls, "setup")
+		}
+
+		for k, v := range decls {
+			globals[k] = v
+		}
+	}
+
+	currentPhase = "/init.star"
+
+	decls, err := starlark.ExecFileOptions(fileOptions, thread, "/init.star", nil, globals)
 	if err != nil {
 		return err
 	}
@@ -1041,6 +1761,8 @@ func initMain() error {
 		return fmt.Errorf("expected Callable got %s", mainFunc.Type())
 	}
 
+	currentPhase = "main"
+
 	_, err = starlark.Call(thread, mainFunc, starlark.Tuple{}, []starlark.Tuple{})
 	if err != nil {
 		return err
@@ -1049,6 +1771,133 @@ func initMain() error {
 	return nil
 }
 
+// The part of startup init is currently running. Included in failure reports.
+var currentPhase = "startup"
+
+const (
+	INIT_FAILURE_URL    = "http://10.42.0.1/init_failure"
+	RESTART_URL         = "http://10.42.0.1/restart"
+	SECRETS_URL         = "http://10.42.0.1/secrets"
+	SSH_CREDENTIALS_URL = "http://10.42.0.1/ssh_credentials"
+)
+
+// applyNftables checks ruleset with nft then loads it into the kernel. Nothing is
+// applied if the ruleset is invalid.
+func applyNftables(ruleset string) error {
+	nft, err := exec.LookPath("nft")
+	if err != nil {
+		return fmt.Errorf("nft was not found in the guest, install nftables to apply a ruleset")
+	}
+
+	run := func(args ...string) error {
+		cmd := exec.Command(nft, args...)
+
+		cmd.Stdin = strings.NewReader(ruleset)
+
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s", strings.TrimSpace(string(out)))
+		}
+
+		return nil
+	}
+
+	if err := run("--check", "--file", "-"); err != nil {
+		return fmt.Errorf("invalid nftables ruleset:\n%w", err)
+	}
+
+	if err := run("--file", "-"); err != nil {
+		return fmt.Errorf("failed to apply nftables ruleset:\n%w", err)
+	}
+
+	return nil
+}
+
+// loadSecrets fetches the secrets from the host and writes them to dir. Only root can read them.
+func loadSecrets(dir string) error {
+	resp, err := http.Get(SECRETS_URL)
+	if err != nil {
+		return fmt.Errorf("failed to fetch secrets: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch secrets: %s", resp.Status)
+	}
+
+	var secrets map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&secrets); err != nil {
+		return fmt.Errorf("failed to decode secrets: %w", err)
+	}
+
+	if err := os.Chmod(dir, 0700); err != nil {
+		return err
+	}
+
+	for name, value := range secrets {
+		// The host already checks names but make sure they can't escape dir.
+		if name != filepath.Base(name) || name == "." || name == ".." {
+			return fmt.Errorf("invalid secret name: %q", name)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0400); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fetchSshCredentials fetches the password and authorized keys of the SSH server from the host.
+func fetchSshCredentials() (config.SshServerCredentials, error) {
+	resp, err := http.Get(SSH_CREDENTIALS_URL)
+	if err != nil {
+		return config.SshServerCredentials{}, fmt.Errorf("failed to fetch ssh credentials: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return config.SshServerCredentials{}, fmt.Errorf("failed to fetch ssh credentials: %s", resp.Status)
+	}
+
+	var credentials config.SshServerCredentials
+	if err := json.NewDecoder(resp.Body).Decode(&credentials); err != nil {
+		return config.SshServerCredentials{}, fmt.Errorf("failed to decode ssh credentials: %w", err)
+	}
+
+	return credentials, nil
+}
+
+// reportFailure sends a structured failure record to the host so it can shut down
+// the virtual machine and return the failure.
+func reportFailure(initErr error) {
+	failure := config.InitFailure{
+		Phase:   currentPhase,
+		Message: initErr.Error(),
+	}
+
+	var evalErr *starlark.EvalError
+	if errors.As(initErr, &evalErr) {
+		failure.Message = evalErr.Msg
+		failure.Stack = evalErr.Backtrace()
+	}
+
+	record, err := json.Marshal(&failure)
+	if err != nil {
+		slog.Error("failed to marshal failure record", "err", err)
+		return
+	}
+
+	client := &http.Client{Timeout: 2 * time.Second}
+
+	resp, err := client.Post(INIT_FAILURE_URL, "application/json", bytes.NewReader(record))
+	if err != nil {
+		slog.Warn("failed to report failure to host", "err", err)
+		return
+	}
+	resp.Body.Close()
+}
+
 func main() {
 	if os.Getenv("TINYRANGE_VERBOSE") == "on" {
 		if err := common.EnableVerbose(); err != nil {
@@ -1059,6 +1908,11 @@ func main() {
 
 	if err := initMain(); err != nil {
 		slog.Error("fatal", "err", err)
+
+		if os.Getpid() == 1 {
+			reportFailure(err)
+		}
+
 		os.Exit(1)
 	}
 }
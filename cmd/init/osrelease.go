@@ -0,0 +1,88 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// The locations of os-release in the order they are checked. See os-release(5).
+var osReleaseFiles = []string{"/etc/os-release", "/usr/lib/os-release"}
+
+// unquoteOsRelease removes the shell style quoting from an os-release value.
+// Inside double quotes the characters $, ", \ and ` can be escaped with a backslash.
+func unquoteOsRelease(value string) string {
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		return value[1 : len(value)-1]
+	}
+
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+
+		var ret strings.Builder
+
+		for i := 0; i < len(value); i++ {
+			if value[i] == '\\' && i+1 < len(value) && strings.IndexByte("$\"\\`", value[i+1]) != -1 {
+				i += 1
+			}
+
+			ret.WriteByte(value[i])
+		}
+
+		return ret.String()
+	}
+
+	return value
+}
+
+// parseOsRelease parses the KEY=value lines of an os-release file. Blank lines,
+// comments, and lines without a = are ignored.
+func parseOsRelease(contents string) map[string]string {
+	ret := make(map[string]string)
+
+	for _, line := range strings.Split(contents, "\n") {
+		line = strings.TrimSpace(line)
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+
+		ret[strings.TrimSpace(key)] = unquoteOsRelease(strings.TrimSpace(value))
+	}
+
+	return ret
+}
+
+// osRelease returns the contents of the guest's os-release file as a dict or
+// an empty dict if the guest doesn't have one.
+func osRelease() (starlark.Value, error) {
+	ret := starlark.NewDict(16)
+
+	for _, filename := range osReleaseFiles {
+		contents, err := os.ReadFile(filename)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return starlark.None, err
+		}
+
+		for key, value := range parseOsRelease(string(contents)) {
+			if err := ret.SetKey(starlark.String(key), starlark.String(value)); err != nil {
+				return starlark.None, err
+			}
+		}
+
+		break
+	}
+
+	return ret, nil
+}
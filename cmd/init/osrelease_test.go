@@ -0,0 +1,75 @@
+//go:build linux
+
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestUnquoteOsRelease(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected string
+	}{
+		{`debian`, `debian`},
+		{`"Debian GNU/Linux"`, `Debian GNU/Linux`},
+		{`'Alpine Linux'`, `Alpine Linux`},
+		{`'no \"escapes\"'`, `no \"escapes\"`},
+		{`"a \"quoted\" \$name \\ \` + "`" + `"`, "a \"quoted\" $name \\ `"},
+		{`"keep \n other escapes"`, `keep \n other escapes`},
+		{`"trailing \"`, `trailing \`},
+		{`""`, ``},
+		{`"`, `"`},
+		{`'unterminated`, `'unterminated`},
+	} {
+		if got := unquoteOsRelease(test.input); got != test.expected {
+			t.Errorf("unquoteOsRelease(%s) = %q, expected %q", test.input, got, test.expected)
+		}
+	}
+}
+
+func TestParseOsRelease(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		input    string
+		expected map[string]string
+	}{
+		{"empty", "", map[string]string{}},
+		{
+			"debian",
+			"PRETTY_NAME=\"Debian GNU/Linux 12 (bookworm)\"\nNAME=\"Debian GNU/Linux\"\nVERSION_ID=\"12\"\nID=debian\n",
+			map[string]string{
+				"PRETTY_NAME": "Debian GNU/Linux 12 (bookworm)",
+				"NAME":        "Debian GNU/Linux",
+				"VERSION_ID":  "12",
+				"ID":          "debian",
+			},
+		},
+		{
+			"comments and blank lines",
+			"# a comment\n\n  ID=alpine  \nnot a pair\n\tVERSION_ID='3.20.0'\n",
+			map[string]string{
+				"ID":         "alpine",
+				"VERSION_ID": "3.20.0",
+			},
+		},
+		{
+			"later keys replace earlier ones",
+			"ID=one\nID=two\n",
+			map[string]string{"ID": "two"},
+		},
+		{
+			"value containing =",
+			"ANSI_COLOR=\"0;38;2;60\"\nHOME_URL=https://example.com/?a=b\n",
+			map[string]string{
+				"ANSI_COLOR": "0;38;2;60",
+				"HOME_URL":   "https://example.com/?a=b",
+			},
+		},
+	} {
+		if got := parseOsRelease(test.input); !maps.Equal(got, test.expected) {
+			t.Errorf("%s: parseOsRelease() = %v, expected %v", test.name, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"go.starlark.net/starlark"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// probeIcmp sends a single ICMP echo request to addr and waits for the reply.
+func probeIcmp(addr *net.IPAddr, timeout time.Duration) (time.Duration, error) {
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	id := os.Getpid() & 0xffff
+
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: id, Seq: 1, Data: []byte("tinyrange")},
+	}
+
+	wb, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+
+	if err := conn.SetDeadline(start.Add(timeout)); err != nil {
+		return 0, err
+	}
+
+	if _, err := conn.WriteTo(wb, addr); err != nil {
+		return 0, err
+	}
+
+	rb := make([]byte, 1500)
+
+	for {
+		n, peer, err := conn.ReadFrom(rb)
+		if err != nil {
+			return 0, err
+		}
+
+		reply, err := icmp.ParseMessage(1, rb[:n])
+		if err != nil {
+			continue
+		}
+
+		// Ignore unrelated ICMP traffic.
+		echo, ok := reply.Body.(*icmp.Echo)
+		if reply.Type != ipv4.ICMPTypeEchoReply || !ok || echo.ID != id || peer.String() != addr.String() {
+			continue
+		}
+
+		return time.Since(start), nil
+	}
+}
+
+// probeTcp measures how long it takes to open a TCP connection to addr.
+func probeTcp(addr string, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return 0, err
+	}
+	conn.Close()
+
+	return time.Since(start), nil
+}
+
+func netProbe(host string, port int, timeout time.Duration) *starlark.Dict {
+	ret := starlark.NewDict(4)
+
+	result := func(method string, latency time.Duration, err error) *starlark.Dict {
+		ret.SetKey(starlark.String("method"), starlark.String(method))
+		ret.SetKey(starlark.String("ok"), starlark.Bool(err == nil))
+		if err != nil {
+			ret.SetKey(starlark.String("error"), starlark.String(err.Error()))
+			ret.SetKey(starlark.String("latency_ms"), starlark.None)
+		} else {
+			ret.SetKey(starlark.String("error"), starlark.None)
+			ret.SetKey(starlark.String("latency_ms"), starlark.Float(float64(latency.Microseconds())/1000))
+		}
+		return ret
+	}
+
+	addr, err := net.ResolveIPAddr("ip4", host)
+	if err != nil {
+		return result("dns", 0, err)
+	}
+
+	latency, err := probeIcmp(addr, timeout)
+	if err == nil {
+		return result("icmp", latency, nil)
+	}
+
+	// ICMP needs a raw socket which isn't always permitted and some networks drop echo
+	// requests. A TCP connection is a good enough test of connectivity in both cases.
+	slog.Debug("icmp probe failed, falling back to tcp", "host", host, "error", err)
+
+	latency, err = probeTcp(net.JoinHostPort(addr.String(), strconv.Itoa(port)), timeout)
+	if err != nil {
+		return result("tcp", 0, fmt.Errorf("failed to connect to %s port %d: %w", host, port, err))
+	}
+
+	return result("tcp", latency, nil)
+}
@@ -0,0 +1,44 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+
+	"go.starlark.net/starlark"
+	"golang.org/x/sys/unix"
+)
+
+// statfs reports the size of the filesystem mounted at or containing path.
+// Since statfs(2) follows the path, a directory on another mount reports that mount.
+func statfs(path string) (starlark.Value, error) {
+	var st unix.Statfs_t
+
+	if err := unix.Statfs(path, &st); err != nil {
+		return starlark.None, fmt.Errorf("statfs %s: %w", path, err)
+	}
+
+	// Block counts are in units of the fragment size which is only different from the block size on some filesystems.
+	blockSize := uint64(st.Frsize)
+	if blockSize == 0 {
+		blockSize = uint64(st.Bsize)
+	}
+
+	ret := starlark.NewDict(4)
+
+	for _, field := range []struct {
+		key   string
+		value uint64
+	}{
+		{"total", st.Blocks * blockSize},
+		{"free", st.Bfree * blockSize},
+		{"available", st.Bavail * blockSize},
+		{"block_size", blockSize},
+	} {
+		if err := ret.SetKey(starlark.String(field.key), starlark.MakeUint64(field.value)); err != nil {
+			return starlark.None, err
+		}
+	}
+
+	return ret, nil
+}
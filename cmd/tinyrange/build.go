@@ -22,6 +22,12 @@ var buildCmd = &cobra.Command{
 			return fmt.Errorf("please specify a definition")
 		}
 
+		var stdout *os.File
+		if buildOutput == "-" {
+			// Keep anything else printed while building out of the output stream.
+			stdout = common.RedirectStdout()
+		}
+
 		db, err := newDb()
 		if err != nil {
 			return err
@@ -59,6 +65,14 @@ var buildCmd = &cobra.Command{
 				}
 				defer fh.Close()
 
+				if stdout != nil {
+					if _, err := io.Copy(stdout, fh); err != nil {
+						return err
+					}
+
+					return nil
+				}
+
 				out, err := os.Create(buildOutput)
 				if err != nil {
 					return err
@@ -78,6 +92,6 @@ var buildCmd = &cobra.Command{
 }
 
 func init() {
-	buildCmd.PersistentFlags().StringVarP(&buildOutput, "output", "o", "", "if specified then copy the build output to a local file at path")
+	buildCmd.PersistentFlags().StringVarP(&buildOutput, "output", "o", "", "if specified then copy the build output to a local file at path (- writes it to stdout)")
 	rootCmd.AddCommand(buildCmd)
 }
@@ -0,0 +1,36 @@
+package cli
+
+import (
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var catCmd = &cobra.Command{
+	Use:   "cat <hash> <path>",
+	Short: "Write a file from a built archive to stdout without extracting it.",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		db, err := newDb()
+		if err != nil {
+			return err
+		}
+
+		fh, err := db.OpenResultFile(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+
+		if _, err := io.Copy(os.Stdout, fh); err != nil {
+			return err
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(catCmd)
+}
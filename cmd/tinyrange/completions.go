@@ -0,0 +1,60 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/tinyrange/tinyrange/pkg/config"
+)
+
+var (
+	completionsBuilder string
+	completionsArch    string
+)
+
+var completionsCmd = &cobra.Command{
+	Use:   "completions",
+	Short: "Print values for shell completion",
+}
+
+var completionsPackagesCmd = &cobra.Command{
+	Use:   "packages [prefix]",
+	Short: "Print the name of every package in a builder one per line",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		arch, err := config.ArchitectureFromString(completionsArch)
+		if err != nil {
+			return err
+		}
+
+		db, err := newDb()
+		if err != nil {
+			return err
+		}
+
+		names, err := db.GetPackageNames(completionsBuilder, arch)
+		if err != nil {
+			return err
+		}
+
+		prefix := ""
+		if len(args) > 0 {
+			prefix = args[0]
+		}
+
+		for _, name := range names {
+			if strings.HasPrefix(name, prefix) {
+				fmt.Printf("%s\n", name)
+			}
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	completionsPackagesCmd.PersistentFlags().StringVarP(&completionsBuilder, "builder", "b", DEFAuLT_BUILDER, "the container builder to list packages from")
+	completionsPackagesCmd.PersistentFlags().StringVar(&completionsArch, "arch", "", "the CPU architecture of the builder")
+	completionsCmd.AddCommand(completionsPackagesCmd)
+	rootCmd.AddCommand(completionsCmd)
+}
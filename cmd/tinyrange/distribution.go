@@ -1,11 +1,17 @@
 package cli
 
 import (
+	"crypto/ed25519"
+	"fmt"
+	"os"
+
 	"github.com/spf13/cobra"
+	"github.com/tinyrange/tinyrange/pkg/database"
 )
 
 var (
-	distributionAddr string
+	distributionAddr    string
+	distributionSignKey string
 )
 
 var distributionCmd = &cobra.Command{
@@ -17,11 +23,88 @@ var distributionCmd = &cobra.Command{
 			return err
 		}
 
-		return db.RunDistributionServer(distributionAddr)
+		var signingKey ed25519.PrivateKey
+
+		if distributionSignKey != "" {
+			signingKey, err = database.ReadDistributionPrivateKey(distributionSignKey)
+			if err != nil {
+				return err
+			}
+		}
+
+		return db.RunDistributionServer(distributionAddr, signingKey)
+	},
+}
+
+var distributionKeygenCmd = &cobra.Command{
+	Use:   "keygen <name>",
+	Short: "Generate a key pair for signing artifacts. Writes <name>.pub and <name>.key.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		public, private, err := database.GenerateDistributionKey()
+		if err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(args[0]+".key", []byte(private+"\n"), os.FileMode(0600)); err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(args[0]+".pub", []byte(public+"\n"), os.FileMode(0644)); err != nil {
+			return err
+		}
+
+		return nil
+	},
+}
+
+var distributionVerifyCmd = &cobra.Command{
+	Use:   "verify <hash>...",
+	Short: "Verify cached build results against signatures from the distribution server.",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		db, err := newDb()
+		if err != nil {
+			return err
+		}
+
+		for _, hash := range args {
+			if err := db.VerifyResult(hash); err != nil {
+				return err
+			}
+
+			fmt.Printf("%s: OK\n", hash)
+		}
+
+		return nil
+	},
+}
+
+var untrustDownloadsCmd = &cobra.Command{
+	Use:   "untrust-downloads [hash...]",
+	Short: "Remove results downloaded from a distribution server so they are rebuilt locally. Removes all downloaded results if no hash is given.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		db, err := newDb()
+		if err != nil {
+			return err
+		}
+
+		count, err := db.UntrustDownloads(args)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("removed %d downloaded results\n", count)
+
+		return nil
 	},
 }
 
 func init() {
 	distributionCmd.PersistentFlags().StringVar(&distributionAddr, "addr", "localhost:5123", "The address to listen on.")
+	distributionCmd.Flags().StringVar(&distributionSignKey, "sign-key", "", "Sign artifacts with the private key from distribution keygen.")
+	distributionCmd.AddCommand(distributionKeygenCmd)
+	distributionCmd.AddCommand(distributionVerifyCmd)
 	rootCmd.AddCommand(distributionCmd)
+	rootCmd.AddCommand(untrustDownloadsCmd)
 }
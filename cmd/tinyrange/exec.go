@@ -0,0 +1,65 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/tinyrange/tinyrange/pkg/builder"
+	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/login"
+)
+
+var execConfig login.Config = login.Config{Version: login.CURRENT_CONFIG_VERSION}
+
+var execCmd = &cobra.Command{
+	Use:   "exec [packages...] -- <command> [args...]",
+	Short: "Run a single command in a virtual machine and exit with it's status",
+	Long: `Build a virtual machine, run a command without a terminal, and exit with the status of the command.
+Stdout and stderr from the command are kept separate. Only warnings are logged unless --verbose is passed.`,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dash := cmd.ArgsLenAtDash()
+		if dash == -1 || dash == len(args) {
+			return fmt.Errorf("exec requires a command after --")
+		}
+
+		execConfig.Packages = args[:dash]
+		execConfig.ExecCommand = args[dash:]
+
+		if !rootVerbose {
+			if err := common.EnableQuiet(); err != nil {
+				return err
+			}
+		}
+
+		db, err := newDb()
+		if err != nil {
+			return err
+		}
+
+		err = execConfig.Run(db)
+
+		// The exit status is the result so don't print it as a error.
+		if _, ok := err.(*builder.ExitStatusError); err != nil && !ok {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		}
+
+		return err
+	},
+}
+
+func init() {
+	execCmd.PersistentFlags().StringVarP(&execConfig.Builder, "builder", "b", DEFAuLT_BUILDER, "The container builder used to construct the virtual machine.")
+	execCmd.PersistentFlags().StringArrayVarP(&execConfig.Files, "file", "f", []string{}, "Specify local files/URLs to be copied into the virtual machine.")
+	execCmd.PersistentFlags().StringArrayVarP(&execConfig.Archives, "archive", "a", []string{}, "Specify archives to be copied into the virtual machine.")
+	execCmd.PersistentFlags().StringArrayVarP(&execConfig.Environment, "environment", "e", []string{}, "Add environment variables to the command.")
+	execCmd.PersistentFlags().StringArrayVarP(&execConfig.Macros, "macro", "m", []string{}, "Add macros to the VM.")
+	execCmd.PersistentFlags().StringVar(&execConfig.Architecture, "arch", "", "Override the CPU architecture of the machine. This will use emulation with a performance hit.")
+	execCmd.PersistentFlags().IntVar(&execConfig.CpuCores, "cpu", 1, "The number of CPU cores to allocate to the virtual machine.")
+	execCmd.PersistentFlags().Var(newSizeValue(&execConfig.MemorySize, 1024), "ram", "The amount of ram in the virtual machine (e.g. 512M, 2G).")
+	execCmd.PersistentFlags().Var(newSizeValue(&execConfig.StorageSize, 1024), "storage", "The amount of storage to allocate in the virtual machine (e.g. 512M, 2G).")
+	execCmd.PersistentFlags().StringVar(&execConfig.HttpCache, "http-cache", "", "Cache guest downloads made through http://host.internal/proxy/<scheme>/<host>/<path> in the given directory.")
+	rootCmd.AddCommand(execCmd)
+}
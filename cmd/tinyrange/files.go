@@ -0,0 +1,70 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/config"
+	"github.com/tinyrange/tinyrange/pkg/filesystem"
+)
+
+var (
+	filesBuilder string
+	filesArch    string
+	filesLong    bool
+)
+
+var filesCmd = &cobra.Command{
+	Use:   "files <package>",
+	Short: "List the files installed by a package",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		arch, err := config.ArchitectureFromString(filesArch)
+		if err != nil {
+			return err
+		}
+
+		q, err := common.ParsePackageQuery(args[0])
+		if err != nil {
+			return err
+		}
+
+		db, err := newDb()
+		if err != nil {
+			return err
+		}
+
+		pkg, files, err := db.PackageContents(filesBuilder, arch, q, common.TagList{"level3", "noScripts"})
+		if err != nil {
+			return err
+		}
+
+		if filesLong {
+			fmt.Printf("# %s\n", pkg.Name)
+		}
+
+		for _, file := range files {
+			if !filesLong {
+				fmt.Printf("%s\n", file.Filename)
+				continue
+			}
+
+			switch file.Entry.Typeflag() {
+			case filesystem.TypeSymlink, filesystem.TypeLink:
+				fmt.Printf("%s %d:%d %8d %s -> %s\n", file.Entry.Mode(), file.Entry.Uid(), file.Entry.Gid(), file.Entry.Size(), file.Filename, file.Entry.Linkname())
+			default:
+				fmt.Printf("%s %d:%d %8d %s\n", file.Entry.Mode(), file.Entry.Uid(), file.Entry.Gid(), file.Entry.Size(), file.Filename)
+			}
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	filesCmd.PersistentFlags().StringVarP(&filesBuilder, "builder", "b", DEFAuLT_BUILDER, "the container builder to find the package in")
+	filesCmd.PersistentFlags().StringVar(&filesArch, "arch", "", "the CPU architecture of the builder")
+	filesCmd.PersistentFlags().BoolVarP(&filesLong, "long", "l", false, "include the mode, owner, size, and link target of each file")
+	rootCmd.AddCommand(filesCmd)
+}
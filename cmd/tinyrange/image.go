@@ -0,0 +1,43 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/tinyrange/tinyrange/pkg/builder"
+)
+
+var resolveImageRegistry string
+
+var resolveImageCmd = &cobra.Command{
+	Use:   "resolve-image <image[:tag]>",
+	Short: "Print the digest a OCI image tag currently resolves to",
+	Long: `Print the digest a OCI image tag currently resolves to.
+The digest can be pinned in define.fetch_oci_image with "image:tag@digest" so the build fails if the tag changes.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		db, err := newDb()
+		if err != nil {
+			return err
+		}
+
+		client, err := db.HttpClient()
+		if err != nil {
+			return err
+		}
+
+		digest, err := builder.ResolveOciImage(client, resolveImageRegistry, args[0])
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s\n", digest)
+
+		return nil
+	},
+}
+
+func init() {
+	resolveImageCmd.PersistentFlags().StringVar(&resolveImageRegistry, "registry", builder.DEFAULT_REGISTRY, "The registry to query.")
+	rootCmd.AddCommand(resolveImageCmd)
+}
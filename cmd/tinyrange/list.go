@@ -0,0 +1,121 @@
+package cli
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/tinyrange/tinyrange/pkg/database"
+)
+
+var (
+	listJson bool
+	listSort string
+)
+
+// formatSize formats a size in bytes with a binary unit suffix.
+func formatSize(size int64) string {
+	const unit = 1024
+
+	if size < unit {
+		return fmt.Sprintf("%dB", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp += 1
+	}
+
+	return fmt.Sprintf("%.1f%ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List every definition in the build directory with the state of its cached output",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		db, err := newDb()
+		if err != nil {
+			return err
+		}
+
+		defs, err := db.ListCachedDefinitions()
+		if err != nil {
+			return err
+		}
+
+		switch listSort {
+		case "hash":
+			slices.SortFunc(defs, func(a, b database.CachedDefinition) int { return strings.Compare(a.Hash, b.Hash) })
+		case "tag":
+			slices.SortFunc(defs, func(a, b database.CachedDefinition) int {
+				return cmp.Or(strings.Compare(a.Tag, b.Tag), strings.Compare(a.Hash, b.Hash))
+			})
+		case "size":
+			// Largest first.
+			slices.SortFunc(defs, func(a, b database.CachedDefinition) int {
+				return cmp.Or(cmp.Compare(b.Size, a.Size), strings.Compare(a.Hash, b.Hash))
+			})
+		default:
+			return fmt.Errorf("unknown sort %q (expected hash, tag, or size)", listSort)
+		}
+
+		if listJson {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+
+			if defs == nil {
+				defs = []database.CachedDefinition{}
+			}
+
+			return enc.Encode(defs)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+		fmt.Fprintf(w, "HASH\tSTATE\tSIZE\tFLAGS\tTAG\n")
+
+		for _, def := range defs {
+			state := "not built"
+			size := "-"
+			if def.Built {
+				state = "built"
+				size = formatSize(def.Size)
+			}
+
+			var flags []string
+			if def.Chunked {
+				flags = append(flags, "chunked")
+			}
+			if def.Redistributable {
+				flags = append(flags, "redistributable")
+			}
+			if def.Downloaded {
+				flags = append(flags, "downloaded")
+			}
+			if len(flags) == 0 {
+				flags = append(flags, "-")
+			}
+
+			tag := def.Tag
+			if def.Error != "" {
+				tag = "<error: " + def.Error + ">"
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", def.Hash[:min(len(def.Hash), 12)], state, size, strings.Join(flags, ","), tag)
+		}
+
+		return w.Flush()
+	},
+}
+
+func init() {
+	listCmd.PersistentFlags().BoolVar(&listJson, "json", false, "Write the list as JSON with full hashes.")
+	listCmd.PersistentFlags().StringVar(&listSort, "sort", "hash", "Sort by hash, tag, or size (largest first).")
+	rootCmd.AddCommand(listCmd)
+}
@@ -1,27 +1,150 @@
 package cli
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
 	"runtime/pprof"
+	"strconv"
+	"strings"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/tinyrange/tinyrange/pkg/builder"
 	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/config"
+	"github.com/tinyrange/tinyrange/pkg/database"
 	"github.com/tinyrange/tinyrange/pkg/login"
 	"gopkg.in/yaml.v3"
 )
 
 const DEFAuLT_BUILDER = "alpine@3.20"
 
+// sizeValue is a pflag.Value that parses sizes like "2G" into megabytes.
+type sizeValue struct {
+	size *int
+}
+
+func newSizeValue(size *int, def int) *sizeValue {
+	*size = def
+	return &sizeValue{size: size}
+}
+
+// Set implements pflag.Value.
+func (s *sizeValue) Set(val string) error {
+	size, err := config.ParseSize(val)
+	if err != nil {
+		return err
+	}
+
+	*s.size = size
+
+	return nil
+}
+
+// String implements pflag.Value.
+func (s *sizeValue) String() string { return strconv.Itoa(*s.size) }
+
+// Type implements pflag.Value.
+func (s *sizeValue) Type() string { return "size" }
+
+// watchRunArgs returns the arguments of each run started by --watch. They're rebuilt from
+// the parsed flags so --watch is left out however it was written.
+func watchRunArgs(cmd *cobra.Command, args []string) []string {
+	ret := strings.Fields(strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()))
+
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		if f.Name == "watch" {
+			return
+		}
+
+		if slice, ok := f.Value.(pflag.SliceValue); ok {
+			for _, val := range slice.GetSlice() {
+				ret = append(ret, "--"+f.Name+"="+val)
+			}
+
+			return
+		}
+
+		ret = append(ret, "--"+f.Name+"="+f.Value.String())
+	})
+
+	return append(append(ret, "--"), args...)
+}
+
 var currentConfig login.Config = login.Config{Version: login.CURRENT_CONFIG_VERSION}
 
+// loadLoginConfig adds the packages in args and the config, Dockerfile, and packages files
+// given on the command line to cfg.
+func loadLoginConfig(cfg *login.Config, args []string) error {
+	cfg.Packages = append([]string{}, args...)
+
+	if loginLoadConfig != "" {
+		f, err := os.Open(loginLoadConfig)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if err := login.DecodeConfig(f, cfg); err != nil {
+			return fmt.Errorf("failed to load %s: %w", loginLoadConfig, err)
+		}
+	}
+
+	if loginDockerfile != "" {
+		f, err := os.Open(loginDockerfile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if err := login.ParseDockerfile(f, filepath.Dir(loginDockerfile), cfg); err != nil {
+			return fmt.Errorf("failed to load %s: %w", loginDockerfile, err)
+		}
+	}
+
+	for _, filename := range loginPackagesFiles {
+		pkgs, err := login.ReadPackagesFile(filename)
+		if err != nil {
+			return err
+		}
+
+		cfg.Packages = append(cfg.Packages, pkgs...)
+	}
+
+	return nil
+}
+
 var (
-	loginSaveConfig string
-	loginLoadConfig string
+	loginSaveConfig        string
+	loginLoadConfig        string
+	loginInteractiveSelect bool
+	loginWatch             bool
+	loginPackagesFiles     []string
+	loginDockerfile        string
 )
 
 var loginCmd = &cobra.Command{
 	Use:   "login",
 	Short: "Start a virtual machine with a builder and a list of packages",
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		arch, err := config.ArchitectureFromString(currentConfig.Architecture)
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+
+		db, err := newDb()
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+
+		names, err := db.GetPackageNames(currentConfig.Builder, arch)
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+
+		return names, cobra.ShellCompDirectiveNoFileComp
+	},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if rootCpuProfile != "" {
 			f, err := os.Create(rootCpuProfile)
@@ -38,18 +161,50 @@ var loginCmd = &cobra.Command{
 			}
 		}
 
-		currentConfig.Packages = args
+		// The config from the command line, before anything is loaded into it.
+		flagConfig := currentConfig
+
+		if err := loadLoginConfig(&currentConfig, args); err != nil {
+			return err
+		}
+
+		if rootCABundle == "" {
+			rootCABundle = currentConfig.CABundle
+		}
+
+		if loginWatch {
+			watchedFiles := func() ([]string, error) {
+				cfg := flagConfig
+				if err := loadLoginConfig(&cfg, args); err != nil {
+					return nil, err
+				}
+
+				files := cfg.WatchedFiles()
+				if loginLoadConfig != "" {
+					files = append(files, loginLoadConfig)
+				}
+				files = append(files, loginPackagesFiles...)
+				if loginDockerfile != "" {
+					files = append(files, loginDockerfile)
+				}
+
+				return files, nil
+			}
+
+			return login.Watch(watchedFiles, watchRunArgs(cmd, args))
+		}
+
+		var db *database.PackageDatabase
 
-		if loginLoadConfig != "" {
-			f, err := os.Open(loginLoadConfig)
+		if loginInteractiveSelect {
+			var err error
+
+			db, err = newDb()
 			if err != nil {
 				return err
 			}
-			defer f.Close()
-
-			dec := yaml.NewDecoder(f)
 
-			if err := dec.Decode(&currentConfig); err != nil {
+			if err := currentConfig.SelectPackages(db, os.Stdin, os.Stdout); err != nil {
 				return err
 			}
 		}
@@ -62,29 +217,77 @@ var loginCmd = &cobra.Command{
 
 			return os.WriteFile(loginSaveConfig, cfg, os.FileMode(0644))
 		} else {
-			db, err := newDb()
-			if err != nil {
-				return err
+			if db == nil {
+				var err error
+
+				db, err = newDb()
+				if err != nil {
+					return err
+				}
 			}
 
-			return currentConfig.Run(db)
+			err := currentConfig.Run(db)
+
+			// The exit status of the guest command is passed through without any other output.
+			// It's only silenced on it's own so errors like a failing post run command are still printed.
+			if _, ok := err.(*builder.ExitStatusError); ok {
+				cmd.SilenceErrors = true
+				cmd.SilenceUsage = true
+			}
+
+			return err
 		}
 	},
 }
 
+var hashCmd = &cobra.Command{
+	Use:   "hash <config>",
+	Short: "Print the definition hash of a login config without building it",
+	Long:  "Print the definition hash of a login config without building it. This is the same as login --load-config <config> --hash-only.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		loginLoadConfig = args[0]
+		currentConfig.HashOnly = true
+
+		return loginCmd.RunE(loginCmd, nil)
+	},
+}
+
+var buildDockerfileCmd = &cobra.Command{
+	Use:   "build-dockerfile <path>",
+	Short: "Build and run a virtual machine from a Dockerfile",
+	Long:  "Build and run a virtual machine from a Dockerfile. Only FROM, RUN, COPY, ENV, and WORKDIR are supported. FROM selects the builder (alpine:3.20 is the alpine@3.20 builder) and COPY sources are relative to the directory containing the Dockerfile. Takes the same flags as login.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		loginDockerfile = args[0]
+
+		return loginCmd.RunE(loginCmd, nil)
+	},
+}
+
 func init() {
+	rootCmd.AddCommand(hashCmd)
+	rootCmd.AddCommand(buildDockerfileCmd)
+
 	// config flags
 	loginCmd.PersistentFlags().StringVarP(&loginSaveConfig, "save-config", "w", "", "Write the config to a given file and don't run it.")
 	loginCmd.PersistentFlags().StringVarP(&loginLoadConfig, "load-config", "c", "", "Load the config from a file and run it.")
+	loginCmd.PersistentFlags().BoolVar(&loginInteractiveSelect, "interactive-select", false, "Search for and select packages in the terminal before building.")
+	loginCmd.PersistentFlags().StringArrayVar(&loginPackagesFiles, "packages-file", []string{}, "Add the packages listed in a file (one per line, # starts a comment) like a pip requirements file.")
 
 	// public flags (saved to config)
 	loginCmd.PersistentFlags().StringVarP(&currentConfig.Builder, "builder", "b", DEFAuLT_BUILDER, "The container builder used to construct the virtual machine.")
 	loginCmd.PersistentFlags().StringArrayVarP(&currentConfig.Commands, "exec", "E", []string{}, "Run a different command rather than dropping into a shell.")
+	loginCmd.PersistentFlags().BoolVar(&currentConfig.Layers, "layers", false, "Build each --exec command into a cached layer so changing a command only rebuilds it and the commands after it.")
 	loginCmd.PersistentFlags().StringVar(&currentConfig.Init, "init", "", "Replace the init system with a different command.")
+	loginCmd.PersistentFlags().BoolVar(&currentConfig.FallbackShell, "fallback-shell", false, "Use the builtin init shell if the guest has no shell (e.g. scratch based images).")
+	loginCmd.PersistentFlags().StringVar(&currentConfig.InitBinary, "init-binary", "", "Replace the builtin init executable with a local file. It must be built for the guest architecture and still runs /init.star.")
 	loginCmd.PersistentFlags().BoolVar(&currentConfig.NoScripts, "no-scripts", false, "Disable script execution.")
-	loginCmd.PersistentFlags().StringArrayVarP(&currentConfig.Files, "file", "f", []string{}, "Specify local files/URLs to be copied into the virtual machine. URLs will be downloaded to the build directory first.")
+	loginCmd.PersistentFlags().StringArrayVarP(&currentConfig.Files, "file", "f", []string{}, "Specify local files/URLs to be copied into the virtual machine. URLs will be downloaded to the build directory first. Files are copied to /root unless an absolute guest path is given after the last comma (file,/path/in/guest).")
 	loginCmd.PersistentFlags().StringArrayVarP(&currentConfig.Archives, "archive", "a", []string{}, "Specify archives to be copied into the virtual machine. A copy will be made in the build directory.")
 	loginCmd.PersistentFlags().StringVarP(&currentConfig.Output, "output", "o", "", "Write the specified file from the guest to the host.")
+	loginCmd.PersistentFlags().StringArrayVar(&currentConfig.OutputTransforms, "output-transform", []string{}, "Apply a registered transform (gzip, zstd, or base64) to the --output file before writing it. Transforms are applied in the order given.")
+	loginCmd.PersistentFlags().BoolVar(&currentConfig.OutputStdout, "output-stdout", false, "Write the --output file to stdout instead of the current directory. Other output goes to stderr.")
 	loginCmd.PersistentFlags().StringArrayVarP(&currentConfig.Environment, "environment", "e", []string{}, "Add environment variables to the VM.")
 	loginCmd.PersistentFlags().StringArrayVarP(&currentConfig.Macros, "macro", "m", []string{}, "Add macros to the VM.")
 	loginCmd.PersistentFlags().StringVar(&currentConfig.Architecture, "arch", "", "Override the CPU architecture of the machine. This will use emulation with a performance hit.")
@@ -92,14 +295,57 @@ func init() {
 
 	// private flags (need to set on command line)
 	loginCmd.PersistentFlags().IntVar(&currentConfig.CpuCores, "cpu", 1, "The number of CPU cores to allocate to the virtual machine.")
-	loginCmd.PersistentFlags().IntVar(&currentConfig.MemorySize, "ram", 1024, "The amount of ram in the virtual machine in megabytes.")
-	loginCmd.PersistentFlags().IntVar(&currentConfig.StorageSize, "storage", 1024, "The amount of storage to allocate in the virtual machine in megabytes.")
+	loginCmd.PersistentFlags().Var(newSizeValue(&currentConfig.MemorySize, 1024), "ram", "The amount of ram in the virtual machine (e.g. 512M, 2G). Sizes without a suffix are in megabytes.")
+	loginCmd.PersistentFlags().Var(newSizeValue(&currentConfig.StorageSize, 1024), "storage", "The amount of storage to allocate in the virtual machine (e.g. 512M, 2G). Sizes without a suffix are in megabytes.")
+	loginCmd.PersistentFlags().StringVar(&currentConfig.Persist, "persist", "", "Store changes to the root filesystem in the given file so they persist across runs.")
+	loginCmd.PersistentFlags().StringVar(&currentConfig.HttpCache, "http-cache", "", "Cache guest downloads made through http://host.internal/proxy/<scheme>/<host>/<path> in the given directory.")
+	loginCmd.PersistentFlags().BoolVar(&currentConfig.ShareCache, "share-cache", false, "Serve downloads cached in the build directory to the guest read-only at http://host.internal/cache/<scheme>/<path>.")
+	loginCmd.PersistentFlags().StringArrayVar(&currentConfig.Secrets, "secret", []string{}, "Write a secret (name=value) to /run/secrets/<name> in the guest at runtime. Secrets are never saved in the build cache.")
+	loginCmd.PersistentFlags().StringArrayVar(&currentConfig.SecretFiles, "secret-file", []string{}, "Write the contents of a host file (name=path or path) to /run/secrets/<name> in the guest at runtime.")
+	loginCmd.PersistentFlags().DurationVar(&currentConfig.ForwardIdleTimeout, "forward-idle-timeout", 0, "Close forwarded SSH and port connections after no data has been sent for this long (e.g. 30m). 0 disables it.")
+	loginCmd.PersistentFlags().BoolVar(&currentConfig.KeepAlive, "keep-alive", false, "Start a shell in the guest once the command exits rather than shutting down the virtual machine. The shell can't be reattached once the terminal is closed.")
+	loginCmd.PersistentFlags().StringVar(&currentConfig.Name, "name", "", "Label the virtual machine. The name is included in log lines and lifecycle events.")
+	loginCmd.PersistentFlags().StringVar(&currentConfig.EventsSocket, "events", "", "Write lifecycle events (booting, ssh-ready, shutting-down, exited) as JSON lines to the given Unix socket.")
+	loginCmd.PersistentFlags().BoolVar(&currentConfig.ResourceLimits, "resource-limits", false, "Limit the hypervisor to the allocated CPU cores and memory with a cgroup (linux only, requires cgroup v2).")
+	loginCmd.PersistentFlags().StringArrayVar(&currentConfig.DataDisks, "disk", []string{}, "Attach a data disk as SIZE (a blank in-memory ext4 filesystem) or SIZE:IMAGE (a host image, changes persist). Disks appear as /dev/vdb, /dev/vdc, etc in order.")
+	loginCmd.PersistentFlags().BoolVar(&currentConfig.ExpandVariables, "expand-vars", false, "Expand ${VAR} references in files, archives, packages, macros, commands, and environment using earlier --environment values. Use $$ for a literal $.")
+	loginCmd.PersistentFlags().BoolVar(&currentConfig.HostVariables, "host-vars", false, "Also expand ${VAR} references from the host environment.")
+	loginCmd.PersistentFlags().BoolVar(&currentConfig.StrictVariables, "strict-vars", false, "Fail if a ${VAR} reference is undefined rather than expanding it to an empty string.")
+	loginCmd.PersistentFlags().StringArrayVar(&currentConfig.Args, "arg", []string{}, "Set a key=value argument in /init.json which is available to init.star as args.")
+	loginCmd.PersistentFlags().StringVar(&currentConfig.ArgsFile, "args-file", "", "Load arguments for /init.json from a JSON file. Values from --arg take priority.")
+	loginCmd.PersistentFlags().StringVar(&currentConfig.Nftables, "nftables", "", "Apply a nftables ruleset file in the guest after the network is configured. Requires nft in the guest.")
+	loginCmd.PersistentFlags().StringArrayVar(&currentConfig.KernelArgs, "cmdline", []string{}, "Append a key=value argument to the guest kernel command line.")
+	loginCmd.PersistentFlags().StringArrayVar(&currentConfig.AllowDomains, "allow-domain", []string{}, "Only let the guest resolve and connect to this domain and its subdomains. Can be repeated. Denied attempts are logged.")
+	loginCmd.PersistentFlags().StringArrayVar(&currentConfig.AllowCIDRs, "allow-cidr", []string{}, "Only let the guest connect to addresses in this CIDR (e.g. 192.168.1.0/24). Can be repeated with --allow-domain.")
+	loginCmd.PersistentFlags().StringArrayVar(&currentConfig.HypervisorArgs, "hypervisor-arg", []string{}, "Append an extra argument to the hypervisor command line (e.g. -device virtio-rng-pci).")
 	loginCmd.PersistentFlags().BoolVar(&currentConfig.Debug, "debug", false, "Redirect output from the hypervisor to the host. the guest will exit as soon as the VM finishes startup.")
-	loginCmd.PersistentFlags().StringVar(&currentConfig.WriteRoot, "write-root", "", "Write the root filesystem as a .tar.gz archive.")
+	loginCmd.PersistentFlags().StringVar(&currentConfig.PostRun, "post-run", "", "Run a shell command on the host after the virtual machine exits successfully. TINYRANGE_OUTPUT, TINYRANGE_EXIT_STATUS, and TINYRANGE_ERROR are set in its environment.")
+	loginCmd.PersistentFlags().BoolVar(&currentConfig.PostRunAlways, "post-run-always", false, "Run the --post-run command even if the run fails.")
+	loginCmd.PersistentFlags().StringVar(&currentConfig.WriteRoot, "write-root", "", "Write the root filesystem as a tar archive. The compression is chosen from the extension (.tar.gz, .tar.zst, or .tar).")
+	loginCmd.PersistentFlags().StringVar(&currentConfig.PlanJson, "plan-json", "", "Write the resolved packages, directives, and definition hash to the given JSON file.")
+	loginCmd.PersistentFlags().StringVar(&currentConfig.Manifest, "manifest", "", "Write a sorted manifest of every file in the root filesystem the virtual machine boots with (type, mode, owner, size, sha256, path) to the given file.")
 	loginCmd.PersistentFlags().StringVar(&currentConfig.WriteDocker, "write-docker", "", "Write the root filesystem to a docker tag on the local docker daemon.")
+	loginCmd.PersistentFlags().DurationVar(&currentConfig.WriteDockerTimeout, "write-docker-timeout", login.DEFAULT_DOCKER_TIMEOUT, "The maximum time to wait for the docker daemon to build the image.")
+	loginCmd.PersistentFlags().StringVar(&currentConfig.WriteVagrant, "write-vagrant", "", "Write the virtual machine as a Vagrant box for the libvirt provider (x86_64 only).")
 	loginCmd.PersistentFlags().BoolVar(&currentConfig.Hash, "hash", false, "print the hash of the definition generated after the machine has exited.")
+	loginCmd.PersistentFlags().BoolVar(&currentConfig.HashOnly, "hash-only", false, "Print the hash of the definition to stdout without building or running anything.")
 	loginCmd.PersistentFlags().StringArrayVar(&currentConfig.ExperimentalFlags, "experimental", []string{}, "Add experimental flags.")
 	loginCmd.PersistentFlags().StringVar(&currentConfig.WebSSH, "web", "", "Start a web interface on the given port.")
+	loginCmd.PersistentFlags().StringVar(&currentConfig.SshUsername, "ssh-user", "", "Only accept this username in the guest SSH server (commands still run as root). Defaults to accepting any username and connecting as root.")
+	loginCmd.PersistentFlags().StringVar(&currentConfig.SshPassword, "ssh-password", "", "The password of the guest SSH server. Defaults to insecurepassword.")
+	loginCmd.PersistentFlags().IntVar(&currentConfig.SshPort, "ssh-port", 0, "The port the guest SSH server listens on. Defaults to 2222.")
+	loginCmd.PersistentFlags().StringVar(&currentConfig.SshKey, "ssh-key", "", "Connect to the guest SSH server with this private key instead of the password. Its public key is accepted by the guest and password authentication is disabled unless --ssh-password is set.")
+	loginCmd.PersistentFlags().StringVar(&currentConfig.SshAuthorizedKeys, "ssh-authorized-keys", "", "Accept the public keys in this authorized_keys file in the guest SSH server and disable password authentication unless --ssh-password is set.")
+	loginCmd.PersistentFlags().StringVar(&currentConfig.SshInfo, "ssh-info", "", "Print the SSH address, username, and password of the guest and keep it running rather than connecting. Listens on localhost:2222 unless an address is given (--ssh-info=host:port).")
+	loginCmd.PersistentFlags().Lookup("ssh-info").NoOptDefVal = "localhost:2222"
+	loginCmd.PersistentFlags().BoolVar(&currentConfig.WebTLS, "tls", false, "Serve the --web interface over HTTPS with a self-signed certificate.")
+	loginCmd.PersistentFlags().StringVar(&currentConfig.WebTLSCert, "tls-cert", "", "Serve the --web interface over HTTPS with the given PEM certificate (requires --tls-key).")
+	loginCmd.PersistentFlags().StringVar(&currentConfig.WebTLSKey, "tls-key", "", "The PEM private key for --tls-cert.")
 	loginCmd.PersistentFlags().BoolVar(&currentConfig.WriteTemplate, "template", false, "If true then just generate the config and don't run the VM.")
+	loginCmd.PersistentFlags().BoolVar(&loginWatch, "watch", false, "Run again whenever the config, local files, archives, or macros change. A run that is still going is stopped first.")
+	loginCmd.PersistentFlags().BoolVar(&currentConfig.ForceRebuild, "force", false, "Always rebuild the VM template even if the inputs have not changed.")
 	rootCmd.AddCommand(loginCmd)
+
+	// build-dockerfile shares the login flags.
+	buildDockerfileCmd.Flags().AddFlagSet(loginCmd.PersistentFlags())
 }
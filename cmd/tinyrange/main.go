@@ -1,25 +1,45 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/tinyrange/tinyrange/pkg/buildinfo"
 	"github.com/tinyrange/tinyrange/pkg/common"
 	"github.com/tinyrange/tinyrange/pkg/database"
+	"github.com/tinyrange/tinyrange/pkg/metrics"
 )
 
 var (
-	rootBuildDir     string
-	rootRebuild      bool
-	rootCpuProfile   string
-	rootVerbose      bool
-	rootDistribution string
-	rootMirrors      []string
+	rootBuildDir          string
+	rootRebuild           bool
+	rootCpuProfile        string
+	rootVerbose           bool
+	rootQuiet             bool
+	rootLogFormat         string
+	rootDistribution      string
+	rootDistKey           string
+	rootOffline           bool
+	rootMaxIndexAge       time.Duration
+	rootCABundle          string
+	rootMaxConns          int
+	rootBuildMemory       int64
+	rootMirrors           []string
+	rootLocalRepos        []string
+	rootMetrics           string
+	rootChunkedCache      bool
+	rootRequireSignatures bool
 )
 
+// Databases created by the current command. Chunked build outputs are released once it exits.
+var openDatabases []*database.PackageDatabase
+
 var rootCmd = &cobra.Command{
 	Use:   "tinyrange",
 	Short: "TinyRange: Next-generation Virtualization for Cyber and beyond",
@@ -27,12 +47,51 @@ var rootCmd = &cobra.Command{
 Built at The University of Queensland
 Complete documentation is available at https://github.com/tinyrange/tinyrange`, buildinfo.VERSION),
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if rootLogFormat == "" {
+			rootLogFormat = os.Getenv("TINYRANGE_LOG_FORMAT")
+		}
+
+		if err := common.SetLogFormat(rootLogFormat); err != nil {
+			return err
+		}
+
+		if rootQuiet || os.Getenv("TINYRANGE_QUIET") == "on" {
+			if err := common.EnableQuiet(); err != nil {
+				return err
+			}
+		}
+
 		if rootVerbose || os.Getenv("TINYRANGE_VERBOSE") == "on" {
 			if err := common.EnableVerbose(); err != nil {
 				return err
 			}
 		}
 
+		buildMemory := rootBuildMemory
+
+		if buildMemory == 0 {
+			if env := os.Getenv("TINYRANGE_BUILD_MEMORY_LIMIT"); env != "" {
+				val, err := strconv.ParseInt(env, 10, 64)
+				if err != nil {
+					return fmt.Errorf("invalid TINYRANGE_BUILD_MEMORY_LIMIT %q: %w", env, err)
+				}
+
+				buildMemory = val
+			}
+		}
+
+		if buildMemory < 0 {
+			return fmt.Errorf("build memory limit must not be negative, got %d", buildMemory)
+		}
+
+		common.SetBuildMemoryLimit(buildMemory)
+
+		if rootMetrics != "" {
+			if err := metrics.Serve(rootMetrics); err != nil {
+				return err
+			}
+		}
+
 		return nil
 	},
 }
@@ -40,6 +99,37 @@ Complete documentation is available at https://github.com/tinyrange/tinyrange`,
 func newDb() (*database.PackageDatabase, error) {
 	db := database.New(rootBuildDir)
 
+	db.Offline = rootOffline || os.Getenv("TINYRANGE_OFFLINE") == "on"
+
+	db.ChunkedCache = rootChunkedCache
+	db.MaxIndexAge = rootMaxIndexAge
+	db.MaxConnsPerHost = rootMaxConns
+	openDatabases = append(openDatabases, db)
+
+	caBundle := rootCABundle
+	if caBundle == "" {
+		caBundle = os.Getenv("SSL_CERT_FILE")
+	}
+
+	if caBundle != "" {
+		if err := db.SetCABundle(caBundle); err != nil {
+			return nil, err
+		}
+	}
+
+	if rootDistKey != "" {
+		key, err := database.ReadDistributionPublicKey(rootDistKey)
+		if err != nil {
+			return nil, err
+		}
+
+		db.SetDistributionKey(key)
+	} else if rootRequireSignatures {
+		return nil, fmt.Errorf("--require-signatures needs a --distribution-key")
+	}
+
+	db.RequireSignatures = rootRequireSignatures
+
 	if rootDistribution != "" {
 		if err := db.SetDistributionServer(rootDistribution); err != nil {
 			return nil, err
@@ -55,6 +145,18 @@ func newDb() (*database.PackageDatabase, error) {
 
 	db.RebuildUserDefinitions = rootRebuild
 
+	// Local repositories are added to package collections when the builders are loaded.
+	for _, repo := range rootLocalRepos {
+		kind, dir, ok := strings.Cut(repo, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid local repo syntax (kind=directory)")
+		}
+
+		if err := db.AddLocalRepo(kind, dir); err != nil {
+			return nil, err
+		}
+	}
+
 	if err := db.LoadBuiltinBuilders(); err != nil {
 		return nil, err
 	}
@@ -76,13 +178,40 @@ func init() {
 	rootCmd.PersistentFlags().BoolVar(&rootRebuild, "rebuild", false, "should user package definitions be rebuilt even if we already have built them previously")
 	rootCmd.PersistentFlags().StringVar(&rootCpuProfile, "cpuprofile", "", "write cpu profile to file")
 	rootCmd.PersistentFlags().BoolVar(&rootVerbose, "verbose", false, "enable debugging output")
+	rootCmd.PersistentFlags().BoolVar(&rootQuiet, "quiet", false, "only log warnings and errors")
+	rootCmd.PersistentFlags().StringVar(&rootLogFormat, "log-format", "", "the format for log output (text or json)")
 	rootCmd.PersistentFlags().StringVar(&rootDistribution, "distribution", "", "The HTTP/HTTPS address of a distribution server to copy build results from")
+	rootCmd.PersistentFlags().StringVar(&rootDistKey, "distribution-key", "", "Only accept artifacts from the distribution server signed by this public key and build the rest locally")
+	rootCmd.PersistentFlags().BoolVar(&rootRequireSignatures, "require-signatures", false, "Fail rather than building locally if a artifact from the distribution server isn't signed by --distribution-key")
+	rootCmd.PersistentFlags().BoolVar(&rootOffline, "offline", false, "only use cached build results and fail rather than accessing the network")
+	rootCmd.PersistentFlags().DurationVar(&rootMaxIndexAge, "max-index-age", 0, "fetch a package index used by the selected builder again if it was fetched longer ago than this (e.g. 24h). With --offline it's an error instead")
+	rootCmd.PersistentFlags().StringVar(&rootCABundle, "ca-bundle", "", "trust the PEM certificates in this file for HTTPS downloads in addition to the system roots (defaults to $SSL_CERT_FILE)")
+	rootCmd.PersistentFlags().IntVar(&rootMaxConns, "max-conns-per-host", database.DEFAULT_MAX_CONNS_PER_HOST, "the maximum number of connections opened to each host by downloads, which are kept open for reuse")
+	rootCmd.PersistentFlags().Int64Var(&rootBuildMemory, "build-memory-limit", 0, "the total estimated memory in megabytes that concurrent virtual machine builds may use, 0 for no limit")
 	rootCmd.PersistentFlags().StringArrayVar(&rootMirrors, "mirror", []string{}, "Specify mirrors to override the default mirror settings")
+	rootCmd.PersistentFlags().StringVar(&rootMetrics, "metrics", "", "Serve Prometheus metrics at http://<addr>/metrics (e.g. localhost:9100)")
+	rootCmd.PersistentFlags().BoolVar(&rootChunkedCache, "chunked-cache", false, "Store build outputs as deduplicated chunks and only keep whole files while they are in use")
+	rootCmd.PersistentFlags().StringArrayVar(&rootLocalRepos, "local-repo", []string{}, "Add a directory of local packages to the builders as kind=directory (supported kinds: alpine)")
 }
 
 func Run() {
-	if err := rootCmd.Execute(); err != nil {
+	err := rootCmd.Execute()
+
+	for _, db := range openDatabases {
+		if releaseErr := db.ReleaseChunkedOutputs(); releaseErr != nil {
+			slog.Warn("failed to release chunked build outputs", "error", releaseErr)
+		}
+	}
+
+	if err != nil {
 		// fmt.Println(err)
+
+		// Pass through the exit status of commands run in the guest.
+		var exitErr interface{ ExitCode() int }
+		if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+			os.Exit(exitErr.ExitCode())
+		}
+
 		os.Exit(1)
 	}
 }
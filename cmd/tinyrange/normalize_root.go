@@ -0,0 +1,84 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/tinyrange/tinyrange/pkg/oci"
+)
+
+var (
+	normalizeRootOutput string
+	normalizeRootOwner  string
+)
+
+var normalizeRootCmd = &cobra.Command{
+	Use:   "normalize-root <in.tar>...",
+	Short: "Rewrite root filesystem tar archives as a single reproducible tar archive",
+	Long: `Rewrite root filesystem tar archives as a single reproducible tar archive.
+Each archive is extracted in memory on top of the ones before it (whiteouts remove files from earlier archives).
+The result is written with entries sorted by name, modification times zeroed, numeric owners only, and
+every path to the same file after the first written as a hard link, so roots built by different tools can be compared.
+Archives can be gzip or zstd compressed.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var opts oci.NormalizeOptions
+
+		if normalizeRootOwner != "" {
+			uid, gid, ok := strings.Cut(normalizeRootOwner, ":")
+			if !ok {
+				return fmt.Errorf("--owner must be uid:gid: %s", normalizeRootOwner)
+			}
+
+			var err error
+
+			opts.Uid, err = strconv.Atoi(uid)
+			if err != nil {
+				return fmt.Errorf("invalid uid in --owner: %w", err)
+			}
+
+			opts.Gid, err = strconv.Atoi(gid)
+			if err != nil {
+				return fmt.Errorf("invalid gid in --owner: %w", err)
+			}
+
+			opts.SetOwner = true
+		}
+
+		var layers []io.Reader
+
+		for _, filename := range args {
+			f, err := os.Open(filename)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			layers = append(layers, f)
+		}
+
+		var out io.Writer = os.Stdout
+		if normalizeRootOutput != "-" {
+			f, err := os.Create(normalizeRootOutput)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			out = f
+		}
+
+		return oci.NormalizeRoot(out, layers, opts)
+	},
+}
+
+func init() {
+	normalizeRootCmd.PersistentFlags().StringVarP(&normalizeRootOutput, "output", "o", "", "The tar archive to write (- for stdout).")
+	normalizeRootCmd.PersistentFlags().StringVar(&normalizeRootOwner, "owner", "", "Set the owner of every entry to uid:gid.")
+	normalizeRootCmd.MarkPersistentFlagRequired("output")
+	rootCmd.AddCommand(normalizeRootCmd)
+}
@@ -0,0 +1,127 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/tinyrange/tinyrange/pkg/config"
+	"github.com/tinyrange/tinyrange/pkg/filesystem"
+	"github.com/tinyrange/tinyrange/pkg/oci"
+)
+
+var (
+	ociExtractOutput string
+	ociExtractArch   string
+)
+
+var ociExtractCmd = &cobra.Command{
+	Use:   "oci-extract <image[:tag]> <path>",
+	Short: "Copy a file or directory out of a Docker Hub image without booting a virtual machine",
+	Long: `Copy a file or directory out of a Docker Hub image without booting a virtual machine.
+The image layers are extracted in memory (whiteouts remove files from lower layers) and the path is written to --output.
+Directories are written as a tar archive. Symlinks and hard links to the path are followed.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		image := args[0]
+		if !strings.Contains(image, "/") {
+			image = "library/" + image
+		}
+		if !strings.Contains(image, ":") {
+			image += ":latest"
+		}
+
+		arch, err := config.ArchitectureFromString(ociExtractArch)
+		if err != nil {
+			return err
+		}
+		if arch == config.ArchInvalid {
+			arch = config.HostArchitecture
+		}
+
+		db, err := newDb()
+		if err != nil {
+			return err
+		}
+
+		client, err := db.HttpClient()
+		if err != nil {
+			return err
+		}
+
+		dl := oci.NewDownloader()
+		dl.SetArchitecture(arch)
+		dl.SetClient(client)
+
+		root := filesystem.NewMemoryDirectory()
+
+		if err := dl.ExtractOciImageToDirectory(root, image); err != nil {
+			return fmt.Errorf("failed to extract %s: %w", image, err)
+		}
+
+		file, err := oci.OpenImagePath(root, args[1])
+		if err != nil {
+			return err
+		}
+
+		dir, isDir := file.(filesystem.Directory)
+
+		name := path.Base(path.Clean("/" + args[1]))
+		if name == "/" {
+			name = "root"
+		}
+
+		output := ociExtractOutput
+		if output == "" {
+			output = name
+			if isDir {
+				output += ".tar"
+			}
+		}
+
+		var out io.Writer = os.Stdout
+		if output != "-" {
+			f, err := os.Create(output)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			out = f
+		}
+
+		if isDir {
+			return oci.WriteDirectoryTar(out, root, dir, name)
+		}
+
+		if f, ok := out.(*os.File); ok && f != os.Stdout {
+			info, err := file.Stat()
+			if err != nil {
+				return err
+			}
+
+			// Keep the permissions so extracted executables can be run.
+			if err := f.Chmod(info.Mode().Perm()); err != nil {
+				return err
+			}
+		}
+
+		fh, err := file.Open()
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+
+		_, err = io.Copy(out, fh)
+		return err
+	},
+}
+
+func init() {
+	ociExtractCmd.PersistentFlags().StringVarP(&ociExtractOutput, "output", "o", "", "The file to write to (- for stdout). Defaults to the name of the path (with .tar added for directories).")
+	ociExtractCmd.PersistentFlags().StringVar(&ociExtractArch, "arch", "", "The architecture of the image to extract. Defaults to the host architecture.")
+	rootCmd.AddCommand(ociExtractCmd)
+}
@@ -2,6 +2,7 @@ package cli
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -9,9 +10,11 @@ import (
 	"path"
 	"runtime/pprof"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/tinyrange/tinyrange/pkg/config"
+	"github.com/tinyrange/tinyrange/pkg/metrics"
 	"github.com/tinyrange/tinyrange/pkg/tinyrange"
 	"gopkg.in/yaml.v3"
 )
@@ -21,6 +24,16 @@ var (
 	runExportFilesystem string
 	runListenNbd        string
 	runStreamingServer  string
+	runPersist          string
+	runEvents           string
+	runName             string
+	runKeepAlive        bool
+	runIdleTimeout      time.Duration
+	runSecrets          []string
+	runSecretFiles      []string
+	runHttpCache        string
+	runResourceLimits   bool
+	runShareCache       bool
 )
 
 var runCmd = &cobra.Command{
@@ -40,6 +53,17 @@ var runCmd = &cobra.Command{
 			defer pprof.StopCPUProfile()
 		}
 
+		// A parent process with --metrics records the metrics of the virtual machine it started.
+		if addr, ok := os.LookupEnv(metrics.ReportEnvironmentVariable); ok {
+			os.Unsetenv(metrics.ReportEnvironmentVariable)
+
+			stop, err := metrics.Report(addr)
+			if err != nil {
+				return err
+			}
+			defer stop()
+		}
+
 		var cfg config.TinyRangeConfig
 
 		if runStreamingServer != "" {
@@ -70,14 +94,15 @@ var runCmd = &cobra.Command{
 			}
 			defer f.Close()
 
-			if strings.HasSuffix(f.Name(), ".json") {
-				dec := json.NewDecoder(f)
+			if strings.HasSuffix(f.Name(), ".yml") {
+				dec := yaml.NewDecoder(f)
 
 				if err := dec.Decode(&cfg); err != nil {
 					return err
 				}
-			} else if strings.HasSuffix(f.Name(), ".yml") {
-				dec := yaml.NewDecoder(f)
+			} else {
+				// Templates written by login are stored in the build directory as JSON.
+				dec := json.NewDecoder(f)
 
 				if err := dec.Decode(&cfg); err != nil {
 					return err
@@ -85,7 +110,75 @@ var runCmd = &cobra.Command{
 			}
 		}
 
-		return tinyrange.RunWithConfig(rootBuildDir, cfg, runDebug, false, runExportFilesystem, runListenNbd, runStreamingServer)
+		if runEvents != "" {
+			cfg.EventsSocket = runEvents
+		}
+
+		if runName != "" {
+			cfg.Name = runName
+		}
+
+		if runKeepAlive {
+			cfg.KeepAlive = true
+		}
+
+		if runIdleTimeout != 0 {
+			cfg.ForwardIdleTimeout = runIdleTimeout
+		}
+
+		secrets, err := config.ParseSecrets(runSecrets, runSecretFiles)
+		if err != nil {
+			return err
+		}
+
+		// Secrets and SSH credentials from a parent login are only kept in memory.
+		if encoded, ok := os.LookupEnv(config.SecretsEnvironmentVariable); ok {
+			os.Unsetenv(config.SecretsEnvironmentVariable)
+
+			var inherited config.RuntimeSecrets
+			if err := json.Unmarshal([]byte(encoded), &inherited); err != nil {
+				return fmt.Errorf("failed to decode secrets: %w", err)
+			}
+
+			for k, v := range inherited.Secrets {
+				secrets[k] = v
+			}
+
+			if inherited.SshPassword != "" {
+				cfg.SshPassword = inherited.SshPassword
+			}
+
+			cfg.SshAuthorizedKeys = inherited.SshAuthorizedKeys
+		}
+
+		cfg.Secrets = secrets
+
+		if runPersist != "" {
+			cfg.PersistFilename = runPersist
+		}
+
+		if runHttpCache != "" {
+			cfg.HttpCacheDirectory = runHttpCache
+		}
+
+		if runResourceLimits {
+			cfg.ResourceLimits = true
+		}
+
+		if runShareCache {
+			cfg.ShareCacheDirectory = rootBuildDir
+		}
+
+		err = tinyrange.RunWithConfig(rootBuildDir, cfg, runDebug, false, runExportFilesystem, runListenNbd, runStreamingServer)
+
+		// The exit status of a exec command is passed to the parent process without any other output.
+		var exitErr *tinyrange.ExitStatusError
+		if errors.As(err, &exitErr) {
+			cmd.SilenceErrors = true
+			cmd.SilenceUsage = true
+		}
+
+		return err
 	},
 }
 
@@ -94,5 +187,15 @@ func init() {
 	runCmd.PersistentFlags().StringVar(&runExportFilesystem, "export-filesystem", "", "write the filesystem to the host filesystem")
 	runCmd.PersistentFlags().StringVar(&runListenNbd, "listen-nbd", "", "Listen with an NBD server on the given address and port")
 	runCmd.PersistentFlags().StringVar(&runStreamingServer, "stream", "", "Specify a server to download the config from.")
+	runCmd.PersistentFlags().StringVar(&runHttpCache, "http-cache", "", "Cache guest downloads made through http://host.internal/proxy/ in the given directory.")
+	runCmd.PersistentFlags().BoolVar(&runShareCache, "share-cache", false, "Serve downloads cached in the build directory to the guest read-only at http://host.internal/cache/.")
+	runCmd.PersistentFlags().BoolVar(&runResourceLimits, "resource-limits", false, "Limit the hypervisor to the allocated CPU cores and memory with a cgroup (linux only, requires cgroup v2).")
+	runCmd.PersistentFlags().StringArrayVar(&runSecrets, "secret", []string{}, "Write a secret (name=value) to /run/secrets/<name> in the guest.")
+	runCmd.PersistentFlags().StringArrayVar(&runSecretFiles, "secret-file", []string{}, "Write the contents of a host file (name=path or path) to /run/secrets/<name> in the guest.")
+	runCmd.PersistentFlags().DurationVar(&runIdleTimeout, "forward-idle-timeout", 0, "Close forwarded SSH and port connections after no data has been sent for this long.")
+	runCmd.PersistentFlags().BoolVar(&runKeepAlive, "keep-alive", false, "Start a shell in the guest once the command exits rather than shutting down. The shell can't be reattached once the terminal is closed.")
+	runCmd.PersistentFlags().StringVar(&runName, "name", "", "Label the virtual machine in log lines and lifecycle events.")
+	runCmd.PersistentFlags().StringVar(&runEvents, "events", "", "Write lifecycle events as JSON lines to the given Unix socket.")
+	runCmd.PersistentFlags().StringVar(&runPersist, "persist", "", "Store changes to the root filesystem in the given file so they persist across runs.")
 	rootCmd.AddCommand(runCmd)
 }
@@ -0,0 +1,109 @@
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/config"
+)
+
+var (
+	testPlanBuilder string
+	testPlanArch    string
+)
+
+type testPlanFailure struct {
+	spec string
+	err  error
+}
+
+var testPlanCmd = &cobra.Command{
+	Use:   "test-plan",
+	Short: "Check that a list of packages read from stdin can be planned",
+	Long: `Check that a list of packages read from stdin can be planned.
+Each line is a package query like the arguments to login (blank lines and lines starting with # are skipped).
+Every package is planned on its own with the builder's default packages. Nothing is downloaded or built.
+Exits with a error if any package fails to plan.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		arch, err := config.ArchitectureFromString(testPlanArch)
+		if err != nil {
+			return err
+		}
+
+		if arch == config.ArchInvalid {
+			arch = config.HostArchitecture
+		}
+
+		db, err := newDb()
+		if err != nil {
+			return err
+		}
+
+		ctx := db.NewBuildContext(nil)
+
+		// Load the builder before reading any packages so a broken builder fails once rather than for every package.
+		b, err := db.GetContainerBuilder(ctx, testPlanBuilder, arch)
+		if err != nil {
+			return err
+		}
+
+		var (
+			passed   int
+			failures []testPlanFailure
+		)
+
+		scanner := bufio.NewScanner(os.Stdin)
+
+		for scanner.Scan() {
+			spec := strings.TrimSpace(scanner.Text())
+			if spec == "" || strings.HasPrefix(spec, "#") {
+				continue
+			}
+
+			q, err := common.ParsePackageQuery(spec)
+			if err != nil {
+				failures = append(failures, testPlanFailure{spec: spec, err: err})
+				continue
+			}
+
+			if _, err := b.Plan(
+				ctx,
+				[]common.PackageQuery{q},
+				common.TagList{"level3", "defaults"},
+				common.PlanOptions{},
+			); err != nil {
+				failures = append(failures, testPlanFailure{spec: spec, err: err})
+				continue
+			}
+
+			passed += 1
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+
+		for _, failure := range failures {
+			fmt.Printf("FAIL %s: %s\n", failure.spec, failure.err)
+		}
+
+		fmt.Printf("%d passed, %d failed\n", passed, len(failures))
+
+		if len(failures) > 0 {
+			return fmt.Errorf("%d of %d packages failed to plan", len(failures), passed+len(failures))
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	testPlanCmd.PersistentFlags().StringVarP(&testPlanBuilder, "builder", "b", "", "the container builder to plan with")
+	testPlanCmd.PersistentFlags().StringVar(&testPlanArch, "arch", "", "the architecture to plan for (defaults to the host architecture)")
+	testPlanCmd.MarkPersistentFlagRequired("builder")
+	rootCmd.AddCommand(testPlanCmd)
+}
@@ -0,0 +1,47 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/tinyrange/tinyrange/pkg/login"
+)
+
+var validateConfigCmd = &cobra.Command{
+	Use:   "validate-config <file>...",
+	Short: "Check login configs for unknown keys and invalid values without building them.",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		invalid := 0
+
+		for _, filename := range args {
+			contents, err := os.ReadFile(filename)
+			if err != nil {
+				return err
+			}
+
+			problems := login.ValidateConfig(contents)
+			if len(problems) == 0 {
+				fmt.Printf("%s: OK\n", filename)
+				continue
+			}
+
+			invalid += 1
+
+			for _, problem := range problems {
+				fmt.Printf("%s: %s\n", filename, problem)
+			}
+		}
+
+		if invalid > 0 {
+			return fmt.Errorf("%d of %d configs are invalid", invalid, len(args))
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(validateConfigCmd)
+}
@@ -2,9 +2,16 @@ package cli
 
 import (
 	"github.com/spf13/cobra"
+	"github.com/tinyrange/tinyrange/pkg/common"
 	"github.com/tinyrange/tinyrange/pkg/trweb"
 )
 
+var (
+	webTLS     bool
+	webTLSCert string
+	webTLSKey  string
+)
+
 var webCmd = &cobra.Command{
 	Use:   "web",
 	Short: "Run a web interface",
@@ -16,10 +23,15 @@ var webCmd = &cobra.Command{
 
 		svr := trweb.New(db)
 
+		svr.SetTLS(common.TLSOptions{TLS: webTLS, CertFile: webTLSCert, KeyFile: webTLSKey})
+
 		return svr.Run("127.0.0.1:5123")
 	},
 }
 
 func init() {
+	webCmd.PersistentFlags().BoolVar(&webTLS, "tls", false, "Serve the web interface over HTTPS with a self-signed certificate.")
+	webCmd.PersistentFlags().StringVar(&webTLSCert, "tls-cert", "", "Serve the web interface over HTTPS with the given PEM certificate (requires --tls-key).")
+	webCmd.PersistentFlags().StringVar(&webTLSKey, "tls-key", "", "The PEM private key for --tls-cert.")
 	rootCmd.AddCommand(webCmd)
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"log/slog"
 	"os"
 	"slices"
@@ -236,11 +237,16 @@ func fromCondaQuery(query string) planner2.PackageQuery {
 
 var (
 	doQuery = flag.String("query", "", "Query to run")
+	doPlan  = flag.Bool("plan", false, "Print the resolved dependency tree and the chosen packages without logging")
 )
 
 func appMain() error {
 	flag.Parse()
 
+	if *doPlan {
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+	}
+
 	db := database.New("build/build")
 
 	def := builder.NewFetchHttpBuildDefinition("https://conda.anaconda.org/conda-forge/linux-64/repodata.json", 0, nil)
@@ -295,13 +301,19 @@ func appMain() error {
 			}
 		}
 
-		if err := plan.ResolveConstraints(); err != nil {
-			return err
-		}
+		err := plan.ResolveConstraints()
 
-		// plan.DumpTree(os.Stdout)
+		if *doPlan {
+			plan.DumpTree(os.Stdout)
 
-		return nil
+			fmt.Printf("\n")
+
+			for _, pkg := range plan.Packages() {
+				fmt.Printf("%s %s\n", pkg.Name, pkg.Version)
+			}
+		}
+
+		return err
 	}
 }
 
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"slices"
+	"strings"
 
 	"github.com/tinyrange/tinyrange/experimental/planner2"
 )
@@ -100,6 +102,8 @@ func (ctx *InstallationContext) add() (*InstallationPlan, error) {
 
 			child, err := childCtx.add()
 			if err != nil {
+				// Keep the dependency in the tree without a installer so ResolveConstraints can report it.
+				ctx.Current.Children = append(ctx.Current.Children, &InstallationPlan{QueryOptions: dep})
 				continue
 			}
 
@@ -230,27 +234,80 @@ func (plan *InstallationPlan) Add(sources []planner2.PackageSource, opts planner
 }
 
 func (plan *InstallationPlan) dumpTree(w io.Writer, prefix string) {
-	fmt.Fprintf(w, "%s%s\n", prefix, plan.QueryOptions)
+	if plan.Installer != nil {
+		fmt.Fprintf(w, "%s%s -> %s\n", prefix, plan.QueryOptions, plan.Installer.Name().Version)
+	} else if plan.QueryOptions != nil {
+		fmt.Fprintf(w, "%s%s -> (unresolved)\n", prefix, plan.QueryOptions)
+	}
+
 	for _, child := range plan.Children {
 		child.dumpTree(w, prefix+"  ")
 	}
 }
 
 func (plan *InstallationPlan) DumpTree(w io.Writer) {
-	plan.dumpTree(w, "")
+	for _, child := range plan.Children {
+		child.dumpTree(w, "")
+	}
+}
+
+// Packages returns the name and version of every package chosen by the plan sorted by name.
+func (plan *InstallationPlan) Packages() []planner2.PackageName {
+	seen := make(map[string]bool)
+	var ret []planner2.PackageName
+
+	packageQueue := []*InstallationPlan{plan}
+
+	for len(packageQueue) > 0 {
+		packageNode := packageQueue[0]
+		packageQueue = packageQueue[1:]
+
+		if packageNode.Installer != nil {
+			name := packageNode.Installer.Name()
+			if key := name.Name + " " + name.Version; !seen[key] {
+				seen[key] = true
+				ret = append(ret, name)
+			}
+		}
+
+		packageQueue = append(packageQueue, packageNode.Children...)
+	}
+
+	slices.SortFunc(ret, func(a planner2.PackageName, b planner2.PackageName) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Version, b.Version)
+	})
+
+	return ret
 }
 
 func (plan *InstallationPlan) ResolveConstraints() error {
 	// A conflict is defined as two installed versions with the same name but incompatible requirements.
 
 	installed := make(map[string][]planner2.PackageQuery)
+	versions := make(map[string][]planner2.PackageName)
+	var problems []string
+
 	packageQueue := []*InstallationPlan{plan}
 
 	for len(packageQueue) > 0 {
 		packageNode := packageQueue[0]
 		packageQueue = packageQueue[1:]
 
-		installed[packageNode.Query.Name] = append(installed[packageNode.Query.Name], packageNode.Query)
+		if packageNode.Installer != nil {
+			installed[packageNode.Query.Name] = append(installed[packageNode.Query.Name], packageNode.Query)
+
+			name := packageNode.Installer.Name()
+			if !slices.ContainsFunc(versions[packageNode.Query.Name], func(other planner2.PackageName) bool {
+				return other.Version == name.Version
+			}) {
+				versions[packageNode.Query.Name] = append(versions[packageNode.Query.Name], name)
+			}
+		} else if packageNode.QueryOptions != nil {
+			problems = append(problems, fmt.Sprintf("no installation candidates found for %s", packageNode.QueryOptions))
+		}
 
 		packageQueue = append(packageQueue, packageNode.Children...)
 	}
@@ -282,7 +339,38 @@ func (plan *InstallationPlan) ResolveConstraints() error {
 			}
 		}
 
-		slog.Info("", "name", name, "condition", combined)
+		slog.Debug("", "name", name, "condition", combined)
+
+		if len(versions[name]) > 1 {
+			var chosen []string
+			for _, version := range versions[name] {
+				chosen = append(chosen, version.Version)
+			}
+
+			problems = append(problems, fmt.Sprintf("%s: multiple versions chosen (%s)", name, strings.Join(chosen, ", ")))
+			continue
+		}
+
+		if combined == nil {
+			continue
+		}
+
+		for _, version := range versions[name] {
+			match, err := combined.Satisfies(version)
+			if err != nil {
+				return err
+			}
+
+			if match != planner2.MatchResultMatched {
+				problems = append(problems, fmt.Sprintf("%s: %s does not satisfy %v", name, version.Version, combined))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		slices.Sort(problems)
+
+		return fmt.Errorf("failed to resolve constraints:\n  %s", strings.Join(problems, "\n  "))
 	}
 
 	return nil
@@ -22,7 +22,7 @@ func appMain() error {
 	db := database.New(common.GetDefaultBuildDir())
 
 	// Just fetch ubuntu.
-	def := builder.NewFetchOCIImageDefinition("", "library/ubuntu", "", "")
+	def := builder.NewFetchOCIImageDefinition("", "library/ubuntu", "", "", false)
 
 	// Get all the fragments/layers from the docker image.
 	frags, err := def.AsFragments(db.NewBuildContext(def))
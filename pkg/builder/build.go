@@ -1,6 +1,7 @@
 package builder
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log/slog"
@@ -13,6 +14,7 @@ import (
 )
 
 type BuildContext struct {
+	ctx      context.Context
 	source   common.BuildSource
 	database common.PackageDatabase
 	parent   *BuildContext
@@ -41,6 +43,11 @@ func (b *BuildContext) DisplayTree() {
 	dumpContext(b, "")
 }
 
+// Context implements common.BuildContext.
+func (b *BuildContext) Context() context.Context {
+	return b.ctx
+}
+
 // SetHasCached implements common.BuildContext.
 func (b *BuildContext) SetHasCached() {
 	b.hasCached = true
@@ -96,6 +103,7 @@ func (b *BuildContext) Database() common.PackageDatabase {
 
 func (b *BuildContext) ChildContext(source common.BuildSource, status *common.BuildStatus, filename string) common.BuildContext {
 	ctx := &BuildContext{
+		ctx:      b.ctx,
 		parent:   b,
 		filename: filename,
 		output:   nil,
@@ -129,6 +137,27 @@ func (b *BuildContext) CreateOutput() (io.WriteCloser, error) {
 	return b.output, nil
 }
 
+// ResumeOutput opens the output without truncating it.
+// The temporary output is kept if the build fails so a interrupted download can continue where it stopped.
+func (b *BuildContext) ResumeOutput() (*os.File, error) {
+	if b.IsInMemory() {
+		return nil, fmt.Errorf("resuming output for in-memory items is not implemented")
+	}
+
+	if b.output != nil {
+		return nil, fmt.Errorf("output already created")
+	}
+
+	out, err := os.OpenFile(b.filename, os.O_RDWR|os.O_CREATE, os.FileMode(0644))
+	if err != nil {
+		return nil, err
+	}
+
+	b.output = out
+
+	return out, nil
+}
+
 func (b *BuildContext) HasCreatedOutput() bool {
 	return b.output != nil
 }
@@ -151,7 +180,8 @@ func (b *BuildContext) NeedsBuild(def common.BuildDefinition) (bool, error) {
 		return true, err
 	}
 
-	filename, err := b.database.FilenameFromHash(hash, ".bin")
+	// Outputs released by the chunked cache are restored so their modification time can be checked.
+	filename, err := b.database.ResultFilename(hash)
 	if err != nil {
 		return true, err
 	}
@@ -286,5 +316,9 @@ var (
 )
 
 func NewBuildContext(source common.BuildSource, db common.PackageDatabase) *BuildContext {
-	return &BuildContext{source: source, database: db}
+	return NewBuildContextWithContext(context.Background(), source, db)
+}
+
+func NewBuildContextWithContext(ctx context.Context, source common.BuildSource, db common.PackageDatabase) *BuildContext {
+	return &BuildContext{ctx: ctx, source: source, database: db}
 }
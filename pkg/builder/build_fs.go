@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"strings"
 	"time"
 
@@ -32,6 +33,10 @@ func toTarTypeFlag(flag filesystem.FileType) byte {
 		return tar.TypeSymlink
 	case filesystem.TypeLink:
 		return tar.TypeLink
+	case filesystem.TypeCharDevice:
+		return tar.TypeChar
+	case filesystem.TypeBlockDevice:
+		return tar.TypeBlock
 	default:
 		panic(fmt.Sprintf("unimplemented type: %s", flag))
 	}
@@ -107,15 +112,67 @@ type tarBuilderResult struct {
 	frags []config.Fragment
 }
 
+// layerReplacements returns the index of the last layer which replaces or removes each path.
+func layerReplacements(frags []config.Fragment) (map[string]int, error) {
+	ret := make(map[string]int)
+
+	for idx, frag := range frags {
+		if frag.Archive == nil || !frag.Archive.Layer {
+			continue
+		}
+
+		ark, err := filesystem.ReadArchiveFromFile(filesystem.NewLocalFile(frag.Archive.HostFilename, nil))
+		if err != nil {
+			return nil, err
+		}
+
+		ents, err := ark.Entries()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ent := range ents {
+			name := path.Clean("/" + ent.Name())
+
+			if base := path.Base(name); strings.HasPrefix(base, filesystem.WhiteoutPrefix) {
+				ret[path.Join(path.Dir(name), strings.TrimPrefix(base, filesystem.WhiteoutPrefix))] = idx
+			} else if ent.Typeflag() != filesystem.TypeDirectory {
+				// Directories are merged so only other files replace what came before.
+				ret[name] = idx
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// replacedByLayer reports if a layer after the fragment at idx replaces or removes name or one of its parents.
+func replacedByLayer(replaced map[string]int, idx int, name string) bool {
+	for p := path.Clean("/" + name); ; p = path.Dir(p) {
+		if later, ok := replaced[p]; ok && later > idx {
+			return true
+		}
+
+		if p == "/" {
+			return false
+		}
+	}
+}
+
 // WriteTo implements common.BuildResult.
 func (i *tarBuilderResult) WriteResult(w io.Writer) error {
 	writer := tar.NewWriter(w)
 
 	written := make(map[string]bool)
 
+	replaced, err := layerReplacements(i.frags)
+	if err != nil {
+		return err
+	}
+
 	var commands []string
 
-	for _, frag := range i.frags {
+	for idx, frag := range i.frags {
 		if frag.Archive != nil {
 			f := filesystem.NewLocalFile(frag.Archive.HostFilename, nil)
 
@@ -140,6 +197,15 @@ func (i *tarBuilderResult) WriteResult(w io.Writer) error {
 					continue
 				}
 
+				// Whiteouts are applied by layerReplacements rather than written to the tar.
+				if frag.Archive.Layer && strings.HasPrefix(path.Base(name), filesystem.WhiteoutPrefix) {
+					continue
+				}
+
+				if replacedByLayer(replaced, idx, name) {
+					continue
+				}
+
 				if err := writer.WriteHeader(&tar.Header{
 					Typeflag: toTarTypeFlag(ent.Typeflag()),
 					Name:     name,
@@ -0,0 +1,112 @@
+package builder
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tinyrange/tinyrange/pkg/config"
+	"github.com/tinyrange/tinyrange/pkg/filesystem"
+)
+
+// writeArchive writes an archive to a temporary file. Names ending in / are directories
+// and everything else is a regular file with the given contents.
+func writeArchive(t *testing.T, files map[string]string, names ...string) string {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "test.archive")
+
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ark := filesystem.NewArchiveWriter(f)
+
+	for _, name := range names {
+		ent := &filesystem.CacheEntry{CTypeflag: filesystem.TypeDirectory, CName: name, CMode: 0755}
+		if !strings.HasSuffix(name, "/") {
+			ent = &filesystem.CacheEntry{CTypeflag: filesystem.TypeRegular, CName: name, CMode: 0644, CSize: int64(len(files[name]))}
+		}
+
+		if err := ark.WriteEntry(ent, strings.NewReader(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return filename
+}
+
+func TestTarBuilderResultLayers(t *testing.T) {
+	base := writeArchive(t, map[string]string{
+		"etc/changed":     "old",
+		"etc/removed":     "removed",
+		"etc/kept":        "kept",
+		"opt/dir/file":    "file",
+		"opt/dir/another": "another",
+	}, "etc/", "etc/changed", "etc/removed", "etc/kept", "opt/", "opt/dir/", "opt/dir/file", "opt/dir/another")
+
+	// Layers are written by the guest with absolute names.
+	layer := writeArchive(t, map[string]string{
+		"/etc/changed": "new",
+		"/etc/added":   "added",
+	}, "/etc/", "/etc/changed", "/etc/added", "/etc/.wh.removed", "/opt/.wh.dir")
+
+	result := &tarBuilderResult{frags: []config.Fragment{
+		{Archive: &config.ArchiveFragment{HostFilename: base}},
+		{Archive: &config.ArchiveFragment{HostFilename: layer, Layer: true}},
+	}}
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(result.WriteResult(w))
+	}()
+
+	contents := make(map[string]string)
+
+	reader := tar.NewReader(r)
+	for {
+		hdr, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		name := strings.TrimSuffix(strings.TrimPrefix(hdr.Name, "/"), "/")
+
+		// Directories are merged when the tar is extracted so only files need to be unique.
+		if _, ok := contents[name]; ok && hdr.Typeflag != tar.TypeDir {
+			t.Errorf("%s is written more than once", name)
+		}
+
+		buf, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		contents[name] = string(buf)
+	}
+
+	for name, expected := range map[string]string{
+		"etc/changed": "new",
+		"etc/added":   "added",
+		"etc/kept":    "kept",
+	} {
+		if got, ok := contents[name]; !ok {
+			t.Errorf("%s is missing", name)
+		} else if got != expected {
+			t.Errorf("%s = %q, expected %q", name, got, expected)
+		}
+	}
+
+	for _, name := range []string{"etc/removed", "etc/.wh.removed", "opt/dir", "opt/dir/file", "opt/dir/another", "opt/.wh.dir"} {
+		if _, ok := contents[name]; ok {
+			t.Errorf("%s should have been removed", name)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package builder
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -10,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -17,6 +19,8 @@ import (
 	"github.com/tinyrange/tinyrange/pkg/config"
 	"github.com/tinyrange/tinyrange/pkg/filesystem"
 	"github.com/tinyrange/tinyrange/pkg/hash"
+	initExec "github.com/tinyrange/tinyrange/pkg/init"
+	"github.com/tinyrange/tinyrange/pkg/metrics"
 	"go.starlark.net/starlark"
 )
 
@@ -27,9 +31,29 @@ func init() {
 var OFFICIAL_KERNEL_URL_X86_64 = "https://github.com/tinyrange/linux_build/releases/download/linux_x86_6.6.7/vmlinux_x86_64"
 var OFFICIAL_KERNEL_URL_AARCH64 = "https://github.com/tinyrange/linux_build/releases/download/linux_arm64_6.6.7/vmlinux_arm64"
 
-func runTinyRange(exe string, configFilename string) (*exec.Cmd, error) {
+func runTinyRange(exe string, configFilename string, secrets config.RuntimeSecrets) (*exec.Cmd, error) {
 	cmd := exec.Command(exe, "run-vm", configFilename)
 
+	// The virtual machine's metrics are recorded in the child so it sends them back to this process.
+	env, err := metrics.ChildEnvironment()
+	if err != nil {
+		return nil, err
+	}
+
+	// Secrets are passed in the environment so they aren't written to the config.
+	if len(secrets.Secrets) > 0 || secrets.SshPassword != "" || secrets.SshAuthorizedKeys != "" {
+		encoded, err := json.Marshal(secrets)
+		if err != nil {
+			return nil, err
+		}
+
+		env = append(env, config.SecretsEnvironmentVariable+"="+string(encoded))
+	}
+
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -43,29 +67,188 @@ func runTinyRange(exe string, configFilename string) (*exec.Cmd, error) {
 	return cmd, nil
 }
 
-type ErrTemplateBuilt string
+// ExitStatusError is returned when the run-vm process exits with a non-zero status. That's the
+// exit status of the command run in the guest and the process has already reported any error.
+type ExitStatusError struct {
+	Status int
+}
+
+func (e *ExitStatusError) Error() string {
+	return fmt.Sprintf("virtual machine exited with status %d", e.Status)
+}
+
+// ExitCode returns the exit status so it can be passed through by the caller.
+func (e *ExitStatusError) ExitCode() int { return e.Status }
+
+type vmTemplateResult struct {
+	cfg config.TinyRangeConfig
+}
+
+// WriteResult implements common.BuildResult.
+func (t *vmTemplateResult) WriteResult(w io.Writer) error {
+	enc := json.NewEncoder(w)
 
-// Error implements error.
-func (e ErrTemplateBuilt) Error() string { return "template built" }
+	if err := enc.Encode(&t.cfg); err != nil {
+		return err
+	}
+
+	return nil
+}
 
 var (
-	_ error = ErrTemplateBuilt("")
+	_ common.BuildResult = &vmTemplateResult{}
 )
 
 type BuildVmDefinition struct {
 	params BuildVmParameters
 
-	buildTemplateOutput bool
-
 	mux       *http.ServeMux
 	server    *http.Server
 	cmd       *exec.Cmd
 	out       io.WriteCloser
 	gotOutput bool
+	release   func()
+
+	// Secrets and SSH credentials are kept out of the parameters so they don't change the hash or get saved.
+	secrets config.RuntimeSecrets
+
+	// The certificate for the web interface can be generated for each run so it doesn't change the hash either.
+	webTLS common.TLSOptions
+
+	// The name only labels the running virtual machine so the same build can be run under different names.
+	name string
 }
 
+// SetBuildTemplateMode makes the build result the virtual machine config
+// rather than the output of running the virtual machine. Since the mode is part
+// of the definition parameters the template is cached like any other build.
 func (def *BuildVmDefinition) SetBuildTemplateMode() {
-	def.buildTemplateOutput = true
+	def.params.TemplateOnly = true
+}
+
+// SetHypervisorArgs sets extra arguments that are appended to the hypervisor command line.
+func (def *BuildVmDefinition) SetHypervisorArgs(args []string) {
+	def.params.HypervisorArgs = args
+}
+
+// SetNetworkAllowlist restricts outbound guest traffic to the given domains and CIDRs.
+func (def *BuildVmDefinition) SetNetworkAllowlist(domains []string, cidrs []string) {
+	def.params.AllowDomains = domains
+	def.params.AllowCIDRs = cidrs
+}
+
+// SetKernelArgs sets extra key=value arguments that are appended to the guest kernel command line.
+func (def *BuildVmDefinition) SetKernelArgs(args []string) {
+	def.params.KernelArgs = args
+}
+
+// SetInitArgs sets a JSON object that is merged into /init.json in the guest.
+func (def *BuildVmDefinition) SetInitArgs(args string) {
+	def.params.InitArgs = args
+}
+
+// SetBaseDirectory sets the directory relative paths are resolved against.
+// Cached templates embed it so it has to be part of the hash.
+func (def *BuildVmDefinition) SetBaseDirectory(baseDirectory string) {
+	def.params.BaseDirectory = baseDirectory
+}
+
+// SetHypervisorDigest records the hash of the hypervisor script the template will run with
+// so cached templates are rebuilt when the script changes.
+func (def *BuildVmDefinition) SetHypervisorDigest(digest string) {
+	def.params.HypervisorDigest = digest
+}
+
+// SetHttpCache caches guest downloads made through the internal HTTP server in dir.
+func (def *BuildVmDefinition) SetHttpCache(dir string) {
+	def.params.HttpCache = dir
+}
+
+// SetShareCache serves downloads cached in the build directory to the guest at http://host.internal/cache/.
+func (def *BuildVmDefinition) SetShareCache(enabled bool) {
+	def.params.ShareCache = enabled
+}
+
+// SetResourceLimits limits the hypervisor process to the CPU cores and memory allocated to the guest.
+func (def *BuildVmDefinition) SetResourceLimits(enabled bool) {
+	def.params.ResourceLimits = enabled
+}
+
+// SetExecCommand sets the shell command run by the exec interaction.
+func (def *BuildVmDefinition) SetExecCommand(command string) {
+	def.params.ExecCommand = command
+}
+
+// SetInitBinary replaces the builtin init with a executable from the host.
+func (def *BuildVmDefinition) SetInitBinary(filename string) {
+	def.params.InitBinary = filename
+}
+
+// SetEventsSocket writes lifecycle events as JSON lines to the Unix socket at path.
+func (def *BuildVmDefinition) SetEventsSocket(path string) {
+	def.params.EventsSocket = path
+}
+
+// SetName labels the running virtual machine in logs and lifecycle events.
+func (def *BuildVmDefinition) SetName(name string) {
+	def.name = name
+}
+
+// SetSecrets passes secrets to the virtual machine at runtime.
+func (def *BuildVmDefinition) SetSecrets(secrets map[string]string) {
+	def.secrets.Secrets = secrets
+}
+
+// SetKeepAlive keeps the virtual machine running with a interactive shell after the command exits.
+func (def *BuildVmDefinition) SetKeepAlive(enabled bool) {
+	def.params.KeepAlive = enabled
+}
+
+// SetForwardIdleTimeout closes forwarded SSH and port connections once they have been idle for timeout.
+func (def *BuildVmDefinition) SetForwardIdleTimeout(timeout time.Duration) {
+	def.params.ForwardIdleTimeoutMs = timeout.Milliseconds()
+}
+
+// SetWebTLS serves the webssh interaction over HTTPS.
+// Like secrets the options are only passed to the virtual machine when it's run.
+func (def *BuildVmDefinition) SetWebTLS(opts common.TLSOptions) {
+	def.webTLS = opts
+}
+
+// SetSshCredentials overrides the username and password of the guest SSH server.
+// Like secrets the password is only passed to the virtual machine when it's run.
+func (def *BuildVmDefinition) SetSshCredentials(username string, password string) {
+	def.params.SshUsername = username
+	def.secrets.SshPassword = password
+}
+
+// SetSshPort changes the port the guest SSH server listens on.
+func (def *BuildVmDefinition) SetSshPort(port int) {
+	def.params.SshPort = port
+}
+
+// SetSshKeys makes the guest SSH server accept the public keys in authorizedKeys and the host
+// connect with the private key in keyFile. Password authentication is disabled unless a password
+// is also set with SetSshCredentials.
+func (def *BuildVmDefinition) SetSshKeys(keyFile string, authorizedKeys string) {
+	def.params.SshKey = keyFile
+	def.secrets.SshAuthorizedKeys = authorizedKeys
+}
+
+// SetFallbackShell uses the builtin init shell for interactive sessions if the guest has no shell.
+func (def *BuildVmDefinition) SetFallbackShell(enabled bool) {
+	def.params.FallbackShell = enabled
+}
+
+// SetPersist stores guest writes to the root filesystem in filename so they persist across runs.
+func (def *BuildVmDefinition) SetPersist(filename string) {
+	def.params.Persist = filename
+}
+
+// SetDataDisks sets additional disks attached to the guest after the root device.
+// Each disk is in the form "SIZE" or "SIZE:SOURCE".
+func (def *BuildVmDefinition) SetDataDisks(disks []string) {
+	def.params.DataDisks = disks
 }
 
 // Dependencies implements common.BuildDefinition.
@@ -118,7 +301,14 @@ func (def *BuildVmDefinition) ToStarlark(ctx common.BuildContext, result filesys
 
 // WriteTo implements common.BuildResult.
 func (def *BuildVmDefinition) WriteResult(w io.Writer) error {
+	defer def.release()
+
 	if err := def.cmd.Wait(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+			return &ExitStatusError{Status: exitErr.ExitCode()}
+		}
+
 		return err
 	}
 
@@ -133,6 +323,28 @@ func (def *BuildVmDefinition) WriteResult(w io.Writer) error {
 	return nil
 }
 
+// Close implements io.Closer. It stops the virtual machine if the result was never written
+// and releases the memory reserved for the build.
+func (def *BuildVmDefinition) Close() error {
+	defer def.release()
+
+	// The process has already exited once the result has been written.
+	if def.cmd.ProcessState == nil {
+		if err := def.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			return err
+		}
+
+		_ = def.cmd.Wait()
+	}
+
+	def.server.Shutdown(context.Background())
+
+	// The output has usually been closed by WriteResult already.
+	_ = def.out.Close()
+
+	return nil
+}
+
 func (def *BuildVmDefinition) BuildTemplate(ctx common.BuildContext, hostAddress string) (config.TinyRangeConfig, error) {
 	arch, err := config.ArchitectureFromString(def.params.Architecture)
 	if err != nil {
@@ -147,12 +359,16 @@ func (def *BuildVmDefinition) BuildTemplate(ctx common.BuildContext, hostAddress
 	builderCfg.OutputFilename = def.params.OutputFile
 
 	builderCfg.HostAddress = hostAddress
+	builderCfg.FallbackShell = def.params.FallbackShell
 
 	vmCfg := config.TinyRangeConfig{}
 
-	wd, err := os.Getwd()
-	if err != nil {
-		return config.TinyRangeConfig{}, err
+	wd := def.params.BaseDirectory
+	if wd == "" {
+		wd, err = os.Getwd()
+		if err != nil {
+			return config.TinyRangeConfig{}, err
+		}
 	}
 
 	kernelDef := def.params.Kernel
@@ -176,11 +392,6 @@ func (def *BuildVmDefinition) BuildTemplate(ctx common.BuildContext, hostAddress
 		return config.TinyRangeConfig{}, err
 	}
 
-	hvScript, err := common.GetAdjacentExecutable("tinyrange_qemu.star")
-	if err != nil {
-		return config.TinyRangeConfig{}, fmt.Errorf("could not find default hypervisor tinyrange_qemu.star: %s", hvScript)
-	}
-
 	interaction := def.params.Interaction
 
 	if strings.HasPrefix(interaction, "init,") {
@@ -190,13 +401,61 @@ func (def *BuildVmDefinition) BuildTemplate(ctx common.BuildContext, hostAddress
 
 	vmCfg.BaseDirectory = wd
 	vmCfg.Architecture = arch
-	vmCfg.HypervisorScript = hvScript
 	vmCfg.KernelFilename = kernelFilename
 	vmCfg.CPUCores = def.params.CpuCores
-	vmCfg.MemoryMB = def.params.MemoryMB
-	vmCfg.StorageSize = def.params.StorageSize
+	vmCfg.MemoryMB = config.SizeMB(def.params.MemoryMB)
+	vmCfg.StorageSize = config.SizeMB(def.params.StorageSize)
 	vmCfg.Interaction = interaction
 	vmCfg.Debug = def.params.Debug
+	vmCfg.HypervisorArgs = def.params.HypervisorArgs
+	vmCfg.AllowDomains = def.params.AllowDomains
+	vmCfg.AllowCIDRs = def.params.AllowCIDRs
+
+	for _, cidr := range def.params.AllowCIDRs {
+		if _, err := config.ParseAllowedCIDR(cidr); err != nil {
+			return config.TinyRangeConfig{}, err
+		}
+	}
+
+	for _, arg := range def.params.KernelArgs {
+		if err := config.ValidateKernelArg(arg); err != nil {
+			return config.TinyRangeConfig{}, err
+		}
+	}
+
+	vmCfg.KernelArgs = def.params.KernelArgs
+	vmCfg.PersistFilename = def.params.Persist
+	vmCfg.HttpCacheDirectory = def.params.HttpCache
+	vmCfg.ResourceLimits = def.params.ResourceLimits
+
+	if def.params.ShareCache {
+		buildDir, err := filepath.Abs(ctx.Database().BuildDir())
+		if err != nil {
+			return config.TinyRangeConfig{}, err
+		}
+
+		vmCfg.ShareCacheDirectory = buildDir
+	}
+	vmCfg.ExecCommand = def.params.ExecCommand
+	vmCfg.EventsSocket = def.params.EventsSocket
+	vmCfg.Name = def.name
+	vmCfg.KeepAlive = def.params.KeepAlive
+	vmCfg.ForwardIdleTimeout = time.Duration(def.params.ForwardIdleTimeoutMs) * time.Millisecond
+	vmCfg.WebTLS = def.webTLS.TLS
+	vmCfg.WebTLSCert = def.webTLS.CertFile
+	vmCfg.WebTLSKey = def.webTLS.KeyFile
+	vmCfg.SshUsername = def.params.SshUsername
+	vmCfg.SshKey = def.params.SshKey
+	vmCfg.SshPort = def.params.SshPort
+
+	for _, disk := range def.params.DataDisks {
+		dataDisk, err := config.ParseDataDisk(disk)
+		if err != nil {
+			return config.TinyRangeConfig{}, err
+		}
+
+		vmCfg.DataDisks = append(vmCfg.DataDisks, dataDisk)
+	}
 
 	if def.params.InitRamFs != nil {
 		// bypass the default init logic.
@@ -215,10 +474,28 @@ func (def *BuildVmDefinition) BuildTemplate(ctx common.BuildContext, hostAddress
 		vmCfg.InitFilesystemFilename = initRamFsFilename
 	}
 
-	initJson := struct {
-		SSHCommand []string `json:"ssh_command"`
-	}{
-		SSHCommand: []string{"/init", "-run-config", "/builder.json"},
+	initJson := make(map[string]any)
+
+	if def.params.InitArgs != "" {
+		if err := json.Unmarshal([]byte(def.params.InitArgs), &initJson); err != nil {
+			return config.TinyRangeConfig{}, fmt.Errorf("failed to parse init args: %w", err)
+		}
+	}
+
+	// The builder entry point always takes priority over user arguments.
+	initJson["ssh_command"] = []string{"/init", "-run-config", "/builder.json"}
+
+	// The username has to match the one the host connects with. The password and authorized
+	// keys are fetched from the host when the guest starts so they aren't stored here.
+	if def.params.SshUsername != "" {
+		initJson["ssh_username"] = def.params.SshUsername
+	}
+	if def.params.SshPort != 0 {
+		if def.params.SshPort < 1 || def.params.SshPort > 65535 {
+			return config.TinyRangeConfig{}, fmt.Errorf("invalid SSH port %d: must be between 1 and 65535", def.params.SshPort)
+		}
+
+		initJson["ssh_port"] = def.params.SshPort
 	}
 
 	initJsonBytes, err := json.Marshal(&initJson)
@@ -226,9 +503,24 @@ func (def *BuildVmDefinition) BuildTemplate(ctx common.BuildContext, hostAddress
 		return config.TinyRangeConfig{}, err
 	}
 
+	initFragment := config.Fragment{Builtin: &config.BuiltinFragment{Name: "init", Architecture: arch, GuestFilename: "/init"}}
+
+	if def.params.InitBinary != "" {
+		// Check the architecture now rather than failing to boot the guest.
+		if _, err := initExec.ReadCustomInitExecutable(def.params.InitBinary, arch); err != nil {
+			return config.TinyRangeConfig{}, err
+		}
+
+		initFragment = config.Fragment{LocalFile: &config.LocalFileFragment{
+			HostFilename:  def.params.InitBinary,
+			GuestFilename: "/init",
+			Executable:    true,
+		}}
+	}
+
 	// Hard code the init file and script.
 	vmCfg.RootFsFragments = append(vmCfg.RootFsFragments,
-		config.Fragment{Builtin: &config.BuiltinFragment{Name: "init", Architecture: arch, GuestFilename: "/init"}},
+		initFragment,
 		config.Fragment{Builtin: &config.BuiltinFragment{Name: "init.star", GuestFilename: "/init.star"}},
 		// Use init.json to set the builder entry point as the SSH command.
 		config.Fragment{FileContents: &config.FileContentsFragment{
@@ -261,6 +553,14 @@ func (def *BuildVmDefinition) BuildTemplate(ctx common.BuildContext, hostAddress
 		}
 	}
 
+	// The exec interaction runs the command directly rather than through the builder so
+	// the environment is passed to the host to send with the request.
+	if interaction == "exec" && len(builderCfg.Environment) > 0 {
+		vmCfg.RootFsFragments = append(vmCfg.RootFsFragments, config.Fragment{
+			Environment: &config.EnvironmentFragment{Variables: builderCfg.Environment},
+		})
+	}
+
 	buildConfig, err := json.Marshal(&builderCfg)
 	if err != nil {
 		return config.TinyRangeConfig{}, err
@@ -278,29 +578,13 @@ func (def *BuildVmDefinition) BuildTemplate(ctx common.BuildContext, hostAddress
 
 // Build implements common.BuildDefinition.
 func (def *BuildVmDefinition) Build(ctx common.BuildContext) (common.BuildResult, error) {
-	if def.buildTemplateOutput {
+	if def.params.TemplateOnly {
 		vmCfg, err := def.BuildTemplate(ctx, "")
 		if err != nil {
 			return nil, err
 		}
 
-		configFilename, out, err := ctx.CreateFile(".json")
-		if err != nil {
-			return nil, err
-		}
-
-		enc := json.NewEncoder(out)
-
-		if err := enc.Encode(&vmCfg); err != nil {
-			out.Close()
-			return nil, err
-		}
-
-		if err := out.Close(); err != nil {
-			return nil, err
-		}
-
-		return nil, ErrTemplateBuilt(configFilename)
+		return &vmTemplateResult{cfg: vmCfg}, nil
 	}
 
 	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
@@ -315,6 +599,18 @@ func (def *BuildVmDefinition) Build(ctx common.BuildContext) (common.BuildResult
 		return nil, err
 	}
 
+	// Child builds are finished by now so holding the reservation can't deadlock nested VMs.
+	release, err := common.AcquireBuildMemory(ctx.Context(), int64(def.params.StorageSize))
+	if err != nil {
+		return nil, err
+	}
+	started := false
+	defer func() {
+		if !started {
+			release()
+		}
+	}()
+
 	def.mux = http.NewServeMux()
 
 	def.server = &http.Server{
@@ -362,12 +658,14 @@ func (def *BuildVmDefinition) Build(ctx common.BuildContext) (common.BuildResult
 		return nil, err
 	}
 
-	cmd, err := runTinyRange(exe, configFilename)
+	cmd, err := runTinyRange(exe, configFilename, def.secrets)
 	if err != nil {
 		return nil, err
 	}
 
 	def.cmd = cmd
+	def.release = release
+	started = true
 
 	return def, nil
 }
@@ -412,6 +710,7 @@ var (
 	_ starlark.Value         = &BuildVmDefinition{}
 	_ common.BuildDefinition = &BuildVmDefinition{}
 	_ common.BuildResult     = &BuildVmDefinition{}
+	_ io.Closer              = &BuildVmDefinition{}
 )
 
 func NewBuildVmDefinition(
@@ -0,0 +1,80 @@
+package builder
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/config"
+	"github.com/tinyrange/tinyrange/pkg/hash"
+)
+
+func TestHashBuildVmDefinition(t *testing.T) {
+	db := hash.NewDefinitionDatabase(nil)
+
+	def := NewBuildVmDefinition(nil, nil, nil, "", 0, 0, config.ArchX8664, 0, "ssh", false)
+
+	if _, err := db.HashDefinition(def); err != nil {
+		t.Fatalf("failed to hash default definition: %s", err)
+	}
+
+	def.SetForwardIdleTimeout(30 * time.Minute)
+	def.SetWebTLS(common.TLSOptions{TLS: true, CertFile: "cert.pem", KeyFile: "key.pem"})
+
+	first, err := db.HashDefinition(def)
+	if err != nil {
+		t.Fatalf("failed to hash definition: %s", err)
+	}
+
+	encoded, err := db.MarshalDefinition(def)
+	if err != nil {
+		t.Fatalf("failed to marshal definition: %s", err)
+	}
+
+	decoded, err := db.UnmarshalDefinition(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("failed to unmarshal definition: %s", err)
+	}
+
+	second, err := db.HashDefinition(decoded)
+	if err != nil {
+		t.Fatalf("failed to hash decoded definition: %s", err)
+	}
+
+	if first != second {
+		t.Fatalf("hash changed after a round trip: %s != %s", first, second)
+	}
+}
+
+func TestHashBuildVmDefinitionSshCredentials(t *testing.T) {
+	db := hash.NewDefinitionDatabase(nil)
+
+	def := NewBuildVmDefinition(nil, nil, nil, "", 0, 0, config.ArchX8664, 0, "ssh", false)
+
+	before, err := db.HashDefinition(def)
+	if err != nil {
+		t.Fatalf("failed to hash definition: %s", err)
+	}
+
+	def.SetSshCredentials("", "password")
+	def.SetSshKeys("", "ssh-ed25519 AAAA")
+
+	after, err := db.HashDefinition(def)
+	if err != nil {
+		t.Fatalf("failed to hash definition: %s", err)
+	}
+
+	if before != after {
+		t.Fatalf("ssh credentials changed the hash: %s != %s", before, after)
+	}
+
+	encoded, err := db.MarshalDefinition(def)
+	if err != nil {
+		t.Fatalf("failed to marshal definition: %s", err)
+	}
+
+	if bytes.Contains(encoded, []byte("password")) || bytes.Contains(encoded, []byte("AAAA")) {
+		t.Fatalf("ssh credentials were serialized: %s", encoded)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/tinyrange/tinyrange/pkg/common"
 	"github.com/tinyrange/tinyrange/pkg/filesystem"
 	"github.com/tinyrange/tinyrange/pkg/hash"
+	"github.com/tinyrange/tinyrange/pkg/metrics"
 	"go.starlark.net/starlark"
 )
 
@@ -51,6 +52,11 @@ func (f *FetchHttpBuildDefinition) ToStarlark(ctx common.BuildContext, result fi
 
 // NeedsBuild implements BuildDefinition.
 func (f *FetchHttpBuildDefinition) NeedsBuild(ctx common.BuildContext, cacheTime time.Time) (bool, error) {
+	// Cached downloads are always considered fresh in offline mode.
+	if ctx.Database().IsOffline() {
+		return false, nil
+	}
+
 	if f.params.ExpireTime != 0 {
 		return time.Now().After(cacheTime.Add(time.Duration(f.params.ExpireTime))), nil
 	}
@@ -69,7 +75,7 @@ func (f *FetchHttpBuildDefinition) WriteResult(w io.Writer) error {
 	prog := progressbar.DefaultBytes(f.resp.ContentLength, f.params.Url)
 	defer prog.Close()
 
-	if _, err := io.Copy(io.MultiWriter(prog, w), f.resp.Body); err != nil {
+	if _, err := io.Copy(io.MultiWriter(prog, w), metrics.DownloadedBytes.Reader(f.resp.Body)); err != nil {
 		return err
 	}
 
@@ -78,6 +84,10 @@ func (f *FetchHttpBuildDefinition) WriteResult(w io.Writer) error {
 
 // Build implements BuildDefinition.
 func (f *FetchHttpBuildDefinition) Build(ctx common.BuildContext) (common.BuildResult, error) {
+	if ctx.Database().IsOffline() {
+		return nil, fmt.Errorf("%s is not cached: %w", f.params.Url, common.ErrOffline)
+	}
+
 	urls, err := ctx.Database().UrlsFor(f.params.Url)
 	if err != nil {
 		return nil, err
@@ -93,7 +103,7 @@ func (f *FetchHttpBuildDefinition) Build(ctx common.BuildContext) (common.BuildR
 	for _, url := range urls {
 		var req *http.Request
 
-		req, err = http.NewRequest("GET", url, nil)
+		req, err = http.NewRequestWithContext(ctx.Context(), "GET", url, nil)
 		if err != nil {
 			return nil, err
 		}
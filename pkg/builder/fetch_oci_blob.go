@@ -0,0 +1,214 @@
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/filesystem"
+	"github.com/tinyrange/tinyrange/pkg/hash"
+	"github.com/tinyrange/tinyrange/pkg/metrics"
+	"go.starlark.net/starlark"
+)
+
+func init() {
+	hash.RegisterType(&fetchOciBlobDefinition{})
+}
+
+// fetchOciBlobDefinition downloads a blob by digest. Interrupted downloads are resumed
+// with a range request on the next build and the result is verified against the digest.
+type fetchOciBlobDefinition struct {
+	ctx    *ociRegistryContext
+	image  string
+	params FetchOciBlobParameters
+
+	out *os.File
+}
+
+// Redistributable implements common.RedistributableDefinition.
+func (def *fetchOciBlobDefinition) Redistributable() bool {
+	return true
+}
+
+// Dependencies implements common.BuildDefinition.
+func (def *fetchOciBlobDefinition) Dependencies(ctx common.BuildContext) ([]common.DependencyNode, error) {
+	return []common.DependencyNode{}, nil
+}
+
+// implements common.BuildDefinition.
+func (def *fetchOciBlobDefinition) Params() hash.SerializableValue { return def.params }
+func (def *fetchOciBlobDefinition) SerializableType() string {
+	return "fetchOciBlobDefinition"
+}
+func (def *fetchOciBlobDefinition) Create(params hash.SerializableValue) hash.Definition {
+	return &fetchOciBlobDefinition{params: params.(FetchOciBlobParameters)}
+}
+
+// ToStarlark implements common.BuildDefinition.
+func (def *fetchOciBlobDefinition) ToStarlark(ctx common.BuildContext, result filesystem.File) (starlark.Value, error) {
+	return filesystem.NewStarFile(result, def.Tag()), nil
+}
+
+// NeedsBuild implements common.BuildDefinition.
+func (def *fetchOciBlobDefinition) NeedsBuild(ctx common.BuildContext, cacheTime time.Time) (bool, error) {
+	// Blobs are content addressed so they never expire.
+	return false, nil
+}
+
+func (def *fetchOciBlobDefinition) request(ctx common.BuildContext, offset int64) (*http.Response, error) {
+	url := fmt.Sprintf("%s/%s/blobs/%s", def.ctx.registry, def.image, def.params.Digest)
+
+	req, err := def.ctx.makeRequest("GET", url)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	client, err := ctx.Database().HttpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx.Context()))
+	if err != nil {
+		return nil, err
+	}
+
+	// Partial responses and a range past the end of a already complete file are handled by the caller.
+	if resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return resp, nil
+	}
+
+	ok, err := def.ctx.responseHandler(client, resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if !ok {
+		resp.Body.Close()
+		return def.request(ctx, offset)
+	}
+
+	return resp, nil
+}
+
+func (def *fetchOciBlobDefinition) download(ctx common.BuildContext, out *os.File) error {
+	algorithm, expected, _ := strings.Cut(def.params.Digest, ":")
+	if algorithm != "sha256" {
+		return fmt.Errorf("unsupported blob digest: %s", def.params.Digest)
+	}
+
+	h := sha256.New()
+
+	// Hash whatever was written by a previous attempt.
+	offset, err := io.Copy(h, out)
+	if err != nil {
+		return err
+	}
+
+	resp, err := def.request(ctx, offset)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		slog.Info("resuming blob download", "digest", def.params.Digest, "offset", offset)
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The previous attempt already downloaded the entire blob.
+	default:
+		// The registry ignored the range request so start again from the beginning.
+		if err := out.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := out.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		h.Reset()
+		offset = 0
+	}
+
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		total := int64(-1)
+		if resp.ContentLength >= 0 {
+			total = offset + resp.ContentLength
+		}
+
+		prog := progressbar.DefaultBytes(total, def.params.Digest)
+		prog.Set64(offset)
+		defer prog.Close()
+
+		if _, err := io.Copy(io.MultiWriter(out, h, prog), metrics.DownloadedBytes.Reader(resp.Body)); err != nil {
+			return err
+		}
+	}
+
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+		// Don't resume from a corrupted file.
+		if err := out.Truncate(0); err != nil {
+			return err
+		}
+
+		return fmt.Errorf("blob %s failed verification: got %s", def.params.Digest, actual)
+	}
+
+	return nil
+}
+
+// Build implements common.BuildDefinition.
+func (def *fetchOciBlobDefinition) Build(ctx common.BuildContext) (common.BuildResult, error) {
+	if ctx.Database().IsOffline() {
+		return nil, fmt.Errorf("%s is not cached: %w", def.params.Digest, common.ErrOffline)
+	}
+
+	out, err := ctx.ResumeOutput()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := def.download(ctx, out); err != nil {
+		out.Close()
+		return nil, err
+	}
+
+	def.out = out
+
+	return def, nil
+}
+
+// WriteResult implements common.BuildResult.
+func (def *fetchOciBlobDefinition) WriteResult(w io.Writer) error {
+	return def.out.Close()
+}
+
+// Tag implements common.BuildDefinition.
+func (def *fetchOciBlobDefinition) Tag() string {
+	return strings.Join([]string{"fetchOciBlob", def.params.Digest}, "_")
+}
+
+var (
+	_ common.BuildDefinition           = &fetchOciBlobDefinition{}
+	_ common.RedistributableDefinition = &fetchOciBlobDefinition{}
+	_ common.BuildResult               = &fetchOciBlobDefinition{}
+)
+
+func newFetchOciBlobDefinition(regCtx *ociRegistryContext, image string, digest string) *fetchOciBlobDefinition {
+	return &fetchOciBlobDefinition{
+		ctx:    regCtx,
+		image:  image,
+		params: FetchOciBlobParameters{Digest: digest},
+	}
+}
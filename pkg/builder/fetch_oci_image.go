@@ -1,11 +1,14 @@
 package builder
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"path"
 	"slices"
 	"strings"
 	"time"
@@ -16,6 +19,7 @@ import (
 	"github.com/tinyrange/tinyrange/pkg/config"
 	"github.com/tinyrange/tinyrange/pkg/filesystem"
 	"github.com/tinyrange/tinyrange/pkg/hash"
+	"github.com/tinyrange/tinyrange/pkg/metrics"
 	"go.starlark.net/starlark"
 )
 
@@ -57,7 +61,7 @@ func (c *copyResponseResult) WriteResult(w io.Writer) error {
 	prog := progressbar.DefaultBytes(c.contentLength, c.url)
 	defer prog.Close()
 
-	if _, err := io.Copy(io.MultiWriter(prog, w), c.body); err != nil {
+	if _, err := io.Copy(io.MultiWriter(prog, w), metrics.DownloadedBytes.Reader(c.body)); err != nil {
 		return err
 	}
 
@@ -86,7 +90,7 @@ func (ctx *ociRegistryContext) makeRequest(method string, url string) (*http.Req
 	return req, nil
 }
 
-func (ctx *ociRegistryContext) responseHandler(resp *http.Response) (bool, error) {
+func (ctx *ociRegistryContext) responseHandler(client *http.Client, resp *http.Response) (bool, error) {
 	if resp.StatusCode == http.StatusOK {
 		return true, nil
 	} else if resp.StatusCode == http.StatusUnauthorized {
@@ -103,10 +107,11 @@ func (ctx *ociRegistryContext) responseHandler(resp *http.Response) (bool, error
 
 		slog.Info("registry auth", "url", tokenUrl)
 
-		resp, err := http.Get(tokenUrl)
+		resp, err := client.Get(tokenUrl)
 		if err != nil {
 			return false, err
 		}
+		defer resp.Body.Close()
 
 		var respJson oci.TokenResponse
 		decoder := json.NewDecoder(resp.Body)
@@ -150,6 +155,10 @@ func (r *registryRequestDefinition) ToStarlark(ctx common.BuildContext, result f
 
 // Build implements common.BuildDefinition.
 func (r *registryRequestDefinition) Build(ctx common.BuildContext) (common.BuildResult, error) {
+	if ctx.Database().IsOffline() {
+		return nil, fmt.Errorf("%s%s is not cached: %w", r.ctx.registry, r.params.Url, common.ErrOffline)
+	}
+
 	req, err := r.ctx.makeRequest("GET", r.ctx.registry+r.params.Url)
 	if err != nil {
 		return nil, err
@@ -169,11 +178,13 @@ func (r *registryRequestDefinition) Build(ctx common.BuildContext) (common.Build
 		return nil, err
 	}
 
-	ok, err := r.ctx.responseHandler(resp)
+	ok, err := r.ctx.responseHandler(client, resp)
 	if err != nil {
+		resp.Body.Close()
 		return nil, err
 	}
 	if !ok {
+		resp.Body.Close()
 		return r.Build(ctx)
 	}
 
@@ -186,7 +197,9 @@ func (r *registryRequestDefinition) Build(ctx common.BuildContext) (common.Build
 
 // NeedsBuild implements common.BuildDefinition.
 func (r *registryRequestDefinition) NeedsBuild(ctx common.BuildContext, cacheTime time.Time) (bool, error) {
-	if r.params.ExpireTime > 0 {
+	if ctx.Database().IsOffline() {
+		return false, nil
+	} else if r.params.ExpireTime > 0 {
 		return cacheTime.After(time.Now().Add(time.Duration(r.params.ExpireTime))), nil
 	} else {
 		return false, nil
@@ -204,6 +217,9 @@ var (
 	_ common.BuildDefinition = &registryRequestDefinition{}
 )
 
+// The image config of a OCI image is written to this file in the guest.
+const OCI_CONFIG_FILENAME = "/etc/oci/config.json"
+
 type FetchOciImageDefinition struct {
 	params FetchOciImageParameters
 
@@ -255,6 +271,33 @@ func (def *FetchOciImageDefinition) AsFragments(ctx common.BuildContext, special
 		ret = append(ret, config.Fragment{Environment: &config.EnvironmentFragment{Variables: def.Config.Config.Env}})
 	}
 
+	// Write the image config into the guest so tools can read the labels, working directory, etc.
+	imageConfig, err := json.MarshalIndent(&def.Config, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	ret = append(ret, config.Fragment{FileContents: &config.FileContentsFragment{
+		Contents:      imageConfig,
+		GuestFilename: OCI_CONFIG_FILENAME,
+	}})
+
+	if def.params.Entrypoint {
+		command, err := def.Config.Config.Command()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(command) > 0 {
+			frags, err := common.DirectiveDefaultInteractive{InteractiveCommand: command}.AsFragments(ctx, special)
+			if err != nil {
+				return nil, err
+			}
+
+			ret = append(ret, frags...)
+		}
+	}
+
 	return ret, nil
 }
 
@@ -289,13 +332,58 @@ func (def *FetchOciImageDefinition) ToStarlark(ctx common.BuildContext, result f
 func (def *FetchOciImageDefinition) TagDirective() { panic("unimplemented") }
 
 func (def *FetchOciImageDefinition) FromDirective() string {
-	return fmt.Sprintf("%s:%s", def.params.Image, def.params.Tag)
+	tag, digest := def.reference()
+
+	ret := def.params.Image
+	if tag != "" {
+		ret += ":" + tag
+	}
+	if digest != "" {
+		ret += "@" + digest
+	}
+
+	return ret
+}
+
+// reference splits the tag into the tag and a pinned digest (from "tag@sha256:...").
+// Either can be empty but not both.
+func (def *FetchOciImageDefinition) reference() (string, string) {
+	tag, digest, _ := strings.Cut(def.params.Tag, "@")
+
+	return tag, digest
+}
+
+// ParseImageReference splits a reference like "library/alpine:3.20@sha256:..." into the
+// image name and the tag. A pinned digest is kept in the tag after a "@".
+func ParseImageReference(ref string) (string, string) {
+	image, digest, pinned := strings.Cut(ref, "@")
+
+	tag := ""
+
+	// Only look for the tag after the last / so registry ports aren't confused with tags.
+	if i := strings.LastIndexByte(image, ':'); i > strings.LastIndexByte(image, '/') {
+		image, tag = image[:i], image[i+1:]
+	}
+
+	if pinned {
+		tag += "@" + digest
+	}
+
+	return image, tag
 }
 
 func (def *FetchOciImageDefinition) setDefaults() {
 	if def.params.Registry == "" {
 		def.params.Registry = DEFAULT_REGISTRY
 	}
+	if strings.ContainsAny(path.Base(def.params.Image), ":@") {
+		image, tag := ParseImageReference(def.params.Image)
+
+		def.params.Image = image
+		if def.params.Tag == "" {
+			def.params.Tag = tag
+		}
+	}
 	if def.params.Tag == "" {
 		def.params.Tag = "latest"
 	}
@@ -305,10 +393,29 @@ func (def *FetchOciImageDefinition) setDefaults() {
 }
 
 func (def *FetchOciImageDefinition) indexDef(regCtx *ociRegistryContext) common.BuildDefinition {
+	tag, digest := def.reference()
+
+	if tag == "" {
+		// A image referenced only by digest may be a single manifest rather than a index.
+		// Digests are content addressed so they don't expire.
+		return &registryRequestDefinition{
+			ctx: regCtx,
+			params: RegistryRequestParameters{
+				Url: fmt.Sprintf("/%s/manifests/%s", def.params.Image, digest),
+				Accept: []string{
+					"application/vnd.docker.distribution.manifest.list.v2+json",
+					"application/vnd.oci.image.index.v1+json",
+					"application/vnd.docker.distribution.manifest.v2+json",
+					"application/vnd.oci.image.manifest.v1+json",
+				},
+			},
+		}
+	}
+
 	return &registryRequestDefinition{
 		ctx: regCtx,
 		params: RegistryRequestParameters{
-			Url: fmt.Sprintf("/%s/manifests/%s", def.params.Image, def.params.Tag),
+			Url: fmt.Sprintf("/%s/manifests/%s", def.params.Image, tag),
 			Accept: []string{
 				"application/vnd.docker.distribution.manifest.list.v2+json",
 				"application/vnd.oci.image.index.v1+json",
@@ -318,16 +425,46 @@ func (def *FetchOciImageDefinition) indexDef(regCtx *ociRegistryContext) common.
 	}
 }
 
+// verifyIndex checks the index matches the pinned digest if there is one.
+func (def *FetchOciImageDefinition) verifyIndex(indexFile filesystem.File) error {
+	tag, digest := def.reference()
+	if digest == "" {
+		return nil
+	}
+
+	algorithm, expected, _ := strings.Cut(digest, ":")
+	if algorithm != "sha256" {
+		return fmt.Errorf("unsupported image digest: %s", digest)
+	}
+
+	fh, err := indexFile.Open()
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	h := sha256.New()
+
+	if _, err := io.Copy(h, fh); err != nil {
+		return err
+	}
+
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+		if tag != "" {
+			return fmt.Errorf("image %s:%s resolves to sha256:%s but %s was pinned", def.params.Image, tag, actual, digest)
+		}
+
+		return fmt.Errorf("image %s@%s failed verification: got sha256:%s", def.params.Image, digest, actual)
+	}
+
+	return nil
+}
+
 func (def *FetchOciImageDefinition) buildFromV1Index(ctx common.BuildContext, regCtx *ociRegistryContext, index oci.ImageIndexV1) (common.BuildResult, error) {
 	// Request all the layers.
 	for _, layer := range index.FsLayers {
 		layerArchive, err := ctx.BuildChild(
-			NewReadArchiveBuildDefinition(&registryRequestDefinition{
-				ctx: regCtx,
-				params: RegistryRequestParameters{
-					Url: fmt.Sprintf("/%s/blobs/%s", def.params.Image, layer.BlobSum),
-				},
-			}, ".tar.gz"),
+			NewReadArchiveBuildDefinition(newFetchOciBlobDefinition(regCtx, def.params.Image, layer.BlobSum), ".tar.gz"),
 		)
 		if err != nil {
 			return nil, err
@@ -356,12 +493,7 @@ func (def *FetchOciImageDefinition) buildFromManifest(
 	// Request all the layers.
 	for _, layer := range manifest.Layers {
 		layerArchive, err := ctx.BuildChild(
-			NewReadArchiveBuildDefinition(&registryRequestDefinition{
-				ctx: regCtx,
-				params: RegistryRequestParameters{
-					Url: fmt.Sprintf("/%s/blobs/%s", def.params.Image, layer.Digest),
-				},
-			}, ".tar.gz"),
+			NewReadArchiveBuildDefinition(newFetchOciBlobDefinition(regCtx, def.params.Image, layer.Digest), ".tar.gz"),
 		)
 		if err != nil {
 			return nil, err
@@ -405,18 +537,16 @@ func (def *FetchOciImageDefinition) buildFromIndex(ctx common.BuildContext, regC
 		return nil, err
 	}
 
+	return def.buildFromManifestFile(ctx, regCtx, manifestFile)
+}
+
+func (def *FetchOciImageDefinition) buildFromManifestFile(ctx common.BuildContext, regCtx *ociRegistryContext, manifestFile filesystem.File) (common.BuildResult, error) {
 	var manifest oci.ImageManifest
 	if err := ParseJsonFromFile(manifestFile, &manifest); err != nil {
 		return nil, err
 	}
 
-	configFile, err := ctx.BuildChild(&registryRequestDefinition{
-		ctx: regCtx,
-		params: RegistryRequestParameters{
-			Url: fmt.Sprintf("/%s/blobs/%s", def.params.Image, manifest.Config.Digest),
-		},
-		// configs are content addressed so don't expire.
-	})
+	configFile, err := ctx.BuildChild(newFetchOciBlobDefinition(regCtx, def.params.Image, manifest.Config.Digest))
 	if err != nil {
 		return nil, err
 	}
@@ -446,6 +576,10 @@ func (def *FetchOciImageDefinition) Build(ctx common.BuildContext) (common.Build
 		return nil, err
 	}
 
+	if err := def.verifyIndex(indexFile); err != nil {
+		return nil, err
+	}
+
 	var index oci.ImageIndexV2
 	if err := ParseJsonFromFile(indexFile, &index); err != nil {
 		return nil, err
@@ -456,6 +590,10 @@ func (def *FetchOciImageDefinition) Build(ctx common.BuildContext) (common.Build
 		return def.buildFromIndex(ctx, regCtx, index)
 	case "application/vnd.oci.image.index.v1+json":
 		return def.buildFromIndex(ctx, regCtx, index)
+	case "application/vnd.docker.distribution.manifest.v2+json":
+		return def.buildFromManifestFile(ctx, regCtx, indexFile)
+	case "application/vnd.oci.image.manifest.v1+json":
+		return def.buildFromManifestFile(ctx, regCtx, indexFile)
 	case "":
 		if index.SchemaVersion != 1 {
 			return nil, fmt.Errorf("index.SchemaVersion != 1 ")
@@ -478,6 +616,10 @@ func (def *FetchOciImageDefinition) Build(ctx common.BuildContext) (common.Build
 
 // NeedsBuild implements common.BuildDefinition.
 func (def *FetchOciImageDefinition) NeedsBuild(ctx common.BuildContext, cacheTime time.Time) (bool, error) {
+	if ctx.Database().IsOffline() {
+		return false, nil
+	}
+
 	if ctx.Database().ShouldRebuildUserDefinitions() {
 		return true, nil
 	}
@@ -488,6 +630,9 @@ func (def *FetchOciImageDefinition) NeedsBuild(ctx common.BuildContext, cacheTim
 // Tag implements common.BuildDefinition.
 func (def *FetchOciImageDefinition) Tag() string {
 	tag := []string{"fetchOciImage", def.params.Registry, def.params.Image, def.params.Tag, def.params.Architecture}
+	if def.params.Entrypoint {
+		tag = append(tag, "entrypoint")
+	}
 
 	return strings.Join(tag, "_")
 }
@@ -518,13 +663,63 @@ var (
 	_ common.Directive       = &FetchOciImageDefinition{}
 )
 
-func NewFetchOCIImageDefinition(registry, image, tag, architecture string) *FetchOciImageDefinition {
+// ResolveOciImage returns the digest the image reference currently resolves to in the registry.
+// Pinning this digest with "image:tag@digest" makes builds fail if the tag is moved.
+func ResolveOciImage(client *http.Client, registry string, ref string) (string, error) {
+	def := NewFetchOCIImageDefinition(registry, ref, "", "", false)
+
+	tag, digest := def.reference()
+	if tag == "" {
+		return digest, nil
+	}
+
+	regCtx := &ociRegistryContext{registry: def.params.Registry}
+
+	for {
+		req, err := regCtx.makeRequest("GET", fmt.Sprintf("%s/%s/manifests/%s", regCtx.registry, def.params.Image, tag))
+		if err != nil {
+			return "", err
+		}
+
+		// Use the same accept headers as the build so the digest is of the same index.
+		req.Header.Add("Accept", "application/vnd.docker.distribution.manifest.list.v2+json")
+		req.Header.Add("Accept", "application/vnd.oci.image.index.v1+json")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+
+		ok, err := regCtx.responseHandler(client, resp)
+		if err != nil {
+			resp.Body.Close()
+			return "", err
+		}
+		if !ok {
+			resp.Body.Close()
+			continue
+		}
+
+		h := sha256.New()
+
+		_, err = io.Copy(h, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return "", err
+		}
+
+		return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+	}
+}
+
+func NewFetchOCIImageDefinition(registry, image, tag, architecture string, entrypoint bool) *FetchOciImageDefinition {
 	ret := &FetchOciImageDefinition{
 		params: FetchOciImageParameters{
 			Registry:     registry,
 			Image:        image,
 			Tag:          tag,
 			Architecture: architecture,
+			Entrypoint:   entrypoint,
 		},
 	}
 
@@ -0,0 +1,62 @@
+package builder
+
+import (
+	"slices"
+
+	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/config"
+)
+
+// Building a VM with this output returns an archive of the files changed by the last command
+// with whiteout entries for the files it deleted.
+const LAYER_OUTPUT = "/init/layer.archive"
+
+// NewLayeredDirectives replaces every command in a flattened list of directives with a cached layer.
+// Each command is run in its own virtual machine on top of the directives and layers before it
+// and the files it changed or deleted are applied as a layer. Since a layer's hash covers everything
+// before it, changing a command only rebuilds that layer and the ones after it.
+func NewLayeredDirectives(
+	directives []common.Directive,
+	architecture config.CPUArchitecture,
+	cpuCores int,
+	memoryMb int,
+	storageSize int,
+) []common.Directive {
+	var base []common.Directive
+	var commands []common.Directive
+	var interactive []common.Directive
+
+	// Commands run after every other directive so the other directives (like the environment)
+	// are part of every layer. The interactive shell is only started once the layers are built.
+	for _, dir := range directives {
+		inner := dir
+		if repeatable, ok := dir.(common.DirectiveRepeatable); ok {
+			inner = repeatable.Directive
+		}
+
+		if cmd, ok := inner.(common.DirectiveRunCommand); !ok {
+			base = append(base, dir)
+		} else if cmd.Command == "interactive" {
+			interactive = append(interactive, dir)
+		} else {
+			commands = append(commands, dir)
+		}
+	}
+
+	ret := base
+
+	for _, cmd := range commands {
+		layer := NewBuildVmDefinition(
+			append(slices.Clone(ret), cmd),
+			nil, nil,
+			LAYER_OUTPUT,
+			cpuCores, memoryMb, architecture,
+			storageSize,
+			"", false,
+		)
+
+		ret = append(ret, common.DirectiveLayer{Definition: layer})
+	}
+
+	return append(ret, interactive...)
+}
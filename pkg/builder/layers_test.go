@@ -0,0 +1,73 @@
+package builder
+
+import (
+	"testing"
+
+	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/config"
+	"github.com/tinyrange/tinyrange/pkg/hash"
+)
+
+func layerHashes(t *testing.T, db *hash.DefinitionDatabase, commands []string) []string {
+	t.Helper()
+
+	directives := []common.Directive{common.DirectiveEnvironment{Variables: []string{"A=1"}}}
+	for _, cmd := range commands {
+		directives = append(directives, common.DirectiveRepeatable{Directive: common.DirectiveRunCommand{Command: cmd}})
+	}
+	directives = append(directives, common.DirectiveRunCommand{Command: "interactive"})
+
+	layered := NewLayeredDirectives(directives, config.ArchX8664, 1, 1024, 1024)
+
+	if last, ok := layered[len(layered)-1].(common.DirectiveRunCommand); !ok || last.Command != "interactive" {
+		t.Fatalf("expected the interactive command last, got %+v", layered[len(layered)-1])
+	}
+
+	var hashes []string
+
+	for _, dir := range layered {
+		step, ok := dir.(common.DirectiveLayer)
+		if !ok {
+			continue
+		}
+
+		layer := step.Definition.(*BuildVmDefinition)
+
+		for _, layerDir := range layer.params.Directives {
+			if cmd, ok := layerDir.(common.DirectiveRunCommand); ok && cmd.Command == "interactive" {
+				t.Fatalf("layer %d runs the interactive command", len(hashes))
+			}
+		}
+
+		h, err := db.HashDefinition(layer)
+		if err != nil {
+			t.Fatalf("failed to hash layer: %s", err)
+		}
+
+		hashes = append(hashes, h)
+	}
+
+	if len(hashes) != len(commands) {
+		t.Fatalf("expected %d layers, got %d", len(commands), len(hashes))
+	}
+
+	return hashes
+}
+
+// Editing the last command only has to rebuild the last layer.
+func TestLayeredDirectivesRebuildLastLayer(t *testing.T) {
+	db := hash.NewDefinitionDatabase(nil)
+
+	before := layerHashes(t, db, []string{"apk add gcc", "make", "make install"})
+	after := layerHashes(t, db, []string{"apk add gcc", "make", "make install DESTDIR=/opt"})
+
+	for i := 0; i < 2; i++ {
+		if before[i] != after[i] {
+			t.Fatalf("layer %d changed after editing the last command", i)
+		}
+	}
+
+	if before[2] == after[2] {
+		t.Fatalf("the last layer didn't change after editing its command")
+	}
+}
@@ -0,0 +1,288 @@
+package builder
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/filesystem"
+	"github.com/tinyrange/tinyrange/pkg/hash"
+	"go.starlark.net/starlark"
+)
+
+func init() {
+	hash.RegisterType(&LocalApkRepoDefinition{})
+}
+
+// The APKINDEX field for each .PKGINFO key in the order they are written.
+var apkIndexFields = []struct {
+	key   string
+	field string
+}{
+	{"pkgname", "P"},
+	{"pkgver", "V"},
+	{"arch", "A"},
+	{"size", "I"},
+	{"pkgdesc", "T"},
+	{"url", "U"},
+	{"license", "L"},
+	{"origin", "o"},
+	{"maintainer", "m"},
+	{"builddate", "t"},
+	{"commit", "c"},
+	{"provider_priority", "k"},
+	{"depend", "D"},
+	{"provides", "p"},
+	{"install_if", "i"},
+	{"replaces", "r"},
+}
+
+// parsePkgInfo parses the "key = value" lines of a .PKGINFO file. Keys like depend can repeat.
+func parsePkgInfo(r io.Reader) (map[string][]string, error) {
+	ret := make(map[string][]string)
+
+	scan := bufio.NewScanner(r)
+	for scan.Scan() {
+		line := scan.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		k, v, ok := strings.Cut(line, " = ")
+		if !ok {
+			return nil, fmt.Errorf("invalid .PKGINFO line: %q", line)
+		}
+
+		ret[k] = append(ret[k], v)
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// readApkInfo reads the .PKGINFO from a .apk file. Packages are a series of
+// concatenated gzip streams (signature, control, and data) so the tar entries
+// can be read in order until .PKGINFO is found.
+func readApkInfo(filename string) (map[string][]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	rd := tar.NewReader(gz)
+
+	for {
+		hdr, err := rd.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no .PKGINFO found")
+		} else if err != nil {
+			return nil, err
+		}
+
+		if hdr.Name == ".PKGINFO" {
+			return parsePkgInfo(rd)
+		}
+	}
+}
+
+type localApkRepoResult struct {
+	index []byte
+}
+
+// WriteResult implements common.BuildResult.
+func (r *localApkRepoResult) WriteResult(w io.Writer) error {
+	tw := tar.NewWriter(w)
+
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "APKINDEX",
+		Size:     int64(len(r.index)),
+		Mode:     0644,
+		ModTime:  time.UnixMilli(0),
+	}); err != nil {
+		return err
+	}
+
+	if _, err := tw.Write(r.index); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// LocalApkRepoDefinition generates a APKINDEX from a directory of .apk files so
+// locally built packages can be installed by the Alpine builders like any other package.
+type LocalApkRepoDefinition struct {
+	params LocalApkRepoParameters
+}
+
+// Dependencies implements common.BuildDefinition.
+func (def *LocalApkRepoDefinition) Dependencies(ctx common.BuildContext) ([]common.DependencyNode, error) {
+	return []common.DependencyNode{}, nil
+}
+
+// implements common.BuildDefinition.
+func (def *LocalApkRepoDefinition) Params() hash.SerializableValue { return def.params }
+func (def *LocalApkRepoDefinition) SerializableType() string {
+	return "LocalApkRepoDefinition"
+}
+func (def *LocalApkRepoDefinition) Create(params hash.SerializableValue) hash.Definition {
+	return &LocalApkRepoDefinition{params: params.(LocalApkRepoParameters)}
+}
+
+// ToStarlark implements common.BuildDefinition.
+func (def *LocalApkRepoDefinition) ToStarlark(ctx common.BuildContext, result filesystem.File) (starlark.Value, error) {
+	return filesystem.NewStarFile(result, def.Tag()), nil
+}
+
+func (def *LocalApkRepoDefinition) packages() ([]string, error) {
+	ents, err := os.ReadDir(def.params.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []string
+
+	for _, ent := range ents {
+		if ent.Type().IsRegular() && strings.HasSuffix(ent.Name(), ".apk") {
+			ret = append(ret, ent.Name())
+		}
+	}
+
+	slices.Sort(ret)
+
+	return ret, nil
+}
+
+// NeedsBuild implements common.BuildDefinition.
+func (def *LocalApkRepoDefinition) NeedsBuild(ctx common.BuildContext, cacheTime time.Time) (bool, error) {
+	// The modification time of the directory changes when packages are added or removed.
+	info, err := os.Stat(def.params.Directory)
+	if err != nil {
+		return true, err
+	}
+	if info.ModTime().After(cacheTime) {
+		return true, nil
+	}
+
+	pkgs, err := def.packages()
+	if err != nil {
+		return true, err
+	}
+
+	for _, name := range pkgs {
+		info, err := os.Stat(filepath.Join(def.params.Directory, name))
+		if err != nil {
+			return true, err
+		}
+
+		if info.ModTime().After(cacheTime) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Build implements common.BuildDefinition.
+func (def *LocalApkRepoDefinition) Build(ctx common.BuildContext) (common.BuildResult, error) {
+	pkgs, err := def.packages()
+	if err != nil {
+		return nil, err
+	}
+
+	var index bytes.Buffer
+
+	for _, name := range pkgs {
+		filename := filepath.Join(def.params.Directory, name)
+
+		info, err := readApkInfo(filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", filename, err)
+		}
+
+		if len(info["pkgname"]) == 0 || len(info["pkgver"]) == 0 {
+			return nil, fmt.Errorf("%s: .PKGINFO is missing pkgname or pkgver", filename)
+		}
+
+		if arch := strings.Join(info["arch"], ""); arch != "noarch" && arch != def.params.Architecture {
+			continue
+		}
+
+		// Packages are downloaded as <url_base>/<pkgname>-<pkgver>.apk like a remote repository.
+		if expected := info["pkgname"][0] + "-" + info["pkgver"][0] + ".apk"; name != expected {
+			return nil, fmt.Errorf("%s: package must be named %s", filename, expected)
+		}
+
+		stat, err := os.Stat(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, field := range apkIndexFields {
+			values, ok := info[field.key]
+			if !ok {
+				continue
+			}
+
+			fmt.Fprintf(&index, "%s:%s\n", field.field, strings.Join(values, " "))
+
+			// The size of the package file follows the architecture.
+			if field.field == "A" {
+				fmt.Fprintf(&index, "S:%d\n", stat.Size())
+			}
+		}
+
+		index.WriteString("\n")
+	}
+
+	return &localApkRepoResult{index: index.Bytes()}, nil
+}
+
+// Tag implements common.BuildDefinition.
+func (def *LocalApkRepoDefinition) Tag() string {
+	return strings.Join([]string{"LocalApkRepo", def.params.Directory, def.params.Architecture}, "_")
+}
+
+func (def *LocalApkRepoDefinition) String() string { return def.Tag() }
+func (*LocalApkRepoDefinition) Type() string       { return "LocalApkRepoDefinition" }
+func (*LocalApkRepoDefinition) Hash() (uint32, error) {
+	return 0, fmt.Errorf("LocalApkRepoDefinition is not hashable")
+}
+func (*LocalApkRepoDefinition) Truth() starlark.Bool { return starlark.True }
+func (*LocalApkRepoDefinition) Freeze()              {}
+
+var (
+	_ starlark.Value         = &LocalApkRepoDefinition{}
+	_ common.BuildDefinition = &LocalApkRepoDefinition{}
+	_ common.BuildResult     = &localApkRepoResult{}
+)
+
+// NewLocalApkRepoDefinition creates a definition that indexes the packages in dir
+// for arch. Relative paths are resolved from the current directory.
+func NewLocalApkRepoDefinition(dir string, arch string) (*LocalApkRepoDefinition, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalApkRepoDefinition{params: LocalApkRepoParameters{Directory: dir, Architecture: arch}}, nil
+}
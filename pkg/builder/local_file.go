@@ -0,0 +1,91 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/filesystem"
+	"github.com/tinyrange/tinyrange/pkg/hash"
+	"go.starlark.net/starlark"
+)
+
+func init() {
+	hash.RegisterType(&LocalFileDefinition{})
+}
+
+// LocalFileDefinition copies a file from the host. It's rebuilt whenever the file is modified.
+type LocalFileDefinition struct {
+	params LocalFileParameters
+}
+
+// Dependencies implements common.BuildDefinition.
+func (def *LocalFileDefinition) Dependencies(ctx common.BuildContext) ([]common.DependencyNode, error) {
+	return []common.DependencyNode{}, nil
+}
+
+// implements common.BuildDefinition.
+func (def *LocalFileDefinition) Params() hash.SerializableValue { return def.params }
+func (def *LocalFileDefinition) SerializableType() string {
+	return "LocalFileDefinition"
+}
+func (def *LocalFileDefinition) Create(params hash.SerializableValue) hash.Definition {
+	return &LocalFileDefinition{params: params.(LocalFileParameters)}
+}
+
+// ToStarlark implements common.BuildDefinition.
+func (def *LocalFileDefinition) ToStarlark(ctx common.BuildContext, result filesystem.File) (starlark.Value, error) {
+	return filesystem.NewStarFile(result, def.Tag()), nil
+}
+
+// NeedsBuild implements common.BuildDefinition.
+func (def *LocalFileDefinition) NeedsBuild(ctx common.BuildContext, cacheTime time.Time) (bool, error) {
+	info, err := os.Stat(def.params.Filename)
+	if err != nil {
+		return true, err
+	}
+
+	return info.ModTime().After(cacheTime), nil
+}
+
+// Build implements common.BuildDefinition.
+func (def *LocalFileDefinition) Build(ctx common.BuildContext) (common.BuildResult, error) {
+	fh, err := os.Open(def.params.Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return &copyFileResult{fh: fh}, nil
+}
+
+// Tag implements common.BuildDefinition.
+func (def *LocalFileDefinition) Tag() string {
+	return strings.Join([]string{"LocalFile", filepath.Base(def.params.Filename)}, "_")
+}
+
+func (def *LocalFileDefinition) String() string { return def.Tag() }
+func (*LocalFileDefinition) Type() string       { return "LocalFileDefinition" }
+func (*LocalFileDefinition) Hash() (uint32, error) {
+	return 0, fmt.Errorf("LocalFileDefinition is not hashable")
+}
+func (*LocalFileDefinition) Truth() starlark.Bool { return starlark.True }
+func (*LocalFileDefinition) Freeze()              {}
+
+var (
+	_ starlark.Value         = &LocalFileDefinition{}
+	_ common.BuildDefinition = &LocalFileDefinition{}
+)
+
+// NewLocalFileDefinition creates a definition for filename. Relative paths are
+// resolved from the current directory.
+func NewLocalFileDefinition(filename string) (*LocalFileDefinition, error) {
+	filename, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalFileDefinition{params: LocalFileParameters{Filename: filename}}, nil
+}
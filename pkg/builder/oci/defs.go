@@ -90,6 +90,31 @@ type ImageConfigInfo struct {
 	Labels       map[string]string `json:"Labels"`
 }
 
+// Command returns the entrypoint followed by the command like a container runtime would run.
+// A entrypoint in shell form is run with /bin/sh -c.
+func (info ImageConfigInfo) Command() ([]string, error) {
+	var ret []string
+
+	switch entrypoint := info.Entrypoint.(type) {
+	case nil:
+	case string:
+		return []string{"/bin/sh", "-c", entrypoint}, nil
+	case []any:
+		for _, arg := range entrypoint {
+			str, ok := arg.(string)
+			if !ok {
+				return nil, fmt.Errorf("could not convert entrypoint argument %T to string", arg)
+			}
+
+			ret = append(ret, str)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported entrypoint type: %T", entrypoint)
+	}
+
+	return append(ret, info.Cmd...), nil
+}
+
 type ImageConfig struct {
 	Config       ImageConfigInfo      `json:"config"`
 	Architecture string               `json:"architecture"`
@@ -29,6 +29,34 @@ type BuildVmParameters struct {
 	StorageSize int                    // The amount of storage the root device will have in megabytes.
 	Interaction string                 // How will the virtual machine be interacted with (ssh, serial)
 	Debug       bool                   // Redirect hypervisor input to the host. The VM will exit after it completes initialization.
+
+	HypervisorArgs []string // Extra arguments appended to the hypervisor command line.
+	KernelArgs     []string // Extra key=value arguments appended to the guest kernel command line.
+	InitArgs       string   // A JSON object merged into /init.json which init.star reads as args.
+	Persist        string   // A host file that stores guest writes to the root filesystem across runs.
+	HttpCache      string   // A host directory used to cache guest downloads made through the internal HTTP server.
+	ShareCache     bool     // Serve downloads cached in the build directory to the guest read-only.
+	ResourceLimits bool     // Limit the hypervisor to the CPU cores and memory allocated to the guest with a cgroup.
+	DataDisks      []string // Additional disks attached to the guest in the form "SIZE" or "SIZE:SOURCE".
+	ExecCommand    string   // A shell command run in the guest without a terminal when the interaction is exec.
+	InitBinary     string   // A host executable that replaces the builtin init in the guest.
+	EventsSocket   string   // A host Unix socket that lifecycle events are written to.
+	FallbackShell  bool     // Use the builtin init shell if the guest has no shell.
+	KeepAlive      bool     // Start a interactive shell once the SSH session ends rather than shutting down.
+
+	ForwardIdleTimeoutMs int64 // Close forwarded connections after they have been idle for this many milliseconds.
+
+	SshUsername string // The username accepted by the guest SSH server. Any username is accepted if it's empty.
+	SshKey      string // The private key file the host connects to the guest SSH server with.
+	SshPort     int    // The port the guest SSH server listens on or 0 for the default.
+
+	AllowDomains []string // Domains the guest can resolve and connect to. The guest is unrestricted if this and AllowCIDRs are empty.
+	AllowCIDRs   []string // Addresses the guest can connect to.
+
+	BaseDirectory    string // The host directory relative paths are resolved against. Defaults to the working directory.
+	HypervisorDigest string // The SHA256 of the default hypervisor script so cached templates follow changes to it.
+
+	TemplateOnly bool // Write the virtual machine config as the build result rather than running it.
 }
 
 // Build Emulator uses a internal shell emulator to run simple shell scripts with support from
@@ -63,6 +91,12 @@ type RegistryRequestParameters struct {
 	Accept     []string
 }
 
+// Download a blob from a OCI registry.
+// Blobs are content addressed so only the digest is hashed and the result is shared between images.
+type FetchOciBlobParameters struct {
+	Digest string
+}
+
 // Download a image from a OCI registry.
 // The output is a serialized copy of FetchOciImageDefinition.
 type FetchOciImageParameters struct {
@@ -70,6 +104,7 @@ type FetchOciImageParameters struct {
 	Image        string
 	Tag          string
 	Architecture string
+	Entrypoint   bool // Use the image entrypoint and command as the default interactive command.
 }
 
 // Copy a file to the build output directory.
@@ -77,6 +112,18 @@ type FileParameters struct {
 	File filesystem.File
 }
 
+// Copy a file from the host into the build output directory.
+type LocalFileParameters struct {
+	Filename string // A absolute path on the host.
+}
+
+// Generate a Alpine APKINDEX for a directory of local .apk files.
+// The output is a tar archive containing APKINDEX.
+type LocalApkRepoParameters struct {
+	Directory    string // A absolute path on the host.
+	Architecture string // Only packages for this architecture (or noarch) are indexed.
+}
+
 // Constant hash needs to be manually replicated by constructing a object.
 type ConstantHashParameters struct {
 	Hash string
@@ -119,8 +166,11 @@ func (b BuildEmulatorParameters) SerializableType() string   { return "BuildEmul
 func (d DecompressFileParameters) SerializableType() string  { return "DecompressFileParameters" }
 func (f FetchHttpParameters) SerializableType() string       { return "FetchHttpParameters" }
 func (r RegistryRequestParameters) SerializableType() string { return "RegistryRequestParameters" }
+func (f FetchOciBlobParameters) SerializableType() string    { return "FetchOciBlobParameters" }
 func (f FetchOciImageParameters) SerializableType() string   { return "FetchOciImageParameters" }
 func (f FileParameters) SerializableType() string            { return "FileParameters" }
+func (f LocalFileParameters) SerializableType() string       { return "LocalFileParameters" }
+func (l LocalApkRepoParameters) SerializableType() string    { return "LocalApkRepoParameters" }
 func (f ConstantHashParameters) SerializableType() string    { return "ConstantHashParameters" }
 func (f ExtractFileParameters) SerializableType() string     { return "ExtractFileParameters" }
 func (p PlanParameters) SerializableType() string            { return "PlanParameters" }
@@ -134,8 +184,11 @@ var (
 	_ hash.SerializableValue = DecompressFileParameters{}
 	_ hash.SerializableValue = FetchHttpParameters{}
 	_ hash.SerializableValue = RegistryRequestParameters{}
+	_ hash.SerializableValue = FetchOciBlobParameters{}
 	_ hash.SerializableValue = FetchOciImageParameters{}
 	_ hash.SerializableValue = FileParameters{}
+	_ hash.SerializableValue = LocalFileParameters{}
+	_ hash.SerializableValue = LocalApkRepoParameters{}
 	_ hash.SerializableValue = ConstantHashParameters{}
 	_ hash.SerializableValue = ExtractFileParameters{}
 	_ hash.SerializableValue = PlanParameters{}
@@ -56,11 +56,15 @@ func (d *directoryToArchiveBuildResult) getEntry(
 			CUid:      cEnt.CUid,
 			CGid:      cEnt.CGid,
 			CModTime:  info.ModTime().UnixMicro(),
-			CDevmajor: 0,
-			CDevminor: 0,
+			CDevmajor: cEnt.CDevmajor,
+			CDevminor: cEnt.CDevminor,
 		}
 	} else {
-		var linkname = ""
+		var (
+			linkname = ""
+			devmajor int64
+			devminor int64
+		)
 
 		if info.Mode().Type() == fs.ModeSymlink {
 			linkname, err = filesystem.GetLinkName(ent)
@@ -70,6 +74,12 @@ func (d *directoryToArchiveBuildResult) getEntry(
 			typ = filesystem.TypeSymlink
 		} else if info.Mode().IsDir() {
 			typ = filesystem.TypeDirectory
+		} else if info.Kind() == filesystem.TypeCharDevice || info.Kind() == filesystem.TypeBlockDevice {
+			devmajor, devminor, err = filesystem.GetDevice(ent)
+			if err != nil {
+				return nil, err
+			}
+			typ = info.Kind()
 		} else {
 			typ = filesystem.TypeRegular
 		}
@@ -88,8 +98,8 @@ func (d *directoryToArchiveBuildResult) getEntry(
 			CUid:      uid,
 			CGid:      gid,
 			CModTime:  info.ModTime().UnixMicro(),
-			CDevmajor: 0,
-			CDevminor: 0,
+			CDevmajor: devmajor,
+			CDevminor: devminor,
 		}
 	}
 
@@ -252,6 +262,10 @@ func (r *tarToArchiveBuildResult) WriteResult(w io.Writer) error {
 			typeFlag = filesystem.TypeSymlink
 		case tar.TypeLink:
 			typeFlag = filesystem.TypeLink
+		case tar.TypeChar:
+			typeFlag = filesystem.TypeCharDevice
+		case tar.TypeBlock:
+			typeFlag = filesystem.TypeBlockDevice
 		case tar.TypeXGlobalHeader:
 			continue
 		default:
@@ -0,0 +1,54 @@
+package buildinfo
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+)
+
+// Describe formats the version and VCS metadata from a binary's build info.
+func Describe(info *debug.BuildInfo) string {
+	if info == nil {
+		return VERSION + " (no build info)"
+	}
+
+	var (
+		revision string
+		time     string
+		modified bool
+	)
+
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.time":
+			time = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+
+	details := []string{info.GoVersion}
+
+	if revision != "" {
+		if modified {
+			revision += "-dirty"
+		}
+
+		details = append(details, "commit "+revision)
+	}
+
+	if time != "" {
+		details = append(details, "built "+time)
+	}
+
+	return fmt.Sprintf("%s (%s)", strings.TrimSpace(VERSION), strings.Join(details, ", "))
+}
+
+// Current returns a description of the running binary.
+func Current() string {
+	info, _ := debug.ReadBuildInfo()
+
+	return Describe(info)
+}
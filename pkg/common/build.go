@@ -1,7 +1,9 @@
 package common
 
 import (
+	"context"
 	"io"
+	"os"
 	"time"
 
 	"github.com/tinyrange/tinyrange/pkg/filesystem"
@@ -9,6 +11,8 @@ import (
 	"go.starlark.net/starlark"
 )
 
+// BuildResult is written to the build cache. If it also implements io.Closer it's closed
+// once it has been written or the build fails.
 type BuildResult interface {
 	WriteResult(out io.Writer) error
 }
@@ -40,8 +44,10 @@ type RedistributableDefinition interface {
 type BuildContext interface {
 	starlark.Value
 
+	Context() context.Context
 	DisplayTree()
 	CreateOutput() (io.WriteCloser, error)
+	ResumeOutput() (*os.File, error)
 	CreateFile(name string) (string, io.WriteCloser, error)
 	HasCreatedOutput() bool
 	SetHasCached()
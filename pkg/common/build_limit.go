@@ -0,0 +1,84 @@
+package common
+
+import (
+	"context"
+	"sync"
+)
+
+// buildLimiter is a weighted semaphore shared by every build in the process.
+type buildLimiter struct {
+	mtx   sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	used  int64
+}
+
+var buildLimit = func() *buildLimiter {
+	l := &buildLimiter{}
+	l.cond = sync.NewCond(&l.mtx)
+	return l
+}()
+
+// SetBuildMemoryLimit sets the total estimated memory in megabytes that
+// concurrent builds may hold. A limit of 0 disables the check.
+func SetBuildMemoryLimit(limitMB int64) {
+	buildLimit.mtx.Lock()
+	defer buildLimit.mtx.Unlock()
+
+	buildLimit.limit = limitMB
+	buildLimit.cond.Broadcast()
+}
+
+// AcquireBuildMemory blocks until weightMB megabytes are available under the
+// build memory limit. Weights larger than the limit are clamped so a single
+// large build can still run on its own. The returned function releases the
+// reservation and must be called exactly once.
+func AcquireBuildMemory(ctx context.Context, weightMB int64) (func(), error) {
+	l := buildLimit
+
+	if weightMB < 1 {
+		weightMB = 1
+	}
+
+	// Wake the waiters if the context is cancelled so they can return.
+	stop := context.AfterFunc(ctx, func() {
+		l.mtx.Lock()
+		defer l.mtx.Unlock()
+
+		l.cond.Broadcast()
+	})
+	defer stop()
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if l.limit <= 0 {
+			return func() {}, nil
+		}
+
+		weight := min(weightMB, l.limit)
+
+		if l.used+weight <= l.limit {
+			l.used += weight
+
+			var once sync.Once
+
+			return func() {
+				once.Do(func() {
+					l.mtx.Lock()
+					defer l.mtx.Unlock()
+
+					l.used -= weight
+					l.cond.Broadcast()
+				})
+			}, nil
+		}
+
+		l.cond.Wait()
+	}
+}
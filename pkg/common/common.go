@@ -4,6 +4,7 @@ import (
 	"embed"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"os/exec"
@@ -14,6 +15,7 @@ import (
 	"github.com/anmitsu/go-shlex"
 	starlarkjson "go.starlark.net/lib/json"
 	"go.starlark.net/starlark"
+	"golang.org/x/term"
 )
 
 var StarlarkJsonEncode = starlarkjson.Module.Members["encode"].(*starlark.Builtin).CallInternal
@@ -27,10 +29,18 @@ func SetSourceFS(fs embed.FS) {
 
 var verboseEnabled = false
 
+// logLevel is shared by every handler installed by SetLogFormat.
+var logLevel = new(slog.LevelVar)
+
+func setLogLevel(level slog.Level) {
+	logLevel.Set(level)
+	slog.SetLogLoggerLevel(level)
+}
+
 func EnableVerbose() error {
 	verboseEnabled = true
 
-	slog.SetLogLoggerLevel(slog.LevelDebug)
+	setLogLevel(slog.LevelDebug)
 
 	if err := os.Setenv("TINYRANGE_VERBOSE", "on"); err != nil {
 		return err
@@ -39,10 +49,54 @@ func EnableVerbose() error {
 	return nil
 }
 
+// EnableQuiet only logs warnings and errors.
+func EnableQuiet() error {
+	setLogLevel(slog.LevelWarn)
+
+	if err := os.Setenv("TINYRANGE_QUIET", "on"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SetLogFormat configures the default slog handler. "text" keeps the default handler
+// and "json" writes one JSON object per line to stderr.
+func SetLogFormat(format string) error {
+	switch format {
+	case "", "text":
+		// Keep the default handler.
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})))
+	default:
+		return fmt.Errorf("unknown log format %s (expected text or json)", format)
+	}
+
+	if err := os.Setenv("TINYRANGE_LOG_FORMAT", format); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func IsVerbose() bool {
 	return verboseEnabled
 }
 
+var realStdout *os.File
+
+// RedirectStdout makes anything later written to os.Stdout (including the output of child processes)
+// go to stderr and returns the original stdout. It's used when a build output is streamed to stdout
+// so other output can't corrupt it. Logs already go to stderr.
+func RedirectStdout() *os.File {
+	if realStdout == nil {
+		realStdout = os.Stdout
+		os.Stdout = os.Stderr
+	}
+
+	return realStdout
+}
+
 func ToStringList(it starlark.Iterable) ([]string, error) {
 	iter := it.Iterate()
 	defer iter.Done()
@@ -131,15 +185,57 @@ func GetDefaultBuildDir() string {
 	return filepath.Join(cache, "tinyrange", "build")
 }
 
+// TailBuffer is a io.Writer that keeps the last Limit bytes written to it.
+type TailBuffer struct {
+	Limit int
+	buf   []byte
+}
+
+// Write implements io.Writer.
+func (t *TailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+
+	if len(t.buf) > t.Limit {
+		t.buf = t.buf[len(t.buf)-t.Limit:]
+	}
+
+	return len(p), nil
+}
+
+func (t *TailBuffer) String() string {
+	return string(t.buf)
+}
+
+var (
+	_ io.Writer = &TailBuffer{}
+)
+
+// teeUnlessTerminal returns a writer that copies to f and output. If f is a
+// terminal or output is nil f is returned unchanged.
+func teeUnlessTerminal(f *os.File, output io.Writer) io.Writer {
+	if output == nil || term.IsTerminal(int(f.Fd())) {
+		return f
+	}
+
+	return io.MultiWriter(f, output)
+}
+
 func ExecCommand(args []string, environment map[string]string) error {
+	return ExecCommandWithOutput(args, environment, nil)
+}
+
+// ExecCommandWithOutput runs a command like ExecCommand but also copies the
+// stdout and stderr of the command to output if it's not nil. Terminals are
+// passed through directly so interactive programs still see a TTY.
+func ExecCommandWithOutput(args []string, environment map[string]string, output io.Writer) error {
 	if ok, _ := Exists(args[0]); !ok {
 		return fmt.Errorf("path %s does not exist", args[0])
 	}
 
 	cmd := exec.Command(args[0], args[1:]...)
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = teeUnlessTerminal(os.Stdout, output)
+	cmd.Stderr = teeUnlessTerminal(os.Stderr, output)
 	cmd.Stdin = os.Stdin
 	cmd.Env = cmd.Environ()
 
@@ -162,22 +258,66 @@ func ExecCommand(args []string, environment map[string]string) error {
 
 var DefaultInteractiveCommand = []string{"/bin/sh"}
 
+// Shells tried in order if the default interactive shell is missing.
+var alternativeShells = [][]string{{"/bin/bash"}, {"/bin/ash"}, {"/bin/busybox", "sh"}}
+
+// FallbackShell is run if no shell is found in the guest. Init sets it to it's
+// builtin shell when the fallback is enabled.
+var FallbackShell []string
+
+// InteractiveCommand returns the command used for the "interactive" script. Images
+// without /bin/sh (like scratch based images) can still have a different shell.
+func InteractiveCommand() ([]string, error) {
+	candidates := [][]string{DefaultInteractiveCommand}
+	if DefaultInteractiveCommand[0] == "/bin/sh" {
+		candidates = append(candidates, alternativeShells...)
+	}
+
+	var tried []string
+
+	for _, args := range candidates {
+		if ok, _ := Exists(args[0]); ok {
+			return args, nil
+		}
+
+		tried = append(tried, args[0])
+	}
+
+	if len(FallbackShell) > 0 {
+		slog.Warn("no shell found, using the builtin init shell", "tried", tried)
+
+		return FallbackShell, nil
+	}
+
+	return nil, fmt.Errorf("no shell found in the guest (tried %s). Install a shell or enable the builtin init shell with --fallback-shell", strings.Join(tried, ", "))
+}
+
 func SetDefaultInteractive(args []string) {
 	DefaultInteractiveCommand = args
 }
 
 func RunCommand(script string) error {
+	return RunCommandWithOutput(script, nil)
+}
+
+// RunCommandWithOutput runs a script like RunCommand but also copies it's output to output.
+func RunCommandWithOutput(script string, output io.Writer) error {
 	if strings.HasPrefix(script, "/init") {
 		tokens, err := shlex.Split(script, true)
 		if err != nil {
 			return err
 		}
 
-		return ExecCommand(tokens, nil)
+		return ExecCommandWithOutput(tokens, nil, output)
 	} else if script == "interactive" {
-		return ExecCommand(DefaultInteractiveCommand, nil)
+		args, err := InteractiveCommand()
+		if err != nil {
+			return err
+		}
+
+		return ExecCommandWithOutput(args, nil, output)
 	} else {
-		return ExecCommand([]string{"/bin/sh", "-lc", script}, nil)
+		return ExecCommandWithOutput([]string{"/bin/sh", "-lc", script}, nil, output)
 	}
 }
 
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/tinyrange/tinyrange/pkg/config"
@@ -8,6 +9,9 @@ import (
 	"go.starlark.net/starlark"
 )
 
+// ErrOffline is returned when a build would need network access while the database is offline.
+var ErrOffline = errors.New("network access is disabled in offline mode")
+
 type BuildOptions struct {
 	AlwaysRebuild bool
 }
@@ -35,10 +39,13 @@ type PackageDatabase interface {
 	starlark.Value
 
 	FilenameFromHash(hash string, suffix string) (string, error)
+	ResultFilename(hash string) (string, error)
+	BuildDir() string
 	Build(ctx BuildContext, def BuildDefinition, opts BuildOptions) (filesystem.File, error)
 	UrlsFor(url string) ([]string, error)
 	HttpClient() (*http.Client, error)
 	ShouldRebuildUserDefinitions() bool
+	IsOffline() bool
 	GetContainerBuilder(ctx BuildContext, name string, arch config.CPUArchitecture) (ContainerBuilder, error)
 	GetBuilder(filename string, builder string) (starlark.Callable, error)
 	NewThread(filename string) *starlark.Thread
@@ -2,6 +2,7 @@ package common
 
 import (
 	"fmt"
+	"log/slog"
 	"strings"
 
 	"github.com/tinyrange/tinyrange/pkg/config"
@@ -13,6 +14,7 @@ func init() {
 	hash.RegisterType(DirectiveRunCommand{})
 	hash.RegisterType(DirectiveEnvironment{})
 	hash.RegisterType(DirectiveList{})
+	hash.RegisterType(DirectiveRepeatable{})
 }
 
 type Directive interface {
@@ -172,6 +174,46 @@ func (d DirectiveArchive) Tag() string {
 	return fmt.Sprintf("DirArchive_%s_%s", d.Definition.Tag(), d.Target)
 }
 
+// DirectiveLayer adds the files changed by a command built in its own virtual machine.
+// Unlike DirectiveArchive the files replace existing ones and files deleted by the command
+// are removed.
+type DirectiveLayer struct {
+	Definition BuildDefinition
+}
+
+// Dependencies implements Directive.
+func (d DirectiveLayer) Dependencies(ctx BuildContext) ([]DependencyNode, error) {
+	return []DependencyNode{d.Definition}, nil
+}
+
+// SerializableType implements Directive.
+func (d DirectiveLayer) SerializableType() string { return "DirectiveLayer" }
+
+// AsFragments implements Directive.
+func (d DirectiveLayer) AsFragments(ctx BuildContext, special SpecialDirectiveHandlers) ([]config.Fragment, error) {
+	res, err := ctx.BuildChild(d.Definition)
+	if err != nil {
+		return nil, err
+	}
+
+	filename, err := ctx.FilenameFromDigest(res.Digest())
+	if err != nil {
+		return nil, err
+	}
+
+	return []config.Fragment{
+		{Archive: &config.ArchiveFragment{
+			HostFilename: filename,
+			Layer:        true,
+		}},
+	}, nil
+}
+
+// Tag implements Directive.
+func (d DirectiveLayer) Tag() string {
+	return fmt.Sprintf("DirLayer_%s", d.Definition.Tag())
+}
+
 type DirectiveExportPort struct {
 	Name string
 	Port int
@@ -292,6 +334,30 @@ func (d DirectiveList) Tag() string {
 	return strings.Join(ret, "_")
 }
 
+// DirectiveRepeatable marks a directive that should be kept by FlattenDirectives
+// even if an identical directive appears earlier.
+type DirectiveRepeatable struct {
+	Directive Directive
+}
+
+// AsFragments implements Directive.
+func (d DirectiveRepeatable) AsFragments(ctx BuildContext, special SpecialDirectiveHandlers) ([]config.Fragment, error) {
+	return d.Directive.AsFragments(ctx, special)
+}
+
+// Dependencies implements Directive.
+func (d DirectiveRepeatable) Dependencies(ctx BuildContext) ([]DependencyNode, error) {
+	return []DependencyNode{d.Directive}, nil
+}
+
+// SerializableType implements Directive.
+func (d DirectiveRepeatable) SerializableType() string { return "DirectiveRepeatable" }
+
+// Tag implements Directive.
+func (d DirectiveRepeatable) Tag() string {
+	return fmt.Sprintf("Repeatable_%s", d.Directive.Tag())
+}
+
 type DirectiveAddPackage struct {
 	Name PackageQuery
 }
@@ -372,10 +438,12 @@ var (
 	_ Directive = DirectiveAddFile{}
 	_ Directive = DirectiveLocalFile{}
 	_ Directive = DirectiveArchive{}
+	_ Directive = DirectiveLayer{}
 	_ Directive = DirectiveExportPort{}
 	_ Directive = DirectiveEnvironment{}
 	_ Directive = DirectiveBuiltin{}
 	_ Directive = DirectiveList{}
+	_ Directive = DirectiveRepeatable{}
 	_ Directive = DirectiveAddPackage{}
 )
 
@@ -401,13 +469,71 @@ type SpecialDirectiveHandlers struct {
 	DefaultInteractive func(dir DirectiveDefaultInteractive) error
 }
 
+// fileKey returns the guest path a file directive writes to and a key identifying
+// the contents written. The key is "" if the contents can't be identified.
+func fileKey(defs *hash.DefinitionDatabase, dir Directive) (string, string) {
+	switch dir := dir.(type) {
+	case DirectiveAddFile:
+		if dir.Definition == nil {
+			return dir.Filename, dir.Tag()
+		}
+
+		// Tags aren't unique so files built from a definition are compared by hash.
+		defHash, err := defs.HashDefinition(dir.Definition)
+		if err != nil {
+			return dir.Filename, ""
+		}
+
+		return dir.Filename, fmt.Sprintf("AddFile:%s:%s:%+v", dir.Filename, defHash, dir.Executable)
+	case DirectiveLocalFile:
+		return dir.Filename, dir.Tag()
+	default:
+		return "", ""
+	}
+}
+
+// FlattenDirectives expands DirectiveLists and passes special directives to handlers.
+// Run commands are only kept the first time they appear and files are dropped if the
+// same file was the last thing written to their path. Archives, layers, and builtins can
+// change anything so commands and files after them are always kept. Wrap a directive in
+// DirectiveRepeatable to keep every copy.
 func FlattenDirectives(directives []Directive, handlers SpecialDirectiveHandlers) ([]Directive, error) {
 	var ret []Directive
 
-	var recurse func(directives []Directive) error
+	defs := hash.NewDefinitionDatabase(nil)
+
+	seenCommands := make(map[string]bool)
+
+	// The key of the last file written to each guest path.
+	lastFiles := make(map[string]string)
 
-	recurse = func(directives []Directive) error {
+	var recurse func(directives []Directive, repeatable bool) error
+
+	recurse = func(directives []Directive, repeatable bool) error {
 		for _, dir := range directives {
+			switch dir := dir.(type) {
+			case DirectiveRunCommand:
+				if seenCommands[dir.Command] && !repeatable {
+					slog.Debug("skipping duplicate directive", "directive", dir.Tag())
+					continue
+				}
+
+				seenCommands[dir.Command] = true
+			case DirectiveAddFile, DirectiveLocalFile:
+				filename, key := fileKey(defs, dir)
+
+				if key != "" && lastFiles[filename] == key && !repeatable {
+					slog.Debug("skipping duplicate directive", "directive", dir.Tag())
+					continue
+				}
+
+				lastFiles[filename] = key
+			case DirectiveArchive, DirectiveLayer, DirectiveBuiltin:
+				// These can write to any path so earlier commands and files may need to run again.
+				clear(seenCommands)
+				clear(lastFiles)
+			}
+
 			switch dir := dir.(type) {
 			case DirectiveRunCommand:
 				if handlers.RunCommand != nil {
@@ -450,7 +576,11 @@ func FlattenDirectives(directives []Directive, handlers SpecialDirectiveHandlers
 					ret = append(ret, dir)
 				}
 			case DirectiveList:
-				if err := recurse(dir.Items); err != nil {
+				if err := recurse(dir.Items, repeatable); err != nil {
+					return err
+				}
+			case DirectiveRepeatable:
+				if err := recurse([]Directive{dir.Directive}, true); err != nil {
 					return err
 				}
 			default:
@@ -461,7 +591,7 @@ func FlattenDirectives(directives []Directive, handlers SpecialDirectiveHandlers
 		return nil
 	}
 
-	if err := recurse(directives); err != nil {
+	if err := recurse(directives, false); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,148 @@
+package common
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/tinyrange/tinyrange/pkg/hash"
+)
+
+type testFileParams struct {
+	Contents string
+}
+
+func (testFileParams) SerializableType() string { return "testFileParams" }
+
+// testFileDefinition only implements what's needed to hash it. Every instance has the same tag.
+type testFileDefinition struct {
+	BuildDefinition
+
+	params testFileParams
+}
+
+func (def *testFileDefinition) SerializableType() string       { return "testFileDefinition" }
+func (def *testFileDefinition) Params() hash.SerializableValue { return def.params }
+func (def *testFileDefinition) Tag() string                    { return "testFile" }
+func (def *testFileDefinition) Create(params hash.SerializableValue) hash.Definition {
+	return &testFileDefinition{params: params.(testFileParams)}
+}
+
+func TestFlattenDirectivesDuplicates(t *testing.T) {
+	run := func(cmd string) Directive { return DirectiveRunCommand{Command: cmd} }
+	file := func(contents string) Directive {
+		return DirectiveAddFile{Filename: "/root/file", Definition: &testFileDefinition{params: testFileParams{Contents: contents}}}
+	}
+	local := DirectiveLocalFile{Filename: "/root/local", HostFilename: "/tmp/local"}
+	archive := DirectiveArchive{Target: "/"}
+	builtin := DirectiveBuiltin{Name: "init", GuestFilename: "/init"}
+
+	for _, test := range []struct {
+		name       string
+		directives []Directive
+		want       []Directive
+	}{
+		{
+			name:       "adjacent commands",
+			directives: []Directive{run("a"), run("a"), run("b")},
+			want:       []Directive{run("a"), run("b")},
+		},
+		{
+			name:       "separated commands",
+			directives: []Directive{run("a"), run("b"), run("a")},
+			want:       []Directive{run("a"), run("b")},
+		},
+		{
+			name:       "repeatable",
+			directives: []Directive{run("a"), DirectiveRepeatable{Directive: run("a")}, DirectiveRepeatable{Directive: run("a")}},
+			want:       []Directive{run("a"), run("a"), run("a")},
+		},
+		{
+			// Commands from the user are wrapped so they still run after a macro ran the same command.
+			name:       "repeatable after a macro",
+			directives: []Directive{DirectiveList{Items: []Directive{run("a")}}, DirectiveRepeatable{Directive: run("a")}},
+			want:       []Directive{run("a"), run("a")},
+		},
+		{
+			// Archives and builtins can change anything so the commands before them aren't remembered.
+			name:       "commands after an archive or builtin",
+			directives: []Directive{run("a"), archive, run("a"), run("a"), builtin, run("a")},
+			want:       []Directive{run("a"), archive, run("a"), builtin, run("a")},
+		},
+		{
+			name:       "across lists",
+			directives: []Directive{DirectiveList{Items: []Directive{run("a")}}, DirectiveList{Items: []Directive{run("a"), run("b")}}},
+			want:       []Directive{run("a"), run("b")},
+		},
+		{
+			name:       "files from the same definition",
+			directives: []Directive{file("one"), file("one")},
+			want:       []Directive{file("one")},
+		},
+		{
+			// The definitions share a tag so only the hash tells them apart.
+			name:       "files from different definitions",
+			directives: []Directive{file("one"), file("two")},
+			want:       []Directive{file("one"), file("two")},
+		},
+		{
+			// The second file overwrote the first so the path no longer has the same contents.
+			name:       "overwritten files",
+			directives: []Directive{file("one"), file("two"), file("one"), file("one")},
+			want:       []Directive{file("one"), file("two"), file("one")},
+		},
+		{
+			name:       "local files",
+			directives: []Directive{local, local, run("a"), local},
+			want:       []Directive{local, run("a")},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := FlattenDirectives(test.directives, SpecialDirectiveHandlers{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.EqualFunc(got, test.want, func(a, b Directive) bool {
+				if a, ok := a.(DirectiveAddFile); ok {
+					b, ok := b.(DirectiveAddFile)
+
+					return ok && a.Filename == b.Filename &&
+						a.Definition.(*testFileDefinition).params == b.Definition.(*testFileDefinition).params
+				}
+
+				return a == b
+			}) {
+				t.Fatalf("FlattenDirectives() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFlattenDirectivesHandlers(t *testing.T) {
+	var commands []string
+
+	got, err := FlattenDirectives([]Directive{
+		DirectiveRunCommand{Command: "a"},
+		DirectiveRunCommand{Command: "a"},
+		DirectiveEnvironment{Variables: []string{"A=1"}},
+		DirectiveRunCommand{Command: "a"},
+		DirectiveBuiltin{Name: "init", GuestFilename: "/init"},
+		DirectiveRunCommand{Command: "a"},
+	}, SpecialDirectiveHandlers{
+		RunCommand: func(dir DirectiveRunCommand) error {
+			commands = append(commands, dir.Command)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(commands, []string{"a", "a"}) {
+		t.Fatalf("handler got %v, want [a a]", commands)
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("FlattenDirectives() = %+v, want only the environment and builtin", got)
+	}
+}
@@ -13,11 +13,12 @@ func init() {
 }
 
 type PackageQuery struct {
-	MatchDirect      bool
-	Name             string
-	MatchPartialName bool
-	Version          string
-	Tags             TagList
+	MatchDirect       bool
+	Name              string
+	MatchPartialName  bool
+	Version           string
+	MatchExactVersion bool
+	Tags              TagList
 }
 
 func (q PackageQuery) Equals(n PackageName) bool {
@@ -27,6 +28,8 @@ func (q PackageQuery) Equals(n PackageName) bool {
 func (q PackageQuery) String() string {
 	if len(q.Tags) > 0 {
 		return fmt.Sprintf("%+v", q.Tags)
+	} else if q.MatchExactVersion {
+		return fmt.Sprintf("%s==%s", q.Name, q.Version)
 	} else {
 		return fmt.Sprintf("%s:%s", q.Name, q.Version)
 	}
@@ -47,6 +50,14 @@ func ParsePackageQuery(s string) (PackageQuery, error) {
 		return PackageQuery{}, nil
 	}
 
+	if name, version, ok := strings.Cut(s, "=="); ok {
+		if name == "" || version == "" {
+			return PackageQuery{}, fmt.Errorf("pinned package query %q must be written as name==version", s)
+		}
+
+		return PackageQuery{Name: name, Version: version, MatchExactVersion: true}, nil
+	}
+
 	name, version, _ := strings.Cut(s, ":")
 
 	return PackageQuery{Name: name, Version: version}, nil
@@ -84,6 +95,10 @@ func (name PackageName) Matches(query PackageQuery) bool {
 		return false
 	}
 
+	if query.MatchExactVersion && name.Version != query.Version {
+		return false
+	}
+
 	// if query.Version != "" {
 	// 	if name.Version != query.Version {
 	// 		return false
@@ -182,7 +197,8 @@ func (pkg *Package) Matches(query PackageQuery) bool {
 		return true
 	}
 
-	if query.MatchDirect {
+	// Pinned versions never resolve to a different package that provides the name.
+	if query.MatchDirect || query.MatchExactVersion {
 		return false
 	}
 
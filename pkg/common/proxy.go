@@ -1,8 +1,11 @@
 package common
 
 import (
+	"errors"
 	"io"
 	"net"
+	"sync/atomic"
+	"time"
 )
 
 // Based on: https://gist.github.com/jbardin/821d08cb64c01c84b81a
@@ -13,14 +16,88 @@ type connLikeObject interface {
 	io.Closer
 }
 
+// ErrProxyIdle is returned by ProxyWithOptions when the connections were closed because they were idle.
+var ErrProxyIdle = errors.New("proxy closed after being idle")
+
+type ProxyOptions struct {
+	BufferSize int
+	// Close both connections once no data has been copied in either direction for this long.
+	// Zero disables the timeout.
+	IdleTimeout time.Duration
+}
+
+// ProxyStats is the number of bytes copied in each direction by ProxyWithOptions.
+type ProxyStats struct {
+	ServerToClient int64
+	ClientToServer int64
+}
+
 func Proxy(srvConn, cliConn connLikeObject, bufferSize int) error {
+	_, err := ProxyWithOptions(srvConn, cliConn, ProxyOptions{BufferSize: bufferSize})
+
+	return err
+}
+
+// ProxyWithOptions copies data between srvConn and cliConn until one side closes and returns
+// the number of bytes copied in each direction.
+func ProxyWithOptions(srvConn, cliConn connLikeObject, opts ProxyOptions) (ProxyStats, error) {
 	// channels to wait on the close event for each connection
 	serverClosed := make(chan struct{}, 1)
 	clientClosed := make(chan struct{}, 1)
-	errC := make(chan error, 1)
+	// Each broker can report two errors. Buffer them all so neither broker blocks once we've returned.
+	errC := make(chan error, 4)
+
+	var (
+		serverToClient atomic.Int64
+		clientToServer atomic.Int64
+		lastActive     atomic.Int64
+		idle           atomic.Bool
+	)
+
+	lastActive.Store(time.Now().UnixNano())
+
+	bufferSize := opts.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = 4096
+	}
+
+	stats := func() ProxyStats {
+		return ProxyStats{
+			ServerToClient: serverToClient.Load(),
+			ClientToServer: clientToServer.Load(),
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
 
-	go broker(srvConn, cliConn, bufferSize, clientClosed, errC)
-	go broker(cliConn, srvConn, bufferSize, serverClosed, errC)
+	if opts.IdleTimeout > 0 {
+		go func() {
+			ticker := time.NewTicker(opts.IdleTimeout / 4)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					if time.Since(time.Unix(0, lastActive.Load())) < opts.IdleTimeout {
+						continue
+					}
+
+					// Closing both connections unblocks the brokers.
+					idle.Store(true)
+					srvConn.Close()
+					cliConn.Close()
+
+					return
+				}
+			}
+		}()
+	}
+
+	go broker(srvConn, cliConn, bufferSize, &clientToServer, &lastActive, clientClosed, errC)
+	go broker(cliConn, srvConn, bufferSize, &serverToClient, &lastActive, serverClosed, errC)
 
 	// wait for one half of the proxy to exit, then trigger a shutdown of the
 	// other half by calling CloseRead(). This will break the read loop in the
@@ -52,7 +129,11 @@ func Proxy(srvConn, cliConn connLikeObject, bufferSize int) error {
 			_ = cliConn.CloseRead()
 		}
 
-		return err
+		if idle.Load() {
+			return stats(), ErrProxyIdle
+		}
+
+		return stats(), err
 	}
 
 	// Wait for the other connection to close.
@@ -61,19 +142,46 @@ func Proxy(srvConn, cliConn connLikeObject, bufferSize int) error {
 	// stats on entry and deferred exit of this function.
 	<-waitFor
 
-	return nil
+	if idle.Load() {
+		return stats(), ErrProxyIdle
+	}
+
+	return stats(), nil
+}
+
+// countingWriter counts the bytes written to w and records the time of the last write.
+type countingWriter struct {
+	w          io.Writer
+	count      *atomic.Int64
+	lastActive *atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+
+	c.count.Add(int64(n))
+	c.lastActive.Store(time.Now().UnixNano())
+
+	return n, err
 }
 
 // This does the actual data transfer.
 // The broker only closes the Read side.
-func broker(dst, src connLikeObject, bufferSize int, srcClosed chan struct{}, errC chan error) {
+func broker(
+	dst, src connLikeObject,
+	bufferSize int,
+	count *atomic.Int64,
+	lastActive *atomic.Int64,
+	srcClosed chan struct{},
+	errC chan error,
+) {
 	buf := make([]byte, bufferSize)
 
 	// We can handle errors in a finer-grained manner by inlining io.Copy (it's
 	// simple, and we drop the ReaderFrom or WriterTo checks for
 	// net.Conn->net.Conn transfers, which aren't needed). This would also let
 	// us adjust buffersize.
-	_, err := io.CopyBuffer(dst, src, buf)
+	_, err := io.CopyBuffer(&countingWriter{w: dst, count: count, lastActive: lastActive}, src, buf)
 
 	if err != nil {
 		// Ensure that the source is closed.
@@ -0,0 +1,161 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// TLSOptions configures serving a web interface over HTTPS.
+// If TLS is set without a certificate then a self-signed certificate is generated.
+type TLSOptions struct {
+	TLS      bool
+	CertFile string
+	KeyFile  string
+}
+
+func (opts TLSOptions) Enabled() bool {
+	return opts.TLS || opts.CertFile != "" || opts.KeyFile != ""
+}
+
+// Scheme returns the URL scheme the web interface is served with.
+func (opts TLSOptions) Scheme() string {
+	if opts.Enabled() {
+		return "https"
+	}
+
+	return "http"
+}
+
+func (opts TLSOptions) Validate() error {
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return fmt.Errorf("both a TLS certificate and key must be specified")
+	}
+
+	return nil
+}
+
+func (opts TLSOptions) certificate(host string) (tls.Certificate, error) {
+	if opts.CertFile != "" {
+		return tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	}
+
+	certPEM, keyPEM, err := GenerateSelfSignedCertificate(host)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// GenerateSelfSignedCertificate returns a PEM encoded certificate and private key valid
+// for localhost and host (which may be a hostname, an IP address, or empty).
+func GenerateSelfSignedCertificate(host string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"TinyRange"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	if host != "" {
+		if ip := net.ParseIP(host); ip != nil {
+			if !ip.IsUnspecified() && !ip.IsLoopback() {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			}
+		} else if host != "localhost" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+
+	return certPEM, keyPEM, nil
+}
+
+// WriteSelfSignedCertificate generates a self-signed certificate for host and writes it to certFile and keyFile.
+// It lets several servers share one certificate so it only has to be trusted once.
+func WriteSelfSignedCertificate(certFile string, keyFile string, host string) error {
+	certPEM, keyPEM, err := GenerateSelfSignedCertificate(host)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(certFile, certPEM, os.FileMode(0644)); err != nil {
+		return err
+	}
+
+	return os.WriteFile(keyFile, keyPEM, os.FileMode(0600))
+}
+
+// ServeHTTP serves handler on listener using HTTPS if opts is enabled.
+func ServeHTTP(listener net.Listener, handler http.Handler, opts TLSOptions) error {
+	if !opts.Enabled() {
+		return http.Serve(listener, handler)
+	}
+
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		return err
+	}
+
+	cert, err := opts.certificate(host)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	if opts.CertFile == "" && len(cert.Certificate) > 0 {
+		sum := sha256.Sum256(cert.Certificate[0])
+		slog.Warn("using a self-signed certificate, your browser will ask you to trust it", "sha256", hex.EncodeToString(sum[:]))
+	}
+
+	svr := &http.Server{
+		Handler:   handler,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12},
+	}
+
+	return svr.ServeTLS(listener, "", "")
+}
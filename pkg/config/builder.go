@@ -7,4 +7,12 @@ type BuilderConfig struct {
 	ExecInit           string
 	OutputFilename     string
 	DefaultInteractive []string
+	FallbackShell      bool // Use the builtin init shell if the guest has no shell.
+}
+
+// InitFailure is reported by the guest init to the host when it fails to start.
+type InitFailure struct {
+	Phase   string `json:"phase"`
+	Message string `json:"message"`
+	Stack   string `json:"stack,omitempty"`
 }
@@ -1,9 +1,17 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/netip"
+	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 )
 
 type CPUArchitecture string
@@ -12,23 +20,41 @@ const (
 	ArchInvalid CPUArchitecture = ""
 	ArchX8664   CPUArchitecture = "x86_64"
 	ArchARM64   CPUArchitecture = "aarch64"
+	ArchRISCV64 CPUArchitecture = "riscv64"
 )
 
+// The architectures TinyRange can build and boot guests for.
+var SupportedArchitectures = []CPUArchitecture{ArchX8664, ArchARM64, ArchRISCV64}
+
 func (arch CPUArchitecture) IsNative() bool {
-	return arch == HostArchitecture
+	return arch != ArchInvalid && arch == HostArchitecture
 }
 
+// ArchitectureFromString parses a architecture name. Go and Debian style names
+// (amd64, arm64) are accepted as aliases. An empty string returns ArchInvalid
+// which callers treat as the host architecture.
 func ArchitectureFromString(s string) (CPUArchitecture, error) {
-	switch s {
-	case "x86_64":
+	switch strings.ToLower(s) {
+	case "x86_64", "amd64":
 		return ArchX8664, nil
-	case "aarch64":
+	case "aarch64", "arm64":
 		return ArchARM64, nil
+	case "riscv64":
+		return ArchRISCV64, nil
 	case "":
 		return ArchInvalid, nil
 	default:
-		return ArchInvalid, fmt.Errorf("could not parse architecture: %s", s)
+		return ArchInvalid, fmt.Errorf("unsupported architecture: %q (supported: %s)", s, supportedArchitectureNames())
+	}
+}
+
+func supportedArchitectureNames() string {
+	var names []string
+	for _, arch := range SupportedArchitectures {
+		names = append(names, string(arch))
 	}
+
+	return strings.Join(names, ", ")
 }
 
 var HostArchitecture = getHostArchitecture()
@@ -39,11 +65,95 @@ func getHostArchitecture() CPUArchitecture {
 		return ArchX8664
 	case "arm64":
 		return ArchARM64
+	case "riscv64":
+		return ArchRISCV64
 	default:
-		panic("unknown architecture: " + runtime.GOARCH)
+		panic(fmt.Sprintf("unsupported host architecture: %s (supported: %s)", runtime.GOARCH, supportedArchitectureNames()))
 	}
 }
 
+// The units accepted by ParseSize in megabytes.
+var sizeUnits = map[string]int{
+	"":   1,
+	"M":  1,
+	"MB": 1,
+	"G":  1024,
+	"GB": 1024,
+	"T":  1024 * 1024,
+	"TB": 1024 * 1024,
+}
+
+// ParseSize parses a size like "2G", "512M" or "1500" into megabytes.
+// Sizes without a suffix are interpreted as megabytes.
+func ParseSize(s string) (int, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+
+	digits := strings.IndexFunc(str, func(r rune) bool { return r < '0' || r > '9' })
+	if digits == -1 {
+		digits = len(str)
+	}
+
+	multiplier, ok := sizeUnits[str[digits:]]
+	if !ok {
+		return 0, fmt.Errorf("could not parse size: %s", s)
+	}
+
+	val, err := strconv.Atoi(str[:digits])
+	if err != nil {
+		return 0, fmt.Errorf("could not parse size: %s", s)
+	}
+
+	return val * multiplier, nil
+}
+
+// A size in megabytes. It can be decoded from either a number or a string accepted by ParseSize.
+type SizeMB int
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *SizeMB) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		var val int
+		if err := json.Unmarshal(data, &val); err != nil {
+			return err
+		}
+
+		*s = SizeMB(val)
+
+		return nil
+	}
+
+	val, err := ParseSize(str)
+	if err != nil {
+		return err
+	}
+
+	*s = SizeMB(val)
+
+	return nil
+}
+
+// UnmarshalYAML implements the yaml obsolete Unmarshaler interface.
+func (s *SizeMB) UnmarshalYAML(unmarshal func(any) error) error {
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+
+	val, err := ParseSize(str)
+	if err != nil {
+		return err
+	}
+
+	*s = SizeMB(val)
+
+	return nil
+}
+
+var (
+	_ json.Unmarshaler = new(SizeMB)
+)
+
 type LocalFileFragment struct {
 	HostFilename  string `json:"host_filename" yaml:"host_filename"`
 	GuestFilename string `json:"guest_filename" yaml:"guest_filename"`
@@ -59,6 +169,9 @@ type FileContentsFragment struct {
 type ArchiveFragment struct {
 	HostFilename string `json:"host_filename" yaml:"host_filename"`
 	Target       string `json:"target" yaml:"target"`
+	// Layers replace existing files and remove the ones named by whiteout entries.
+	// Other archives never overwrite files added before them.
+	Layer bool `json:"layer,omitempty" yaml:"layer"`
 }
 
 type RunCommandFragment struct {
@@ -96,6 +209,131 @@ type Fragment struct {
 	ExportPort         *ExportPortFragment         `json:"export_port,omitempty" yaml:"export_port"`
 }
 
+// A additional block device attached to the virtual machine after the root device.
+type DataDisk struct {
+	// The size of the disk in megabytes. Accepts suffixed sizes like "2G".
+	Size SizeMB `json:"size" yaml:"size"`
+	// A host image attached read/write so changes persist. If empty a blank ext4 filesystem
+	// is created in memory and discarded when the virtual machine exits.
+	Source string `json:"source,omitempty" yaml:"source,omitempty"`
+}
+
+// ParseDataDisk parses a data disk from "SIZE" or "SIZE:SOURCE".
+func ParseDataDisk(s string) (DataDisk, error) {
+	sizeStr, source, _ := strings.Cut(s, ":")
+
+	size, err := ParseSize(sizeStr)
+	if err != nil {
+		return DataDisk{}, err
+	}
+
+	return DataDisk{Size: SizeMB(size), Source: source}, nil
+}
+
+var kernelArgKey = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// ValidateKernelArg checks a key=value argument can be safely appended to the guest kernel
+// command line. Values can't contain whitespace, quotes, or control characters since they
+// would change how the kernel splits the command line.
+func ValidateKernelArg(arg string) error {
+	key, value, _ := strings.Cut(arg, "=")
+
+	if !kernelArgKey.MatchString(key) {
+		return fmt.Errorf("invalid kernel argument key: %q", key)
+	}
+
+	for _, r := range value {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || r == '"' || r == '\'' || r == '\\' {
+			return fmt.Errorf("invalid character %q in kernel argument %q", r, key)
+		}
+	}
+
+	return nil
+}
+
+// ParseAllowedCIDR parses a entry of AllowCIDRs. A single address is treated as a prefix containing only it.
+func ParseAllowedCIDR(s string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid allowed CIDR %q", s)
+	}
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// SecretsEnvironmentVariable passes RuntimeSecrets to a child run-vm process so they are never
+// written to the virtual machine config.
+const SecretsEnvironmentVariable = "TINYRANGE_SECRETS"
+
+// RuntimeSecrets are only passed to the virtual machine when it's run.
+type RuntimeSecrets struct {
+	Secrets           map[string]string `json:"secrets,omitempty"`
+	SshPassword       string            `json:"ssh_password,omitempty"`
+	SshAuthorizedKeys string            `json:"ssh_authorized_keys,omitempty"`
+}
+
+// SshServerCredentials are fetched from the host by the guest init so they aren't stored in /init.json.
+type SshServerCredentials struct {
+	Password       string `json:"password,omitempty"`
+	AuthorizedKeys string `json:"authorized_keys,omitempty"`
+}
+
+var secretName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// ParseSecrets reads secrets given as name=value and secret files given as name=path or path.
+// If only a path is given the name is the base name of the file.
+func ParseSecrets(values []string, files []string) (map[string]string, error) {
+	secrets := make(map[string]string)
+
+	add := func(name string, value string) error {
+		if !secretName.MatchString(name) || name == "." || name == ".." {
+			return fmt.Errorf("invalid secret name: %q", name)
+		}
+
+		if _, ok := secrets[name]; ok {
+			return fmt.Errorf("secret %s given more than once", name)
+		}
+
+		secrets[name] = value
+
+		return nil
+	}
+
+	for _, secret := range values {
+		name, value, ok := strings.Cut(secret, "=")
+		if !ok {
+			// Don't include the argument since it might be the secret itself.
+			return nil, fmt.Errorf("secrets must be written as name=value")
+		}
+
+		if err := add(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, file := range files {
+		name, filename, ok := strings.Cut(file, "=")
+		if !ok {
+			name, filename = filepath.Base(file), file
+		}
+
+		contents, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secret file: %w", err)
+		}
+
+		if err := add(name, string(contents)); err != nil {
+			return nil, err
+		}
+	}
+
+	return secrets, nil
+}
+
 // A config file that can be passed to TinyRange to configure and execute a virtual machine.
 type TinyRangeConfig struct {
 	// The base directory all other filenames resolve from.
@@ -110,20 +348,95 @@ type TinyRangeConfig struct {
 	InitFilesystemFilename string `json:"init_filesystem_filename" yaml:"init_filesystem_filename"`
 	// A list of RootFsFragments.
 	RootFsFragments []Fragment `json:"rootfs_fragments" yaml:"rootfs_fragments"`
-	// The size of the rootfs in megabytes.
-	StorageSize int `json:"storage_size" yaml:"storage_size"`
+	// The size of the rootfs in megabytes. Accepts suffixed sizes like "2G".
+	StorageSize SizeMB `json:"storage_size" yaml:"storage_size"`
 	// The way the user will interact with the virtual machine (options: [ssh, serial], default: ssh).
 	Interaction string `json:"interaction" yaml:"interaction"`
 	// The number of CPU cores to allocate to the virtual machine.
 	CPUCores int `json:"cpu_cores" yaml:"cpu_cores"`
-	// The amount of memory to allocate to the virtual machine.
-	MemoryMB int `json:"memory_mb" yaml:"memory_mb"`
+	// The amount of memory to allocate to the virtual machine in megabytes. Accepts suffixed sizes like "2G".
+	MemoryMB SizeMB `json:"memory_mb" yaml:"memory_mb"`
 	// Config parameters to pass to the hypervisor.
 	HypervisorConfig map[string]string `json:"hypervisor_config" yaml:"hypervisor_config"`
+	// A host file that stores guest writes to the root filesystem so they persist across runs.
+	// The built root filesystem is used read-only underneath it.
+	PersistFilename string `json:"persist_filename,omitempty" yaml:"persist_filename,omitempty"`
+	// A host directory used to cache guest downloads made through http://host.internal/proxy/.
+	// The directory can be shared between virtual machines.
+	HttpCacheDirectory string `json:"http_cache_directory,omitempty" yaml:"http_cache_directory,omitempty"`
+	// A host build directory whose cached downloads are served read-only to the guest at http://host.internal/cache/.
+	ShareCacheDirectory string `json:"share_cache_directory,omitempty" yaml:"share_cache_directory,omitempty"`
+	// Limit the hypervisor process to CPUCores and MemoryMB with a cgroup (linux only).
+	ResourceLimits bool `json:"resource_limits,omitempty" yaml:"resource_limits,omitempty"`
+	// Additional disks attached to the guest as /dev/vdb, /dev/vdc, etc in order.
+	DataDisks []DataDisk `json:"data_disks,omitempty" yaml:"data_disks,omitempty"`
+	// Extra key=value arguments appended to the guest kernel command line.
+	KernelArgs []string `json:"kernel_args,omitempty" yaml:"kernel_args,omitempty"`
+	// Extra arguments appended to the hypervisor command line.
+	HypervisorArgs []string `json:"hypervisor_args,omitempty" yaml:"hypervisor_args,omitempty"`
+	// The shell command run in the guest without a terminal when the interaction is exec.
+	ExecCommand string `json:"exec_command,omitempty" yaml:"exec_command,omitempty"`
+	// A Unix socket that lifecycle events are written to as JSON lines.
+	EventsSocket string `json:"events_socket,omitempty" yaml:"events_socket,omitempty"`
+	// A label for the virtual machine included in logs and lifecycle events.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// Start a interactive shell once the SSH session ends rather than shutting down.
+	KeepAlive bool `json:"keep_alive,omitempty" yaml:"keep_alive,omitempty"`
+	// Close forwarded SSH and port connections after no data has been sent either way for this long. Zero disables it.
+	ForwardIdleTimeout time.Duration `json:"forward_idle_timeout,omitempty" yaml:"forward_idle_timeout,omitempty"`
+	// The credentials of the guest SSH server. The defaults from SshCredentials are used if they are empty.
+	SshUsername string `json:"ssh_username,omitempty" yaml:"ssh_username,omitempty"`
+	SshPassword string `json:"ssh_password,omitempty" yaml:"ssh_password,omitempty"`
+	// A private key file the host authenticates with instead of the password.
+	SshKey string `json:"ssh_key,omitempty" yaml:"ssh_key,omitempty"`
+	// Public keys accepted by the guest SSH server in the authorized_keys format. Like Secrets it's never saved in the config.
+	SshAuthorizedKeys string `json:"-" yaml:"-"`
+	// The port the guest SSH server listens on. DefaultSshPort is used if it's zero.
+	SshPort int `json:"ssh_port,omitempty" yaml:"ssh_port,omitempty"`
+	// Restrict outbound guest traffic to these domains (and their subdomains) and CIDRs.
+	// The guest is unrestricted if both are empty.
+	AllowDomains []string `json:"allow_domains,omitempty" yaml:"allow_domains,omitempty"`
+	AllowCIDRs   []string `json:"allow_cidrs,omitempty" yaml:"allow_cidrs,omitempty"`
+	// Serve the webssh interaction over HTTPS. A self-signed certificate is generated unless WebTLSCert and WebTLSKey are set.
+	WebTLS     bool   `json:"web_tls,omitempty" yaml:"web_tls,omitempty"`
+	WebTLSCert string `json:"web_tls_cert,omitempty" yaml:"web_tls_cert,omitempty"`
+	WebTLSKey  string `json:"web_tls_key,omitempty" yaml:"web_tls_key,omitempty"`
+	// Secrets are written to /run/secrets in the guest at runtime. They are never saved in the config.
+	Secrets map[string]string `json:"-" yaml:"-"`
 	// Redirect hypervisor input to the host. The VM will exit after it completes initialization.
 	Debug bool `json:"debug" yaml:"debug"`
 }
 
+// The credentials of the guest SSH server unless they are overridden.
+const (
+	DefaultSshUsername = "root"
+	DefaultSshPassword = "insecurepassword"
+	DefaultSshPort     = 2222
+)
+
+// SshGuestPort returns the port the guest SSH server listens on.
+func (cfg TinyRangeConfig) SshGuestPort() int {
+	if cfg.SshPort == 0 {
+		return DefaultSshPort
+	}
+
+	return cfg.SshPort
+}
+
+// SshCredentials returns the username and password used to connect to the guest SSH server.
+func (cfg TinyRangeConfig) SshCredentials() (string, string) {
+	username, password := cfg.SshUsername, cfg.SshPassword
+
+	if username == "" {
+		username = DefaultSshUsername
+	}
+	if password == "" {
+		password = DefaultSshPassword
+	}
+
+	return username, password
+}
+
 func (cfg TinyRangeConfig) Resolve(filename string) string {
 	if filename == "" {
 		return ""
@@ -0,0 +1,163 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected int
+	}{
+		{"1500", 1500},
+		{"512M", 512},
+		{"512mb", 512},
+		{"2G", 2048},
+		{"1T", 1024 * 1024},
+		{"4GB", 4096},
+	} {
+		size, err := ParseSize(test.input)
+		if err != nil {
+			t.Fatalf("ParseSize(%q) failed: %s", test.input, err)
+		}
+
+		if size != test.expected {
+			t.Fatalf("ParseSize(%q) = %d, expected %d", test.input, size, test.expected)
+		}
+	}
+
+	for _, input := range []string{"", "G", "-1", "1.5G", "10K", "100B", "2GG", "1MG", "1 G", "+1G"} {
+		if _, err := ParseSize(input); err == nil {
+			t.Fatalf("ParseSize(%q) should have failed", input)
+		}
+	}
+}
+
+func TestDecodeSizes(t *testing.T) {
+	var cfg TinyRangeConfig
+
+	if err := json.Unmarshal([]byte(`{"memory_mb": "2G", "storage_size": 512}`), &cfg); err != nil {
+		t.Fatalf("failed to decode config: %s", err)
+	}
+
+	if cfg.MemoryMB != 2048 || cfg.StorageSize != 512 {
+		t.Fatalf("decoded memory_mb = %d and storage_size = %d, expected 2048 and 512", cfg.MemoryMB, cfg.StorageSize)
+	}
+
+	if err := json.Unmarshal([]byte(`{"memory_mb": "2GG"}`), &cfg); err == nil {
+		t.Fatalf("decoding memory_mb 2GG should have failed")
+	}
+}
+
+func TestParseDataDisk(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected DataDisk
+	}{
+		{"1G", DataDisk{Size: 1024}},
+		{"512:data.img", DataDisk{Size: 512, Source: "data.img"}},
+		{"0:/tmp/disk.img", DataDisk{Source: "/tmp/disk.img"}},
+	} {
+		disk, err := ParseDataDisk(test.input)
+		if err != nil {
+			t.Fatalf("ParseDataDisk(%q) failed: %s", test.input, err)
+		}
+
+		if disk != test.expected {
+			t.Fatalf("ParseDataDisk(%q) = %+v, expected %+v", test.input, disk, test.expected)
+		}
+	}
+}
+
+func TestValidateKernelArg(t *testing.T) {
+	for _, arg := range []string{"quiet", "tinyrange.mode=lab", "console=ttyS0,115200", "a-b_c.d=/dev/vdb"} {
+		if err := ValidateKernelArg(arg); err != nil {
+			t.Fatalf("ValidateKernelArg(%q) failed: %s", arg, err)
+		}
+	}
+
+	for _, arg := range []string{"", "a b", "key=a b", "key=\"x\"", "key='x'", "key=a\nb", "$(x)=1"} {
+		if err := ValidateKernelArg(arg); err == nil {
+			t.Fatalf("ValidateKernelArg(%q) should have failed", arg)
+		}
+	}
+}
+
+func TestParseSecrets(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(filename, []byte("from-file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	secrets, err := ParseSecrets([]string{"api_key=a=b"}, []string{filename, "other=" + filename})
+	if err != nil {
+		t.Fatalf("ParseSecrets failed: %s", err)
+	}
+
+	for name, expected := range map[string]string{"api_key": "a=b", "token": "from-file", "other": "from-file"} {
+		if secrets[name] != expected {
+			t.Fatalf("secret %s = %q, expected %q", name, secrets[name], expected)
+		}
+	}
+
+	for _, values := range [][]string{{"novalue"}, {"../x=1"}, {"a/b=1"}, {"a=1", "a=2"}} {
+		if _, err := ParseSecrets(values, nil); err == nil {
+			t.Fatalf("ParseSecrets(%q) should have failed", values)
+		}
+	}
+}
+
+func TestArchitectureFromString(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected CPUArchitecture
+	}{
+		{"", ArchInvalid},
+		{"x86_64", ArchX8664},
+		{"amd64", ArchX8664},
+		{"aarch64", ArchARM64},
+		{"arm64", ArchARM64},
+		{"ARM64", ArchARM64},
+		{"riscv64", ArchRISCV64},
+	} {
+		arch, err := ArchitectureFromString(test.input)
+		if err != nil {
+			t.Fatalf("ArchitectureFromString(%q) failed: %s", test.input, err)
+		}
+
+		if arch != test.expected {
+			t.Fatalf("ArchitectureFromString(%q) = %q, expected %q", test.input, arch, test.expected)
+		}
+	}
+
+	for _, input := range []string{"i386", "armv7", "riscv32", "ppc64le", "x86"} {
+		if _, err := ArchitectureFromString(input); err == nil {
+			t.Fatalf("ArchitectureFromString(%q) should have failed", input)
+		}
+	}
+}
+
+func TestIsNative(t *testing.T) {
+	native := 0
+
+	for _, arch := range SupportedArchitectures {
+		if arch.IsNative() {
+			native += 1
+		}
+	}
+
+	if native != 1 {
+		t.Fatalf("expected exactly one native architecture, got %d", native)
+	}
+
+	if !HostArchitecture.IsNative() {
+		t.Fatalf("HostArchitecture %q is not native", HostArchitecture)
+	}
+
+	if ArchInvalid.IsNative() {
+		t.Fatalf("ArchInvalid should not be native")
+	}
+}
@@ -197,6 +197,9 @@ type cpioEntry struct {
 	mtime   time.Time
 	content []byte
 	name    string
+
+	rDevMajor int64
+	rDevMinor int64
 }
 
 // Children implements entry.
@@ -226,18 +229,18 @@ func (ent *cpioEntry) Write(e entry, w *cpioWriter, namePrefix string) error {
 	}
 
 	hdr := cpioHeader{
-		Ino:      inode,
-		Mode:     makeCpioMode(e.Kind(), ent.mode),
-		Uid:      uint64(ent.uid),
-		Gid:      uint64(ent.gid),
-		NLink:    nLinks,
-		MTime:    uint64(ent.mtime.Unix()),
-		FileSize: uint64(len(ent.content)),
-		DevMajor: 10,
-		DevMinor: 1,
-		// RDevMajor: uint64(n.rDevMajor),
-		// RDevMinor: uint64(n.rDevMinor),
-		Name: namePrefix + ent.name,
+		Ino:       inode,
+		Mode:      makeCpioMode(e.Kind(), ent.mode),
+		Uid:       uint64(ent.uid),
+		Gid:       uint64(ent.gid),
+		NLink:     nLinks,
+		MTime:     uint64(ent.mtime.Unix()),
+		FileSize:  uint64(len(ent.content)),
+		DevMajor:  10,
+		DevMinor:  1,
+		RDevMajor: uint64(ent.rDevMajor),
+		RDevMinor: uint64(ent.rDevMinor),
+		Name:      namePrefix + ent.name,
 	}
 
 	err := w.writeHeader(hdr)
@@ -279,6 +282,12 @@ func (file *file) makeSymlink(linkname string) {
 	file.content = []byte(linkname)
 }
 
+func (file *file) makeDevice(kind cpioKind, major int64, minor int64) {
+	file.kind = kind
+	file.rDevMajor = major
+	file.rDevMinor = minor
+}
+
 func newFile(name string) (*file, error) {
 	if name == "" {
 		return nil, fmt.Errorf("empty name")
@@ -451,6 +460,25 @@ func (fs *Filesystem) AddFromEntry(prefix string, hdr filesystem.Entry) error {
 
 		f.makeSymlink(hdr.Linkname())
 
+		ent = f
+	case filesystem.TypeCharDevice, filesystem.TypeBlockDevice:
+		parent, name, err := fs.openPath(cleanedName, true)
+		if err != nil {
+			return err
+		}
+
+		f, err := parent.create(name)
+		if err != nil {
+			return err
+		}
+
+		var kind cpioKind = _CPIO_KIND_BLOCK_SPECIAL
+		if hdr.Typeflag() == filesystem.TypeCharDevice {
+			kind = _CPIO_KIND_CHAR_SPECIAL
+		}
+
+		f.makeDevice(kind, hdr.Devmajor(), hdr.Devminor())
+
 		ent = f
 	case filesystem.TypeDirectory:
 		parent, name, err := fs.openPath(cleanedName, true)
@@ -0,0 +1,380 @@
+package database
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Chunk boundaries are picked with a gear rolling hash so shared data (like a common base layer)
+// produces the same chunks even if it's at a different offset in each build output.
+const (
+	minChunkSize = 256 * 1024
+	maxChunkSize = 4 * 1024 * 1024
+	chunkMask    = 1<<20 - 1 // about 1MB chunks on average
+)
+
+var gearTable = func() (table [256]uint64) {
+	// splitmix64 with a fixed seed so chunk boundaries never change between versions.
+	state := uint64(0x7472616e6765)
+
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+
+	return
+}()
+
+// splitChunks calls fn with each content defined chunk of r. The slice is only valid during the call.
+func splitChunks(r io.Reader, fn func(chunk []byte) error) error {
+	reader := bufio.NewReaderSize(r, 1024*1024)
+
+	buf := make([]byte, 0, maxChunkSize)
+	var hash uint64
+
+	for {
+		b, err := reader.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		buf = append(buf, b)
+		hash = (hash << 1) + gearTable[b]
+
+		if (len(buf) >= minChunkSize && hash&chunkMask == 0) || len(buf) >= maxChunkSize {
+			if err := fn(buf); err != nil {
+				return err
+			}
+
+			buf = buf[:0]
+			hash = 0
+		}
+	}
+
+	if len(buf) > 0 {
+		return fn(buf)
+	}
+
+	return nil
+}
+
+type chunkManifest struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Chunks  []string  `json:"chunks"`
+}
+
+func (db *PackageDatabase) chunkFilename(sum string) string {
+	return filepath.Join(db.buildDir, "chunks", sum[:2], sum)
+}
+
+func (db *PackageDatabase) writeChunk(chunk []byte) (string, error) {
+	digest := sha256.Sum256(chunk)
+	sum := hex.EncodeToString(digest[:])
+
+	filename := db.chunkFilename(sum)
+
+	// Chunks are content addressed so a existing chunk never needs to be written again.
+	if _, err := os.Stat(filename); err == nil {
+		return sum, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+		return "", err
+	}
+
+	// Other processes sharing the build directory may write the same chunk so use a unique temporary file.
+	tmp, err := os.CreateTemp(filepath.Dir(filename), sum+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(chunk); err != nil {
+		tmp.Close()
+		return "", err
+	}
+
+	if err := tmp.Chmod(os.FileMode(0644)); err != nil {
+		tmp.Close()
+		return "", err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return "", err
+	}
+
+	return sum, nil
+}
+
+// storeChunked splits the build output for hash into deduplicated chunks and writes a manifest
+// next to it. The output is removed by ReleaseChunkedOutputs and restored from the chunks when it's needed again.
+func (db *PackageDatabase) storeChunked(hash string, filename string) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	manifest := chunkManifest{Size: info.Size(), ModTime: info.ModTime()}
+
+	if err := splitChunks(f, func(chunk []byte) error {
+		sum, err := db.writeChunk(chunk)
+		if err != nil {
+			return err
+		}
+
+		manifest.Chunks = append(manifest.Chunks, sum)
+
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to chunk build output: %w", err)
+	}
+
+	manifestFilename, err := db.FilenameFromHash(hash, ".chunks")
+	if err != nil {
+		return err
+	}
+
+	manifestBytes, err := json.Marshal(&manifest)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(manifestFilename, manifestBytes, os.FileMode(0644)); err != nil {
+		return err
+	}
+
+	_, err = db.lockChunked(hash, filename)
+
+	return err
+}
+
+// lockChunked takes a shared lock on the chunk manifest for hash and keeps it until
+// ReleaseChunkedOutputs so other processes using the build directory don't remove filename
+// while it's in use. It returns "" if the output isn't stored as chunks.
+func (db *PackageDatabase) lockChunked(hash string, filename string) (string, error) {
+	db.chunkedMtx.Lock()
+	defer db.chunkedMtx.Unlock()
+
+	if f, ok := db.materialized[filename]; ok {
+		return f.Name(), nil
+	}
+
+	manifestFilename, err := db.FilenameFromHash(hash, ".chunks")
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(manifestFilename)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	if err := lockShared(f); err != nil {
+		f.Close()
+		return "", fmt.Errorf("failed to lock chunk manifest: %w", err)
+	}
+
+	if db.materialized == nil {
+		db.materialized = make(map[string]*os.File)
+	}
+
+	db.materialized[filename] = f
+
+	return manifestFilename, nil
+}
+
+// ResultFilename returns the build output for hash. It's restored from the chunks if it was released.
+func (db *PackageDatabase) ResultFilename(hash string) (string, error) {
+	filename, err := db.FilenameFromHash(hash, ".bin")
+	if err != nil {
+		return "", err
+	}
+
+	if err := db.restoreChunked(hash, filename); err != nil {
+		return "", fmt.Errorf("failed to restore chunked build output: %w", err)
+	}
+
+	return filename, nil
+}
+
+// restoreChunked recreates the build output for hash from it's chunks if it was released.
+func (db *PackageDatabase) restoreChunked(hash string, filename string) error {
+	// Lock the manifest first so another process can't release the output after it's checked.
+	manifestFilename, err := db.lockChunked(hash, filename)
+	if err != nil || manifestFilename == "" {
+		return err
+	}
+
+	if _, err := os.Stat(filename); err == nil {
+		return nil
+	}
+
+	manifestBytes, err := os.ReadFile(manifestFilename)
+	if err != nil {
+		return err
+	}
+
+	var manifest chunkManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return fmt.Errorf("failed to read chunk manifest: %w", err)
+	}
+
+	// The manifest is only locked shared so another process may be restoring the same output.
+	// Each restore uses a unique temporary file so they can't overwrite each other's partial output.
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.restore.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := db.writeChunks(tmp, manifest); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Chmod(os.FileMode(0644)); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// Keep the original modification time since it's used to check if a rebuild is needed.
+	if err := os.Chtimes(tmp.Name(), manifest.ModTime, manifest.ModTime); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filename)
+}
+
+// trackChunked makes sure a cached output is stored as chunks so it can be released.
+// Outputs cached before chunking was enabled are converted the first time they're used.
+func (db *PackageDatabase) trackChunked(hash string, filename string) error {
+	manifestFilename, err := db.FilenameFromHash(hash, ".chunks")
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(manifestFilename); errors.Is(err, os.ErrNotExist) {
+		return db.storeChunked(hash, filename)
+	} else if err != nil {
+		return err
+	}
+
+	_, err = db.lockChunked(hash, filename)
+
+	return err
+}
+
+func (db *PackageDatabase) writeChunks(out io.Writer, manifest chunkManifest) error {
+	var total int64
+
+	for _, sum := range manifest.Chunks {
+		chunk, err := os.ReadFile(db.chunkFilename(sum))
+		if err != nil {
+			return fmt.Errorf("failed to read chunk: %w", err)
+		}
+
+		if digest := sha256.Sum256(chunk); hex.EncodeToString(digest[:]) != sum {
+			return fmt.Errorf("chunk %s is corrupt", sum)
+		}
+
+		n, err := out.Write(chunk)
+		if err != nil {
+			return err
+		}
+
+		total += int64(n)
+	}
+
+	if total != manifest.Size {
+		return fmt.Errorf("restored %d bytes but expected %d", total, manifest.Size)
+	}
+
+	return nil
+}
+
+// ReleaseChunkedOutputs removes build outputs written or restored by this database which are
+// stored as chunks. They are restored from the chunks the next time they're needed. Outputs
+// another process is still using are kept.
+// It must only be called once nothing in this process is using the outputs.
+func (db *PackageDatabase) ReleaseChunkedOutputs() error {
+	db.chunkedMtx.Lock()
+	defer db.chunkedMtx.Unlock()
+
+	var errs []error
+
+	for filename, manifest := range db.materialized {
+		manifestFilename := manifest.Name()
+
+		manifest.Close()
+
+		// Without chunking restored outputs are kept as normal files.
+		if !db.ChunkedCache {
+			continue
+		}
+
+		if err := releaseChunked(manifestFilename, filename); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	db.materialized = nil
+
+	return errors.Join(errs...)
+}
+
+// releaseChunked removes filename unless another process holds a lock on its manifest.
+func releaseChunked(manifestFilename string, filename string) error {
+	manifest, err := os.Open(manifestFilename)
+	if errors.Is(err, os.ErrNotExist) {
+		// The output is no longer stored as chunks so it can't be restored.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer manifest.Close()
+
+	ok, err := tryLockExclusive(manifest)
+	if err != nil {
+		return err
+	} else if !ok {
+		slog.Debug("keeping chunked build output in use by another process", "filename", filename)
+		return nil
+	}
+
+	if err := os.Remove(filename); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,261 @@
+package database
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tinyrange/tinyrange/pkg/builder"
+	"github.com/tinyrange/tinyrange/pkg/common"
+)
+
+func writeTestOutput(t *testing.T, db *PackageDatabase, hash string, contents []byte) string {
+	t.Helper()
+
+	filename, err := db.FilenameFromHash(hash, ".bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filename, contents, os.FileMode(0644)); err != nil {
+		t.Fatal(err)
+	}
+
+	modTime := time.Unix(1700000000, 0)
+	if err := os.Chtimes(filename, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	return filename
+}
+
+func TestSplitChunksSharesOffsetData(t *testing.T) {
+	shared := make([]byte, 8*1024*1024)
+	rand.New(rand.NewSource(1)).Read(shared)
+
+	chunks := func(data []byte) map[string]bool {
+		ret := make(map[string]bool)
+
+		if err := splitChunks(bytes.NewReader(data), func(chunk []byte) error {
+			if len(chunk) > maxChunkSize {
+				t.Fatalf("chunk is %d bytes, larger than the maximum", len(chunk))
+			}
+
+			ret[string(chunk)] = true
+
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		return ret
+	}
+
+	first := chunks(shared)
+	second := chunks(append([]byte("a different header"), shared...))
+
+	common := 0
+	for chunk := range second {
+		if first[chunk] {
+			common++
+		}
+	}
+
+	// Only the chunk containing the header should differ.
+	if common < len(first)-1 {
+		t.Fatalf("only %d of %d chunks are shared after shifting the data", common, len(first))
+	}
+}
+
+func TestChunkedOutputRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+
+	db := New(dir)
+	db.ChunkedCache = true
+
+	contents := make([]byte, 3*1024*1024+17)
+	rand.New(rand.NewSource(2)).Read(contents)
+
+	filename := writeTestOutput(t, db, "output", contents)
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.storeChunked("output", filename); err != nil {
+		t.Fatalf("failed to store chunks: %s", err)
+	}
+
+	if err := db.ReleaseChunkedOutputs(); err != nil {
+		t.Fatalf("failed to release outputs: %s", err)
+	}
+
+	if _, err := os.Stat(filename); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("output still exists after release: %v", err)
+	}
+
+	restored, err := db.ResultFilename("output")
+	if err != nil {
+		t.Fatalf("failed to restore output: %s", err)
+	}
+
+	got, err := os.ReadFile(restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, contents) {
+		t.Fatalf("restored output differs from the original")
+	}
+
+	restoredInfo, err := os.Stat(restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !restoredInfo.ModTime().Equal(info.ModTime()) {
+		t.Fatalf("restored modification time = %s, want %s", restoredInfo.ModTime(), info.ModTime())
+	}
+
+	if err := db.ReleaseChunkedOutputs(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReleaseChunkedKeepsOutputsInUse(t *testing.T) {
+	dir := t.TempDir()
+
+	// Each database opens its own lock on the manifest like separate processes would.
+	db := New(dir)
+	db.ChunkedCache = true
+
+	other := New(dir)
+	other.ChunkedCache = true
+
+	filename := writeTestOutput(t, db, "output", []byte("hello world"))
+
+	if err := db.storeChunked("output", filename); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := other.ResultFilename("output"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.ReleaseChunkedOutputs(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filename); err != nil {
+		t.Fatalf("output in use by another database was removed: %s", err)
+	}
+
+	if err := other.ReleaseChunkedOutputs(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filename); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("output still exists once nothing uses it: %v", err)
+	}
+}
+
+func TestRestoreChunkedRejectsCorruptChunks(t *testing.T) {
+	db := New(t.TempDir())
+	db.ChunkedCache = true
+
+	filename := writeTestOutput(t, db, "output", []byte("hello world"))
+
+	if err := db.storeChunked("output", filename); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.ReleaseChunkedOutputs(); err != nil {
+		t.Fatal(err)
+	}
+
+	sum, err := db.writeChunk([]byte("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(db.chunkFilename(sum), []byte("jello world"), os.FileMode(0644)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.ResultFilename("output"); err == nil {
+		t.Fatalf("restored a output from a corrupt chunk")
+	}
+
+	if _, err := os.Stat(filename); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("a corrupt output was restored: %v", err)
+	}
+}
+
+func TestChunkedCacheKeepsDependentsCached(t *testing.T) {
+	dir := t.TempDir()
+
+	var compressed bytes.Buffer
+
+	w := gzip.NewWriter(&compressed)
+	if _, err := w.Write([]byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fetch := builder.NewFetchHttpBuildDefinition("http://example.invalid/hello.gz", 0, nil)
+	decompress := builder.NewDecompressFileBuildDefinition(fetch, ".gz")
+
+	// Each build uses a new database like separate runs of tinyrange would.
+	build := func() *common.BuildStatus {
+		t.Helper()
+
+		db := New(dir)
+		db.ChunkedCache = true
+
+		fetchHash, err := db.HashDefinition(fetch)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		manifestFilename, err := db.FilenameFromHash(fetchHash, ".chunks")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The download is already cached so the test doesn't need the network.
+		if _, err := os.Stat(manifestFilename); errors.Is(err, os.ErrNotExist) {
+			writeTestOutput(t, db, fetchHash, compressed.Bytes())
+		}
+
+		if _, err := db.Build(db.NewBuildContext(nil), decompress, common.BuildOptions{}); err != nil {
+			t.Fatalf("failed to build: %s", err)
+		}
+
+		status, err := db.GetBuildStatus(decompress)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.ReleaseChunkedOutputs(); err != nil {
+			t.Fatal(err)
+		}
+
+		return status
+	}
+
+	if status := build(); status.Status != common.BuildStatusBuilt {
+		t.Fatalf("first build status = %v, want built", status.Status)
+	}
+
+	// Both outputs have been released so checking the dependency has to restore it.
+	if status := build(); status.Status != common.BuildStatusCached {
+		t.Fatalf("second build status = %v, want cached", status.Status)
+	}
+}
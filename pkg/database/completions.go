@@ -0,0 +1,109 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/tinyrange/tinyrange/pkg/config"
+)
+
+// PackageNames returns the sorted list of package names (including aliases) in the builder.
+func (builder *ContainerBuilder) PackageNames() []string {
+	var names []string
+
+	for name := range builder.Packages.Packages {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	return names
+}
+
+// completionsCacheFilename returns the cache filename for a builders package names.
+// The cache is keyed on the hashes of the package sources.
+func (db *PackageDatabase) completionsCacheFilename(builder *ContainerBuilder) (string, []string, error) {
+	h := sha256.New()
+
+	var sourceFilenames []string
+
+	for _, source := range builder.Packages.Sources {
+		hash, err := db.HashDefinition(source)
+		if err != nil {
+			return "", nil, err
+		}
+
+		h.Write([]byte(hash))
+
+		filename, err := db.ResultFilename(hash)
+		if err != nil {
+			return "", nil, err
+		}
+
+		sourceFilenames = append(sourceFilenames, filename)
+	}
+
+	filename, err := db.FilenameFromHash(hex.EncodeToString(h.Sum(nil)), ".names")
+	if err != nil {
+		return "", nil, err
+	}
+
+	return filename, sourceFilenames, nil
+}
+
+// GetPackageNames returns the names of every package a builder can install.
+// The names are cached in the build directory so repeated calls (like shell completion)
+// don't need to load the package index. The cache is refreshed if any of the
+// package sources have been rebuilt.
+func (db *PackageDatabase) GetPackageNames(name string, arch config.CPUArchitecture) ([]string, error) {
+	if arch == config.ArchInvalid {
+		arch = config.HostArchitecture
+	}
+
+	builder, ok := db.ContainerBuilders[fmt.Sprintf("%s-%s", name, arch)]
+	if !ok {
+		return nil, fmt.Errorf("builder %s not found for arch %s", name, arch)
+	}
+
+	cacheFilename, sourceFilenames, err := db.completionsCacheFilename(builder)
+	if err != nil {
+		return nil, err
+	}
+
+	if info, err := os.Stat(cacheFilename); err == nil && !db.RebuildUserDefinitions {
+		fresh := true
+
+		for _, source := range sourceFilenames {
+			sourceInfo, err := os.Stat(source)
+			if err != nil || sourceInfo.ModTime().After(info.ModTime()) {
+				fresh = false
+				break
+			}
+		}
+
+		if fresh {
+			contents, err := os.ReadFile(cacheFilename)
+			if err != nil {
+				return nil, err
+			}
+
+			return strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n"), nil
+		}
+	}
+
+	if _, err := db.GetContainerBuilder(db.NewBuildContext(nil), name, arch); err != nil {
+		return nil, err
+	}
+
+	names := builder.PackageNames()
+
+	if err := os.WriteFile(cacheFilename, []byte(strings.Join(names, "\n")+"\n"), os.FileMode(0644)); err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
@@ -0,0 +1,126 @@
+package database
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/config"
+	"github.com/tinyrange/tinyrange/pkg/filesystem"
+)
+
+// A file installed by a package.
+type PackageFile struct {
+	Filename string // The absolute path of the file in the guest.
+	Entry    filesystem.Entry
+}
+
+// PackageContents returns the files installed by the first package matching query.
+// Only the archives from the package installer are read. Dependencies aren't included and
+// the files aren't merged into a root filesystem so every entry is reported as packaged.
+func (db *PackageDatabase) PackageContents(
+	name string,
+	arch config.CPUArchitecture,
+	query common.PackageQuery,
+	tags common.TagList,
+) (*common.Package, []PackageFile, error) {
+	if arch == config.ArchInvalid {
+		arch = config.HostArchitecture
+	}
+
+	ctx := db.NewBuildContext(nil)
+
+	if _, err := db.GetContainerBuilder(ctx, name, arch); err != nil {
+		return nil, nil, err
+	}
+
+	builder := db.ContainerBuilders[fmt.Sprintf("%s-%s", name, arch)]
+
+	results, err := builder.Packages.Query(query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(results) == 0 {
+		return nil, nil, fmt.Errorf("could not find package for query: %s", query)
+	}
+
+	pkg := results[0]
+
+	installer, err := builder.Packages.InstallerFor(ctx, pkg, tags)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get installer for %s: %w", pkg.Name, err)
+	}
+
+	var ret []PackageFile
+
+	for _, directive := range installer.Directives {
+		frags, err := directive.AsFragments(ctx, common.SpecialDirectiveHandlers{})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, frag := range frags {
+			if frag.Archive == nil {
+				continue
+			}
+
+			ark, err := filesystem.ReadArchiveFromFile(filesystem.NewLocalFile(frag.Archive.HostFilename, nil))
+			if err != nil {
+				return nil, nil, err
+			}
+
+			ents, err := ark.Entries()
+			if err != nil {
+				return nil, nil, err
+			}
+
+			for _, ent := range ents {
+				ret = append(ret, PackageFile{
+					Filename: path.Join("/", frag.Archive.Target, ent.Name()),
+					Entry:    ent,
+				})
+			}
+		}
+	}
+
+	slices.SortStableFunc(ret, func(a, b PackageFile) int {
+		return strings.Compare(a.Filename, b.Filename)
+	})
+
+	return pkg, ret, nil
+}
+
+// OpenResultFile opens a file inside the archive built for the definition with the given hash.
+func (db *PackageDatabase) OpenResultFile(hash string, filename string) (filesystem.FileHandle, error) {
+	if !validHash.MatchString(hash) || len(hash) != 64 {
+		return nil, fmt.Errorf("invalid hash: %q", hash)
+	}
+
+	resultFilename, err := db.ResultFilename(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if exists, _ := common.Exists(resultFilename); !exists {
+		return nil, fmt.Errorf("build result %s does not exist", hash)
+	}
+
+	ark, err := filesystem.ReadArchiveFromFile(filesystem.NewLocalFile(resultFilename, nil))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s as an archive: %w", hash, err)
+	}
+
+	ent, err := filesystem.LookupArchiveEntry(ark, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if ent.Typeflag() == filesystem.TypeDirectory {
+		return nil, fmt.Errorf("%s: is a directory", filename)
+	}
+
+	return ent.Open()
+}
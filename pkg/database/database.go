@@ -2,6 +2,10 @@ package database
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -25,6 +29,7 @@ import (
 	"github.com/tinyrange/tinyrange/pkg/hash"
 	initExec "github.com/tinyrange/tinyrange/pkg/init"
 	"github.com/tinyrange/tinyrange/pkg/macro"
+	"github.com/tinyrange/tinyrange/pkg/metrics"
 	"github.com/tinyrange/tinyrange/stdlib"
 	"go.starlark.net/starlark"
 	"go.starlark.net/syntax"
@@ -216,13 +221,38 @@ type PackageDatabase struct {
 
 	RebuildUserDefinitions bool
 
+	// Only use cached build results and never access the network.
+	Offline bool
+
+	// Store build outputs as deduplicated chunks. See ReleaseChunkedOutputs.
+	ChunkedCache bool
+
+	// Fail the build if a artifact from the distribution server isn't correctly signed rather than building it locally.
+	RequireSignatures bool
+
+	// Refuse to use a builder if any of its package indexes were fetched longer ago than this. Zero disables the check.
+	MaxIndexAge time.Duration
+
+	// The maximum number of connections HttpClient opens to each host, which are all kept open
+	// while idle. Zero uses DEFAULT_MAX_CONNS_PER_HOST.
+	MaxConnsPerHost int
+
 	mirrors map[string][]string
 
+	// Directories of local packages by kind (for example alpine).
+	localRepos map[string][]string
+
 	memoryCache map[string][]byte
 	buildCache  map[string]filesystem.File
 
 	buildStatusMtx sync.Mutex
-	buildStatuses  map[common.BuildDefinition]*common.BuildStatus
+	buildStatuses  map[string]*common.BuildStatus
+
+	chunkedMtx   sync.Mutex
+	materialized map[string]*os.File // Outputs in use mapped to their locked chunk manifest.
+
+	partialMtx     sync.Mutex
+	partialOutputs map[context.Context][]string // Temporary outputs of unfinished builds by cancellable context.
 
 	loadedFiles map[string]bool
 	defs        map[string]starlark.Value
@@ -233,6 +263,14 @@ type PackageDatabase struct {
 
 	buildDir           string
 	distributionServer string
+	distributionKey    ed25519.PublicKey
+
+	// Extra root certificates trusted by HttpClient or nil for the system roots. See SetCABundle.
+	rootCAs *x509.CertPool
+
+	// The client shared by every download so connections are reused. Created by HttpClient.
+	clientMtx sync.Mutex
+	client    *http.Client
 }
 
 // HashDefinition implements common.PackageDatabase.
@@ -240,6 +278,11 @@ func (db *PackageDatabase) HashDefinition(def common.BuildDefinition) (string, e
 	return db.defDb.HashDefinition(def)
 }
 
+// IsOffline implements common.PackageDatabase.
+func (db *PackageDatabase) IsOffline() bool {
+	return db.Offline
+}
+
 // ShouldRebuildUserDefinitions implements common.PackageDatabase.
 func (db *PackageDatabase) ShouldRebuildUserDefinitions() bool {
 	return db.RebuildUserDefinitions
@@ -318,8 +361,26 @@ func (db *PackageDatabase) getFileOptions() *syntax.FileOptions {
 	}
 }
 
+type offlineTransport struct{}
+
+// RoundTrip implements http.RoundTripper.
+func (offlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("%s %s: %w", req.Method, req.URL, common.ErrOffline)
+}
+
 func (db *PackageDatabase) HttpClient() (*http.Client, error) {
-	return &http.Client{}, nil
+	if db.Offline {
+		return &http.Client{Transport: offlineTransport{}}, nil
+	}
+
+	db.clientMtx.Lock()
+	defer db.clientMtx.Unlock()
+
+	if db.client == nil {
+		db.client = &http.Client{Transport: db.newTransport()}
+	}
+
+	return db.client, nil
 }
 
 func (db *PackageDatabase) UrlsFor(urlStr string) ([]string, error) {
@@ -354,6 +415,34 @@ func (db *PackageDatabase) AddMirror(name string, options []string) error {
 	return nil
 }
 
+// The kinds of local repositories the builtin builders support.
+var localRepoKinds = []string{"alpine"}
+
+// AddLocalRepo adds a directory of local packages that the builders for kind
+// include in their package collections. It must be called before the builders are loaded.
+func (db *PackageDatabase) AddLocalRepo(kind string, dir string) error {
+	if !slices.Contains(localRepoKinds, kind) {
+		return fmt.Errorf("unsupported local repo kind: %s (supported: %s)", kind, strings.Join(localRepoKinds, ", "))
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read local repo: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("local repo %s is not a directory", dir)
+	}
+
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	db.localRepos[kind] = append(db.localRepos[kind], dir)
+
+	return nil
+}
+
 func (db *PackageDatabase) AddContainerBuilder(builder *ContainerBuilder) error {
 	db.ContainerBuilders[fmt.Sprintf("%s-%s", builder.Name, builder.Architecture)] = builder
 
@@ -433,38 +522,56 @@ func (db *PackageDatabase) RunScript(filename string, files map[string]filesyste
 	return nil
 }
 
+// The maximum number of container builders loaded at the same time by LoadAll.
+var loadAllConcurrency = min(runtime.NumCPU(), 8)
+
 func (db *PackageDatabase) LoadAll(parallel bool) error {
 	ctx := db.NewBuildContext(nil)
 
 	if parallel {
-		var wg sync.WaitGroup
-		done := make(chan bool)
-		errors := make(chan error)
+		var (
+			wg   sync.WaitGroup
+			mtx  sync.Mutex
+			errs []error
+		)
 
-		for _, builder := range db.ContainerBuilders {
+		names := make(chan string)
+
+		for i := 0; i < loadAllConcurrency; i++ {
 			wg.Add(1)
 
-			go func(builder *ContainerBuilder) {
+			go func() {
 				defer wg.Done()
 
-				if err := builder.Load(ctx); err != nil {
-					errors <- err
+				for name := range names {
+					if err := db.ContainerBuilders[name].Load(ctx); err != nil {
+						mtx.Lock()
+						errs = append(errs, fmt.Errorf("failed to load builder %s: %w", name, err))
+						mtx.Unlock()
+					}
 				}
-			}(builder)
+			}()
 		}
 
-		go func() {
-			wg.Wait()
-
-			done <- true
-		}()
+		// Load builders in a stable order so the aggregated errors are reproducible.
+		var sorted []string
+		for name := range db.ContainerBuilders {
+			sorted = append(sorted, name)
+		}
+		slices.Sort(sorted)
 
-		select {
-		case err := <-errors:
-			return err
-		case <-done:
-			return nil
+		for _, name := range sorted {
+			names <- name
 		}
+		close(names)
+
+		wg.Wait()
+
+		slices.SortFunc(errs, func(a, b error) int {
+			return strings.Compare(a.Error(), b.Error())
+		})
+
+		return errors.Join(errs...)
 	} else {
 		for _, builder := range db.ContainerBuilders {
 			if err := builder.Load(ctx); err != nil {
@@ -480,17 +587,85 @@ func (db *PackageDatabase) NewBuildContext(source common.BuildSource) common.Bui
 	return builder.NewBuildContext(source, db)
 }
 
-func (db *PackageDatabase) updateBuildStatus(def common.BuildDefinition, status *common.BuildStatus) {
+// NewBuildContextWithContext returns a build context which stops building once ctx is cancelled.
+func (db *PackageDatabase) NewBuildContextWithContext(ctx context.Context, source common.BuildSource) common.BuildContext {
+	return builder.NewBuildContextWithContext(ctx, source, db)
+}
+
+func (db *PackageDatabase) updateBuildStatus(hash string, status *common.BuildStatus) {
 	db.buildStatusMtx.Lock()
 	defer db.buildStatusMtx.Unlock()
 
-	db.buildStatuses[def] = status
+	db.buildStatuses[hash] = status
+
+	switch status.Status {
+	case common.BuildStatusCached:
+		metrics.BuildCacheHits.Inc()
+	case common.BuildStatusBuilt:
+		metrics.BuildCacheMisses.Inc()
+	}
+}
+
+// BuildDir returns the directory build results are stored in.
+func (db *PackageDatabase) BuildDir() string {
+	return db.buildDir
 }
 
 func (db *PackageDatabase) FilenameFromHash(hash string, suffix string) (string, error) {
 	return filepath.Join(db.buildDir, hash+suffix), nil
 }
 
+// trackPartialOutput records a temporary output created by a build running under ctx.
+// Contexts that can't be cancelled aren't tracked.
+func (db *PackageDatabase) trackPartialOutput(ctx context.Context, filename string) {
+	if ctx.Done() == nil {
+		return
+	}
+
+	db.partialMtx.Lock()
+	defer db.partialMtx.Unlock()
+
+	db.partialOutputs[ctx] = append(db.partialOutputs[ctx], filename)
+}
+
+// untrackPartialOutput forgets a temporary output once its build has finished.
+func (db *PackageDatabase) untrackPartialOutput(ctx context.Context, filename string) {
+	db.partialMtx.Lock()
+	defer db.partialMtx.Unlock()
+
+	filenames := db.partialOutputs[ctx]
+
+	for i, name := range filenames {
+		if name == filename {
+			filenames = append(filenames[:i], filenames[i+1:]...)
+			break
+		}
+	}
+
+	if len(filenames) == 0 {
+		delete(db.partialOutputs, ctx)
+	} else {
+		db.partialOutputs[ctx] = filenames
+	}
+}
+
+// RemovePartialOutputs removes the temporary outputs of builds started under ctx which didn't finish.
+// It's used to clean up after a cancelled build without touching the outputs of other builds.
+func (db *PackageDatabase) RemovePartialOutputs(ctx context.Context) error {
+	db.partialMtx.Lock()
+	filenames := db.partialOutputs[ctx]
+	delete(db.partialOutputs, ctx)
+	db.partialMtx.Unlock()
+
+	for _, filename := range filenames {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (db *PackageDatabase) downloadFromDistributionServer(hash string, def common.BuildDefinition) (bool, error) {
 	if redistributable, ok := def.(common.RedistributableDefinition); !ok || !redistributable.Redistributable() {
 		return false, nil // not redistributable
@@ -530,7 +705,9 @@ func (db *PackageDatabase) downloadFromDistributionServer(hash string, def commo
 	pb := progressbar.DefaultBytes(resp.ContentLength, url)
 	defer pb.Close()
 
-	if _, err := io.Copy(io.MultiWriter(f, pb), resp.Body); err != nil {
+	h := sha256.New()
+
+	if _, err := io.Copy(io.MultiWriter(f, pb, h), metrics.DownloadedBytes.Reader(resp.Body)); err != nil {
 		f.Close()
 		os.Remove(tmpFilename)
 		return false, err
@@ -540,6 +717,22 @@ func (db *PackageDatabase) downloadFromDistributionServer(hash string, def commo
 		return false, err
 	}
 
+	// Only accept the artifact if it's signed by the configured key.
+	// Otherwise it's discarded and built locally unless signatures are required.
+	if db.distributionKey != nil {
+		if err := db.verifyDigest(client, hash, h.Sum(nil)); err != nil {
+			os.Remove(tmpFilename)
+
+			if db.RequireSignatures {
+				return false, err
+			}
+
+			slog.Warn("discarding untrusted artifact from distribution server", "hash", hash, "error", err)
+
+			return false, nil
+		}
+	}
+
 	if err := os.Rename(tmpFilename, filename); err != nil {
 		return false, err
 	}
@@ -585,6 +778,11 @@ func (db *PackageDatabase) Build(ctx common.BuildContext, def common.BuildDefini
 	// Get a child context for the build.
 	child := ctx.ChildContext(def, status, tmpFilename)
 
+	// Outputs stored as chunks are restored so they can be used like any other file.
+	if err := db.restoreChunked(hash, filename); err != nil {
+		return nil, fmt.Errorf("failed to restore chunked build output: %w", err)
+	}
+
 	if !opts.AlwaysRebuild {
 		// Check if the file already exists. If it does then return it.
 		if info, err := os.Stat(filename); err == nil {
@@ -609,10 +807,16 @@ func (db *PackageDatabase) Build(ctx common.BuildContext, def common.BuildDefini
 				status.Status = common.BuildStatusCached
 
 				// Write the build status.
-				db.updateBuildStatus(def, status)
+				db.updateBuildStatus(hash, status)
 
 				slog.Debug("cached", "Tag", def.Tag(), "filename", filename)
 
+				if db.ChunkedCache {
+					if err := db.trackChunked(hash, filename); err != nil {
+						return nil, err
+					}
+				}
+
 				return filesystem.NewLocalFile(filename, def), nil
 			}
 
@@ -640,7 +844,9 @@ func (db *PackageDatabase) Build(ctx common.BuildContext, def common.BuildDefini
 		return nil, fmt.Errorf("failed to write definition: %s", err)
 	}
 
-	if db.distributionServer != "" {
+	start := time.Now()
+
+	if db.distributionServer != "" && !db.Offline {
 		// If we have a distribution server then check it first.
 		ok, err := db.downloadFromDistributionServer(hash, def)
 		if err != nil {
@@ -650,7 +856,9 @@ func (db *PackageDatabase) Build(ctx common.BuildContext, def common.BuildDefini
 		if ok {
 			status.Status = common.BuildStatusBuilt
 
-			db.updateBuildStatus(def, status)
+			db.updateBuildStatus(hash, status)
+
+			metrics.BuildDuration.Observe(time.Since(start))
 
 			// This definition is redistributable so write a manifest.
 			redistributableTag, err := db.FilenameFromHash(hash, ".redistributable")
@@ -662,6 +870,12 @@ func (db *PackageDatabase) Build(ctx common.BuildContext, def common.BuildDefini
 				return nil, err
 			}
 
+			if db.ChunkedCache {
+				if err := db.storeChunked(hash, filename); err != nil {
+					return nil, err
+				}
+			}
+
 			f := filesystem.NewLocalFile(filename, def)
 
 			db.buildCache[hash] = f
@@ -673,18 +887,41 @@ func (db *PackageDatabase) Build(ctx common.BuildContext, def common.BuildDefini
 
 	// If the downloaded tag exists then remove it.
 
+	// Don't start new builds once the build has been cancelled.
+	if err := child.Context().Err(); err != nil {
+		return nil, err
+	}
+
+	// Remember the temporary output so it can be removed if the build is cancelled.
+	db.trackPartialOutput(child.Context(), tmpFilename)
+
+	// The temporary output only needs tracking while this build is running, whether it succeeds or fails.
+	defer db.untrackPartialOutput(child.Context(), tmpFilename)
+
 	// If not then trigger the build.
 	result, err := def.Build(child)
 	if err != nil {
+		metrics.BuildFailures.Inc()
+
+		// Partial outputs of cancelled builds are not kept around.
+		if child.Context().Err() != nil {
+			os.Remove(tmpFilename)
+		}
+
 		return nil, err
 	}
 
+	// Results holding resources like a running virtual machine release them even if they aren't written.
+	if closer, ok := result.(io.Closer); ok {
+		defer closer.Close()
+	}
+
 	// If the result is nil then the builder is telling us to use the cached version.
 	if result == nil {
 		status.Status = common.BuildStatusCached
 
 		// Write the build status.
-		db.updateBuildStatus(def, status)
+		db.updateBuildStatus(hash, status)
 
 		return filesystem.NewLocalFile(filename, def), nil
 	}
@@ -722,10 +959,18 @@ func (db *PackageDatabase) Build(ctx common.BuildContext, def common.BuildDefini
 		return nil, err
 	}
 
+	if db.ChunkedCache {
+		if err := db.storeChunked(hash, filename); err != nil {
+			return nil, err
+		}
+	}
+
 	status.Status = common.BuildStatusBuilt
 
 	// Write the build status.
-	db.updateBuildStatus(def, status)
+	db.updateBuildStatus(hash, status)
+
+	metrics.BuildDuration.Observe(time.Since(start))
 
 	if redistributable, ok := def.(common.RedistributableDefinition); ok && redistributable.Redistributable() {
 		// This definition is redistributable so write a manifest.
@@ -749,7 +994,21 @@ func (db *PackageDatabase) Build(ctx common.BuildContext, def common.BuildDefini
 }
 
 func (db *PackageDatabase) GetBuildStatus(def common.BuildDefinition) (*common.BuildStatus, error) {
-	status, ok := db.buildStatuses[def]
+	hash, err := db.HashDefinition(def)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.GetBuildStatusByHash(hash)
+}
+
+// GetBuildStatusByHash returns the status of the last build of the definition with the given hash.
+// It's safe to call while builds are running on other goroutines.
+func (db *PackageDatabase) GetBuildStatusByHash(hash string) (*common.BuildStatus, error) {
+	db.buildStatusMtx.Lock()
+	defer db.buildStatusMtx.Unlock()
+
+	status, ok := db.buildStatuses[hash]
 	if !ok {
 		return nil, fmt.Errorf("build status not found")
 	}
@@ -784,6 +1043,13 @@ func (db *PackageDatabase) GetContainerBuilder(ctx common.BuildContext, name str
 	}
 
 	if !builder.Loaded() {
+		// Stale indexes are fetched again before they're read.
+		if db.MaxIndexAge > 0 {
+			if err := db.refreshIndexes(ctx, builder); err != nil {
+				return nil, err
+			}
+		}
+
 		start := time.Now()
 		if err := builder.Load(ctx); err != nil {
 			return nil, err
@@ -949,7 +1215,7 @@ func (db *PackageDatabase) Inspect(def common.BuildDefinition, out io.Writer) er
 		return err
 	}
 
-	filename, err := db.FilenameFromHash(hash, ".bin")
+	filename, err := db.ResultFilename(hash)
 	if err != nil {
 		return err
 	}
@@ -983,6 +1249,8 @@ func (db *PackageDatabase) Inspect(def common.BuildDefinition, out io.Writer) er
 			fmt.Fprintf(out, "R %04d:%04d % 10d %s %s\n", ent.Uid(), ent.Gid(), ent.Size(), ent.ModTime(), ent.Name())
 		case filesystem.TypeSymlink:
 			fmt.Fprintf(out, "S %04d:%04d % 10d %s %s -> %s\n", ent.Uid(), ent.Gid(), ent.Size(), ent.Name(), ent.ModTime(), ent.Linkname())
+		case filesystem.TypeCharDevice, filesystem.TypeBlockDevice:
+			fmt.Fprintf(out, "%s %04d:%04d % 10d %s %s %d,%d\n", ent.Typeflag().String()[:1], ent.Uid(), ent.Gid(), ent.Size(), ent.ModTime(), ent.Name(), ent.Devmajor(), ent.Devminor())
 		}
 	}
 
@@ -990,6 +1258,11 @@ func (db *PackageDatabase) Inspect(def common.BuildDefinition, out io.Writer) er
 }
 
 func (db *PackageDatabase) LoadBuiltinBuilders() error {
+	var (
+		loaded int
+		errs   []error
+	)
+
 	for _, builder := range []string{
 		"//fetchers/alpine.star",
 		"//fetchers/rpm.star",
@@ -997,14 +1270,28 @@ func (db *PackageDatabase) LoadBuiltinBuilders() error {
 		"//fetchers/arch.star",
 	} {
 		if err := db.LoadFile(builder); err != nil {
-			return err
+			// Keep going so a single broken fetcher doesn't stop the other builders from loading.
+			slog.Warn("failed to load builtin builder", "filename", builder, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", builder, err))
+			continue
 		}
+
+		loaded++
+	}
+
+	if loaded == 0 {
+		return fmt.Errorf("failed to load any builtin builders: %w", errors.Join(errs...))
 	}
 
 	return nil
 }
 
 func (db *PackageDatabase) SetDistributionServer(server string) error {
+	if db.Offline {
+		slog.Warn("ignoring distribution server in offline mode", "server", server)
+		return nil
+	}
+
 	client, err := db.HttpClient()
 	if err != nil {
 		return err
@@ -1058,6 +1345,30 @@ func (db *PackageDatabase) Attr(name string) (starlark.Value, error) {
 
 			return starlark.None, db.AddMirror(name, mirrors)
 		}), nil
+	} else if name == "local_repos" {
+		return starlark.NewBuiltin("Database.local_repos", func(
+			thread *starlark.Thread,
+			fn *starlark.Builtin,
+			args starlark.Tuple,
+			kwargs []starlark.Tuple,
+		) (starlark.Value, error) {
+			var (
+				kind string
+			)
+
+			if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
+				"kind", &kind,
+			); err != nil {
+				return starlark.None, err
+			}
+
+			var ret []starlark.Value
+			for _, dir := range db.localRepos[kind] {
+				ret = append(ret, starlark.String(dir))
+			}
+
+			return starlark.NewList(ret), nil
+		}), nil
 	} else if name == "add_container_builder" {
 		return starlark.NewBuiltin("Database.add_container_builder", func(
 			thread *starlark.Thread,
@@ -1253,9 +1564,11 @@ func New(buildDir string) *PackageDatabase {
 	db := &PackageDatabase{
 		ContainerBuilders: make(map[string]*ContainerBuilder),
 		mirrors:           make(map[string][]string),
+		localRepos:        make(map[string][]string),
 		memoryCache:       make(map[string][]byte),
 		buildCache:        make(map[string]filesystem.File),
-		buildStatuses:     make(map[common.BuildDefinition]*common.BuildStatus),
+		buildStatuses:     make(map[string]*common.BuildStatus),
+		partialOutputs:    make(map[context.Context][]string),
 		buildDir:          buildDir,
 		defs:              make(map[string]starlark.Value),
 		loadedFiles:       make(map[string]bool),
@@ -1,11 +1,13 @@
 package database
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"regexp"
+	"strings"
 
 	"github.com/tinyrange/tinyrange/pkg/common"
 )
@@ -29,8 +31,9 @@ func handler(f func(http.ResponseWriter, *http.Request) error) http.HandlerFunc
 var validHash = regexp.MustCompile("[0-9a-f]{64}")
 
 type distributionServer struct {
-	db  *PackageDatabase
-	mux *http.ServeMux
+	db         *PackageDatabase
+	mux        *http.ServeMux
+	signingKey ed25519.PrivateKey
 }
 
 func (svr *distributionServer) validateHash(hash string) (string, error) {
@@ -53,6 +56,8 @@ func (svr *distributionServer) handleHealthCheck(w http.ResponseWriter, r *http.
 func (svr *distributionServer) handleGetResult(w http.ResponseWriter, r *http.Request) error {
 	hash := r.PathValue("hash")
 
+	hash, isSignature := strings.CutSuffix(hash, ".sig")
+
 	// First validate the hash. This will return only the hash and exclude any data after it.
 	validated, err := svr.validateHash(hash)
 	if err != nil {
@@ -71,8 +76,28 @@ func (svr *distributionServer) handleGetResult(w http.ResponseWriter, r *http.Re
 		return nil
 	}
 
+	if isSignature {
+		if svr.signingKey == nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return nil
+		}
+
+		sig, err := svr.db.signResult(svr.signingKey, validated)
+		if err != nil {
+			return fmt.Errorf("failed to sign result")
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+
+		if _, err := w.Write(sig); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
 	// Only then open the result file and serve it like normal.
-	filename, err := svr.db.FilenameFromHash(validated, ".bin")
+	filename, err := svr.db.ResultFilename(validated)
 	if err != nil {
 		return err
 	}
@@ -93,10 +118,13 @@ func (svr *distributionServer) handleGetResult(w http.ResponseWriter, r *http.Re
 	return nil
 }
 
-func (db *PackageDatabase) RunDistributionServer(addr string) error {
+// RunDistributionServer serves redistributable build results on addr.
+// If signingKey is not nil then signatures are served at /result/{hash}.sig.
+func (db *PackageDatabase) RunDistributionServer(addr string, signingKey ed25519.PrivateKey) error {
 	server := &distributionServer{
-		db:  db,
-		mux: http.NewServeMux(),
+		db:         db,
+		mux:        http.NewServeMux(),
+		signingKey: signingKey,
 	}
 
 	server.mux.HandleFunc("/health", handler(server.handleHealthCheck))
@@ -106,3 +134,56 @@ func (db *PackageDatabase) RunDistributionServer(addr string) error {
 
 	return http.ListenAndServe(addr, logHandler(server.mux))
 }
+
+// UntrustDownloads removes results downloaded from a distribution server so they are
+// rebuilt locally the next time they are needed. If no hashes are given every downloaded
+// result is removed. Results built locally are left alone. Returns the number of results removed.
+func (db *PackageDatabase) UntrustDownloads(hashes []string) (int, error) {
+	if len(hashes) == 0 {
+		ents, err := os.ReadDir(db.buildDir)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, ent := range ents {
+			if hash, ok := strings.CutSuffix(ent.Name(), ".downloaded"); ok {
+				hashes = append(hashes, hash)
+			}
+		}
+	}
+
+	count := 0
+
+	for _, hash := range hashes {
+		if !validHash.MatchString(hash) || len(hash) != 64 {
+			return count, fmt.Errorf("invalid hash: %q", hash)
+		}
+
+		downloadedTag, err := db.FilenameFromHash(hash, ".downloaded")
+		if err != nil {
+			return count, err
+		}
+
+		if exists, _ := common.Exists(downloadedTag); !exists {
+			slog.Debug("result was not downloaded", "hash", hash)
+			continue
+		}
+
+		// The result is removed along with the markers since otherwise it would
+		// still be treated as cached and the server would keep redistributing it.
+		for _, suffix := range []string{".bin", ".chunks", ".redistributable", ".downloaded"} {
+			filename, err := db.FilenameFromHash(hash, suffix)
+			if err != nil {
+				return count, err
+			}
+
+			if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+				return count, fmt.Errorf("failed to remove %s: %w", filename, err)
+			}
+		}
+
+		count += 1
+	}
+
+	return count, nil
+}
@@ -0,0 +1,74 @@
+package database
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestUntrustDownloads(t *testing.T) {
+	db := New(t.TempDir())
+
+	downloaded := hex.EncodeToString(make([]byte, 32))
+	local := hex.EncodeToString(append(make([]byte, 31), 1))
+
+	for _, hash := range []string{downloaded, local} {
+		writeTestOutput(t, db, hash, []byte(hash))
+
+		for _, suffix := range []string{".chunks", ".redistributable"} {
+			filename, err := db.FilenameFromHash(hash, suffix)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.WriteFile(filename, []byte(""), os.ModePerm); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	downloadedTag, err := db.FilenameFromHash(downloaded, ".downloaded")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(downloadedTag, []byte(""), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := db.UntrustDownloads(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 1 {
+		t.Fatalf("removed %d results, want 1", count)
+	}
+
+	for _, suffix := range []string{".bin", ".chunks", ".redistributable", ".downloaded"} {
+		filename, err := db.FilenameFromHash(downloaded, suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(filename); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s of the downloaded result was kept", suffix)
+		}
+	}
+
+	for _, suffix := range []string{".bin", ".chunks", ".redistributable"} {
+		filename, err := db.FilenameFromHash(local, suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(filename); err != nil {
+			t.Errorf("%s of the local result was removed", suffix)
+		}
+	}
+
+	if _, err := db.UntrustDownloads([]string{"not a hash"}); err == nil {
+		t.Fatalf("accepted a invalid hash")
+	}
+}
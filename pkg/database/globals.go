@@ -273,6 +273,44 @@ func (db *PackageDatabase) getGlobals(name string) starlark.StringDict {
 
 				return builder.NewFetchHttpBuildDefinition(url, time.Duration(expireTime), headers), nil
 			}),
+			"local_file": starlark.NewBuiltin("define.local_file", func(
+				thread *starlark.Thread,
+				fn *starlark.Builtin,
+				args starlark.Tuple,
+				kwargs []starlark.Tuple,
+			) (starlark.Value, error) {
+				var (
+					filename string
+				)
+
+				if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
+					"filename", &filename,
+				); err != nil {
+					return starlark.None, err
+				}
+
+				return builder.NewLocalFileDefinition(filename)
+			}),
+			"local_apk_repo": starlark.NewBuiltin("define.local_apk_repo", func(
+				thread *starlark.Thread,
+				fn *starlark.Builtin,
+				args starlark.Tuple,
+				kwargs []starlark.Tuple,
+			) (starlark.Value, error) {
+				var (
+					dir  string
+					arch string
+				)
+
+				if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
+					"dir", &dir,
+					"arch", &arch,
+				); err != nil {
+					return starlark.None, err
+				}
+
+				return builder.NewLocalApkRepoDefinition(dir, arch)
+			}),
 			"read_archive": starlark.NewBuiltin("define.read_archive", func(
 				thread *starlark.Thread,
 				fn *starlark.Builtin,
@@ -337,6 +375,7 @@ func (db *PackageDatabase) getGlobals(name string) starlark.StringDict {
 					image        string
 					tag          string
 					architecture string
+					entrypoint   bool
 				)
 
 				if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
@@ -344,11 +383,12 @@ func (db *PackageDatabase) getGlobals(name string) starlark.StringDict {
 					"registry?", &registry,
 					"tag?", &tag,
 					"arch?", &architecture,
+					"entrypoint?", &entrypoint,
 				); err != nil {
 					return starlark.None, err
 				}
 
-				return builder.NewFetchOCIImageDefinition(registry, image, tag, architecture), nil
+				return builder.NewFetchOCIImageDefinition(registry, image, tag, architecture, entrypoint), nil
 			}),
 			"build_vm": starlark.NewBuiltin("define.build_vm", func(
 				thread *starlark.Thread,
@@ -557,17 +597,26 @@ func (db *PackageDatabase) getGlobals(name string) starlark.StringDict {
 			) (starlark.Value, error) {
 				var (
 					command string
+					repeat  bool
 				)
 
 				if err := starlark.UnpackArgs(fn.Name(), args, kwargs,
 					"command", &command,
+					"repeat?", &repeat,
 				); err != nil {
 					return starlark.None, err
 				}
 
-				return &common.StarDirective{Directive: common.DirectiveRunCommand{
+				var dir common.Directive = common.DirectiveRunCommand{
 					Command: command,
-				}}, nil
+				}
+
+				// By default identical commands are only run once.
+				if repeat {
+					dir = common.DirectiveRepeatable{Directive: dir}
+				}
+
+				return &common.StarDirective{Directive: dir}, nil
 			}),
 			"archive": starlark.NewBuiltin("directive.archive", func(
 				thread *starlark.Thread,
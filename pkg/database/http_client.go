@@ -0,0 +1,68 @@
+package database
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// The number of connections opened and kept idle for each host if MaxConnsPerHost isn't set.
+// Builds fetch hundreds of small packages from the same mirror so this is much higher
+// than the net/http default of 2 idle connections.
+const DEFAULT_MAX_CONNS_PER_HOST = 16
+
+// newTransport makes the transport shared by every request made with HttpClient. It keeps
+// connections alive between requests and negotiates HTTP/2 with servers that support it.
+func (db *PackageDatabase) newTransport() *http.Transport {
+	maxConns := db.MaxConnsPerHost
+	if maxConns <= 0 {
+		maxConns = DEFAULT_MAX_CONNS_PER_HOST
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	transport.ForceAttemptHTTP2 = true
+	transport.MaxIdleConns = 0
+	transport.MaxIdleConnsPerHost = maxConns
+	// Requests beyond the limit wait for a connection to be free instead of opening more.
+	transport.MaxConnsPerHost = maxConns
+	transport.IdleConnTimeout = 90 * time.Second
+
+	if db.rootCAs != nil {
+		transport.TLSClientConfig = &tls.Config{RootCAs: db.rootCAs}
+	}
+
+	return transport
+}
+
+// SetCABundle trusts the PEM encoded certificates in filename for HTTPS requests made with
+// HttpClient in addition to the system roots. This is needed for mirrors and distribution
+// servers with certificates signed by a private CA.
+func (db *PackageDatabase) SetCABundle(filename string) error {
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(contents) {
+		return fmt.Errorf("failed to parse CA bundle %s: no PEM encoded certificates found", filename)
+	}
+
+	db.clientMtx.Lock()
+	defer db.clientMtx.Unlock()
+
+	db.rootCAs = pool
+
+	// Make a new client with the new roots the next time one is needed.
+	db.client = nil
+
+	return nil
+}
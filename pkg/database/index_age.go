@@ -0,0 +1,95 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/tinyrange/tinyrange/pkg/builder"
+	"github.com/tinyrange/tinyrange/pkg/common"
+)
+
+// refreshIndexes fetches any package index used to load b again if it's older than db.MaxIndexAge.
+// The age is the time since the cached download was last fetched. Definitions built from a stale
+// index are rebuilt as well. In offline mode a stale index can't be fetched so it's an error.
+func (db *PackageDatabase) refreshIndexes(ctx common.BuildContext, b *ContainerBuilder) error {
+	var refresh func(node common.DependencyNode) (bool, error)
+
+	// refresh returns true if node was rebuilt because it used a stale index.
+	refresh = func(node common.DependencyNode) (bool, error) {
+		if fetch, ok := node.(*builder.FetchHttpBuildDefinition); ok {
+			hash, err := db.HashDefinition(fetch)
+			if err != nil {
+				return false, err
+			}
+
+			filename, err := db.ResultFilename(hash)
+			if err != nil {
+				return false, err
+			}
+
+			info, err := os.Stat(filename)
+			if errors.Is(err, os.ErrNotExist) {
+				// The index hasn't been fetched yet so it will be fetched when the builder loads.
+				return false, nil
+			} else if err != nil {
+				return false, err
+			}
+
+			age := time.Since(info.ModTime())
+			if age <= db.MaxIndexAge {
+				return false, nil
+			}
+
+			if db.Offline {
+				return false, fmt.Errorf(
+					"the package index %s for %s was fetched %s ago which is older than the maximum index age of %s and can't be refreshed in offline mode",
+					fetch.Tag(), b.DisplayName, age.Truncate(time.Second), db.MaxIndexAge,
+				)
+			}
+
+			slog.Info("refreshing package index", "index", fetch.Tag(), "age", age.Truncate(time.Second))
+
+			if _, err := db.Build(ctx, fetch, common.BuildOptions{AlwaysRebuild: true}); err != nil {
+				return false, fmt.Errorf("failed to refresh package index %s: %w", fetch.Tag(), err)
+			}
+
+			return true, nil
+		}
+
+		deps, err := node.Dependencies(ctx)
+		if err != nil {
+			return false, err
+		}
+
+		refreshed := false
+
+		for _, dep := range deps {
+			ok, err := refresh(dep)
+			if err != nil {
+				return false, err
+			}
+
+			refreshed = refreshed || ok
+		}
+
+		// Definitions like decompressing a index don't check if their input changed so they're rebuilt here.
+		if def, ok := node.(common.BuildDefinition); ok && refreshed {
+			if _, err := db.Build(ctx, def, common.BuildOptions{AlwaysRebuild: true}); err != nil {
+				return false, err
+			}
+		}
+
+		return refreshed, nil
+	}
+
+	for _, source := range b.Packages.Sources {
+		if _, err := refresh(source); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+// CachedDefinition describes a definition in the build directory and the state of its cached output.
+type CachedDefinition struct {
+	Hash string `json:"hash"`
+	Tag  string `json:"tag"`
+	// The definition couldn't be read (for example it was written by a different version).
+	Error string `json:"error,omitempty"`
+	// The output has been built. It may be stored as chunks rather than a .bin file.
+	Built   bool  `json:"built"`
+	Chunked bool  `json:"chunked,omitempty"`
+	Size    int64 `json:"size"`
+	// The output can be served by a distribution server.
+	Redistributable bool `json:"redistributable"`
+	// The output was downloaded from a distribution server rather than built locally.
+	Downloaded bool `json:"downloaded"`
+}
+
+func (db *PackageDatabase) markerExists(hash string, ext string) (bool, error) {
+	filename, err := db.FilenameFromHash(hash, ext)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := os.Stat(filename); errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// ListCachedDefinitions returns every definition in the build directory with the state of its output.
+func (db *PackageDatabase) ListCachedDefinitions() ([]CachedDefinition, error) {
+	hashes, err := db.GetAllHashes()
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []CachedDefinition
+
+	for _, hash := range hashes {
+		ent := CachedDefinition{Hash: hash}
+
+		def, err := db.GetDefinitionByHash(hash)
+		if err != nil {
+			ent.Error = err.Error()
+		} else {
+			ent.Tag = def.Tag()
+		}
+
+		binFilename, err := db.FilenameFromHash(hash, ".bin")
+		if err != nil {
+			return nil, err
+		}
+
+		if info, err := os.Stat(binFilename); err == nil {
+			ent.Built = true
+			ent.Size = info.Size()
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+
+		manifestFilename, err := db.FilenameFromHash(hash, ".chunks")
+		if err != nil {
+			return nil, err
+		}
+
+		if manifestBytes, err := os.ReadFile(manifestFilename); err == nil {
+			var manifest chunkManifest
+
+			if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+				return nil, err
+			}
+
+			ent.Chunked = true
+
+			if !ent.Built {
+				ent.Built = true
+				ent.Size = manifest.Size
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+
+		if ent.Redistributable, err = db.markerExists(hash, ".redistributable"); err != nil {
+			return nil, err
+		}
+
+		if ent.Downloaded, err = db.markerExists(hash, ".downloaded"); err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, ent)
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+
+package database
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockShared blocks until f can be locked alongside other shared locks.
+func lockShared(f *os.File) error {
+	return unix.Flock(int(f.Fd()), unix.LOCK_SH)
+}
+
+// tryLockExclusive locks f if no other process holds a lock on it.
+func tryLockExclusive(f *os.File) (bool, error) {
+	err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -2,6 +2,7 @@ package database
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/fatih/color"
 	"github.com/tinyrange/tinyrange/pkg/builder"
@@ -238,6 +239,25 @@ func (plan *InstallationPlan) addInternal(
 	return
 }
 
+// pinnedVersionError reports the versions that are available when a pinned version can't be found.
+func (plan *InstallationPlan) pinnedVersionError(builder *ContainerBuilder, query common.PackageQuery) error {
+	results, err := builder.Packages.Query(common.PackageQuery{Name: query.Name, MatchDirect: true})
+	if err != nil {
+		return err
+	}
+
+	var versions []string
+	for _, result := range results {
+		versions = append(versions, result.Name.Version)
+	}
+
+	if len(versions) == 0 {
+		return fmt.Errorf("could not find package for pinned query: %s", query)
+	}
+
+	return fmt.Errorf("could not find pinned version %s of %s (available: %s)", query.Version, query.Name, strings.Join(versions, ", "))
+}
+
 func (plan *InstallationPlan) add(ctx common.BuildContext, builder *ContainerBuilder, query common.PackageQuery, isDefault bool) (ret *installationTree) {
 	ret = &installationTree{Query: query}
 
@@ -249,7 +269,10 @@ func (plan *InstallationPlan) add(ctx common.BuildContext, builder *ContainerBui
 	}
 
 	// Early out if we can't find a package matching the query.
-	if len(results) == 0 {
+	if len(results) == 0 && query.MatchExactVersion {
+		ret.Error = plan.pinnedVersionError(builder, query)
+		return
+	} else if len(results) == 0 {
 		ret.Error = fmt.Errorf("could not find package for query: %s", query)
 		return
 	}
@@ -333,6 +356,11 @@ func EmitDockerfile(plan common.InstallationPlan) (string, error) {
 	ret := ""
 
 	for _, directive := range plan.Directives() {
+		// Repeatable commands are written like any other command.
+		if repeatable, ok := directive.(common.DirectiveRepeatable); ok {
+			directive = repeatable.Directive
+		}
+
 		switch directive := directive.(type) {
 		case *builder.FetchOciImageDefinition:
 			ret += fmt.Sprintf("FROM %s\n", directive.FromDirective())
@@ -345,3 +373,36 @@ func EmitDockerfile(plan common.InstallationPlan) (string, error) {
 
 	return ret, nil
 }
+
+// A package selected by a plan along with the installer used for it.
+type PlannedPackage struct {
+	Package   *common.Package
+	Installer *common.Installer
+}
+
+// Packages returns every package selected by the plan in installation order.
+func (plan *InstallationPlan) Packages() []PlannedPackage {
+	var ret []PlannedPackage
+
+	seen := make(map[*common.Package]bool)
+
+	var walk func(tree *installationTree)
+
+	walk = func(tree *installationTree) {
+		// Packages that were already installed have no installer.
+		if tree.Package != nil && tree.Installer != nil && !seen[tree.Package] {
+			seen[tree.Package] = true
+			ret = append(ret, PlannedPackage{Package: tree.Package, Installer: tree.Installer})
+		}
+
+		for _, depend := range tree.Dependencies {
+			walk(depend)
+		}
+	}
+
+	for _, tree := range plan.trees {
+		walk(tree)
+	}
+
+	return ret
+}
@@ -0,0 +1,112 @@
+package database
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/tinyrange/tinyrange/pkg/builder"
+	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/config"
+	"github.com/tinyrange/tinyrange/pkg/hash"
+)
+
+// A package resolved by ResolvePackages.
+type ResolvedPackage struct {
+	Name         string   `json:"name"`
+	Version      string   `json:"version"`
+	Architecture string   `json:"architecture"`
+	Urls         []string `json:"urls,omitempty"`
+}
+
+// findUrls walks a value looking for HTTP downloads in build definitions.
+func (db *PackageDatabase) findUrls(val reflect.Value, urls *[]string) {
+	switch val.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		if val.IsNil() {
+			return
+		}
+	case reflect.Slice:
+		for i := 0; i < val.Len(); i++ {
+			db.findUrls(val.Index(i), urls)
+		}
+		return
+	case reflect.Struct:
+	default:
+		return
+	}
+
+	if !val.CanInterface() {
+		return
+	}
+
+	switch v := val.Interface().(type) {
+	case builder.FetchHttpParameters:
+		url := v.Url
+
+		// Report the actual URL for mirrors.
+		if strings.HasPrefix(url, "mirror://") {
+			if resolved, err := db.UrlsFor(url); err == nil && len(resolved) > 0 {
+				url = resolved[0]
+			}
+		}
+
+		*urls = append(*urls, url)
+	case hash.Definition:
+		db.findUrls(reflect.ValueOf(v.Params()), urls)
+	default:
+		if val.Kind() == reflect.Interface || val.Kind() == reflect.Pointer {
+			db.findUrls(val.Elem(), urls)
+		} else if val.Kind() == reflect.Struct {
+			for i := 0; i < val.NumField(); i++ {
+				db.findUrls(val.Field(i), urls)
+			}
+		}
+	}
+}
+
+// ResolvePackages plans an installation and returns the packages it selects in
+// installation order. Nothing is downloaded or built.
+func (db *PackageDatabase) ResolvePackages(
+	name string,
+	arch config.CPUArchitecture,
+	packages []common.PackageQuery,
+	tags common.TagList,
+) ([]ResolvedPackage, error) {
+	if arch == config.ArchInvalid {
+		arch = config.HostArchitecture
+	}
+
+	ctx := db.NewBuildContext(nil)
+
+	b, err := db.GetContainerBuilder(ctx, name, arch)
+	if err != nil {
+		return nil, err
+	}
+
+	plan, err := b.Plan(ctx, packages, tags, common.PlanOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	installPlan, ok := plan.(*InstallationPlan)
+	if !ok {
+		return nil, fmt.Errorf("could not convert %T to InstallationPlan", plan)
+	}
+
+	var ret []ResolvedPackage
+
+	for _, pkg := range installPlan.Packages() {
+		resolved := ResolvedPackage{
+			Name:         pkg.Package.Name.Name,
+			Version:      pkg.Package.Name.Version,
+			Architecture: string(arch),
+		}
+
+		db.findUrls(reflect.ValueOf(pkg.Installer.Directives), &resolved.Urls)
+
+		ret = append(ret, resolved)
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,112 @@
+package database
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/agnivade/levenshtein"
+	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/config"
+)
+
+// How package search results are ordered.
+type SearchRanking string
+
+const (
+	// Exact matches first, then names starting with the query, then names containing it.
+	// Each group is ordered by levenshtein distance.
+	RankingPrefix SearchRanking = "prefix"
+	// Only levenshtein distance from the query.
+	RankingDistance SearchRanking = "distance"
+)
+
+func ParseSearchRanking(s string) (SearchRanking, error) {
+	switch SearchRanking(s) {
+	case RankingPrefix, "":
+		return RankingPrefix, nil
+	case RankingDistance:
+		return RankingDistance, nil
+	default:
+		return "", fmt.Errorf("unknown search ranking %q (supported: %s, %s)", s, RankingPrefix, RankingDistance)
+	}
+}
+
+// matchTier returns how closely name matches query ignoring versions. Lower is better.
+func matchTier(name string, query string) int {
+	name, _, _ = strings.Cut(strings.ToLower(name), ":")
+	query, _, _ = strings.Cut(strings.ToLower(query), ":")
+
+	switch {
+	case name == query:
+		return 0
+	case strings.HasPrefix(name, query):
+		return 1
+	case strings.Contains(name, query):
+		return 2
+	default:
+		return 3
+	}
+}
+
+// RankPackageNames sorts names by how well they match query. Names that rank equally keep their order.
+func RankPackageNames(names []string, query string, ranking SearchRanking) {
+	if ranking == RankingDistance {
+		slices.SortStableFunc(names, func(a, b string) int {
+			return levenshtein.ComputeDistance(a, query) - levenshtein.ComputeDistance(b, query)
+		})
+
+		return
+	}
+
+	queryName, _, _ := strings.Cut(query, ":")
+
+	slices.SortStableFunc(names, func(a, b string) int {
+		if tierA, tierB := matchTier(a, query), matchTier(b, query); tierA != tierB {
+			return tierA - tierB
+		}
+
+		nameA, _, _ := strings.Cut(a, ":")
+		nameB, _, _ := strings.Cut(b, ":")
+
+		return levenshtein.ComputeDistance(nameA, queryName) - levenshtein.ComputeDistance(nameB, queryName)
+	})
+}
+
+// SearchPackageNames searches a builder for packages partially matching query and
+// returns the names ordered by ranking.
+func (db *PackageDatabase) SearchPackageNames(
+	ctx common.BuildContext,
+	builder string,
+	arch config.CPUArchitecture,
+	query string,
+	ranking SearchRanking,
+) ([]string, error) {
+	b, err := db.GetContainerBuilder(ctx, builder, arch)
+	if err != nil {
+		return nil, err
+	}
+
+	q, err := common.ParsePackageQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	q.MatchDirect = true
+	q.MatchPartialName = true
+
+	results, err := b.Search(q)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+
+	for _, result := range results {
+		names = append(names, result.Name.String())
+	}
+
+	RankPackageNames(names, query, ranking)
+
+	return names, nil
+}
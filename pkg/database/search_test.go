@@ -0,0 +1,59 @@
+package database
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRankPackageNames(t *testing.T) {
+	for _, test := range []struct {
+		query   string
+		ranking SearchRanking
+		names   []string
+		want    []string
+	}{
+		{
+			query:   "python3",
+			ranking: RankingPrefix,
+			names:   []string{"py3-python3-dateutil:2.9.0-r1", "python3-dev:3.12.3-r1", "python3:3.12.3-r1", "python3-tkinter:3.12.3-r1"},
+			want:    []string{"python3:3.12.3-r1", "python3-dev:3.12.3-r1", "python3-tkinter:3.12.3-r1", "py3-python3-dateutil:2.9.0-r1"},
+		},
+		{
+			query:   "gcc",
+			ranking: RankingPrefix,
+			names:   []string{"libgcc:13.2.1-r0", "gcc-doc:13.2.1-r0", "gcc:13.2.1-r0", "gc:8.2.6-r0"},
+			want:    []string{"gcc:13.2.1-r0", "gcc-doc:13.2.1-r0", "libgcc:13.2.1-r0", "gc:8.2.6-r0"},
+		},
+		{
+			// Prefix matches rank above closer names that only contain the query.
+			query:   "vim",
+			ranking: RankingPrefix,
+			names:   []string{"gvim:9.1-r0", "vim-common:9.1-r0", "vim:9.1-r0"},
+			want:    []string{"vim:9.1-r0", "vim-common:9.1-r0", "gvim:9.1-r0"},
+		},
+		{
+			query:   "vim",
+			ranking: RankingDistance,
+			names:   []string{"vim-common:9.1-r0", "gvim:9.1-r0", "vim:9.1-r0"},
+			want:    []string{"vim:9.1-r0", "gvim:9.1-r0", "vim-common:9.1-r0"},
+		},
+	} {
+		got := slices.Clone(test.names)
+
+		RankPackageNames(got, test.query, test.ranking)
+
+		if !slices.Equal(got, test.want) {
+			t.Errorf("RankPackageNames(%q, %s) = %v, want %v", test.query, test.ranking, got, test.want)
+		}
+	}
+}
+
+func TestParseSearchRanking(t *testing.T) {
+	if ranking, err := ParseSearchRanking(""); err != nil || ranking != RankingPrefix {
+		t.Errorf("ParseSearchRanking(\"\") = %s, %v", ranking, err)
+	}
+
+	if _, err := ParseSearchRanking("alphabetical"); err == nil {
+		t.Errorf("ParseSearchRanking(\"alphabetical\") should fail")
+	}
+}
@@ -0,0 +1,170 @@
+package database
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ErrMissingSignature is returned when a distribution key is configured but
+// the distribution server doesn't have a signature for a artifact.
+var ErrMissingSignature = errors.New("distribution server did not provide a signature")
+
+// The signed message binds the definition hash to the contents of the artifact.
+func signatureMessage(hash string, digest []byte) []byte {
+	return []byte(hash + ":" + hex.EncodeToString(digest))
+}
+
+// GenerateDistributionKey generates a new ed25519 key pair for signing artifacts.
+// Both keys are returned base64 encoded.
+func GenerateDistributionKey() (string, string, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(public),
+		base64.StdEncoding.EncodeToString(private.Seed()),
+		nil
+}
+
+func readKeyFile(filename string, size int) ([]byte, error) {
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode key %s: %w", filename, err)
+	}
+
+	if len(key) != size {
+		return nil, fmt.Errorf("key %s has the wrong size", filename)
+	}
+
+	return key, nil
+}
+
+// ReadDistributionPublicKey reads a public key written by GenerateDistributionKey.
+func ReadDistributionPublicKey(filename string) (ed25519.PublicKey, error) {
+	key, err := readKeyFile(filename, ed25519.PublicKeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	return ed25519.PublicKey(key), nil
+}
+
+// ReadDistributionPrivateKey reads a private key written by GenerateDistributionKey.
+func ReadDistributionPrivateKey(filename string) (ed25519.PrivateKey, error) {
+	seed, err := readKeyFile(filename, ed25519.SeedSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// SetDistributionKey only trusts artifacts downloaded from the distribution
+// server that are signed by key. Untrusted artifacts are built locally instead
+// unless RequireSignatures is set.
+func (db *PackageDatabase) SetDistributionKey(key ed25519.PublicKey) {
+	db.distributionKey = key
+}
+
+func digestFile(filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+func (db *PackageDatabase) signResult(key ed25519.PrivateKey, hash string) ([]byte, error) {
+	filename, err := db.ResultFilename(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	digest, err := digestFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return ed25519.Sign(key, signatureMessage(hash, digest)), nil
+}
+
+func (db *PackageDatabase) fetchSignature(client *http.Client, hash string) ([]byte, error) {
+	resp, err := client.Get(fmt.Sprintf("%s/result/%s.sig", db.distributionServer, hash))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrMissingSignature
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status %s", resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, ed25519.SignatureSize+1))
+}
+
+// verifyDigest checks the signature from the distribution server for a
+// artifact with the given contents digest. It fails closed if the signature is missing.
+func (db *PackageDatabase) verifyDigest(client *http.Client, hash string, digest []byte) error {
+	sig, err := db.fetchSignature(client, hash)
+	if err != nil {
+		return fmt.Errorf("failed to get signature for %s: %w", hash, err)
+	}
+
+	if !ed25519.Verify(db.distributionKey, signatureMessage(hash, digest), sig) {
+		return fmt.Errorf("bad signature for %s", hash)
+	}
+
+	return nil
+}
+
+// VerifyResult checks a cached build result against the signature from the distribution server.
+func (db *PackageDatabase) VerifyResult(hash string) error {
+	if db.distributionServer == "" {
+		return fmt.Errorf("no distribution server configured")
+	}
+	if db.distributionKey == nil {
+		return fmt.Errorf("no distribution key configured")
+	}
+
+	filename, err := db.ResultFilename(hash)
+	if err != nil {
+		return err
+	}
+
+	digest, err := digestFile(filename)
+	if err != nil {
+		return err
+	}
+
+	client, err := db.HttpClient()
+	if err != nil {
+		return err
+	}
+
+	return db.verifyDigest(client, hash, digest)
+}
@@ -0,0 +1,138 @@
+package database
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/tinyrange/tinyrange/pkg/common"
+)
+
+// newTestDistribution returns a database serving a redistributable result and a database using it as a distribution server.
+func newTestDistribution(t *testing.T, signingKey ed25519.PrivateKey, contents []byte) (*PackageDatabase, string) {
+	t.Helper()
+
+	sum := sha256.Sum256([]byte("test result"))
+	hash := hex.EncodeToString(sum[:])
+
+	server := New(t.TempDir())
+
+	writeTestOutput(t, server, hash, contents)
+
+	redistributableTag, err := server.FilenameFromHash(hash, ".redistributable")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(redistributableTag, []byte(""), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	svr := &distributionServer{db: server, mux: http.NewServeMux(), signingKey: signingKey}
+	svr.mux.HandleFunc("/result/{hash}", handler(svr.handleGetResult))
+
+	ts := httptest.NewServer(svr.mux)
+	t.Cleanup(ts.Close)
+
+	client := New(t.TempDir())
+	client.distributionServer = ts.URL
+
+	writeTestOutput(t, client, hash, contents)
+
+	return client, hash
+}
+
+func TestVerifyResult(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherPublic, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		db, hash := newTestDistribution(t, private, []byte("hello world"))
+		db.SetDistributionKey(public)
+
+		if err := db.VerifyResult(hash); err != nil {
+			t.Fatalf("failed to verify a correctly signed result: %s", err)
+		}
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		db, hash := newTestDistribution(t, private, []byte("hello world"))
+		db.SetDistributionKey(otherPublic)
+
+		if err := db.VerifyResult(hash); err == nil {
+			t.Fatalf("verified a result signed by a different key")
+		}
+	})
+
+	t.Run("modified", func(t *testing.T) {
+		db, hash := newTestDistribution(t, private, []byte("hello world"))
+		db.SetDistributionKey(public)
+
+		writeTestOutput(t, db, hash, []byte("hello there"))
+
+		if err := db.VerifyResult(hash); err == nil {
+			t.Fatalf("verified a result that doesn't match the signed contents")
+		}
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		db, hash := newTestDistribution(t, nil, []byte("hello world"))
+		db.SetDistributionKey(public)
+
+		if err := db.VerifyResult(hash); !errors.Is(err, ErrMissingSignature) {
+			t.Fatalf("VerifyResult() = %v, want %v", err, ErrMissingSignature)
+		}
+	})
+}
+
+type testRedistributableDefinition struct {
+	common.BuildDefinition
+}
+
+func (testRedistributableDefinition) Redistributable() bool { return true }
+
+func TestDownloadUntrustedResult(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, hash := newTestDistribution(t, nil, []byte("hello world"))
+	db.SetDistributionKey(public)
+
+	downloadedTag, err := db.FilenameFromHash(hash, ".downloaded")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := db.downloadFromDistributionServer(hash, testRedistributableDefinition{})
+	if err != nil {
+		t.Fatalf("an unsigned result failed the download rather than building locally: %s", err)
+	}
+
+	if ok {
+		t.Fatalf("accepted an unsigned result")
+	}
+
+	if _, err := os.Stat(downloadedTag); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("marked an unsigned result as downloaded")
+	}
+
+	db.RequireSignatures = true
+
+	if _, err := db.downloadFromDistributionServer(hash, testRedistributableDefinition{}); !errors.Is(err, ErrMissingSignature) {
+		t.Fatalf("downloadFromDistributionServer() = %v, want %v", err, ErrMissingSignature)
+	}
+}
@@ -314,21 +314,21 @@ func (emu *Emulator) openPath(name string) (filesystem.File, error) {
 func (emu *Emulator) LookPath(cwd string, env shared.Environment, name string) (string, error) {
 	if strings.HasPrefix(name, "./") {
 		name = path.Join(cwd, name)
-		if _, err := emu.openPath(name); err != nil {
+		if _, err := filesystem.LstatPath(emu.root, name); err != nil {
 			return "", fmt.Errorf("could not open %s: %s", name, err)
 		}
 
 		return name, nil
 	}
 
-	if _, err := emu.openPath(name); err == nil {
+	if _, err := filesystem.LstatPath(emu.root, name); err == nil {
 		return name, nil
 	}
 
 	pathOptions := strings.Split(env.Get("PATH"), ":")
 
 	for _, opt := range pathOptions {
-		if _, err := emu.openPath(path.Join(opt, name)); err == nil {
+		if _, err := filesystem.LstatPath(emu.root, path.Join(opt, name)); err == nil {
 			return path.Join(opt, name), nil
 		}
 	}
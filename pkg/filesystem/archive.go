@@ -339,6 +339,10 @@ func ArchiveFromFS(eFs embed.FS, base string) (ArrayArchive, error) {
 
 const CACHE_ENTRY_SIZE = 1024
 
+// Entries in a layer with a name starting with WhiteoutPrefix remove the file they name from
+// the layers below instead of being extracted.
+const WhiteoutPrefix = ".wh."
+
 type CacheEntry struct {
 	underlyingFile   io.ReaderAt
 	underlyingSource hash.SerializableValue
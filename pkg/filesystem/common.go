@@ -70,6 +70,10 @@ func ExtractReaderTo(input io.Reader, kind string, fs *ext4.Ext4Filesystem, filt
 					if err := fs.Mkdir(name, false); err != nil {
 						return err
 					}
+				case tar.TypeChar, tar.TypeBlock:
+					if err := fs.Mknod(name, hdr.FileInfo().Mode(), uint32(hdr.Devmajor), uint32(hdr.Devminor)); err != nil {
+						return err
+					}
 				default:
 					return fmt.Errorf("Filesystem.AddFromTar: Typeflag not implemented: %d", hdr.Typeflag)
 				}
@@ -6,6 +6,7 @@ import (
 	"io/fs"
 	"os"
 	"path"
+	"slices"
 	"strings"
 )
 
@@ -101,6 +102,17 @@ func OpenPath(dir Directory, p string) (DirectoryEntry, error) {
 	return currentDir.GetChild(dirname)
 }
 
+// LstatPath returns information about the entry at p without opening it. Like lstat
+// symlinks in parent directories are followed but a symlink at p is not.
+func LstatPath(dir Directory, p string) (FileInfo, error) {
+	ent, err := OpenPath(dir, p)
+	if err != nil {
+		return nil, err
+	}
+
+	return ent.Stat()
+}
+
 func Mkdir(dir Directory, p string) (MutableDirectory, error) {
 	p = strings.TrimPrefix(p, "/")
 
@@ -187,6 +199,28 @@ func CreateChild(dir Directory, p string, f File) error {
 	return mut.Create(tokens[len(tokens)-1], f)
 }
 
+// Unlink removes the entry at p if it exists. Nothing is removed if the parent directory isn't mutable.
+func Unlink(dir Directory, p string) error {
+	parent, err := OpenPath(dir, path.Dir(strings.TrimPrefix(p, "/")))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	parentDir, ok := parent.File.(Directory)
+	if !ok {
+		return nil
+	}
+
+	mut := getMutable(parentDir)
+	if mut == nil {
+		return nil
+	}
+
+	return mut.Unlink(path.Base(p))
+}
+
 func GetTotalSize(dir Directory) (int64, error) {
 	ents, err := dir.Readdir()
 	if err != nil {
@@ -256,7 +290,12 @@ func (m *memoryDirectory) Unlink(name string) error {
 		return fmt.Errorf("MutableDirectory methods can not handle paths: %s", name)
 	}
 
+	if _, ok := m.entries[name]; !ok {
+		return nil
+	}
+
 	delete(m.entries, name)
+	m.names = slices.DeleteFunc(m.names, func(n string) bool { return n == name })
 
 	return nil
 }
@@ -403,6 +442,8 @@ func ExtractEntry(ent Entry, dir MutableDirectory) error {
 		return CreateChild(dir, ent.Name(), ent)
 	case TypeLink:
 		return CreateChild(dir, ent.Name(), ent)
+	case TypeCharDevice, TypeBlockDevice:
+		return CreateChild(dir, ent.Name(), ent)
 	default:
 		return fmt.Errorf("unknown Entry type: %s", ent.Typeflag())
 	}
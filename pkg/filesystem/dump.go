@@ -44,6 +44,10 @@ func (v *filesystemValidator) validateFile(f File, p string) error {
 		if target == "" {
 			return fmt.Errorf("%s: link has empty target", p)
 		}
+	case TypeCharDevice, TypeBlockDevice:
+		if _, _, err := GetDevice(f); err != nil {
+			return err
+		}
 	default:
 		return fmt.Errorf("unknown kind: %s", info.Kind())
 	}
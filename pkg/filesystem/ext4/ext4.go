@@ -3,6 +3,7 @@
 package ext4
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	goFs "io/fs"
@@ -20,6 +21,9 @@ import (
 
 const DEFAULT_MODE = goFs.FileMode(0755)
 
+// ErrNoSpace is returned when the filesystem runs out of blocks or inodes.
+var ErrNoSpace = errors.New("no space left on filesystem")
+
 const INODE_SIZE = 256
 
 type InodeFlags uint32
@@ -215,6 +219,10 @@ func (d *LinearDirectory) AddEntry(child *InodeWrapper, name string) error {
 		typ = 0x7
 	} else if childMode.IsDir() {
 		typ = 0x2
+	} else if childMode&goFs.ModeCharDevice != 0 {
+		typ = 0x3
+	} else if childMode&goFs.ModeDevice != 0 {
+		typ = 0x4
 	}
 
 	block := d.blocks[len(d.blocks)-1]
@@ -236,7 +244,7 @@ func (d *LinearDirectory) AddEntry(child *InodeWrapper, name string) error {
 		if int(currentLen-lastRecLen) < requiredLen {
 			// Otherwise increase the size.
 			if err := d.increaseSize(); err != nil {
-				return fmt.Errorf("failed to increase size: %v", err)
+				return fmt.Errorf("failed to increase size: %w", err)
 			}
 
 			// Call the method again.
@@ -931,7 +939,7 @@ func (i *InodeWrapper) addContents(contents vm.MemoryRegion, symlink bool) error
 
 	if symlink && contents.Size() < 60 {
 		if err := i.fs.mapRegion(vm.NewPaddedRegion(contents, 60), int64(i.offset)+40); err != nil {
-			return fmt.Errorf("failed to mapRegion: %+v", err)
+			return fmt.Errorf("failed to mapRegion: %w", err)
 		}
 
 		i.node.SetNSize(uint64(contents.Size()))
@@ -941,12 +949,12 @@ func (i *InodeWrapper) addContents(contents vm.MemoryRegion, symlink bool) error
 		blocks := roundUpDiv(int(contents.Size()), int(i.fs.sb.blockSize()))
 
 		if err := i.allocateExtent(int64(blocks)); err != nil {
-			return fmt.Errorf("failed to allocate extent: %+v", err)
+			return fmt.Errorf("failed to allocate extent: %w", err)
 		}
 
 		ext, err := i.extentTree.Extents()
 		if err != nil {
-			return fmt.Errorf("failed to get extents: %+v", err)
+			return fmt.Errorf("failed to get extents: %w", err)
 		}
 
 		i.node.SetNSize(uint64(contents.Size()))
@@ -954,7 +962,7 @@ func (i *InodeWrapper) addContents(contents vm.MemoryRegion, symlink bool) error
 
 		for _, extent := range ext {
 			if err := i.fs.mapExtent(contents, &extent); err != nil {
-				return fmt.Errorf("failed to addContents: %+v", err)
+				return fmt.Errorf("failed to addContents: %w", err)
 			}
 		}
 	}
@@ -964,6 +972,23 @@ func (i *InodeWrapper) addContents(contents vm.MemoryRegion, symlink bool) error
 	return nil
 }
 
+// setDevice stores a device number in i_block using the same encoding as Linux.
+func (i *InodeWrapper) setDevice(major uint32, minor uint32) {
+	if major < 256 && minor < 256 {
+		// Old style device numbers are stored in i_block[0].
+		dev := major<<8 | minor
+
+		i.node.SetBlockMagic(uint16(dev))
+		i.node.SetBlockEntries(uint16(dev >> 16))
+	} else {
+		// New style device numbers are stored in i_block[1] with i_block[0] left as zero.
+		dev := (minor & 0xff) | (major << 8) | ((minor &^ 0xff) << 12)
+
+		i.node.SetBlockMax(uint16(dev))
+		i.node.SetBlockDepth(uint16(dev >> 16))
+	}
+}
+
 func (i *InodeWrapper) chmod(mode goFs.FileMode) error {
 	oldMode := i.node.Mode()
 
@@ -1054,7 +1079,7 @@ func (bg *BlockGroup) allocateBlocks(blocks uint32) (*Extent, error) {
 		// Return a new extent.
 		ext, err := NewExtent(0, uint64(bg.firstBlock), uint16(blocks))
 		if err != nil {
-			return nil, fmt.Errorf("failed to allocate full block group: %v", err)
+			return nil, fmt.Errorf("failed to allocate full block group: %w", err)
 		}
 
 		return &ext, nil
@@ -1105,7 +1130,7 @@ func (bg *BlockGroup) allocateBlocks(blocks uint32) (*Extent, error) {
 			// 	"blocks", blocks,
 			// 	"freeBlocks", bg.desc.FreeBlocksCount(),
 			// )
-			return nil, fmt.Errorf("failed to allocate regular blocks: %v", err)
+			return nil, fmt.Errorf("failed to allocate regular blocks: %w", err)
 		}
 
 		return &ext, nil
@@ -1256,7 +1281,7 @@ func (fs *Ext4Filesystem) allocateBlocks(blocks int64) (*Extent, error) {
 
 	// TODO(joshua): Add a fallback for mapping from fragments.
 
-	return nil, fmt.Errorf("filesystem is full or fragmented")
+	return nil, fmt.Errorf("filesystem is full or fragmented: %w", ErrNoSpace)
 }
 
 func (fs *Ext4Filesystem) allocateBlocksForBytes(size int64) (*Extent, error) {
@@ -1287,7 +1312,7 @@ func (fs *Ext4Filesystem) allocateInode() (*InodeWrapper, error) {
 	}
 
 	if inode == nil {
-		return nil, fmt.Errorf("filesystem has run out of inodes")
+		return nil, fmt.Errorf("filesystem has run out of inodes: %w", ErrNoSpace)
 	}
 
 	// Add the inode to the main inode index.
@@ -1474,15 +1499,15 @@ func (fs *Ext4Filesystem) CreateFile(filename string, content vm.MemoryRegion) e
 
 	f, err := fs.allocateInode()
 	if err != nil {
-		return fmt.Errorf("failed to allocate inode: %v", err)
+		return fmt.Errorf("failed to allocate inode: %w", err)
 	}
 
 	if err := f.addContents(content, false); err != nil {
-		return fmt.Errorf("failed to add contents: %v", err)
+		return fmt.Errorf("failed to add contents: %w", err)
 	}
 
 	if err := node.addDirectoryEntry(f, path.Base(filename)); err != nil {
-		return fmt.Errorf("CreateFile(%s): failed to addDirectoryEntry: %v", filename, err)
+		return fmt.Errorf("CreateFile(%s): failed to addDirectoryEntry: %w", filename, err)
 	}
 
 	return nil
@@ -1540,6 +1565,47 @@ func (fs *Ext4Filesystem) Symlink(filename string, target string) error {
 	return nil
 }
 
+// Mknod creates a character device (if mode has goFs.ModeCharDevice set) or block device node.
+func (fs *Ext4Filesystem) Mknod(filename string, mode goFs.FileMode, major uint32, minor uint32) error {
+	node, err := fs.getNode(path.Dir(filename), false, false, true)
+	if err != nil {
+		return err
+	}
+
+	if !node.Mode().IsDir() {
+		return goFs.ErrInvalid
+	}
+
+	f, err := fs.allocateInode()
+	if err != nil {
+		return err
+	}
+
+	if mode&goFs.ModeCharDevice != 0 {
+		f.node.SetMode(f.node.Mode() | S_IFCHR)
+	} else {
+		f.node.SetMode(f.node.Mode() | S_IFBLK)
+	}
+
+	if !fs.deterministicTime.IsZero() {
+		f.node.SetCtime(uint32(fs.deterministicTime.Unix()))
+		f.node.SetMtime(uint32(fs.deterministicTime.Unix()))
+		f.node.SetAtime(uint32(fs.deterministicTime.Unix()))
+	} else {
+		f.node.SetCtime(uint32(time.Now().Unix()))
+		f.node.SetMtime(uint32(time.Now().Unix()))
+		f.node.SetAtime(uint32(time.Now().Unix()))
+	}
+
+	f.setDevice(major, minor)
+
+	if err := node.addDirectoryEntry(f, path.Base(filename)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (fs *Ext4Filesystem) Exists(filename string) bool {
 	_, err := fs.getNode(filename, false, false, false)
 	return err == nil
@@ -1800,13 +1866,13 @@ func CreateExt4Filesystem(_vm *vm.VirtualMemory, offset int64, size int64) (*Ext
 
 				_, err := fs.allocateBlocksForBytes(blockGroupCount * BlockGroupDescriptor{}.Size())
 				if err != nil {
-					return nil, fmt.Errorf("could not allocate bgd blocks: %v", err)
+					return nil, fmt.Errorf("could not allocate bgd blocks: %w", err)
 				}
 			}
 		}
 
 		if err := fs.mapRegion(bg.desc, blockGroupOffset); err != nil {
-			return nil, fmt.Errorf("failed to reinterpret block group: %v", err)
+			return nil, fmt.Errorf("failed to reinterpret block group: %w", err)
 		}
 		blockGroupOffset += bg.desc.Size()
 
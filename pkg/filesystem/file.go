@@ -35,6 +35,27 @@ func GetLinkName(ent File) (string, error) {
 	}
 }
 
+// GetDevice returns the major and minor device numbers of a character or block device.
+func GetDevice(ent File) (int64, int64, error) {
+	switch ent := ent.(type) {
+	case *StarFile:
+		return GetDevice(ent.File)
+	case *CacheEntry:
+		return ent.CDevmajor, ent.CDevminor, nil
+	case *memoryFile:
+		if ent.kind != TypeCharDevice && ent.kind != TypeBlockDevice {
+			return 0, 0, fs.ErrInvalid
+		}
+		return ent.devMajor, ent.devMinor, nil
+	case *overlayFile:
+		return GetDevice(ent.File)
+	case SimpleEntry:
+		return ent.Devmajor(), ent.Devminor(), nil
+	default:
+		return 0, 0, fmt.Errorf("GetDevice not implemented: %T", ent)
+	}
+}
+
 func GetUidAndGid(ent File) (int, int, error) {
 	switch ent := ent.(type) {
 	case *StarDirectory:
@@ -123,6 +144,8 @@ const (
 	TypeDirectory
 	TypeSymlink
 	TypeLink
+	TypeCharDevice
+	TypeBlockDevice
 )
 
 func (t FileType) String() string {
@@ -135,6 +158,10 @@ func (t FileType) String() string {
 		return "Symlink"
 	case TypeLink:
 		return "Link"
+	case TypeCharDevice:
+		return "CharDevice"
+	case TypeBlockDevice:
+		return "BlockDevice"
 	default:
 		return "<unknown>"
 	}
@@ -155,8 +182,8 @@ type Entry interface {
 
 	ModTime() time.Time // Modification time
 
-	Devmajor() int64 // Major device number (valid for TypeChar or TypeBlock)
-	Devminor() int64 // Minor device number (valid for TypeChar or TypeBlock)
+	Devmajor() int64 // Major device number (valid for TypeCharDevice or TypeBlockDevice)
+	Devminor() int64 // Minor device number (valid for TypeCharDevice or TypeBlockDevice)
 }
 
 type osStat struct {
@@ -169,6 +196,10 @@ func (o *osStat) Kind() FileType {
 		return TypeDirectory
 	} else if o.Mode().Type() == fs.ModeSymlink {
 		return TypeSymlink
+	} else if o.Mode()&fs.ModeCharDevice != 0 {
+		return TypeCharDevice
+	} else if o.Mode()&fs.ModeDevice != 0 {
+		return TypeBlockDevice
 	} else {
 		return TypeRegular
 	}
@@ -430,6 +461,8 @@ type memoryFile struct {
 	uid      int
 	gid      int
 	contents []byte
+	devMajor int64
+	devMinor int64
 }
 
 func (m *memoryFile) Kind() FileType      { return m.kind }
@@ -513,6 +546,24 @@ func NewHardLink(target string) (MutableFile, error) {
 	}, nil
 }
 
+// NewDeviceNode creates a character or block device with the given device numbers.
+func NewDeviceNode(kind FileType, major int64, minor int64) (MutableFile, error) {
+	mode := fs.ModeDevice
+	if kind == TypeCharDevice {
+		mode |= fs.ModeCharDevice
+	} else if kind != TypeBlockDevice {
+		return nil, fmt.Errorf("%s is not a device type", kind)
+	}
+
+	return &memoryFile{
+		kind:     kind,
+		mode:     mode | fs.FileMode(0644),
+		mTime:    time.Now(),
+		devMajor: major,
+		devMinor: minor,
+	}, nil
+}
+
 type SimpleEntry struct {
 	File
 
@@ -0,0 +1,97 @@
+package filesystem
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// The maximum number of symlinks followed when looking up an entry.
+const maxSymlinks = 40
+
+func cleanArchiveName(name string) string {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return ""
+	}
+
+	return strings.TrimPrefix(name, "/")
+}
+
+// LookupArchiveEntry finds the entry for filename in an archive. Symlinks (including
+// in parent directories) and hard links are resolved relative to the root of the archive.
+func LookupArchiveEntry(ark Archive, filename string) (Entry, error) {
+	ents, err := ark.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	// Later entries replace earlier ones like they do when the archive is extracted.
+	entries := make(map[string]Entry)
+	for _, ent := range ents {
+		entries[cleanArchiveName(ent.Name())] = ent
+	}
+
+	remaining := strings.Split(cleanArchiveName(filename), "/")
+	resolved := ""
+	links := 0
+
+	for len(remaining) > 0 {
+		component := remaining[0]
+		remaining = remaining[1:]
+
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			resolved = cleanArchiveName(path.Dir("/" + resolved))
+			continue
+		}
+
+		current := path.Join(resolved, component)
+
+		ent, ok := entries[current]
+		if !ok {
+			// Archives don't always include entries for parent directories.
+			if len(remaining) > 0 {
+				resolved = current
+				continue
+			}
+
+			return nil, fmt.Errorf("%s: file not found", filename)
+		}
+
+		switch ent.Typeflag() {
+		case TypeSymlink:
+			links += 1
+			if links > maxSymlinks {
+				return nil, fmt.Errorf("%s: too many levels of symbolic links", filename)
+			}
+
+			target := ent.Linkname()
+			if strings.HasPrefix(target, "/") {
+				resolved = ""
+			}
+
+			remaining = append(strings.Split(target, "/"), remaining...)
+		case TypeLink:
+			// Hard links are named from the root of the archive.
+			links += 1
+			if links > maxSymlinks {
+				return nil, fmt.Errorf("%s: too many levels of symbolic links", filename)
+			}
+
+			resolved = ""
+			remaining = append(strings.Split(ent.Linkname(), "/"), remaining...)
+		default:
+			resolved = current
+		}
+	}
+
+	ent, ok := entries[resolved]
+	if !ok {
+		return nil, fmt.Errorf("%s: file not found", filename)
+	}
+
+	return ent, nil
+}
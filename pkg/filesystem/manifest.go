@@ -0,0 +1,111 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+)
+
+type manifestEntry struct {
+	typeflag byte
+	mode     int64
+	uid      int
+	gid      int
+	size     int64
+	hash     string
+	linkname string
+	devmajor int64
+	devminor int64
+}
+
+// WriteTarManifest writes a manifest of every file in a tar archive to w.
+// Each line contains the type, mode, owner, size, content hash and path of a file.
+// Entries are sorted by path and modification times are excluded so manifests
+// can be compared between builds. If a path appears more than once the last
+// entry wins, matching how the archive is extracted.
+func WriteTarManifest(r io.Reader, w io.Writer) error {
+	entries := make(map[string]manifestEntry)
+
+	reader := tar.NewReader(r)
+
+	for {
+		hdr, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		name := path.Clean("/" + hdr.Name)
+
+		ent := manifestEntry{
+			typeflag: hdr.Typeflag,
+			mode:     hdr.Mode & 07777,
+			uid:      hdr.Uid,
+			gid:      hdr.Gid,
+			hash:     "-",
+			linkname: hdr.Linkname,
+			devmajor: hdr.Devmajor,
+			devminor: hdr.Devminor,
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			h := sha256.New()
+
+			size, err := io.Copy(h, reader)
+			if err != nil {
+				return err
+			}
+
+			ent.size = size
+			ent.hash = hex.EncodeToString(h.Sum(nil))
+		}
+
+		entries[name] = ent
+	}
+
+	var names []string
+	for name := range entries {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	for _, name := range names {
+		ent := entries[name]
+
+		kind := "?"
+		switch ent.typeflag {
+		case tar.TypeDir:
+			kind = "D"
+		case tar.TypeReg:
+			kind = "R"
+		case tar.TypeSymlink:
+			kind = "S"
+		case tar.TypeLink:
+			kind = "L"
+		case tar.TypeChar:
+			kind = "C"
+		case tar.TypeBlock:
+			kind = "B"
+		}
+
+		line := fmt.Sprintf("%s %04o %d:%d %d %s %s", kind, ent.mode, ent.uid, ent.gid, ent.size, ent.hash, name)
+		if ent.typeflag == tar.TypeSymlink || ent.typeflag == tar.TypeLink {
+			line += " -> " + ent.linkname
+		} else if ent.typeflag == tar.TypeChar || ent.typeflag == tar.TypeBlock {
+			line += fmt.Sprintf(" %d,%d", ent.devmajor, ent.devminor)
+		}
+
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
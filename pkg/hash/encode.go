@@ -0,0 +1,248 @@
+package hash
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// encoder writes the canonical encoding of a definition straight to a writer so
+// large values (like inline file contents) don't need to be buffered before hashing.
+// The output is byte-for-byte identical to encoding the same values with encoding/json
+// so hashes of existing definitions don't change.
+type encoder struct {
+	db  *DefinitionDatabase
+	w   *bufio.Writer
+	buf []byte
+}
+
+func newEncoder(db *DefinitionDatabase, w io.Writer) *encoder {
+	return &encoder{db: db, w: bufio.NewWriter(w)}
+}
+
+func (e *encoder) writeString(s string) {
+	e.w.WriteString(s)
+}
+
+// writeJSON writes a small value using encoding/json so escaping matches exactly.
+func (e *encoder) writeJSON(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	e.w.Write(b)
+
+	return nil
+}
+
+func (e *encoder) writeInt(v int64) {
+	e.buf = strconv.AppendInt(e.buf[:0], v, 10)
+	e.w.Write(e.buf)
+}
+
+func (e *encoder) writeBool(v bool) {
+	e.buf = strconv.AppendBool(e.buf[:0], v)
+	e.w.Write(e.buf)
+}
+
+func (e *encoder) encodeDefinition(d Definition) error {
+	e.writeString(`{"TypeName":`)
+	if err := e.writeJSON(d.SerializableType()); err != nil {
+		return err
+	}
+
+	e.writeString(`,"Params":`)
+	if err := e.encodeFields(d.Params()); err != nil {
+		return err
+	}
+
+	e.writeString(`}`)
+
+	return e.w.Flush()
+}
+
+// encodeFields writes the fields of a struct as a JSON object sorted by field name.
+func (e *encoder) encodeFields(params SerializableValue) error {
+	val := reflect.ValueOf(params)
+
+	if val.Kind() != reflect.Struct {
+		return fmt.Errorf("attempt to marshal non struct: %T", params)
+	}
+
+	typ := val.Type()
+
+	fields := make([]int, typ.NumField())
+	for i := range fields {
+		fields[i] = i
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return typ.Field(fields[i]).Name < typ.Field(fields[j]).Name
+	})
+
+	e.writeString(`{`)
+
+	for i, idx := range fields {
+		if i > 0 {
+			e.writeString(`,`)
+		}
+
+		if err := e.writeJSON(typ.Field(idx).Name); err != nil {
+			return err
+		}
+
+		e.writeString(`:`)
+
+		if err := e.encodeValue(val.Field(idx)); err != nil {
+			return err
+		}
+	}
+
+	e.writeString(`}`)
+
+	return nil
+}
+
+func (e *encoder) encodeValue(field reflect.Value) error {
+	typ := field.Type()
+
+	if (typ.Kind() == reflect.Pointer || typ.Kind() == reflect.Interface) && field.IsNil() {
+		e.writeString(`null`)
+		return nil
+	}
+
+	switch typ.Kind() {
+	case reflect.Slice:
+		if field.Len() == 0 {
+			e.writeString(`null`)
+			return nil
+		}
+
+		// Fast path for byte slices which are encoded as a list of numbers.
+		if typ.Elem() == reflect.TypeFor[uint8]() {
+			e.writeString(`[`)
+			for i, b := range field.Bytes() {
+				if i > 0 {
+					e.writeString(`,`)
+				}
+				e.writeInt(int64(b))
+			}
+			e.writeString(`]`)
+
+			return nil
+		}
+
+		e.writeString(`[`)
+		for i := 0; i < field.Len(); i++ {
+			if i > 0 {
+				e.writeString(`,`)
+			}
+			if err := e.encodeValue(field.Index(i)); err != nil {
+				return err
+			}
+		}
+		e.writeString(`]`)
+
+		return nil
+	case reflect.Map:
+		if typ.Key() != reflect.TypeFor[string]() {
+			return fmt.Errorf("encoding maps only supports string keys")
+		}
+
+		keys := field.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+
+		e.writeString(`{`)
+		for i, k := range keys {
+			if i > 0 {
+				e.writeString(`,`)
+			}
+			if err := e.writeJSON(k.String()); err != nil {
+				return err
+			}
+			e.writeString(`:`)
+			if err := e.encodeValue(field.MapIndex(k)); err != nil {
+				return err
+			}
+		}
+		e.writeString(`}`)
+
+		return nil
+	}
+
+	val := field.Interface()
+
+	if caster, ok := val.(ValueCaster); ok {
+		newVal, err := caster.AsSerializableValue()
+		if err != nil {
+			return err
+		}
+
+		val = newVal
+	}
+
+	switch val := val.(type) {
+	case Definition:
+		hash, err := e.db.HashDefinition(val)
+		if err != nil {
+			return err
+		}
+
+		return e.writeJSON(definitionPointer{
+			TypeName: val.SerializableType(),
+			Hash:     hash,
+		})
+	case SerializableString:
+		return e.writeJSON(string(val))
+	case SerializableBool:
+		e.writeBool(bool(val))
+	case SerializableList:
+		if len(val) == 0 {
+			e.writeString(`null`)
+			return nil
+		}
+
+		e.writeString(`[`)
+		for i, item := range val {
+			if i > 0 {
+				e.writeString(`,`)
+			}
+			if err := e.encodeValue(reflect.ValueOf(item)); err != nil {
+				return err
+			}
+		}
+		e.writeString(`]`)
+	case SerializableValue:
+		e.writeString(`{"TypeName":`)
+		if err := e.writeJSON(val.SerializableType()); err != nil {
+			return err
+		}
+
+		e.writeString(`,"Values":`)
+		if err := e.encodeFields(val); err != nil {
+			return err
+		}
+
+		e.writeString(`}`)
+	case string:
+		return e.writeJSON(val)
+	case int:
+		e.writeInt(int64(val))
+	case bool:
+		e.writeBool(val)
+	case int64:
+		e.writeInt(val)
+	case uint8:
+		e.writeInt(int64(val))
+	default:
+		return fmt.Errorf("encodeValue not implemented: %T %+v", val, val)
+	}
+
+	return nil
+}
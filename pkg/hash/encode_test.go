@@ -0,0 +1,292 @@
+package hash
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+type testValue struct {
+	Name  string
+	Count int
+}
+
+func (testValue) SerializableType() string { return "testValue" }
+
+type testParams struct {
+	Name     string
+	Escaped  string
+	Count    int
+	Size     int64
+	Byte     uint8
+	Enabled  bool
+	Data     []byte
+	Empty    []string
+	Tags     []string
+	Labels   map[string]string
+	Nested   map[string][]int
+	Inner    testValue
+	Values   []testValue
+	List     SerializableList
+	Str      SerializableString
+	Bool     SerializableBool
+	Child    Definition
+	Children []Definition
+	Missing  Definition
+}
+
+func (testParams) SerializableType() string { return "testParams" }
+
+type testDefinition struct {
+	params testParams
+}
+
+func (def *testDefinition) SerializableType() string { return "testDefinition" }
+
+func (def *testDefinition) Create(params SerializableValue) Definition {
+	return &testDefinition{params: params.(testParams)}
+}
+
+func (def *testDefinition) Params() SerializableValue { return def.params }
+
+// legacyMarshalDefinition is MarshalDefinition from before the streaming encoder.
+// It builds the whole value in memory and encodes it with encoding/json.
+func legacyMarshalDefinition(d Definition) ([]byte, error) {
+	params, err := legacyMarshalSerializableValue(d.Params())
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&serializedDefinition{
+		TypeName: d.SerializableType(),
+		Params:   params,
+	})
+}
+
+func legacyHashDefinition(d Definition) (string, error) {
+	val, err := legacyMarshalDefinition(d)
+	if err != nil {
+		return "", err
+	}
+
+	return GetSha256Hash(val), nil
+}
+
+func legacyMarshalSerializableValue(params SerializableValue) (map[string]json.RawMessage, error) {
+	ret := make(map[string]json.RawMessage)
+
+	val := reflect.ValueOf(params)
+
+	if val.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("attempt to marshal non struct: %T", params)
+	}
+
+	typ := reflect.TypeOf(params)
+
+	var encodeValue func(val reflect.Value) (any, error)
+
+	encodeValue = func(field reflect.Value) (any, error) {
+		typ := field.Type()
+
+		if (typ.Kind() == reflect.Pointer || typ.Kind() == reflect.Interface) && field.IsNil() {
+			return nil, nil
+		}
+
+		if typ.Kind() == reflect.Slice {
+			var ret []any
+
+			for i := 0; i < field.Len(); i++ {
+				val, err := encodeValue(field.Index(i))
+				if err != nil {
+					return nil, err
+				}
+
+				ret = append(ret, val)
+			}
+
+			return ret, nil
+		} else if typ.Kind() == reflect.Map {
+			ret := make(map[string]any)
+
+			if typ.Key() != reflect.TypeFor[string]() {
+				return nil, fmt.Errorf("encoding maps only supports string keys")
+			}
+
+			for _, k := range field.MapKeys() {
+				key, err := encodeValue(k)
+				if err != nil {
+					return nil, err
+				}
+
+				val, err := encodeValue(field.MapIndex(k))
+				if err != nil {
+					return nil, err
+				}
+
+				ret[key.(string)] = val
+			}
+
+			return ret, nil
+		} else {
+			val := field.Interface()
+
+			if caster, ok := val.(ValueCaster); ok {
+				newVal, err := caster.AsSerializableValue()
+				if err != nil {
+					return nil, err
+				}
+
+				val = newVal
+			}
+
+			switch val := val.(type) {
+			case Definition:
+				hash, err := legacyHashDefinition(val)
+				if err != nil {
+					return nil, err
+				}
+
+				return definitionPointer{
+					TypeName: val.SerializableType(),
+					Hash:     hash,
+				}, nil
+			case SerializableString:
+				return val, nil
+			case SerializableBool:
+				return val, nil
+			case SerializableList:
+				var ret []any
+
+				for _, item := range val {
+					childVal := reflect.ValueOf(item)
+
+					child, err := encodeValue(childVal)
+					if err != nil {
+						return nil, err
+					}
+
+					ret = append(ret, child)
+				}
+
+				return ret, nil
+			case SerializableValue:
+				values, err := legacyMarshalSerializableValue(val)
+				if err != nil {
+					return nil, err
+				}
+
+				return serializedValue{
+					TypeName: val.SerializableType(),
+					Values:   values,
+				}, nil
+			case string:
+				return val, nil
+			case int:
+				return val, nil
+			case bool:
+				return val, nil
+			case int64:
+				return val, nil
+			case uint8:
+				return val, nil
+			default:
+				return nil, fmt.Errorf("encodeValue not implemented: %T %+v", val, val)
+			}
+		}
+	}
+
+	for i := 0; i < val.NumField(); i++ {
+		field := val.Field(i)
+		fieldType := typ.Field(i)
+
+		encoded, err := encodeValue(field)
+		if err != nil {
+			return nil, err
+		}
+
+		marshalled, err := json.Marshal(encoded)
+		if err != nil {
+			return nil, err
+		}
+
+		ret[fieldType.Name] = marshalled
+	}
+
+	return ret, nil
+}
+
+func TestEncoderMatchesLegacyEncoding(t *testing.T) {
+	leaf := &testDefinition{params: testParams{Name: "leaf", Data: []byte{0, 1, 255}}}
+
+	child := &testDefinition{params: testParams{
+		Name:     "child",
+		Children: []Definition{leaf, leaf},
+	}}
+
+	tests := []struct {
+		name string
+		def  Definition
+	}{
+		{"empty", &testDefinition{}},
+		{"leaf", leaf},
+		{"nested", &testDefinition{params: testParams{
+			Name:    "nested",
+			Escaped: "quote \" slash \\ html <a>&</a> newline \n separator \u2028 unicode é",
+			Count:   -42,
+			Size:    1 << 40,
+			Byte:    200,
+			Enabled: true,
+			Data:    bytes.Repeat([]byte{7, 0, 128}, 100),
+			Empty:   []string{},
+			Tags:    []string{"b", "a", ""},
+			Labels:  map[string]string{"z": "last", "a": "first", "é": "unicode", "": "empty"},
+			Nested:  map[string][]int{"odd": {1, 3}, "even": {2, 4}, "none": nil},
+			Inner:   testValue{Name: "inner", Count: 1},
+			Values:  []testValue{{Name: "one"}, {Name: "two", Count: 2}},
+			List:    SerializableList{SerializableString("item"), testValue{Name: "in list"}, SerializableList{}},
+			Str:     SerializableString("serializable"),
+			Bool:    SerializableBool(true),
+			Child:   child,
+			Children: []Definition{
+				leaf,
+				&testDefinition{params: testParams{Name: "sibling", Child: leaf}},
+			},
+		}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := NewDefinitionDatabase(nil)
+
+			want, err := legacyMarshalDefinition(test.def)
+			if err != nil {
+				t.Fatalf("failed to marshal with the legacy encoder: %s", err)
+			}
+
+			got, err := db.MarshalDefinition(test.def)
+			if err != nil {
+				t.Fatalf("failed to marshal definition: %s", err)
+			}
+
+			if !bytes.Equal(got, want) {
+				t.Fatalf("encoding differs from the legacy encoder:\n got: %s\nwant: %s", got, want)
+			}
+
+			wantHash, err := legacyHashDefinition(test.def)
+			if err != nil {
+				t.Fatalf("failed to hash with the legacy encoder: %s", err)
+			}
+
+			gotHash, err := db.HashDefinition(test.def)
+			if err != nil {
+				t.Fatalf("failed to hash definition: %s", err)
+			}
+
+			if gotHash != wantHash {
+				t.Fatalf("hash = %s, want %s", gotHash, wantHash)
+			}
+		})
+	}
+}
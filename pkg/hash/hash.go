@@ -1,6 +1,7 @@
 package hash
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -96,175 +97,27 @@ func (db *DefinitionDatabase) GetDefinitionByHash(hash string) (Definition, bool
 }
 
 func (db *DefinitionDatabase) HashDefinition(d Definition) (string, error) {
-	val, err := db.MarshalDefinition(d)
-	if err != nil {
+	h := sha256.New()
+
+	if err := newEncoder(db, h).encodeDefinition(d); err != nil {
 		return "", err
 	}
 
-	hash := GetSha256Hash(val)
+	hash := hex.EncodeToString(h.Sum(nil))
 
 	db.cache[hash] = d
 
 	return hash, nil
 }
 
-func (db *DefinitionDatabase) marshalSerializableValue(params SerializableValue) (map[string]json.RawMessage, error) {
-	ret := make(map[string]json.RawMessage)
-
-	val := reflect.ValueOf(params)
-
-	if val.Kind() != reflect.Struct {
-		return nil, fmt.Errorf("attempt to marshal non struct: %T", params)
-	}
-
-	typ := reflect.TypeOf(params)
-
-	var encodeValue func(val reflect.Value) (any, error)
-
-	encodeValue = func(field reflect.Value) (any, error) {
-		typ := field.Type()
-
-		if (typ.Kind() == reflect.Pointer || typ.Kind() == reflect.Interface) && field.IsNil() {
-			return nil, nil
-		}
-
-		if typ.Kind() == reflect.Slice {
-			var ret []any
-
-			for i := 0; i < field.Len(); i++ {
-				val, err := encodeValue(field.Index(i))
-				if err != nil {
-					return nil, err
-				}
-
-				ret = append(ret, val)
-			}
-
-			return ret, nil
-		} else if typ.Kind() == reflect.Map {
-			ret := make(map[string]any)
-
-			if typ.Key() != reflect.TypeFor[string]() {
-				return nil, fmt.Errorf("encoding maps only supports string keys")
-			}
-
-			for _, k := range field.MapKeys() {
-				key, err := encodeValue(k)
-				if err != nil {
-					return nil, err
-				}
-
-				val, err := encodeValue(field.MapIndex(k))
-				if err != nil {
-					return nil, err
-				}
-
-				ret[key.(string)] = val
-			}
-
-			return ret, nil
-		} else {
-			val := field.Interface()
-
-			if caster, ok := val.(ValueCaster); ok {
-				newVal, err := caster.AsSerializableValue()
-				if err != nil {
-					return nil, err
-				}
-
-				val = newVal
-			}
-
-			switch val := val.(type) {
-			case Definition:
-				hash, err := db.HashDefinition(val)
-				if err != nil {
-					return nil, err
-				}
-
-				return definitionPointer{
-					TypeName: val.SerializableType(),
-					Hash:     hash,
-				}, nil
-			case SerializableString:
-				return val, nil
-			case SerializableBool:
-				return val, nil
-			case SerializableList:
-				var ret []any
-
-				for _, item := range val {
-					childVal := reflect.ValueOf(item)
-
-					child, err := encodeValue(childVal)
-					if err != nil {
-						return nil, err
-					}
-
-					ret = append(ret, child)
-				}
-
-				return ret, nil
-			case SerializableValue:
-				values, err := db.marshalSerializableValue(val)
-				if err != nil {
-					return nil, err
-				}
-
-				return serializedValue{
-					TypeName: val.SerializableType(),
-					Values:   values,
-				}, nil
-			case string:
-				return val, nil
-			case int:
-				return val, nil
-			case bool:
-				return val, nil
-			case int64:
-				return val, nil
-			case uint8:
-				return val, nil
-			default:
-				return nil, fmt.Errorf("encodeValue not implemented: %T %+v", val, val)
-			}
-		}
-	}
-
-	for i := 0; i < val.NumField(); i++ {
-		field := val.Field(i)
-		fieldType := typ.Field(i)
-
-		encoded, err := encodeValue(field)
-		if err != nil {
-			return nil, err
-		}
-
-		marshalled, err := json.Marshal(encoded)
-		if err != nil {
-			return nil, err
-		}
-
-		ret[fieldType.Name] = marshalled
-	}
-
-	return ret, nil
-}
-
 func (db *DefinitionDatabase) MarshalDefinition(d Definition) ([]byte, error) {
-	serialized := &serializedDefinition{
-		TypeName: d.SerializableType(),
-	}
+	buf := new(bytes.Buffer)
 
-	params := d.Params()
-
-	var err error
-	serialized.Params, err = db.marshalSerializableValue(params)
-	if err != nil {
+	if err := newEncoder(db, buf).encodeDefinition(d); err != nil {
 		return nil, err
 	}
 
-	return json.Marshal(serialized)
+	return buf.Bytes(), nil
 }
 
 func (db *DefinitionDatabase) unmarshalObject(params any, input map[string]json.RawMessage) (any, error) {
@@ -1,10 +1,15 @@
 package init
 
 import (
+	"bytes"
+	goBuildInfo "debug/buildinfo"
+	"debug/elf"
 	_ "embed"
 	"fmt"
+	"log/slog"
 	"os"
 
+	"github.com/tinyrange/tinyrange/pkg/buildinfo"
 	"github.com/tinyrange/tinyrange/pkg/common"
 	"github.com/tinyrange/tinyrange/pkg/config"
 )
@@ -15,12 +20,32 @@ var INIT_EXECUTABLE []byte
 //go:embed init.star
 var INIT_SCRIPT []byte
 
+// InitVersion returns the build metadata embedded in a init executable.
+func InitVersion(exe []byte) string {
+	info, err := goBuildInfo.Read(bytes.NewReader(exe))
+	if err != nil {
+		return fmt.Sprintf("unknown (%s)", err)
+	}
+
+	return buildinfo.Describe(info)
+}
+
+// lazyInitVersion defers parsing the build info until the log record is actually written.
+type lazyInitVersion []byte
+
+// LogValue implements slog.LogValuer.
+func (exe lazyInitVersion) LogValue() slog.Value {
+	return slog.StringValue(InitVersion(exe))
+}
+
 func GetInitExecutable(arch config.CPUArchitecture) ([]byte, error) {
 	if arch == config.ArchInvalid {
 		arch = config.HostArchitecture
 	}
 
 	if arch.IsNative() {
+		slog.Debug("embedding init", "arch", arch, "version", lazyInitVersion(INIT_EXECUTABLE))
+
 		return INIT_EXECUTABLE, nil
 	} else {
 		exe, err := common.GetAdjacentExecutable(fmt.Sprintf("tinyrange_init_%s", arch))
@@ -33,6 +58,50 @@ func GetInitExecutable(arch config.CPUArchitecture) ([]byte, error) {
 			return nil, err
 		}
 
+		slog.Debug("embedding init", "arch", arch, "filename", exe, "version", lazyInitVersion(buf))
+
 		return buf, nil
 	}
 }
+
+var elfArchitectures = map[elf.Machine]config.CPUArchitecture{
+	elf.EM_X86_64:  config.ArchX8664,
+	elf.EM_AARCH64: config.ArchARM64,
+	elf.EM_RISCV:   config.ArchRISCV64,
+}
+
+// ReadCustomInitExecutable reads a init executable supplied by the user to replace
+// the builtin one. The executable must be a Linux ELF binary for arch.
+func ReadCustomInitExecutable(filename string, arch config.CPUArchitecture) ([]byte, error) {
+	if arch == config.ArchInvalid {
+		arch = config.HostArchitecture
+	}
+
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := elf.NewFile(bytes.NewReader(buf))
+	if err != nil {
+		return nil, fmt.Errorf("init binary %s is not a ELF executable: %w", filename, err)
+	}
+	defer f.Close()
+
+	if f.Type != elf.ET_EXEC && f.Type != elf.ET_DYN {
+		return nil, fmt.Errorf("init binary %s is not a executable (type %s)", filename, f.Type)
+	}
+
+	exeArch, ok := elfArchitectures[f.Machine]
+	if !ok || (exeArch == config.ArchRISCV64 && f.Class != elf.ELFCLASS64) {
+		return nil, fmt.Errorf("init binary %s has unsupported machine type %s", filename, f.Machine)
+	}
+
+	if exeArch != arch {
+		return nil, fmt.Errorf("init binary %s is built for %s but the guest is %s", filename, exeArch, arch)
+	}
+
+	slog.Debug("embedding custom init", "arch", arch, "filename", filename)
+
+	return buf, nil
+}
@@ -0,0 +1,175 @@
+package login
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/tinyrange/tinyrange/pkg/filesystem"
+)
+
+// The default time allowed for the docker daemon to build the image.
+const DEFAULT_DOCKER_TIMEOUT = 30 * time.Minute
+
+// The number of times the image build is attempted if the daemon can't be reached.
+const dockerBuildAttempts = 3
+
+// writeDockerContext writes a docker build context containing the root filesystem and a
+// Dockerfile that runs the install scripts.
+func writeDockerContext(out io.Writer, f filesystem.File) error {
+	w := tar.NewWriter(out)
+
+	fh, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := w.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "rootfs.tar",
+		Size:     info.Size(),
+		Mode:     int64(info.Mode()),
+	}); err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(w, fh); err != nil {
+		return err
+	}
+
+	dockerfile := "FROM scratch\nADD rootfs.tar .\nRUN /init -run-basic-scripts /init.commands.json"
+
+	if err := w.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "Dockerfile",
+		Size:     int64(len(dockerfile)),
+		Mode:     int64(os.ModePerm),
+	}); err != nil {
+		return err
+	}
+
+	if _, err := w.Write([]byte(dockerfile)); err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+// dockerMessage is a single message from the docker image build stream.
+type dockerMessage struct {
+	Stream      string `json:"stream"`
+	Error       string `json:"error"`
+	ErrorDetail struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+}
+
+// startDockerBuild sends the build context to the daemon. The context is streamed through a pipe
+// which is closed with the error from either side so neither goroutine is left blocked.
+func startDockerBuild(ctx context.Context, apiClient *client.Client, f filesystem.File, tag string) (types.ImageBuildResponse, error) {
+	buildCtxOut, buildCtxIn := io.Pipe()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		buildCtxIn.CloseWithError(writeDockerContext(buildCtxIn, f))
+	}()
+
+	resp, err := apiClient.ImageBuild(ctx, buildCtxOut, types.ImageBuildOptions{
+		Tags:       []string{tag},
+		Dockerfile: "Dockerfile",
+	})
+	if err != nil {
+		buildCtxOut.CloseWithError(err)
+		<-done
+
+		return resp, err
+	}
+
+	return resp, nil
+}
+
+// writeDocker builds a docker image tagged tag from the root filesystem archive f.
+func writeDocker(f filesystem.File, tag string, timeout time.Duration) error {
+	if timeout == 0 {
+		timeout = DEFAULT_DOCKER_TIMEOUT
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	apiClient, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		return fmt.Errorf("failed to connect to docker: %w", err)
+	}
+	defer apiClient.Close()
+
+	var resp types.ImageBuildResponse
+
+	for attempt := 1; ; attempt++ {
+		resp, err = startDockerBuild(ctx, apiClient, f, tag)
+		if err == nil {
+			break
+		}
+
+		if attempt == dockerBuildAttempts || ctx.Err() != nil {
+			return fmt.Errorf("failed to start docker build: %w", err)
+		}
+
+		slog.Warn("docker build failed, retrying", "attempt", attempt, "err", err)
+
+		select {
+		case <-time.After(time.Duration(attempt) * time.Second):
+		case <-ctx.Done():
+			return fmt.Errorf("failed to start docker build: %w", ctx.Err())
+		}
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+
+	for {
+		var msg dockerMessage
+
+		err := dec.Decode(&msg)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("docker build timed out after %s", timeout)
+			}
+
+			return fmt.Errorf("failed to read docker build output: %w", err)
+		}
+
+		if msg.Error != "" {
+			if msg.ErrorDetail.Message != "" {
+				return fmt.Errorf("docker build failed: %s", msg.ErrorDetail.Message)
+			}
+
+			return fmt.Errorf("docker build failed: %s", msg.Error)
+		}
+
+		if msg.Stream != "" {
+			fmt.Fprintf(os.Stdout, "%s", msg.Stream)
+		}
+	}
+
+	return nil
+}
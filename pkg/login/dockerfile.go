@@ -0,0 +1,357 @@
+package login
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// dockerfileDirectoryFiles returns a --file argument for each file in dir which copies it to the same
+// relative path under dest. Empty directories aren't created since only files can be copied.
+func dockerfileDirectoryFiles(dir string, dest string) ([]string, error) {
+	var ret []string
+
+	err := filepath.WalkDir(dir, func(filename string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		if !d.Type().IsRegular() {
+			return fmt.Errorf("only regular files can be copied from a directory: %s", filename)
+		}
+
+		rel, err := filepath.Rel(dir, filename)
+		if err != nil {
+			return err
+		}
+
+		ret = append(ret, filename+","+path.Join(dest, filepath.ToSlash(rel)))
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// splitDockerfileWords splits s into words the way Dockerfile arguments are split.
+// Single and double quotes group words and a backslash escapes the next character.
+func splitDockerfileWords(s string) ([]string, error) {
+	var (
+		ret     []string
+		current strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+
+	for _, c := range s {
+		if escaped {
+			current.WriteRune(c)
+			escaped = false
+			continue
+		}
+
+		switch {
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				current.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t':
+			if inWord {
+				ret = append(ret, current.String())
+				current.Reset()
+				inWord = false
+			}
+		default:
+			current.WriteRune(c)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+
+	if inWord {
+		ret = append(ret, current.String())
+	}
+
+	return ret, nil
+}
+
+// dockerfileArgs parses the arguments of a instruction in either the JSON (exec) form or the plain form.
+func dockerfileArgs(args string) ([]string, bool, error) {
+	if strings.HasPrefix(args, "[") {
+		var ret []string
+		if err := json.Unmarshal([]byte(args), &ret); err == nil {
+			return ret, true, nil
+		}
+	}
+
+	words, err := splitDockerfileWords(args)
+	return words, false, err
+}
+
+// dockerfileBuilder converts a FROM image like alpine:3.20 into a builder name like alpine@3.20.
+func dockerfileBuilder(image string) (string, error) {
+	if image == "scratch" {
+		return "", fmt.Errorf("FROM scratch is not supported")
+	}
+
+	if strings.Contains(image, "@") {
+		return "", fmt.Errorf("image digests are not supported: %s", image)
+	}
+
+	image = strings.TrimPrefix(image, "docker.io/")
+	image = strings.TrimPrefix(image, "library/")
+
+	// Only a : after the last / is a tag. An earlier one is a registry port.
+	slash := strings.LastIndex(image, "/")
+	if colon := strings.LastIndex(image, ":"); colon > slash {
+		return image[:colon] + "@" + image[colon+1:], nil
+	}
+
+	return image, nil
+}
+
+// ParseDockerfile reads a Dockerfile into config. Only FROM, RUN, COPY, ENV, and WORKDIR are supported.
+// FROM sets the builder and COPY sources are relative to contextDir.
+func ParseDockerfile(r io.Reader, contextDir string, config *Config) error {
+	var (
+		lines     []string
+		lineStart []int
+	)
+
+	// Join continuation lines and drop comments.
+	scanner := bufio.NewScanner(r)
+
+	lineNumber := 0
+	current := ""
+	start := 0
+	for scanner.Scan() {
+		lineNumber += 1
+
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if current == "" {
+			if line == "" {
+				continue
+			}
+			start = lineNumber
+		}
+
+		if strings.HasSuffix(line, "\\") {
+			current += strings.TrimSuffix(line, "\\")
+			continue
+		}
+
+		lines = append(lines, current+line)
+		lineStart = append(lineStart, start)
+		current = ""
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if current != "" {
+		lines = append(lines, current)
+		lineStart = append(lineStart, start)
+	}
+
+	workdir := ""
+	seenFrom := false
+
+	for i, line := range lines {
+		instruction, args, _ := strings.Cut(line, " ")
+		instruction = strings.ToUpper(instruction)
+		args = strings.TrimSpace(args)
+
+		fail := func(format string, a ...any) error {
+			return fmt.Errorf("line %d: %s: %s", lineStart[i], instruction, fmt.Sprintf(format, a...))
+		}
+
+		if instruction != "FROM" && !seenFrom {
+			return fail("the Dockerfile must start with FROM")
+		}
+
+		if strings.HasPrefix(args, "--") {
+			return fail("flags are not supported")
+		}
+
+		switch instruction {
+		case "FROM":
+			if seenFrom {
+				return fail("multi-stage builds are not supported")
+			}
+			seenFrom = true
+
+			words, _, err := dockerfileArgs(args)
+			if err != nil {
+				return fail("%s", err)
+			}
+			if len(words) != 1 {
+				return fail("expected a single image, multi-stage builds are not supported")
+			}
+
+			builder, err := dockerfileBuilder(words[0])
+			if err != nil {
+				return fail("%s", err)
+			}
+
+			config.Builder = builder
+		case "RUN":
+			if args == "" {
+				return fail("missing command")
+			}
+
+			command := args
+
+			words, exec, err := dockerfileArgs(args)
+			if err != nil {
+				return fail("%s", err)
+			}
+			if exec {
+				command = shellJoin(words)
+			}
+
+			if workdir != "" {
+				command = "cd " + shellQuote(workdir) + " && " + command
+			}
+
+			config.Commands = append(config.Commands, command)
+		case "COPY":
+			words, _, err := dockerfileArgs(args)
+			if err != nil {
+				return fail("%s", err)
+			}
+			if len(words) < 2 {
+				return fail("expected at least one source and a destination")
+			}
+
+			sources := words[:len(words)-1]
+			dest := words[len(words)-1]
+
+			toDir := strings.HasSuffix(dest, "/") || dest == "."
+			if len(sources) > 1 && !toDir {
+				return fail("the destination must end with / when copying several files")
+			}
+
+			if !path.IsAbs(dest) {
+				base := workdir
+				if base == "" {
+					base = "/"
+				}
+				dest = path.Join(base, dest)
+			}
+
+			for _, source := range sources {
+				if strings.ContainsAny(source, "*?[") {
+					return fail("wildcards are not supported: %s", source)
+				}
+
+				hostFilename := source
+				if !filepath.IsAbs(hostFilename) {
+					hostFilename = filepath.Join(contextDir, hostFilename)
+				}
+
+				info, err := os.Stat(hostFilename)
+				if err != nil {
+					return fail("%s", err)
+				}
+
+				// Like docker the contents of a directory are copied into the destination.
+				if info.IsDir() {
+					files, err := dockerfileDirectoryFiles(hostFilename, dest)
+					if err != nil {
+						return fail("%s", err)
+					}
+
+					config.Files = append(config.Files, files...)
+
+					continue
+				}
+
+				target := dest
+				if toDir {
+					target = path.Join(dest, path.Base(filepath.ToSlash(source)))
+				}
+
+				config.Files = append(config.Files, hostFilename+","+target)
+			}
+		case "ENV":
+			words, _, err := dockerfileArgs(args)
+			if err != nil {
+				return fail("%s", err)
+			}
+			if len(words) == 0 {
+				return fail("missing variable")
+			}
+
+			if !strings.Contains(words[0], "=") {
+				// The legacy ENV key value form.
+				if len(words) < 2 {
+					return fail("missing value for %s", words[0])
+				}
+
+				config.Environment = append(config.Environment, words[0]+"="+strings.Join(words[1:], " "))
+				continue
+			}
+
+			for _, word := range words {
+				if !strings.Contains(word, "=") {
+					return fail("expected key=value: %s", word)
+				}
+
+				config.Environment = append(config.Environment, word)
+			}
+		case "WORKDIR":
+			words, _, err := dockerfileArgs(args)
+			if err != nil {
+				return fail("%s", err)
+			}
+			if len(words) != 1 {
+				return fail("expected a single directory")
+			}
+
+			if path.IsAbs(words[0]) || workdir == "" {
+				workdir = path.Join("/", words[0])
+			} else {
+				workdir = path.Join(workdir, words[0])
+			}
+
+			// Like docker the directory is created if it doesn't exist.
+			config.Commands = append(config.Commands, "mkdir -p "+shellQuote(workdir))
+		default:
+			return fail("unsupported instruction (only FROM, RUN, COPY, ENV, and WORKDIR are supported)")
+		}
+	}
+
+	if !seenFrom {
+		return fmt.Errorf("the Dockerfile has no FROM instruction")
+	}
+
+	return nil
+}
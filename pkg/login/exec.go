@@ -0,0 +1,25 @@
+package login
+
+import (
+	"strings"
+)
+
+// shellQuote quotes s so /bin/sh treats it as a single word.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:,+@%") == "" {
+		return s
+	}
+
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shellJoin joins args into a shell command that runs them without further expansion.
+func shellJoin(args []string) string {
+	var quoted []string
+
+	for _, arg := range args {
+		quoted = append(quoted, shellQuote(arg))
+	}
+
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,140 @@
+package login
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var variableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type variableExpander struct {
+	vars   map[string]string
+	host   bool
+	strict bool
+}
+
+func (e *variableExpander) lookup(name string) (string, bool) {
+	if val, ok := e.vars[name]; ok {
+		return val, true
+	}
+
+	if e.host {
+		return os.LookupEnv(name)
+	}
+
+	return "", false
+}
+
+// expand replaces ${VAR} references in s. $$ is replaced with a single $ and
+// any other $ is left as-is so shell syntax like $1 still reaches the guest.
+func (e *variableExpander) expand(s string) (string, error) {
+	var ret strings.Builder
+
+	for {
+		i := strings.IndexByte(s, '$')
+		if i == -1 || i == len(s)-1 {
+			ret.WriteString(s)
+			break
+		}
+
+		ret.WriteString(s[:i])
+
+		switch s[i+1] {
+		case '$':
+			ret.WriteByte('$')
+			s = s[i+2:]
+		case '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end == -1 {
+				return "", fmt.Errorf("unterminated variable reference in %q", s)
+			}
+
+			name := s[i+2 : i+end]
+			if !variableName.MatchString(name) {
+				return "", fmt.Errorf("invalid variable name %q", name)
+			}
+
+			val, ok := e.lookup(name)
+			if !ok && e.strict {
+				return "", fmt.Errorf("undefined variable %s", name)
+			}
+
+			ret.WriteString(val)
+			s = s[i+end+1:]
+		default:
+			ret.WriteByte('$')
+			s = s[i+1:]
+		}
+	}
+
+	return ret.String(), nil
+}
+
+func (e *variableExpander) expandAll(values []string) ([]string, error) {
+	var ret []string
+
+	for _, val := range values {
+		expanded, err := e.expand(val)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, expanded)
+	}
+
+	return ret, nil
+}
+
+// withExpandedVariables returns a copy of the config with ${VAR} references expanded in
+// the environment, files, archives, packages, macros, and commands. Environment entries
+// are expanded in order and can refer to variables defined before them.
+func (config *Config) withExpandedVariables() (*Config, error) {
+	if !config.ExpandVariables {
+		return config, nil
+	}
+
+	expander := &variableExpander{
+		vars:   make(map[string]string),
+		host:   config.HostVariables,
+		strict: config.StrictVariables,
+	}
+
+	ret := *config
+
+	ret.Environment = nil
+
+	for _, env := range config.Environment {
+		expanded, err := expander.expand(env)
+		if err != nil {
+			return nil, fmt.Errorf("failed to expand environment: %w", err)
+		}
+
+		if key, value, ok := strings.Cut(expanded, "="); ok {
+			expander.vars[key] = value
+		}
+
+		ret.Environment = append(ret.Environment, expanded)
+	}
+
+	var err error
+
+	for _, field := range []struct {
+		name   string
+		values *[]string
+	}{
+		{"files", &ret.Files},
+		{"archives", &ret.Archives},
+		{"packages", &ret.Packages},
+		{"macros", &ret.Macros},
+		{"commands", &ret.Commands},
+	} {
+		*field.values, err = expander.expandAll(*field.values)
+		if err != nil {
+			return nil, fmt.Errorf("failed to expand %s: %w", field.name, err)
+		}
+	}
+
+	return &ret, nil
+}
@@ -0,0 +1,69 @@
+package login
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+)
+
+// runPostRun runs the post run command on the host. The output filename, exit status, and
+// error from the run are passed in the environment as TINYRANGE_OUTPUT, TINYRANGE_EXIT_STATUS,
+// and TINYRANGE_ERROR.
+func (config *Config) runPostRun(runErr error) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", config.PostRun)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", config.PostRun)
+	}
+
+	output := ""
+	if config.Output != "" && !config.OutputStdout {
+		abs, err := filepath.Abs(path.Base(config.Output))
+		if err != nil {
+			return err
+		}
+
+		output = abs
+	}
+
+	status := 0
+	errMessage := ""
+	if runErr != nil {
+		status = 1
+		errMessage = runErr.Error()
+
+		var exitErr interface{ ExitCode() int }
+		if errors.As(runErr, &exitErr) && exitErr.ExitCode() > 0 {
+			status = exitErr.ExitCode()
+		}
+	}
+
+	cmd.Env = append(os.Environ(),
+		"TINYRANGE_OUTPUT="+output,
+		fmt.Sprintf("TINYRANGE_EXIT_STATUS=%d", status),
+		"TINYRANGE_ERROR="+errMessage,
+	)
+
+	slog.Debug("running post run command", "command", config.PostRun)
+
+	out, err := cmd.CombinedOutput()
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		slog.Info("post run", "output", scanner.Text())
+	}
+
+	if err != nil {
+		return fmt.Errorf("post run command failed: %w", err)
+	}
+
+	return nil
+}
@@ -1,11 +1,13 @@
 package login
 
 import (
-	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -16,14 +18,17 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
+	"github.com/agnivade/levenshtein"
+	"github.com/klauspost/compress/zstd"
 	"github.com/tinyrange/tinyrange/pkg/builder"
 	"github.com/tinyrange/tinyrange/pkg/common"
 	cfg "github.com/tinyrange/tinyrange/pkg/config"
 	"github.com/tinyrange/tinyrange/pkg/database"
-	"gopkg.in/yaml.v3"
+	"github.com/tinyrange/tinyrange/pkg/filesystem"
+	initExec "github.com/tinyrange/tinyrange/pkg/init"
+	"golang.org/x/crypto/ssh"
 )
 
 func detectArchiveExtractor(base common.BuildDefinition, filename string) (common.BuildDefinition, error) {
@@ -56,6 +61,46 @@ func sha256HashFromFile(filename string) (string, error) {
 	return sha256HashFromReader(f)
 }
 
+// validateBuilder checks that a container builder exists for the architecture and
+// returns an error listing the available builders if it doesn't.
+func validateBuilder(db *database.PackageDatabase, name string, arch cfg.CPUArchitecture) error {
+	if arch == cfg.ArchInvalid {
+		arch = cfg.HostArchitecture
+	}
+
+	if _, ok := db.ContainerBuilders[fmt.Sprintf("%s-%s", name, arch)]; ok {
+		return nil
+	}
+
+	var names []string
+
+	for _, builder := range db.ContainerBuilders {
+		if builder.Architecture != arch {
+			continue
+		}
+
+		names = append(names, builder.Name)
+	}
+
+	if len(names) == 0 {
+		return fmt.Errorf("builder %s not found: no builders are available for %s", name, arch)
+	}
+
+	slices.Sort(names)
+
+	closest := slices.MinFunc(names, func(a, b string) int {
+		return levenshtein.ComputeDistance(a, name) - levenshtein.ComputeDistance(b, name)
+	})
+
+	msg := fmt.Sprintf("builder %s not found for %s. Did you mean %s?\navailable builders:", name, arch, closest)
+
+	for _, builder := range names {
+		msg += "\n - " + builder
+	}
+
+	return errors.New(msg)
+}
+
 var CURRENT_CONFIG_VERSION = 1
 
 type Config struct {
@@ -66,24 +111,159 @@ type Config struct {
 	Files        []string `json:"files,omitempty" yaml:"files,omitempty"`
 	Archives     []string `json:"archives,omitempty" yaml:"archives,omitempty"`
 	Output       string   `json:"output,omitempty" yaml:"output,omitempty"`
-	Packages     []string `json:"packages,omitempty" yaml:"packages,omitempty"`
-	Macros       []string `json:"macros,omitempty" yaml:"macros,omitempty"`
-	Environment  []string `json:"environment,omitempty" yaml:"environment,omitempty"`
-	NoScripts    bool     `json:"no_scripts,omitempty" yaml:"no_scripts,omitempty"`
-	Init         string   `json:"init,omitempty" yaml:"init,omitempty"`
-	ForwardPorts []string `json:"forward_ports,omitempty" yaml:"forward_ports,omitempty"`
+	// Names of registered OutputTransformers applied to the output in order before it's written.
+	OutputTransforms []string `json:"output_transforms,omitempty" yaml:"output_transforms,omitempty"`
+	Packages         []string `json:"packages,omitempty" yaml:"packages,omitempty"`
+	Macros           []string `json:"macros,omitempty" yaml:"macros,omitempty"`
+	Environment      []string `json:"environment,omitempty" yaml:"environment,omitempty"`
+	NoScripts        bool     `json:"no_scripts,omitempty" yaml:"no_scripts,omitempty"`
+	Init             string   `json:"init,omitempty" yaml:"init,omitempty"`
+	InitBinary       string   `json:"init_binary,omitempty" yaml:"init_binary,omitempty"`
+	ForwardPorts     []string `json:"forward_ports,omitempty" yaml:"forward_ports,omitempty"`
+	Args             []string `json:"args,omitempty" yaml:"args,omitempty"`
+	ArgsFile         string   `json:"args_file,omitempty" yaml:"args_file,omitempty"`
+	Nftables         string   `json:"nftables,omitempty" yaml:"nftables,omitempty"`
+	AllowDomains     []string `json:"allow_domains,omitempty" yaml:"allow_domains,omitempty"`
+	AllowCIDRs       []string `json:"allow_cidrs,omitempty" yaml:"allow_cidrs,omitempty"`
+
+	// A label for the virtual machine included in logs and lifecycle events.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+
+	// A PEM file of extra CA certificates to trust when downloading packages. --ca-bundle takes priority.
+	CABundle string `json:"ca_bundle,omitempty" yaml:"ca_bundle,omitempty"`
+
+	// Build each command into a cached layer rather than running them when the VM boots.
+	Layers bool `json:"layers,omitempty" yaml:"layers,omitempty"`
+
+	// Use the builtin init shell for interactive sessions if the guest has no shell.
+	FallbackShell bool `json:"fallback_shell,omitempty" yaml:"fallback_shell,omitempty"`
+
+	// Expand ${VAR} references using earlier environment entries (and with --host-vars the host environment).
+	ExpandVariables bool `json:"expand_variables,omitempty" yaml:"expand_variables,omitempty"`
+	StrictVariables bool `json:"strict_variables,omitempty" yaml:"strict_variables,omitempty"`
 
 	// secure configs that have to be set on the command line.
-	CpuCores          int      `json:"-" yaml:"-"`
-	MemorySize        int      `json:"-" yaml:"-"`
-	StorageSize       int      `json:"-" yaml:"-"`
-	Debug             bool     `json:"-" yaml:"-"`
-	WriteRoot         string   `json:"-" yaml:"-"`
-	WriteDocker       string   `json:"-" yaml:"-"`
-	ExperimentalFlags []string `json:"-" yaml:"-"`
-	Hash              bool     `json:"-" yaml:"-"`
-	WebSSH            string   `json:"-" yaml:"-"`
-	WriteTemplate     bool     `json:"-" yaml:"-"`
+	CpuCores           int           `json:"-" yaml:"-"`
+	MemorySize         int           `json:"-" yaml:"-"`
+	StorageSize        int           `json:"-" yaml:"-"`
+	Debug              bool          `json:"-" yaml:"-"`
+	HostVariables      bool          `json:"-" yaml:"-"`
+	OutputStdout       bool          `json:"-" yaml:"-"`
+	WriteRoot          string        `json:"-" yaml:"-"`
+	WriteDocker        string        `json:"-" yaml:"-"`
+	WriteDockerTimeout time.Duration `json:"-" yaml:"-"`
+	WriteVagrant       string        `json:"-" yaml:"-"`
+	Manifest           string        `json:"-" yaml:"-"`
+	ExperimentalFlags  []string      `json:"-" yaml:"-"`
+	Hash               bool          `json:"-" yaml:"-"`
+	HashOnly           bool          `json:"-" yaml:"-"`
+	WebSSH             string        `json:"-" yaml:"-"`
+	SshInfo            string        `json:"-" yaml:"-"`
+	SshUsername        string        `json:"-" yaml:"-"`
+	SshPassword        string        `json:"-" yaml:"-"`
+	SshKey             string        `json:"-" yaml:"-"`
+	SshAuthorizedKeys  string        `json:"-" yaml:"-"`
+	SshPort            int           `json:"-" yaml:"-"`
+	WebTLS             bool          `json:"-" yaml:"-"`
+	WebTLSCert         string        `json:"-" yaml:"-"`
+	WebTLSKey          string        `json:"-" yaml:"-"`
+	WriteTemplate      bool          `json:"-" yaml:"-"`
+	ForceRebuild       bool          `json:"-" yaml:"-"`
+	HypervisorArgs     []string      `json:"-" yaml:"-"`
+	DataDisks          []string      `json:"-" yaml:"-"`
+	Persist            string        `json:"-" yaml:"-"`
+	HttpCache          string        `json:"-" yaml:"-"`
+	ResourceLimits     bool          `json:"-" yaml:"-"`
+	ShareCache         bool          `json:"-" yaml:"-"`
+	EventsSocket       string        `json:"-" yaml:"-"`
+	KeepAlive          bool          `json:"-" yaml:"-"`
+	ForwardIdleTimeout time.Duration `json:"-" yaml:"-"`
+	Secrets            []string      `json:"-" yaml:"-"`
+	SecretFiles        []string      `json:"-" yaml:"-"`
+	KernelArgs         []string      `json:"-" yaml:"-"`
+	PostRun            string        `json:"-" yaml:"-"`
+	PostRunAlways      bool          `json:"-" yaml:"-"`
+	PlanJson           string        `json:"-" yaml:"-"`
+	ExecCommand        []string      `json:"-" yaml:"-"`
+}
+
+// writeManifest writes a manifest of the root filesystem archive in f to filename.
+func writeManifest(f filesystem.File, filename string) error {
+	fh, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	out, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := filesystem.WriteTarManifest(fh, out); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	return out.Close()
+}
+
+// writeBootManifest writes a manifest of the root filesystem the virtual machine boots with.
+// It's planned without the --write-root and --write-docker options so scripts and commands
+// are included like they are when booting.
+func (config *Config) writeBootManifest(db *database.PackageDatabase, arch cfg.CPUArchitecture) error {
+	bootConfig := *config
+	bootConfig.WriteRoot = ""
+	bootConfig.WriteDocker = ""
+
+	directives, _, err := bootConfig.getDirectives(db)
+	if err != nil {
+		return err
+	}
+
+	initDirective, err := bootConfig.initDirective(arch)
+	if err != nil {
+		return err
+	}
+
+	directives = append(directives, initDirective)
+
+	def := builder.NewBuildFsDefinition(directives, "tar")
+
+	// When --write-root is also given the plan for the written root is saved instead.
+	if config.WriteRoot == "" {
+		if err := bootConfig.writePlanJson(db, directives, arch, def); err != nil {
+			return err
+		}
+	}
+
+	ctx := db.NewBuildContext(def)
+
+	f, err := db.Build(ctx, def, common.BuildOptions{})
+	if err != nil {
+		return err
+	}
+
+	return writeManifest(f, config.Manifest)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// newArchiveWriter compresses a tar archive written to w based on the extension of filename.
+// .tar.gz/.tgz uses gzip, .tar.zst uses zstd, and anything else is written uncompressed.
+func newArchiveWriter(filename string, w io.Writer) (io.WriteCloser, error) {
+	switch {
+	case strings.HasSuffix(filename, ".tar.gz") || strings.HasSuffix(filename, ".tgz"):
+		return gzip.NewWriter(w), nil
+	case strings.HasSuffix(filename, ".tar.zst"):
+		return zstd.NewWriter(w)
+	default:
+		return nopWriteCloser{Writer: w}, nil
+	}
 }
 
 func (config *Config) parseInclusion(db *database.PackageDatabase, inclusion string) (common.Directive, error) {
@@ -99,10 +279,8 @@ func (config *Config) parseInclusion(db *database.PackageDatabase, inclusion str
 	}
 	defer f.Close()
 
-	dec := yaml.NewDecoder(f)
-
-	if err := dec.Decode(&subConfig); err != nil {
-		return nil, err
+	if err := DecodeConfig(f, &subConfig); err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", inclusion, err)
 	}
 
 	if subConfig.Output == "" {
@@ -138,13 +316,8 @@ func (config *Config) parseInclusion(db *database.PackageDatabase, inclusion str
 	}, nil
 }
 
-func (config *Config) getDirectives(db *database.PackageDatabase) ([]common.Directive, string, error) {
-	var directives []common.Directive
-
-	if config.Builder == "" {
-		return nil, "", fmt.Errorf("please specify a builder")
-	}
-
+// planTags returns the tags used to plan the installation of the packages.
+func (config *Config) planTags() common.TagList {
 	var tags common.TagList
 
 	tags = append(tags, "level3", "defaults")
@@ -157,23 +330,61 @@ func (config *Config) getDirectives(db *database.PackageDatabase) ([]common.Dire
 		tags = append(tags, "noScripts")
 	}
 
+	return tags
+}
+
+// commandDirectives returns the commands from the user. They are run as given so
+// each one is marked repeatable even if a macro or an earlier command ran it already.
+func (config *Config) commandDirectives() []common.Directive {
+	var ret []common.Directive
+
+	for _, cmd := range config.Commands {
+		ret = append(ret, common.DirectiveRepeatable{Directive: common.DirectiveRunCommand{Command: cmd}})
+	}
+
+	return ret
+}
+
+func (config *Config) getDirectives(db *database.PackageDatabase) ([]common.Directive, string, error) {
+	var directives []common.Directive
+
+	if config.Builder == "" {
+		return nil, "", fmt.Errorf("please specify a builder")
+	}
+
+	config, err := config.withExpandedVariables()
+	if err != nil {
+		return nil, "", err
+	}
+
+	tags := config.planTags()
+
 	arch, err := cfg.ArchitectureFromString(config.Architecture)
 	if err != nil {
 		return nil, "", err
 	}
 
+	if err := validateBuilder(db, config.Builder, arch); err != nil {
+		return nil, "", err
+	}
+
 	for _, filename := range config.Files {
+		// Files are copied to /root unless a guest filename is given after a comma.
+		filename, target, hasTarget := splitFileTarget(filename)
+
 		if strings.HasPrefix(filename, "http://") || strings.HasPrefix(filename, "https://") {
 			parsed, err := url.Parse(filename)
 			if err != nil {
 				return nil, "", err
 			}
 
-			base := path.Base(parsed.Path)
+			if !hasTarget {
+				target = path.Join("/root", path.Base(parsed.Path))
+			}
 
 			directives = append(directives, common.DirectiveAddFile{
 				Definition: builder.NewFetchHttpBuildDefinition(filename, 0, nil),
-				Filename:   path.Join("/root", base),
+				Filename:   target,
 			})
 		} else {
 			absPath, err := filepath.Abs(filename)
@@ -181,9 +392,13 @@ func (config *Config) getDirectives(db *database.PackageDatabase) ([]common.Dire
 				return nil, "", err
 			}
 
+			if !hasTarget {
+				target = path.Join("/root", filepath.Base(absPath))
+			}
+
 			directives = append(directives, common.DirectiveLocalFile{
 				HostFilename: absPath,
-				Filename:     path.Join("/root", filepath.Base(absPath)),
+				Filename:     target,
 			})
 		}
 	}
@@ -279,13 +494,19 @@ func (config *Config) getDirectives(db *database.PackageDatabase) ([]common.Dire
 		}
 	}
 
-	if config.WriteRoot == "" && config.WriteDocker == "" {
-		if len(config.Commands) == 0 && config.Init == "" {
+	if config.Layers {
+		// The commands are built into layers so they are part of every output.
+		directives = append(directives, config.commandDirectives()...)
+
+		if config.WriteRoot == "" && config.WriteDocker == "" &&
+			config.Output == "" && config.Init == "" && len(config.ExecCommand) == 0 {
+			directives = append(directives, common.DirectiveRunCommand{Command: "interactive"})
+		}
+	} else if config.WriteRoot == "" && config.WriteDocker == "" {
+		if len(config.Commands) == 0 && config.Init == "" && len(config.ExecCommand) == 0 {
 			directives = append(directives, common.DirectiveRunCommand{Command: "interactive"})
 		} else {
-			for _, cmd := range config.Commands {
-				directives = append(directives, common.DirectiveRunCommand{Command: cmd})
-			}
+			directives = append(directives, config.commandDirectives()...)
 		}
 	}
 
@@ -325,12 +546,21 @@ func (config *Config) getDirectives(db *database.PackageDatabase) ([]common.Dire
 
 	directives = append([]common.Directive{planDirective}, directives...)
 
+	if config.Layers {
+		directives = builder.NewLayeredDirectives(directives, arch, config.CpuCores, config.MemorySize, config.StorageSize)
+	}
+
 	return directives, interaction, nil
 }
 
 func (config *Config) MakeTemplate(db *database.PackageDatabase) (string, error) {
-	if config.Version > CURRENT_CONFIG_VERSION {
-		return "", fmt.Errorf("attempt to run config version %d on TinyRange version %d", config.Version, CURRENT_CONFIG_VERSION)
+	return config.MakeTemplateContext(context.Background(), db)
+}
+
+// MakeTemplateContext is like MakeTemplate but stops building once ctx is cancelled.
+func (config *Config) MakeTemplateContext(ctx context.Context, db *database.PackageDatabase) (string, error) {
+	if err := config.checkVersion(); err != nil {
+		return "", err
 	}
 
 	directives, interaction, err := config.getDirectives(db)
@@ -351,6 +581,118 @@ func (config *Config) MakeTemplate(db *database.PackageDatabase) (string, error)
 		interaction = "webssh," + config.WebSSH
 	}
 
+	if config.SshInfo != "" {
+		interaction = "info," + config.SshInfo
+	}
+
+	def, err := config.newVmDefinition(directives, interaction, arch)
+	if err != nil {
+		return "", err
+	}
+
+	return config.buildTemplate(ctx, db, def)
+}
+
+// sshKeys returns the absolute path of the private key TinyRange connects to the guest with and
+// the public keys the guest SSH server accepts in the authorized_keys format.
+func (config *Config) sshKeys() (string, string, error) {
+	var authorizedKeys []string
+
+	if config.SshAuthorizedKeys != "" {
+		contents, err := os.ReadFile(config.SshAuthorizedKeys)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read authorized keys: %w", err)
+		}
+
+		rest := contents
+		for len(bytes.TrimSpace(rest)) > 0 {
+			key, comment, _, next, err := ssh.ParseAuthorizedKey(rest)
+			if err != nil {
+				return "", "", fmt.Errorf("failed to parse authorized keys %s: %w", config.SshAuthorizedKeys, err)
+			}
+
+			line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+			if comment != "" {
+				line += " " + comment
+			}
+
+			authorizedKeys = append(authorizedKeys, line)
+			rest = next
+		}
+
+		if len(authorizedKeys) == 0 && config.SshPassword == "" {
+			return "", "", fmt.Errorf("%s has no keys and no --ssh-password is set", config.SshAuthorizedKeys)
+		}
+	}
+
+	keyFile := ""
+
+	if config.SshKey != "" {
+		var err error
+
+		// The template is run from the build directory so the path has to be absolute.
+		keyFile, err = filepath.Abs(config.SshKey)
+		if err != nil {
+			return "", "", err
+		}
+
+		contents, err := os.ReadFile(keyFile)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read SSH key: %w", err)
+		}
+
+		signer, err := ssh.ParsePrivateKey(contents)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to parse SSH key %s: %w", config.SshKey, err)
+		}
+
+		authorizedKeys = append(authorizedKeys, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))))
+	} else if config.SshPassword == "" {
+		return "", "", fmt.Errorf("--ssh-authorized-keys disables password authentication so --ssh-key or --ssh-password is needed for TinyRange to connect")
+	}
+
+	if len(authorizedKeys) == 0 {
+		return keyFile, "", nil
+	}
+
+	return keyFile, strings.Join(authorizedKeys, "\n") + "\n", nil
+}
+
+// dataDisks returns DataDisks with the image paths made absolute so they are found when the
+// template is run from the build directory.
+func (config *Config) dataDisks() ([]string, error) {
+	var ret []string
+
+	for _, disk := range config.DataDisks {
+		size, source, ok := strings.Cut(disk, ":")
+		if ok && source != "" {
+			abs, err := filepath.Abs(source)
+			if err != nil {
+				return nil, err
+			}
+
+			disk = size + ":" + abs
+		}
+
+		ret = append(ret, disk)
+	}
+
+	return ret, nil
+}
+
+// splitFileTarget splits a file given as "file,/path/in/guest". It only splits on the
+// last comma when an absolute guest path follows so host filenames can contain commas.
+func splitFileTarget(file string) (string, string, bool) {
+	idx := strings.LastIndex(file, ",")
+	if idx == -1 || !path.IsAbs(file[idx+1:]) {
+		return file, "", false
+	}
+
+	return file[:idx], file[idx+1:], true
+}
+
+// newVmDefinition creates the virtual machine definition with the options from the config.
+func (config *Config) newVmDefinition(directives []common.Directive, interaction string, arch cfg.CPUArchitecture) (*builder.BuildVmDefinition, error) {
 	def := builder.NewBuildVmDefinition(
 		directives,
 		nil, nil,
@@ -360,23 +702,233 @@ func (config *Config) MakeTemplate(db *database.PackageDatabase) (string, error)
 		interaction, config.Debug,
 	)
 
+	// The template is cached so the directory and hypervisor script it's run with have to be part of the hash.
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+
+	def.SetBaseDirectory(wd)
+
+	// The script is only needed once the VM starts so a missing script isn't an error here.
+	if hvScript, err := common.GetAdjacentExecutable("tinyrange_qemu.star"); err == nil {
+		contents, err := os.ReadFile(hvScript)
+		if err != nil {
+			return nil, err
+		}
+
+		def.SetHypervisorDigest(fmt.Sprintf("%x", sha256.Sum256(contents)))
+	}
+
+	def.SetHypervisorArgs(config.HypervisorArgs)
+
+	dataDisks, err := config.dataDisks()
+	if err != nil {
+		return nil, err
+	}
+
+	def.SetDataDisks(dataDisks)
+	def.SetPersist(config.Persist)
+	def.SetHttpCache(config.HttpCache)
+	def.SetResourceLimits(config.ResourceLimits)
+	def.SetShareCache(config.ShareCache)
+	def.SetEventsSocket(config.EventsSocket)
+	def.SetName(config.Name)
+	def.SetKeepAlive(config.KeepAlive)
+	def.SetForwardIdleTimeout(config.ForwardIdleTimeout)
+	def.SetSshCredentials(config.SshUsername, config.SshPassword)
+	def.SetSshPort(config.SshPort)
+	def.SetNetworkAllowlist(config.AllowDomains, config.AllowCIDRs)
+
+	if config.SshKey != "" || config.SshAuthorizedKeys != "" {
+		keyFile, authorizedKeys, err := config.sshKeys()
+		if err != nil {
+			return nil, err
+		}
+
+		def.SetSshKeys(keyFile, authorizedKeys)
+	}
+
+	def.SetFallbackShell(config.FallbackShell)
+	def.SetKernelArgs(config.KernelArgs)
+	def.SetExecCommand(shellJoin(config.ExecCommand))
+
+	if config.InitBinary != "" {
+		// The template is run from the build directory so the path has to be absolute.
+		initBinary, err := filepath.Abs(config.InitBinary)
+		if err != nil {
+			return nil, err
+		}
+
+		def.SetInitBinary(initBinary)
+	}
+
+	webTLS := common.TLSOptions{TLS: config.WebTLS, CertFile: config.WebTLSCert, KeyFile: config.WebTLSKey}
+	if err := webTLS.Validate(); err != nil {
+		return nil, err
+	}
+
+	if webTLS.CertFile != "" {
+		// Like InitBinary these are loaded when the template is run from the build directory.
+		certFile, err := filepath.Abs(webTLS.CertFile)
+		if err != nil {
+			return nil, err
+		}
+
+		keyFile, err := filepath.Abs(webTLS.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		webTLS.CertFile = certFile
+		webTLS.KeyFile = keyFile
+	}
+
+	def.SetWebTLS(webTLS)
+
+	initArgs, err := config.initArgs()
+	if err != nil {
+		return nil, err
+	}
+
+	def.SetInitArgs(initArgs)
+
+	secrets, err := cfg.ParseSecrets(config.Secrets, config.SecretFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	def.SetSecrets(secrets)
+
+	return def, nil
+}
+
+// initDirective returns the directive that adds init to a root filesystem. This
+// is the builtin init unless InitBinary replaces it.
+func (config *Config) initDirective(arch cfg.CPUArchitecture) (common.Directive, error) {
+	if config.InitBinary == "" {
+		return common.DirectiveBuiltin{Name: "init", Architecture: string(arch), GuestFilename: "init"}, nil
+	}
+
+	buf, err := initExec.ReadCustomInitExecutable(config.InitBinary, arch)
+	if err != nil {
+		return nil, err
+	}
+
+	return common.DirectiveAddFile{Filename: "init", Contents: buf, Executable: true}, nil
+}
+
+// initArgs returns the JSON object written to /init.json in the guest. The
+// values from ArgsFile are loaded first then each key=value in Args is merged
+// over them. Returns "" if no arguments are set.
+func (config *Config) initArgs() (string, error) {
+	if config.ArgsFile == "" && len(config.Args) == 0 && config.Nftables == "" {
+		return "", nil
+	}
+
+	args := make(map[string]any)
+
+	if config.ArgsFile != "" {
+		contents, err := os.ReadFile(config.ArgsFile)
+		if err != nil {
+			return "", err
+		}
+
+		if err := json.Unmarshal(contents, &args); err != nil {
+			return "", fmt.Errorf("failed to parse args file %s: %w", config.ArgsFile, err)
+		}
+	}
+
+	for _, arg := range config.Args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return "", fmt.Errorf("invalid argument syntax (key=value): %s", arg)
+		}
+
+		args[key] = value
+	}
+
+	// The ruleset is applied by init.star after the network is configured.
+	if config.Nftables != "" {
+		ruleset, err := os.ReadFile(config.Nftables)
+		if err != nil {
+			return "", err
+		}
+
+		args["nftables"] = string(ruleset)
+	}
+
+	bytes, err := json.Marshal(args)
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytes), nil
+}
+
+// buildTemplate writes the virtual machine config for def and returns the filename.
+// The template is cached using the definition hash so it's only rebuilt if the inputs
+// changed or ForceRebuild is set.
+func (config *Config) buildTemplate(goCtx context.Context, db *database.PackageDatabase, def *builder.BuildVmDefinition) (string, error) {
 	def.SetBuildTemplateMode()
 
-	ctx := db.NewBuildContext(def)
+	ctx := db.NewBuildContextWithContext(goCtx, def)
 
-	_, err = db.Build(ctx, def, common.BuildOptions{AlwaysRebuild: true})
-	if built, ok := err.(builder.ErrTemplateBuilt); ok {
-		return string(built), nil
-	} else if err != nil {
+	f, err := db.Build(ctx, def, common.BuildOptions{AlwaysRebuild: config.ForceRebuild})
+	if err != nil {
 		return "", err
-	} else {
-		return "", fmt.Errorf("failed to write template output")
 	}
+
+	return ctx.FilenameFromDigest(f.Digest())
 }
 
 func (config *Config) Run(db *database.PackageDatabase) error {
-	if config.Version > CURRENT_CONFIG_VERSION {
-		return fmt.Errorf("attempt to run config version %d on TinyRange version %d", config.Version, CURRENT_CONFIG_VERSION)
+	err := config.run(db)
+
+	if config.PostRun != "" && !config.HashOnly && (err == nil || config.PostRunAlways) {
+		if hookErr := config.runPostRun(err); hookErr != nil {
+			return errors.Join(err, hookErr)
+		}
+	}
+
+	return err
+}
+
+func (config *Config) run(db *database.PackageDatabase) error {
+	if err := config.checkVersion(); err != nil {
+		return err
+	}
+
+	var stdout *os.File
+	if config.OutputStdout {
+		if config.Output == "" {
+			return fmt.Errorf("--output-stdout needs a file to copy from the guest with --output")
+		}
+
+		// Keep anything else printed while building (including the guest console) out of the output stream.
+		stdout = common.RedirectStdout()
+	}
+
+	for _, name := range config.OutputTransforms {
+		if _, err := getOutputTransformer(name); err != nil {
+			return err
+		}
+	}
+
+	if config.HashOnly && (config.WriteRoot != "" || config.Manifest != "" || config.WriteDocker != "" || config.WriteVagrant != "") {
+		return fmt.Errorf("--hash-only only hashes the virtual machine definition and can't be combined with --write-root, --manifest, --write-docker, or --write-vagrant")
+	}
+
+	// SSH credentials are only passed to the virtual machine when it's run so a template
+	// (or a Vagrant box made from one) would fall back to the default password.
+	if config.SshPassword != "" || config.SshKey != "" || config.SshAuthorizedKeys != "" {
+		if config.WriteTemplate {
+			return fmt.Errorf("--template can't be combined with --ssh-password, --ssh-key, or --ssh-authorized-keys since SSH credentials aren't written to templates")
+		}
+
+		if config.WriteVagrant != "" {
+			return fmt.Errorf("--write-vagrant can't be combined with --ssh-password, --ssh-key, or --ssh-authorized-keys since SSH credentials aren't written to Vagrant boxes")
+		}
 	}
 
 	if config.Builder == "list" {
@@ -387,27 +939,41 @@ func (config *Config) Run(db *database.PackageDatabase) error {
 		return nil
 	}
 
-	directives, interaction, err := config.getDirectives(db)
+	arch, err := cfg.ArchitectureFromString(config.Architecture)
 	if err != nil {
 		return err
 	}
 
-	arch, err := cfg.ArchitectureFromString(config.Architecture)
+	if config.Manifest != "" {
+		if err := config.writeBootManifest(db, arch); err != nil {
+			return err
+		}
+	}
+
+	directives, interaction, err := config.getDirectives(db)
 	if err != nil {
 		return err
 	}
 
 	if config.WriteRoot != "" {
-		directives = append(directives, common.DirectiveBuiltin{Name: "init", Architecture: string(arch), GuestFilename: "init"})
+		initDirective, err := config.initDirective(arch)
+		if err != nil {
+			return err
+		}
+
+		directives = append(directives, initDirective)
 
 		def := builder.NewBuildFsDefinition(directives, "tar")
 
+		if err := config.writePlanJson(db, directives, arch, def); err != nil {
+			return err
+		}
+
 		ctx := db.NewBuildContext(def)
 
 		f, err := db.Build(ctx, def, common.BuildOptions{})
 		if err != nil {
-			slog.Error("fatal", "err", err)
-			os.Exit(1)
+			return err
 		}
 
 		fh, err := f.Open()
@@ -422,119 +988,68 @@ func (config *Config) Run(db *database.PackageDatabase) error {
 		}
 		defer out.Close()
 
-		if _, err := io.Copy(out, fh); err != nil {
+		w, err := newArchiveWriter(config.WriteRoot, out)
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(w, fh); err != nil {
+			w.Close()
 			return err
 		}
 
-		return nil
+		return w.Close()
 	} else if config.WriteDocker != "" {
-		ctx := context.Background()
-
-		apiClient, err := client.NewClientWithOpts(client.FromEnv)
+		initDirective, err := config.initDirective(arch)
 		if err != nil {
-			slog.Error("fatal", "err", err)
-			os.Exit(1)
+			return err
 		}
-		defer apiClient.Close()
 
-		directives = append(directives, common.DirectiveBuiltin{Name: "init", Architecture: string(arch), GuestFilename: "init"})
+		directives = append(directives, initDirective)
 
 		def := builder.NewBuildFsDefinition(directives, "tar")
 
+		if err := config.writePlanJson(db, directives, arch, def); err != nil {
+			return err
+		}
+
 		buildCtx := db.NewBuildContext(def)
 
 		f, err := db.Build(buildCtx, def, common.BuildOptions{})
 		if err != nil {
-			slog.Error("fatal", "err", err)
-			os.Exit(1)
+			return err
 		}
 
-		buildCtxOut, buildCtxIn := io.Pipe()
-
-		go func() {
-			err := func() error {
-				defer buildCtxIn.Close()
-
-				w := tar.NewWriter(buildCtxIn)
-
-				fh, err := f.Open()
-				if err != nil {
-					return err
-				}
-				defer fh.Close()
-
-				info, err := f.Stat()
-				if err != nil {
-					return err
-				}
-
-				if err := w.WriteHeader(&tar.Header{
-					Typeflag: tar.TypeReg,
-					Name:     "rootfs.tar",
-					Size:     info.Size(),
-					Mode:     int64(info.Mode()),
-				}); err != nil {
-					return err
-				}
-
-				if _, err := io.Copy(w, fh); err != nil {
-					return err
-				}
-
-				dockerfile := "FROM scratch\nADD rootfs.tar .\nRUN /init -run-basic-scripts /init.commands.json"
-
-				if err := w.WriteHeader(&tar.Header{
-					Typeflag: tar.TypeReg,
-					Name:     "Dockerfile",
-					Size:     int64(len(dockerfile)),
-					Mode:     int64(os.ModePerm),
-				}); err != nil {
-					return err
-				}
-
-				if _, err := w.Write([]byte(dockerfile)); err != nil {
-					return err
-				}
-
-				return nil
-			}()
-			if err != nil {
-				slog.Error("fatal", "err", err)
-				os.Exit(1)
-			}
-		}()
-
-		resp, err := apiClient.ImageBuild(ctx, buildCtxOut, types.ImageBuildOptions{
-			Tags:       []string{config.WriteDocker},
-			Dockerfile: "Dockerfile",
-		})
+		return writeDocker(f, config.WriteDocker, config.WriteDockerTimeout)
+	} else if config.WriteVagrant != "" {
+		// Vagrant connects over SSH so the interaction from the config is ignored.
+		def, err := config.newVmDefinition(directives, "ssh", arch)
 		if err != nil {
 			return err
 		}
-		defer resp.Body.Close()
 
-		dec := json.NewDecoder(resp.Body)
+		if err := config.writePlanJson(db, directives, arch, def); err != nil {
+			return err
+		}
 
-		var item map[string]any
+		templateFilename, err := config.buildTemplate(context.Background(), db, def)
+		if err != nil {
+			return err
+		}
 
-		for {
-			item = nil
+		templateFile, err := os.Open(templateFilename)
+		if err != nil {
+			return err
+		}
+		defer templateFile.Close()
 
-			err := dec.Decode(&item)
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				return err
-			}
+		var vmCfg cfg.TinyRangeConfig
 
-			if stream, ok := item["stream"]; ok {
-				fmt.Fprintf(os.Stdout, "%s", stream)
-			} else {
-				slog.Info("", "item", item)
-			}
+		if err := json.NewDecoder(templateFile).Decode(&vmCfg); err != nil {
+			return fmt.Errorf("failed to read template: %w", err)
 		}
 
-		return nil
+		return writeVagrantBox(vmCfg, filepath.Dir(templateFilename), path.Base(config.WriteVagrant))
 	} else {
 		if config.Init != "" {
 			interaction = "init," + config.Init
@@ -544,37 +1059,48 @@ func (config *Config) Run(db *database.PackageDatabase) error {
 			interaction = "webssh," + config.WebSSH
 		}
 
-		def := builder.NewBuildVmDefinition(
-			directives,
-			nil, nil,
-			config.Output,
-			config.CpuCores, config.MemorySize, arch,
-			config.StorageSize,
-			interaction, config.Debug,
-		)
+		if config.SshInfo != "" {
+			interaction = "info," + config.SshInfo
+		}
 
-		if config.WriteTemplate {
-			def.SetBuildTemplateMode()
+		if len(config.ExecCommand) > 0 {
+			interaction = "exec"
+		}
 
-			ctx := db.NewBuildContext(def)
+		def, err := config.newVmDefinition(directives, interaction, arch)
+		if err != nil {
+			return err
+		}
 
-			_, err := db.Build(ctx, def, common.BuildOptions{AlwaysRebuild: true})
-			if built, ok := err.(builder.ErrTemplateBuilt); ok {
-				fmt.Printf("%s\n", string(built))
+		if err := config.writePlanJson(db, directives, arch, def); err != nil {
+			return err
+		}
 
-				return nil
-			} else if err != nil {
+		if config.HashOnly {
+			// Hashing only resolves the directives so nothing is built.
+			defHash, err := db.HashDefinition(def)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("%s\n", defHash)
+
+			return nil
+		} else if config.WriteTemplate {
+			filename, err := config.buildTemplate(context.Background(), db, def)
+			if err != nil {
 				return err
-			} else {
-				return fmt.Errorf("failed to write template output")
 			}
+
+			fmt.Printf("%s\n", filename)
+
+			return nil
 		} else if config.Output != "" {
 			ctx := db.NewBuildContext(def)
 
 			defHash, err := db.HashDefinition(def)
 			if err != nil {
-				slog.Error("fatal", "err", err)
-				os.Exit(1)
+				return err
 			}
 
 			opts := common.BuildOptions{}
@@ -585,8 +1111,7 @@ func (config *Config) Run(db *database.PackageDatabase) error {
 
 			f, err := db.Build(ctx, def, opts)
 			if err != nil {
-				slog.Error("fatal", "err", err)
-				os.Exit(1)
+				return err
 			}
 
 			fh, err := f.Open()
@@ -595,14 +1120,20 @@ func (config *Config) Run(db *database.PackageDatabase) error {
 			}
 			defer fh.Close()
 
-			out, err := os.Create(path.Base(config.Output))
-			if err != nil {
-				return err
-			}
-			defer out.Close()
+			if stdout != nil {
+				if err := transformOutput(config.OutputTransforms, fh, stdout); err != nil {
+					return err
+				}
+			} else {
+				out, err := os.Create(path.Base(config.Output))
+				if err != nil {
+					return err
+				}
+				defer out.Close()
 
-			if _, err := io.Copy(out, fh); err != nil {
-				return err
+				if err := transformOutput(config.OutputTransforms, fh, out); err != nil {
+					return err
+				}
 			}
 
 			if config.Hash {
@@ -615,8 +1146,7 @@ func (config *Config) Run(db *database.PackageDatabase) error {
 			if _, err := db.Build(ctx, def, common.BuildOptions{
 				AlwaysRebuild: true,
 			}); err != nil {
-				slog.Error("fatal", "err", err)
-				os.Exit(1)
+				return err
 			}
 
 			// if common.IsVerbose() {
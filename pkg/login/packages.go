@@ -0,0 +1,48 @@
+package login
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/tinyrange/tinyrange/pkg/common"
+)
+
+// ReadPackagesFile reads a list of packages with one package query per line like a pip
+// requirements file. Blank lines are skipped and anything after a # is a comment.
+func ReadPackagesFile(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ret []string
+
+	scanner := bufio.NewScanner(f)
+
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber += 1
+
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+
+		if line == "" {
+			continue
+		}
+
+		if _, err := common.ParsePackageQuery(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid package %q: %w", filename, lineNumber, line, err)
+		}
+
+		ret = append(ret, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,120 @@
+package login
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/tinyrange/tinyrange/pkg/common"
+	cfg "github.com/tinyrange/tinyrange/pkg/config"
+	"github.com/tinyrange/tinyrange/pkg/database"
+	"github.com/tinyrange/tinyrange/pkg/hash"
+)
+
+type planJsonDirective struct {
+	Type  string          `json:"type"`
+	Tag   string          `json:"tag,omitempty"`
+	Hash  string          `json:"hash,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// The machine readable form of a resolved login config written by --plan-json.
+type planJson struct {
+	Builder      string                     `json:"builder"`
+	Architecture string                     `json:"architecture"`
+	Hash         string                     `json:"hash"`
+	Packages     []database.ResolvedPackage `json:"packages"`
+	Directives   []planJsonDirective        `json:"directives"`
+}
+
+func (config *Config) planJsonDirective(db *database.PackageDatabase, dir common.Directive) (planJsonDirective, error) {
+	ret := planJsonDirective{Type: fmt.Sprintf("%T", dir)}
+
+	if val, ok := dir.(hash.SerializableValue); ok {
+		ret.Type = val.SerializableType()
+	}
+
+	if def, ok := dir.(common.BuildDefinition); ok {
+		hash, err := db.HashDefinition(def)
+		if err != nil {
+			return ret, err
+		}
+
+		ret.Tag = def.Tag()
+		ret.Hash = hash
+
+		return ret, nil
+	}
+
+	// Directives that aren't definitions are plain values.
+	if value, err := json.Marshal(dir); err == nil {
+		ret.Value = value
+	}
+
+	return ret, nil
+}
+
+// writePlanJson writes the resolved packages, directives, and hash of def to config.PlanJson.
+func (config *Config) writePlanJson(
+	db *database.PackageDatabase,
+	directives []common.Directive,
+	arch cfg.CPUArchitecture,
+	def common.BuildDefinition,
+) error {
+	if config.PlanJson == "" {
+		return nil
+	}
+
+	if arch == cfg.ArchInvalid {
+		arch = cfg.HostArchitecture
+	}
+
+	expanded, err := config.withExpandedVariables()
+	if err != nil {
+		return err
+	}
+
+	var queries []common.PackageQuery
+
+	for _, arg := range expanded.Packages {
+		q, err := common.ParsePackageQuery(arg)
+		if err != nil {
+			return err
+		}
+
+		queries = append(queries, q)
+	}
+
+	packages, err := db.ResolvePackages(config.Builder, arch, queries, config.planTags())
+	if err != nil {
+		return fmt.Errorf("failed to resolve packages: %w", err)
+	}
+
+	defHash, err := db.HashDefinition(def)
+	if err != nil {
+		return err
+	}
+
+	out := planJson{
+		Builder:      config.Builder,
+		Architecture: string(arch),
+		Hash:         defHash,
+		Packages:     packages,
+	}
+
+	for _, dir := range directives {
+		ent, err := config.planJsonDirective(db, dir)
+		if err != nil {
+			return err
+		}
+
+		out.Directives = append(out.Directives, ent)
+	}
+
+	contents, err := json.MarshalIndent(&out, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(config.PlanJson, contents, os.FileMode(0644))
+}
@@ -0,0 +1,129 @@
+package login
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	cfg "github.com/tinyrange/tinyrange/pkg/config"
+	"github.com/tinyrange/tinyrange/pkg/database"
+)
+
+// The maximum number of search results shown at once.
+const selectMaxResults = 20
+
+// SelectPackages runs a terminal picker that searches the builder for packages and adds them to
+// config.Packages. Entering a search shows numbered results, entering the numbers adds them,
+// -name removes a selected package, and an empty line finishes the selection.
+func (config *Config) SelectPackages(db *database.PackageDatabase, in io.Reader, out io.Writer) error {
+	arch, err := cfg.ArchitectureFromString(config.Architecture)
+	if err != nil {
+		return err
+	}
+
+	if arch == cfg.ArchInvalid {
+		arch = cfg.HostArchitecture
+	}
+
+	if err := validateBuilder(db, config.Builder, arch); err != nil {
+		return err
+	}
+
+	ctx := db.NewBuildContext(nil)
+
+	scanner := bufio.NewScanner(in)
+
+	var results []string
+
+	fmt.Fprintf(out, "Search %s for packages. Enter numbers to add results, -name to remove a package, or an empty line to continue.\n", config.Builder)
+
+	for {
+		if len(config.Packages) > 0 {
+			fmt.Fprintf(out, "selected: %s\n", strings.Join(config.Packages, " "))
+		}
+
+		fmt.Fprint(out, "search> ")
+
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			break
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			break
+		}
+
+		if name, ok := strings.CutPrefix(line, "-"); ok {
+			idx := slices.Index(config.Packages, name)
+			if idx == -1 {
+				fmt.Fprintf(out, "%s is not selected\n", name)
+				continue
+			}
+
+			config.Packages = slices.Delete(config.Packages, idx, idx+1)
+
+			continue
+		}
+
+		if selected, ok := parseSelection(line, len(results)); ok {
+			for _, i := range selected {
+				if !slices.Contains(config.Packages, results[i]) {
+					config.Packages = append(config.Packages, results[i])
+				}
+			}
+
+			continue
+		}
+
+		names, err := db.SearchPackageNames(ctx, config.Builder, arch, line, database.RankingPrefix)
+		if err != nil {
+			return err
+		}
+
+		results = nil
+
+		for _, name := range names {
+			if len(results) == selectMaxResults {
+				break
+			}
+
+			if slices.Contains(config.Packages, name) {
+				continue
+			}
+
+			results = append(results, name)
+		}
+
+		if len(results) == 0 {
+			fmt.Fprintln(out, "No results found")
+			continue
+		}
+
+		for i, name := range results {
+			fmt.Fprintf(out, "%3d) %s\n", i+1, name)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// parseSelection parses a list of 1-based result numbers. It returns false if the line isn't
+// a selection so it can be used as a search instead.
+func parseSelection(line string, count int) ([]int, bool) {
+	var ret []int
+
+	for _, field := range strings.Fields(line) {
+		i, err := strconv.Atoi(field)
+		if err != nil || i < 1 || i > count {
+			return nil, false
+		}
+
+		ret = append(ret, i-1)
+	}
+
+	return ret, true
+}
@@ -0,0 +1,152 @@
+package login
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// OutputTransformer converts the output of a build before it's written.
+type OutputTransformer interface {
+	Transform(in io.Reader, out io.Writer) error
+}
+
+// OutputTransformerFunc adapts a function to a OutputTransformer.
+type OutputTransformerFunc func(in io.Reader, out io.Writer) error
+
+// Transform implements OutputTransformer.
+func (f OutputTransformerFunc) Transform(in io.Reader, out io.Writer) error {
+	return f(in, out)
+}
+
+var (
+	outputTransformersMtx sync.Mutex
+	outputTransformers    = make(map[string]OutputTransformer)
+)
+
+// RegisterOutputTransformer makes a transformer available to output_transforms in configs.
+// It's meant to be called at startup (usually from init) and panics if name is already registered.
+func RegisterOutputTransformer(name string, transformer OutputTransformer) {
+	outputTransformersMtx.Lock()
+	defer outputTransformersMtx.Unlock()
+
+	if _, ok := outputTransformers[name]; ok {
+		panic("output transformer already registered: " + name)
+	}
+
+	outputTransformers[name] = transformer
+}
+
+// OutputTransformerNames returns the names of every registered transformer in sorted order.
+func OutputTransformerNames() []string {
+	outputTransformersMtx.Lock()
+	defer outputTransformersMtx.Unlock()
+
+	var ret []string
+	for name := range outputTransformers {
+		ret = append(ret, name)
+	}
+
+	slices.Sort(ret)
+
+	return ret
+}
+
+func getOutputTransformer(name string) (OutputTransformer, error) {
+	outputTransformersMtx.Lock()
+	transformer, ok := outputTransformers[name]
+	outputTransformersMtx.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown output transform %q (available: %s)", name, strings.Join(OutputTransformerNames(), ", "))
+	}
+
+	return transformer, nil
+}
+
+// transformOutput copies in to out through each of the named transformers in order.
+func transformOutput(names []string, in io.Reader, out io.Writer) error {
+	var transformers []OutputTransformer
+
+	for _, name := range names {
+		transformer, err := getOutputTransformer(name)
+		if err != nil {
+			return err
+		}
+
+		transformers = append(transformers, transformer)
+	}
+
+	if len(transformers) == 0 {
+		_, err := io.Copy(out, in)
+		return err
+	}
+
+	// Every transformer except the last writes to a pipe read by the next one.
+	var pipes []*io.PipeReader
+	defer func() {
+		// Unblock earlier transformers if a later one stopped reading.
+		for _, pipe := range pipes {
+			pipe.Close()
+		}
+	}()
+
+	r := in
+
+	for _, transformer := range transformers[:len(transformers)-1] {
+		pr, pw := io.Pipe()
+
+		go func(transformer OutputTransformer, r io.Reader) {
+			pw.CloseWithError(transformer.Transform(r, pw))
+		}(transformer, r)
+
+		pipes = append(pipes, pr)
+		r = pr
+	}
+
+	return transformers[len(transformers)-1].Transform(r, out)
+}
+
+func init() {
+	RegisterOutputTransformer("gzip", OutputTransformerFunc(func(in io.Reader, out io.Writer) error {
+		w := gzip.NewWriter(out)
+
+		if _, err := io.Copy(w, in); err != nil {
+			w.Close()
+			return err
+		}
+
+		return w.Close()
+	}))
+
+	RegisterOutputTransformer("zstd", OutputTransformerFunc(func(in io.Reader, out io.Writer) error {
+		w, err := zstd.NewWriter(out)
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(w, in); err != nil {
+			w.Close()
+			return err
+		}
+
+		return w.Close()
+	}))
+
+	RegisterOutputTransformer("base64", OutputTransformerFunc(func(in io.Reader, out io.Writer) error {
+		w := base64.NewEncoder(base64.StdEncoding, out)
+
+		if _, err := io.Copy(w, in); err != nil {
+			w.Close()
+			return err
+		}
+
+		return w.Close()
+	}))
+}
@@ -0,0 +1,73 @@
+package login
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+type errorReader struct {
+	err error
+}
+
+func (r errorReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestTransformOutputNone(t *testing.T) {
+	var out bytes.Buffer
+
+	if err := transformOutput(nil, strings.NewReader("hello"), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.String() != "hello" {
+		t.Fatalf("output = %q, expected %q", out.String(), "hello")
+	}
+}
+
+func TestTransformOutputChain(t *testing.T) {
+	input := strings.Repeat("hello world\n", 10000)
+
+	var out bytes.Buffer
+
+	if err := transformOutput([]string{"gzip", "base64"}, strings.NewReader(input), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	// Undo the transforms in reverse order.
+	r, err := gzip.NewReader(base64.NewDecoder(base64.StdEncoding, &out))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(decoded) != input {
+		t.Fatal("decoded output doesn't match the input")
+	}
+}
+
+func TestTransformOutputUnknown(t *testing.T) {
+	err := transformOutput([]string{"gzip", "missing"}, strings.NewReader("hello"), io.Discard)
+	if err == nil || !strings.Contains(err.Error(), `"missing"`) {
+		t.Fatalf("expected an unknown transform error, got %v", err)
+	}
+}
+
+func TestTransformOutputError(t *testing.T) {
+	readErr := errors.New("read failed")
+
+	// The error from the first transformer is passed down the pipe to the last one.
+	err := transformOutput([]string{"gzip", "base64"}, errorReader{err: readErr}, io.Discard)
+	if !errors.Is(err, readErr) {
+		t.Fatalf("expected %v, got %v", readErr, err)
+	}
+}
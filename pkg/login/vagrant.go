@@ -0,0 +1,201 @@
+package login
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	cfg "github.com/tinyrange/tinyrange/pkg/config"
+	"github.com/tinyrange/tinyrange/pkg/qcow2"
+	"github.com/tinyrange/tinyrange/pkg/tinyrange"
+)
+
+// The Vagrantfile shipped in the box. Vagrant merges it with the Vagrantfile of the project.
+// The guest runs the TinyRange init as PID 1 so it only has the builtin SSH server and no sudo.
+const vagrantfileTemplate = `Vagrant.configure("2") do |config|
+  config.vm.synced_folder ".", "/vagrant", disabled: true
+
+  config.ssh.username = %s
+  config.ssh.password = %s
+  config.ssh.insert_key = false
+  config.ssh.guest_port = %d
+  config.ssh.shell = "sh"
+  config.ssh.sudo_command = "%%c"
+
+  config.vm.provider :libvirt do |libvirt|
+    libvirt.cpus = %d
+    libvirt.memory = %d
+    libvirt.kernel = File.join(File.dirname(__FILE__), "vmlinux")
+    libvirt.cmd_line = %s
+  end
+end
+`
+
+// rubyString quotes s as a Ruby single-quoted string so nothing in it is interpolated.
+func rubyString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `'`, `\'`)
+
+	return "'" + s + "'"
+}
+
+type vagrantMetadata struct {
+	Provider    string `json:"provider"`
+	Format      string `json:"format"`
+	VirtualSize int64  `json:"virtual_size"`
+}
+
+func writeTarFile(w *tar.Writer, name string, size int64, r io.Reader) error {
+	if err := w.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  time.Now(),
+	}); err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func writeTarFileFrom(w *tar.Writer, name string, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	return writeTarFile(w, name, info.Size(), f)
+}
+
+// writeVagrantBox writes a Vagrant box for the libvirt provider from the virtual machine template vmCfg.
+// The root filesystem is converted to a qcow2 image and booted directly with the TinyRange kernel.
+func writeVagrantBox(vmCfg cfg.TinyRangeConfig, buildDir string, filename string) error {
+	if vmCfg.Architecture != cfg.ArchX8664 {
+		return fmt.Errorf("vagrant boxes are only supported for %s", cfg.ArchX8664)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "tinyrange-vagrant-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	rawFilename := filepath.Join(tmpDir, "root.img")
+
+	// Reuse the filesystem export from run-vm to build the root filesystem image.
+	if err := tinyrange.RunWithConfig(buildDir, vmCfg, false, false, rawFilename, "", ""); err != nil {
+		return fmt.Errorf("failed to build root filesystem: %w", err)
+	}
+
+	raw, err := os.Open(rawFilename)
+	if err != nil {
+		return err
+	}
+	defer raw.Close()
+
+	rawInfo, err := raw.Stat()
+	if err != nil {
+		return err
+	}
+
+	imageFilename := filepath.Join(tmpDir, "box.img")
+
+	image, err := os.Create(imageFilename)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	if err := qcow2.Write(image, raw, rawInfo.Size()); err != nil {
+		return fmt.Errorf("failed to write qcow2 image: %w", err)
+	}
+
+	if err := image.Close(); err != nil {
+		return err
+	}
+
+	metadata, err := json.Marshal(&vagrantMetadata{
+		Provider: "libvirt",
+		Format:   "qcow2",
+		// Vagrant expects the size in gigabytes.
+		VirtualSize: (rawInfo.Size() + 1<<30 - 1) >> 30,
+	})
+	if err != nil {
+		return err
+	}
+
+	cmdline := []string{
+		"console=ttyS0",
+		"reboot=k",
+		"panic=-1",
+		"init=/init",
+		"root=/dev/vda",
+		"rw",
+		"random.trust_cpu=on",
+		"tinyrange.interaction=ssh",
+		// There's no TinyRange network stack so use the address from the libvirt network.
+		"tinyrange.network=dhcp",
+	}
+	cmdline = append(cmdline, vmCfg.KernelArgs...)
+
+	username, password := vmCfg.SshCredentials()
+
+	vagrantfile := fmt.Sprintf(vagrantfileTemplate,
+		rubyString(username), rubyString(password),
+		vmCfg.SshGuestPort(), vmCfg.CPUCores, vmCfg.MemoryMB,
+		rubyString(strings.Join(cmdline, " ")),
+	)
+
+	out, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gz := gzip.NewWriter(out)
+
+	w := tar.NewWriter(gz)
+
+	if err := writeTarFile(w, "metadata.json", int64(len(metadata)), strings.NewReader(string(metadata))); err != nil {
+		return err
+	}
+
+	if err := writeTarFile(w, "Vagrantfile", int64(len(vagrantfile)), strings.NewReader(vagrantfile)); err != nil {
+		return err
+	}
+
+	if err := writeTarFileFrom(w, "vmlinux", vmCfg.Resolve(vmCfg.KernelFilename)); err != nil {
+		return fmt.Errorf("failed to add kernel: %w", err)
+	}
+
+	if err := writeTarFileFrom(w, "box.img", imageFilename); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,159 @@
+package login
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	cfg "github.com/tinyrange/tinyrange/pkg/config"
+	"gopkg.in/yaml.v3"
+)
+
+func (config *Config) checkVersion() error {
+	if config.Version > CURRENT_CONFIG_VERSION {
+		return fmt.Errorf(
+			"config version %d is newer than this version of TinyRange supports (up to version %d), upgrade TinyRange to use this config",
+			config.Version, CURRENT_CONFIG_VERSION,
+		)
+	}
+
+	return nil
+}
+
+// DecodeConfig decodes a YAML (or JSON) login config into config. Unknown keys are an
+// error so typos don't silently leave fields empty.
+func DecodeConfig(r io.Reader, config *Config) error {
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+
+	if err := dec.Decode(config); err == io.EOF {
+		return fmt.Errorf("config is empty")
+	} else if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	return config.checkVersion()
+}
+
+// A problem found in a config by ValidateConfig.
+type ConfigProblem struct {
+	Line    int // The line number of the problem or 0 if it applies to the whole file.
+	Message string
+}
+
+func (p ConfigProblem) String() string {
+	if p.Line == 0 {
+		return p.Message
+	}
+
+	return fmt.Sprintf("line %d: %s", p.Line, p.Message)
+}
+
+// yamlErrorProblems splits a yaml error into its individual problems.
+func yamlErrorProblems(err error) []ConfigProblem {
+	var messages []string
+
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		messages = typeErr.Errors
+	} else {
+		messages = []string{strings.TrimPrefix(err.Error(), "yaml: ")}
+	}
+
+	var ret []ConfigProblem
+
+	for _, msg := range messages {
+		var line int
+		if _, err := fmt.Sscanf(msg, "line %d:", &line); err == nil {
+			_, msg, _ = strings.Cut(msg, ": ")
+		}
+
+		ret = append(ret, ConfigProblem{Line: line, Message: msg})
+	}
+
+	return ret
+}
+
+// ValidateConfig checks a login config for unknown keys, values with the wrong type,
+// and fields with invalid values. An empty result means the config is valid.
+func ValidateConfig(contents []byte) []ConfigProblem {
+	var root yaml.Node
+	if err := yaml.Unmarshal(contents, &root); err != nil {
+		return yamlErrorProblems(err)
+	}
+
+	if len(root.Content) == 0 {
+		return []ConfigProblem{{Message: "config is empty"}}
+	}
+
+	doc := root.Content[0]
+	if doc.Kind != yaml.MappingNode {
+		return []ConfigProblem{{Line: doc.Line, Message: "config must be a mapping of keys to values"}}
+	}
+
+	// Find the line a key was declared on so problems with values can be reported.
+	keyLine := func(key string) int {
+		for i := 0; i+1 < len(doc.Content); i += 2 {
+			if doc.Content[i].Value == key {
+				return doc.Content[i].Line
+			}
+		}
+
+		return 0
+	}
+
+	var config Config
+
+	dec := yaml.NewDecoder(bytes.NewReader(contents))
+	dec.KnownFields(true)
+
+	if err := dec.Decode(&config); err != nil {
+		return yamlErrorProblems(err)
+	}
+
+	var ret []ConfigProblem
+
+	if keyLine("version") == 0 {
+		ret = append(ret, ConfigProblem{Message: fmt.Sprintf("version is missing (the current version is %d)", CURRENT_CONFIG_VERSION)})
+	} else if err := config.checkVersion(); err != nil {
+		ret = append(ret, ConfigProblem{Line: keyLine("version"), Message: err.Error()})
+	} else if config.Version < 1 {
+		ret = append(ret, ConfigProblem{Line: keyLine("version"), Message: fmt.Sprintf("invalid version %d", config.Version)})
+	}
+
+	if config.Builder == "" {
+		ret = append(ret, ConfigProblem{Line: keyLine("builder"), Message: "builder is required"})
+	}
+
+	if _, err := cfg.ArchitectureFromString(config.Architecture); err != nil {
+		ret = append(ret, ConfigProblem{Line: keyLine("architecture"), Message: err.Error()})
+	}
+
+	for _, arg := range config.Args {
+		if !strings.Contains(arg, "=") {
+			ret = append(ret, ConfigProblem{Line: keyLine("args"), Message: fmt.Sprintf("invalid argument syntax (key=value): %s", arg)})
+		}
+	}
+
+	for _, env := range config.Environment {
+		if !strings.Contains(env, "=") {
+			ret = append(ret, ConfigProblem{Line: keyLine("environment"), Message: fmt.Sprintf("invalid environment variable (KEY=value): %s", env)})
+		}
+	}
+
+	for _, name := range config.OutputTransforms {
+		if _, err := getOutputTransformer(name); err != nil {
+			ret = append(ret, ConfigProblem{Line: keyLine("output_transforms"), Message: err.Error()})
+		}
+	}
+
+	if config.ExpandVariables {
+		if _, err := config.withExpandedVariables(); err != nil {
+			ret = append(ret, ConfigProblem{Message: err.Error()})
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,262 @@
+package login
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/term"
+)
+
+// Changes are collected until the watched files have stopped changing for this long.
+const WATCH_DEBOUNCE = 300 * time.Millisecond
+
+// How long a run has to exit after it's asked to stop before it's killed.
+const WATCH_STOP_GRACE_PERIOD = 5 * time.Second
+
+// WatchedFiles returns the local files the config reads so they can be watched for changes.
+func (config *Config) WatchedFiles() []string {
+	var files []string
+
+	isUrl := func(filename string) bool {
+		return strings.HasPrefix(filename, "http://") || strings.HasPrefix(filename, "https://")
+	}
+
+	for _, file := range config.Files {
+		filename, _, _ := splitFileTarget(file)
+		if !isUrl(filename) {
+			files = append(files, filename)
+		}
+	}
+
+	for _, archive := range config.Archives {
+		filename, _, _ := strings.Cut(archive, ",")
+		if !isUrl(filename) {
+			files = append(files, filename)
+		}
+	}
+
+	for _, macro := range config.Macros {
+		if strings.HasSuffix(macro, ".yaml") {
+			files = append(files, macro)
+			continue
+		}
+
+		// Macros declared in local starlark files (file.star:name).
+		filename, _, ok := strings.Cut(macro, ":")
+		if !ok || strings.HasPrefix(filename, "//") {
+			continue
+		}
+
+		if !strings.HasSuffix(filename, ".star") {
+			filename += ".star"
+		}
+
+		files = append(files, filename)
+	}
+
+	if config.ArgsFile != "" {
+		files = append(files, config.ArgsFile)
+	}
+
+	if config.InitBinary != "" {
+		files = append(files, config.InitBinary)
+	}
+
+	if config.Nftables != "" {
+		files = append(files, config.Nftables)
+	}
+
+	return files
+}
+
+// fileWatcher reports changes to a set of files. The directories containing the files
+// are watched rather than the files themselves so a file an editor replaces by renaming a
+// new copy over it is still seen.
+type fileWatcher struct {
+	watcher *fsnotify.Watcher
+	files   map[string]bool
+	dirs    map[string]bool
+
+	// Fires once the watched files have stopped changing. Nil if there are no changes.
+	settled <-chan time.Time
+}
+
+func newFileWatcher() (*fileWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileWatcher{watcher: watcher, dirs: make(map[string]bool)}, nil
+}
+
+// setFiles replaces the watched files with files.
+func (w *fileWatcher) setFiles(files []string) {
+	w.files = make(map[string]bool)
+
+	dirs := make(map[string]bool)
+
+	for _, filename := range files {
+		abs, err := filepath.Abs(filename)
+		if err != nil {
+			slog.Warn("failed to watch file", "filename", filename, "error", err)
+			continue
+		}
+
+		w.files[abs] = true
+		dirs[filepath.Dir(abs)] = true
+	}
+
+	for dir := range w.dirs {
+		if !dirs[dir] {
+			// The directory may have been removed already.
+			_ = w.watcher.Remove(dir)
+		}
+	}
+
+	for dir := range dirs {
+		if w.dirs[dir] {
+			continue
+		}
+
+		// Directories that fail are tried again the next time the files are set.
+		if err := w.watcher.Add(dir); err != nil {
+			slog.Warn("failed to watch directory", "dir", dir, "error", err)
+			delete(dirs, dir)
+		}
+	}
+
+	w.dirs = dirs
+}
+
+// waitForChange blocks until the watched files change and then stop changing.
+// If the run exits first then exited is true and err is the result of the run.
+// A change that hasn't settled yet is kept for the next call.
+func (w *fileWatcher) waitForChange(done <-chan error) (exited bool, err error) {
+	for {
+		select {
+		case err := <-done:
+			return true, err
+		case ev := <-w.watcher.Events:
+			// Only the permissions or timestamps changed.
+			if ev.Op == fsnotify.Chmod || !w.files[filepath.Clean(ev.Name)] {
+				continue
+			}
+
+			w.settled = time.After(WATCH_DEBOUNCE)
+		case err := <-w.watcher.Errors:
+			slog.Warn("error watching files", "error", err)
+		case <-w.settled:
+			w.settled = nil
+
+			return false, nil
+		}
+	}
+}
+
+func (w *fileWatcher) Close() error {
+	return w.watcher.Close()
+}
+
+// Watch runs tinyrange with args and runs it again whenever one of the files returned by
+// watchedFiles changes. watchedFiles is called again after each change so files the config
+// starts reading are watched too. A run that hasn't finished when a change is detected is
+// stopped first. Each run is a separate process so cached build results are reused between runs.
+func Watch(watchedFiles func() ([]string, error), args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	files, err := watchedFiles()
+	if err != nil {
+		return err
+	}
+
+	watcher, err := newFileWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	watcher.setFiles(files)
+
+	// Runs put the terminal in raw mode and one that is killed can't restore it.
+	var termState *term.State
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		termState, err = term.GetState(fd)
+		if err != nil {
+			return err
+		}
+	}
+
+	restoreTerminal := func() {
+		restoreWatchForeground()
+
+		if termState != nil {
+			_ = term.Restore(int(os.Stdin.Fd()), termState)
+		}
+	}
+
+	slog.Info("watching for changes, press CTRL-C once a run has finished to stop watching", "files", files)
+
+	for {
+		cmd := exec.Command(exe, args...)
+
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		setWatchProcessGroup(cmd)
+
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+
+		for {
+			exited, runErr := watcher.waitForChange(done)
+			if exited {
+				restoreTerminal()
+
+				if runErr != nil {
+					slog.Warn("run failed, waiting for changes", "error", runErr)
+				} else {
+					slog.Info("run finished, waiting for changes")
+				}
+
+				// Only wait for changes from now on.
+				done = nil
+				continue
+			}
+
+			// The change may have added or removed files the config reads.
+			if next, err := watchedFiles(); err != nil {
+				slog.Warn("failed to reload the config, watching the same files", "error", err)
+			} else {
+				watcher.setFiles(next)
+			}
+
+			if done != nil {
+				slog.Info("change detected, stopping the current run")
+
+				if err := stopWatchProcessGroup(cmd, done); err != nil {
+					slog.Warn("failed to stop run", "error", err)
+				}
+
+				restoreTerminal()
+			} else {
+				slog.Info("change detected, running again")
+			}
+
+			break
+		}
+	}
+}
@@ -0,0 +1,69 @@
+//go:build !windows
+
+package login
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// isForegroundTerminal returns true if stdin is the controlling terminal.
+func isForegroundTerminal() bool {
+	_, err := unix.IoctlGetInt(int(os.Stdin.Fd()), unix.TIOCGPGRP)
+	return err == nil
+}
+
+// setWatchProcessGroup starts the run in a new process group so the hypervisor
+// and any other child processes are stopped with it. The group is moved to the
+// foreground of the terminal so interactive runs can still read from it.
+func setWatchProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if isForegroundTerminal() {
+		cmd.SysProcAttr.Foreground = true
+		cmd.SysProcAttr.Ctty = int(os.Stdin.Fd())
+	}
+}
+
+// stopWatchProcessGroup sends SIGTERM to the run so it can clean up and waits for done.
+// If it hasn't exited after WATCH_STOP_GRACE_PERIOD the process group is killed.
+func stopWatchProcessGroup(cmd *exec.Cmd, done <-chan error) error {
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM); err != nil {
+		return err
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(WATCH_STOP_GRACE_PERIOD):
+	}
+
+	slog.Warn("run did not stop in time, killing it")
+
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		return err
+	}
+
+	<-done
+
+	return nil
+}
+
+// restoreWatchForeground moves the watcher back to the foreground of the terminal
+// once a run exits so it receives CTRL-C again.
+func restoreWatchForeground() {
+	if !isForegroundTerminal() {
+		return
+	}
+
+	// Changing the foreground process group from the background raises SIGTTOU.
+	signal.Ignore(syscall.SIGTTOU)
+
+	_ = unix.IoctlSetPointerInt(int(os.Stdin.Fd()), unix.TIOCSPGRP, unix.Getpgrp())
+}
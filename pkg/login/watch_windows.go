@@ -0,0 +1,21 @@
+//go:build windows
+
+package login
+
+import (
+	"os/exec"
+)
+
+func setWatchProcessGroup(cmd *exec.Cmd) {}
+
+func stopWatchProcessGroup(cmd *exec.Cmd, done <-chan error) error {
+	if err := cmd.Process.Kill(); err != nil {
+		return err
+	}
+
+	<-done
+
+	return nil
+}
+
+func restoreWatchForeground() {}
@@ -0,0 +1,392 @@
+// Package metrics exposes counters in the Prometheus text format. Metrics are
+// only recorded once Serve is called so they have no cost when disabled.
+package metrics
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var enabled atomic.Bool
+
+// Enabled returns true if metrics are being recorded.
+func Enabled() bool { return enabled.Load() }
+
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+var (
+	registryMtx sync.Mutex
+	registry    []metric
+	counters    = make(map[string]*Counter)
+	gauges      = make(map[string]*Gauge)
+)
+
+func register(m metric) {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+
+	registry = append(registry, m)
+
+	switch m := m.(type) {
+	case *Counter:
+		counters[m.name] = m
+	case *Gauge:
+		gauges[m.name] = m
+	}
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Counter is a value that only increases.
+type Counter struct {
+	name  string
+	help  string
+	value atomic.Int64
+}
+
+func (c *Counter) Add(n int64) {
+	if enabled.Load() {
+		c.value.Add(n)
+	}
+}
+
+func (c *Counter) Inc() { c.Add(1) }
+
+// Reader counts the bytes read from r. r is returned unchanged if metrics are disabled.
+func (c *Counter) Reader(r io.Reader) io.Reader {
+	if !enabled.Load() {
+		return r
+	}
+
+	return &countingReader{r: r, c: c}
+}
+
+func (c *Counter) writeTo(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.name, c.value.Load())
+}
+
+func NewCounter(name string, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	register(c)
+	return c
+}
+
+type countingReader struct {
+	r io.Reader
+	c *Counter
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.c.Add(int64(n))
+	return n, err
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	name  string
+	help  string
+	value atomic.Int64
+}
+
+func (g *Gauge) Add(n int64) {
+	if enabled.Load() {
+		g.value.Add(n)
+	}
+}
+
+func (g *Gauge) Inc() { g.Add(1) }
+func (g *Gauge) Dec() { g.Add(-1) }
+
+func (g *Gauge) writeTo(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", g.name, g.value.Load())
+}
+
+func NewGauge(name string, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	register(g)
+	return g
+}
+
+// Histogram counts observed durations in buckets.
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64 // upper bounds in seconds
+
+	mtx    sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	if !enabled.Load() {
+		return
+	}
+
+	v := d.Seconds()
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+
+	h.count++
+	h.sum += v
+}
+
+func (h *Histogram) writeTo(w io.Writer) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	for i, upper := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, strconv.FormatFloat(upper, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// NewHistogram creates a histogram with buckets as upper bounds in seconds.
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	register(h)
+	return h
+}
+
+var (
+	ActiveVMs             = NewGauge("tinyrange_active_vms", "The number of virtual machines currently running.")
+	BuildCacheHits        = NewCounter("tinyrange_build_cache_hits_total", "Builds satisfied from the build cache.")
+	BuildCacheMisses      = NewCounter("tinyrange_build_cache_misses_total", "Builds that had to be run or downloaded.")
+	BuildFailures         = NewCounter("tinyrange_build_failures_total", "Builds that failed.")
+	BuildDuration         = NewHistogram("tinyrange_build_duration_seconds", "The time taken to run a build that missed the cache.", []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900})
+	DownloadedBytes       = NewCounter("tinyrange_downloaded_bytes_total", "Bytes downloaded from HTTP servers, OCI registries, and distribution servers.")
+	BlockDeviceReadBytes  = NewCounter("tinyrange_block_device_read_bytes_total", "Bytes read from the guest root filesystem by the block device.")
+	BlockDeviceWriteBytes = NewCounter("tinyrange_block_device_write_bytes_total", "Bytes written to the guest root filesystem by the block device.")
+	ForwardedToGuest      = NewCounter("tinyrange_forwarded_to_guest_bytes_total", "Bytes sent to the guest over forwarded SSH and port connections.")
+	ForwardedFromGuest    = NewCounter("tinyrange_forwarded_from_guest_bytes_total", "Bytes received from the guest over forwarded SSH and port connections.")
+	ForwardIdleClosed     = NewCounter("tinyrange_forward_idle_closed_total", "Forwarded connections closed because they were idle.")
+)
+
+// Handler writes every metric in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		registryMtx.Lock()
+		defer registryMtx.Unlock()
+
+		for _, m := range registry {
+			m.writeTo(w)
+		}
+	})
+}
+
+// Serve enables metrics and serves them at http://<addr>/metrics in the background.
+func Serve(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for metrics: %w", err)
+	}
+
+	enabled.Store(true)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			slog.Warn("metrics server stopped", "error", err)
+		}
+	}()
+
+	slog.Info("serving metrics", "url", fmt.Sprintf("http://%s/metrics", listener.Addr()))
+
+	return nil
+}
+
+// ReportEnvironmentVariable is set for child processes so they send their metrics to the parent.
+// Virtual machines run in a separate run-vm process which is never given --metrics.
+const ReportEnvironmentVariable = "TINYRANGE_METRICS_REPORT"
+
+// How often a child process sends changes to its metrics.
+const reportInterval = time.Second
+
+var (
+	receiveOnce    sync.Once
+	receiveAddress string
+	receiveErr     error
+)
+
+// ChildEnvironment returns the environment variables that make a child process report its
+// metrics to this one. It returns nil if metrics are disabled.
+func ChildEnvironment() ([]string, error) {
+	if !enabled.Load() {
+		return nil, nil
+	}
+
+	receiveOnce.Do(func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			receiveErr = fmt.Errorf("failed to listen for child metrics: %w", err)
+			return
+		}
+
+		receiveAddress = listener.Addr().String()
+
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					slog.Warn("child metrics listener stopped", "error", err)
+					return
+				}
+
+				go receive(conn)
+			}
+		}()
+	})
+	if receiveErr != nil {
+		return nil, receiveErr
+	}
+
+	return []string{ReportEnvironmentVariable + "=" + receiveAddress}, nil
+}
+
+// receive adds the changes reported by a child process to the metrics in this process. Gauges
+// are restored once the child disconnects so a child that exits early doesn't leave them raised.
+func receive(conn net.Conn) {
+	defer conn.Close()
+
+	raised := make(map[*Gauge]int64)
+
+	defer func() {
+		for g, n := range raised {
+			g.Add(-n)
+		}
+	}()
+
+	dec := json.NewDecoder(bufio.NewReader(conn))
+
+	for {
+		var changes map[string]int64
+		if err := dec.Decode(&changes); err == io.EOF {
+			return
+		} else if err != nil {
+			slog.Debug("failed to read child metrics", "error", err)
+			return
+		}
+
+		registryMtx.Lock()
+		for name, n := range changes {
+			if c, ok := counters[name]; ok {
+				c.Add(n)
+			} else if g, ok := gauges[name]; ok {
+				g.Add(n)
+				raised[g] += n
+			}
+		}
+		registryMtx.Unlock()
+	}
+}
+
+// snapshot returns the value of every counter and gauge.
+func snapshot() map[string]int64 {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+
+	ret := make(map[string]int64)
+
+	for name, c := range counters {
+		ret[name] = c.value.Load()
+	}
+
+	for name, g := range gauges {
+		ret[name] = g.value.Load()
+	}
+
+	return ret
+}
+
+// Report enables metrics and sends changes to them to the parent process listening at addr.
+// The returned function sends any remaining changes and must be called before exiting.
+func Report(addr string) (func(), error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to parent metrics: %w", err)
+	}
+
+	enabled.Store(true)
+
+	enc := json.NewEncoder(conn)
+	last := make(map[string]int64)
+
+	send := func() {
+		current := snapshot()
+
+		changes := make(map[string]int64)
+		for name, n := range current {
+			if n != last[name] {
+				changes[name] = n - last[name]
+			}
+		}
+
+		last = current
+
+		if len(changes) == 0 {
+			return
+		}
+
+		if err := enc.Encode(changes); err != nil {
+			slog.Debug("failed to report metrics", "error", err)
+		}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(reportInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				send()
+			case <-done:
+				send()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+
+		conn.Close()
+	}, nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -61,11 +62,20 @@ type NetworkInterface struct {
 	NetRecv    string
 	MacAddress string
 
-	udpConn *net.UDPConn
+	udpConn  *net.UDPConn
+	sendConn *net.UDPConn
+	cancel   context.CancelFunc
 
 	channel *channel.Endpoint
 }
 
+func (nic *NetworkInterface) close() {
+	nic.cancel()
+	nic.sendConn.Close()
+	nic.udpConn.Close()
+	nic.channel.Close()
+}
+
 func (nic *NetworkInterface) onReceivePacket(pkt []byte) {
 	// dstMac := net.HardwareAddr(pkt[:6])
 	// srcMac := net.HardwareAddr(pkt[6:12])
@@ -98,6 +108,26 @@ type NetStack struct {
 	interfaces []*NetworkInterface
 	nextNicId  int
 	packetDump *pcapgo.Writer
+
+	// Called for every outbound TCP connection from the guest. Connections it returns false for are refused.
+	outboundFilter func(addr netip.Addr, port uint16) bool
+}
+
+// Close shuts down the network interfaces and every endpoint on the stack including
+// internal listeners.
+func (ns *NetStack) Close() {
+	for _, nic := range ns.interfaces {
+		nic.close()
+	}
+	ns.interfaces = nil
+
+	ns.nStack.Close()
+	ns.nStack.Wait()
+}
+
+// SetOutboundFilter restricts the addresses the guest can connect to.
+func (ns *NetStack) SetOutboundFilter(filter func(addr netip.Addr, port uint16) bool) {
+	ns.outboundFilter = filter
 }
 
 func (ns *NetStack) splitAddress(addr string) (tcpip.FullAddress, error) {
@@ -279,13 +309,16 @@ func (ns *NetStack) AttachNetworkInterface() (*NetworkInterface, error) {
 	}
 
 	nic.NetSend = send.LocalAddr().String()
+	nic.sendConn = send
 
 	go func() {
 		buf := make([]byte, 8192)
 
 		for {
 			n, _, err := send.ReadFromUDP(buf)
-			if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			} else if err != nil {
 				slog.Error("failed to read send socket", "err", err)
 				return
 			}
@@ -315,6 +348,7 @@ func (ns *NetStack) AttachNetworkInterface() (*NetworkInterface, error) {
 	recvPort := recv.LocalAddr().(*net.UDPAddr).Port
 
 	if err := recv.Close(); err != nil {
+		send.Close()
 		return nil, err
 	}
 
@@ -323,17 +357,27 @@ func (ns *NetStack) AttachNetworkInterface() (*NetworkInterface, error) {
 		Port: recvPort,
 	})
 	if err != nil {
+		send.Close()
 		return nil, err
 	}
 
 	deviceMac, err := generateMacAddress()
 	if err != nil {
+		send.Close()
+		nic.udpConn.Close()
 		return nil, err
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	nic.cancel = cancel
+
 	go func() {
 		for {
-			pkt := nic.channel.ReadContext(context.Background())
+			pkt := nic.channel.ReadContext(ctx)
+			if pkt == nil {
+				// The interface was closed.
+				return
+			}
 
 			pktBytes := make([]byte, pkt.Size()+14)
 
@@ -388,6 +432,17 @@ func (ns *NetStack) OpenPacketCapture(w io.Writer) error {
 func (ns *NetStack) handleTcpForward(r *tcp.ForwarderRequest) {
 	id := r.ID()
 
+	if ns.outboundFilter != nil {
+		addr, _ := netip.AddrFromSlice(id.LocalAddress.AsSlice())
+
+		if !ns.outboundFilter(addr, id.LocalPort) {
+			slog.Warn("denied outbound connection", "addr", netip.AddrPortFrom(addr, id.LocalPort).String())
+			// Sending a reset makes the connection fail with connection refused in the guest.
+			r.Complete(true)
+			return
+		}
+	}
+
 	var wq waiter.Queue
 
 	ep, ipErr := r.CreateEndpoint(&wq)
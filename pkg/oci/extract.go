@@ -0,0 +1,267 @@
+package oci
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tinyrange/tinyrange/pkg/filesystem"
+)
+
+// The maximum number of links followed by OpenImagePath.
+const maxLinks = 40
+
+// OpenImagePath finds p in a directory created by ExtractOciImageToDirectory. Symlinks and hard
+// links are followed so the result is never a link.
+func OpenImagePath(root filesystem.Directory, p string) (filesystem.File, error) {
+	p = path.Clean("/" + p)
+
+	for i := 0; i <= maxLinks; i++ {
+		ent, err := filesystem.OpenPath(root, p)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+
+		info, err := ent.Stat()
+		if err != nil {
+			return nil, err
+		}
+
+		switch info.Kind() {
+		case filesystem.TypeSymlink:
+			target, err := filesystem.GetLinkName(ent.File)
+			if err != nil {
+				return nil, err
+			}
+
+			if path.IsAbs(target) {
+				p = path.Clean(target)
+			} else {
+				p = path.Join(path.Dir(p), target)
+			}
+		case filesystem.TypeLink:
+			// Hard links are named from the root of the image.
+			target, err := filesystem.GetLinkName(ent.File)
+			if err != nil {
+				return nil, err
+			}
+
+			p = path.Clean("/" + target)
+		default:
+			return ent.File, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s: too many levels of links", p)
+}
+
+// tarOptions controls how writeDirectoryTar writes entries.
+type tarOptions struct {
+	// Write the second and later paths to the same file as hard links to the first one
+	// rather than copies.
+	hardLinks bool
+	// Write every modification time as the Unix epoch.
+	zeroTimes bool
+	// Override the owner of every entry.
+	setOwner bool
+	uid      int
+	gid      int
+	// Don't write a entry for dir itself.
+	skipRoot bool
+}
+
+// tarMode converts mode into the permission bits stored in a tar header including the
+// setuid, setgid, and sticky bits.
+func tarMode(mode fs.FileMode) int64 {
+	ret := int64(mode.Perm())
+
+	if mode&fs.ModeSetuid != 0 {
+		ret |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		ret |= 0o2000
+	}
+	if mode&fs.ModeSticky != 0 {
+		ret |= 0o1000
+	}
+
+	return ret
+}
+
+// WriteDirectoryTar writes the contents of dir to w as a tar archive with every name under prefix.
+// Hard links are written as regular files since their target may not be in the archive.
+func WriteDirectoryTar(w io.Writer, root filesystem.Directory, dir filesystem.Directory, prefix string) error {
+	return writeDirectoryTar(w, root, dir, prefix, tarOptions{})
+}
+
+func writeDirectoryTar(w io.Writer, root filesystem.Directory, dir filesystem.Directory, prefix string, opts tarOptions) error {
+	writer := tar.NewWriter(w)
+
+	// The first name written for each file reached through a hard link.
+	linkTargets := make(map[filesystem.File]string)
+
+	header := func(name string, info filesystem.FileInfo, uid int, gid int) *tar.Header {
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    tarMode(info.Mode()),
+			Uid:     uid,
+			Gid:     gid,
+			ModTime: info.ModTime(),
+		}
+
+		if opts.zeroTimes {
+			hdr.ModTime = time.Unix(0, 0)
+		}
+
+		if opts.setOwner {
+			hdr.Uid = opts.uid
+			hdr.Gid = opts.gid
+		}
+
+		return hdr
+	}
+
+	var walk func(dir filesystem.Directory, name string) error
+
+	walk = func(dir filesystem.Directory, name string) error {
+		children, err := dir.Readdir()
+		if err != nil {
+			return err
+		}
+
+		slices.SortFunc(children, func(a, b filesystem.DirectoryEntry) int {
+			return strings.Compare(a.Name, b.Name)
+		})
+
+		for _, child := range children {
+			childName := path.Join(name, child.Name)
+
+			file := child.File
+
+			info, err := file.Stat()
+			if err != nil {
+				return err
+			}
+
+			if info.Kind() == filesystem.TypeLink {
+				target, err := filesystem.GetLinkName(file)
+				if err != nil {
+					return err
+				}
+
+				file, err = OpenImagePath(root, target)
+				if err != nil {
+					return err
+				}
+
+				info, err = file.Stat()
+				if err != nil {
+					return err
+				}
+			}
+
+			if opts.hardLinks && info.Kind() == filesystem.TypeRegular {
+				if first, ok := linkTargets[file]; ok {
+					hdr := header(childName, info, 0, 0)
+					hdr.Typeflag = tar.TypeLink
+					hdr.Linkname = first
+					hdr.Mode = 0
+
+					if err := writer.WriteHeader(hdr); err != nil {
+						return err
+					}
+
+					continue
+				}
+
+				linkTargets[file] = childName
+			}
+
+			uid, gid, err := filesystem.GetUidAndGid(file)
+			if err != nil {
+				return err
+			}
+
+			hdr := header(childName, info, uid, gid)
+
+			switch info.Kind() {
+			case filesystem.TypeDirectory:
+				hdr.Typeflag = tar.TypeDir
+				hdr.Name += "/"
+			case filesystem.TypeRegular:
+				hdr.Typeflag = tar.TypeReg
+				hdr.Size = info.Size()
+			case filesystem.TypeSymlink:
+				hdr.Typeflag = tar.TypeSymlink
+				hdr.Linkname, err = filesystem.GetLinkName(file)
+				if err != nil {
+					return err
+				}
+			case filesystem.TypeCharDevice, filesystem.TypeBlockDevice:
+				hdr.Typeflag = tar.TypeChar
+				if info.Kind() == filesystem.TypeBlockDevice {
+					hdr.Typeflag = tar.TypeBlock
+				}
+				hdr.Devmajor, hdr.Devminor, err = filesystem.GetDevice(file)
+				if err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("%s: unsupported file type %s", childName, info.Kind())
+			}
+
+			if err := writer.WriteHeader(hdr); err != nil {
+				return err
+			}
+
+			if hdr.Typeflag == tar.TypeReg {
+				fh, err := file.Open()
+				if err != nil {
+					return err
+				}
+
+				_, err = io.Copy(writer, fh)
+				fh.Close()
+				if err != nil {
+					return err
+				}
+			} else if hdr.Typeflag == tar.TypeDir {
+				childDir, ok := file.(filesystem.Directory)
+				if !ok {
+					return fmt.Errorf("%s: %T is not a directory", childName, file)
+				}
+
+				if err := walk(childDir, childName); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	if !opts.skipRoot {
+		info, err := dir.Stat()
+		if err != nil {
+			return err
+		}
+
+		hdr := header(prefix+"/", info, 0, 0)
+		hdr.Typeflag = tar.TypeDir
+
+		if err := writer.WriteHeader(hdr); err != nil {
+			return err
+		}
+	}
+
+	if err := walk(dir, prefix); err != nil {
+		return err
+	}
+
+	return writer.Close()
+}
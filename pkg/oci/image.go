@@ -9,6 +9,7 @@ import (
 	"slices"
 	"strings"
 
+	"github.com/tinyrange/tinyrange/pkg/config"
 	"github.com/tinyrange/tinyrange/pkg/filesystem"
 	"github.com/tinyrange/tinyrange/pkg/filesystem/ext4"
 )
@@ -86,7 +87,34 @@ func parseAuthenticate(value string) (map[string]string, error) {
 }
 
 type OciImageDownloader struct {
-	token string
+	client       *http.Client
+	token        string
+	architecture string
+}
+
+// SetClient sets the client used for registry requests so proxy and CA settings apply. It defaults to http.DefaultClient.
+func (dl *OciImageDownloader) SetClient(client *http.Client) {
+	dl.client = client
+}
+
+func (dl *OciImageDownloader) httpClient() *http.Client {
+	if dl.client == nil {
+		return http.DefaultClient
+	}
+
+	return dl.client
+}
+
+// SetArchitecture selects the image for arch from multi-platform images. It defaults to x86_64.
+func (dl *OciImageDownloader) SetArchitecture(arch config.CPUArchitecture) {
+	switch arch {
+	case config.ArchX8664:
+		dl.architecture = "amd64"
+	case config.ArchARM64:
+		dl.architecture = "arm64"
+	default:
+		dl.architecture = string(arch)
+	}
 }
 
 func (dl *OciImageDownloader) makeRegistryRequest(method string, url string, acceptHeaders []string) (*http.Response, error) {
@@ -105,7 +133,7 @@ func (dl *OciImageDownloader) makeRegistryRequest(method string, url string, acc
 		req.Header.Add("Accept", val)
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := dl.httpClient().Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -126,7 +154,7 @@ func (dl *OciImageDownloader) makeRegistryRequest(method string, url string, acc
 
 		slog.Debug("registry auth", "url", tokenUrl)
 
-		resp, err := http.Get(tokenUrl)
+		resp, err := dl.httpClient().Get(tokenUrl)
 		if err != nil {
 			return nil, err
 		}
@@ -163,11 +191,11 @@ func (dl *OciImageDownloader) downloadJson(method string, url string, acceptHead
 	return nil
 }
 
-func (dl *OciImageDownloader) ExtractOciImage(fs *ext4.Ext4Filesystem, name string) error {
-	imageName, ref, _ := strings.Cut(name, ":")
-
-	if imageName == "library/scratch" {
-		return nil
+// imageLayers returns the layers of the image for the selected architecture from the bottom up.
+func (dl *OciImageDownloader) imageLayers(imageName string, ref string) ([]ImageLayerIdentifier, error) {
+	architecture := dl.architecture
+	if architecture == "" {
+		architecture = "amd64"
 	}
 
 	// download image index.
@@ -177,51 +205,110 @@ func (dl *OciImageDownloader) ExtractOciImage(fs *ext4.Ext4Filesystem, name stri
 		"application/vnd.docker.distribution.manifest.list.v2+json",
 		"application/vnd.oci.image.index.v1+json",
 	}, &index); err != nil {
+		return nil, err
+	}
+
+	if index.SchemaVersion != 2 {
+		return nil, fmt.Errorf("expected schema version 2 got: %+v", index)
+	}
+
+	var manifestId ImageManifestIdentifier
+	for _, manifest := range index.Manifests {
+		if manifest.Platform.Architecture == architecture {
+			manifestId = manifest
+		}
+	}
+
+	if manifestId.Digest == "" {
+		return nil, fmt.Errorf("image %s:%s has no manifest for %s", imageName, ref, architecture)
+	}
+
+	manifestUrl := fmt.Sprintf("%s/%s/manifests/%s", DEFAULT_REGISTRY, imageName, manifestId.Digest)
+	var manifest ImageManifest
+	if err := dl.downloadJson("GET", manifestUrl, []string{
+		"application/vnd.oci.image.manifest.v1+json",
+		"application/vnd.docker.distribution.manifest.v2+json",
+	}, &manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest.Layers, nil
+}
+
+// ExtractOciImageToDirectory extracts every layer of the image into dir from the bottom up.
+// Unlike ExtractOciImage whiteouts in upper layers remove files from the layers below.
+func (dl *OciImageDownloader) ExtractOciImageToDirectory(dir filesystem.MutableDirectory, name string) error {
+	imageName, ref, _ := strings.Cut(name, ":")
+
+	if imageName == "library/scratch" {
+		return nil
+	}
+
+	layers, err := dl.imageLayers(imageName, ref)
+	if err != nil {
 		return err
 	}
 
-	if index.SchemaVersion == 2 {
-		var manifestId ImageManifestIdentifier
-		for _, manifest := range index.Manifests {
-			if manifest.Platform.Architecture == "amd64" {
-				manifestId = manifest
-			}
+	for _, layer := range layers {
+		if err := dl.extractLayer(dir, imageName, layer); err != nil {
+			return fmt.Errorf("failed to extract layer %s: %w", layer.Digest, err)
 		}
+	}
+
+	return nil
+}
+
+func (dl *OciImageDownloader) extractLayer(dir filesystem.MutableDirectory, imageName string, layer ImageLayerIdentifier) error {
+	layerUrl := fmt.Sprintf("%s/%s/blobs/%s", DEFAULT_REGISTRY, imageName, layer.Digest)
+	resp, err := dl.makeRegistryRequest("GET", layerUrl, []string{})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 
-		manifestUrl := fmt.Sprintf("%s/%s/manifests/%s", DEFAULT_REGISTRY, imageName, manifestId.Digest)
-		var manifest ImageManifest
-		if err := dl.downloadJson("GET", manifestUrl, []string{
-			"application/vnd.oci.image.manifest.v1+json",
-		}, &manifest); err != nil {
+	r, err := openLayer(resp.Body, layer.MediaType)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return applyLayer(dir, r)
+}
+
+func (dl *OciImageDownloader) ExtractOciImage(fs *ext4.Ext4Filesystem, name string) error {
+	imageName, ref, _ := strings.Cut(name, ":")
+
+	if imageName == "library/scratch" {
+		return nil
+	}
+
+	layers, err := dl.imageLayers(imageName, ref)
+	if err != nil {
+		return err
+	}
+
+	slices.Reverse(layers)
+
+	for _, layer := range layers {
+		layerUrl := fmt.Sprintf("%s/%s/blobs/%s", DEFAULT_REGISTRY, imageName, layer.Digest)
+		resp, err := dl.makeRegistryRequest("GET", layerUrl, []string{})
+		if err != nil {
 			return err
 		}
 
-		layers := manifest.Layers
-		slices.Reverse(layers)
-
-		for _, layer := range layers {
-			layerUrl := fmt.Sprintf("%s/%s/blobs/%s", DEFAULT_REGISTRY, imageName, layer.Digest)
-			resp, err := dl.makeRegistryRequest("GET", layerUrl, []string{})
-			if err != nil {
-				return err
+		// assume tar.gz
+		if err := filesystem.ExtractReaderTo(resp.Body, ".tar.gz", fs, func(hdr *tar.Header) bool {
+			if !strings.HasPrefix(hdr.Name, "/") {
+				hdr.Name = "/" + hdr.Name
 			}
-
-			// assume tar.gz
-			if err := filesystem.ExtractReaderTo(resp.Body, ".tar.gz", fs, func(hdr *tar.Header) bool {
-				if !strings.HasPrefix(hdr.Name, "/") {
-					hdr.Name = "/" + hdr.Name
-				}
-				if hdr.Typeflag == tar.TypeLink && !strings.HasPrefix(hdr.Linkname, "/") {
-					hdr.Linkname = "/" + hdr.Linkname
-				}
-
-				return true
-			}); err != nil {
-				return err
+			if hdr.Typeflag == tar.TypeLink && !strings.HasPrefix(hdr.Linkname, "/") {
+				hdr.Linkname = "/" + hdr.Linkname
 			}
+
+			return true
+		}); err != nil {
+			return err
 		}
-	} else {
-		return fmt.Errorf("expected schema version 2 got: %+v", index)
 	}
 
 	// return fmt.Errorf("not implemented")
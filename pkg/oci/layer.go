@@ -0,0 +1,200 @@
+package oci
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/tinyrange/tinyrange/pkg/filesystem"
+)
+
+// An opaque whiteout removes everything the layers below put in its directory.
+const whiteoutOpaque = ".wh..wh..opq"
+
+type layerEntry struct {
+	hdr      *tar.Header
+	contents []byte
+}
+
+// openLayer decompresses a layer based on its media type.
+func openLayer(r io.Reader, mediaType string) (io.ReadCloser, error) {
+	if strings.HasSuffix(mediaType, "+zstd") {
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+
+		return dec.IOReadCloser(), nil
+	} else if strings.HasSuffix(mediaType, "gzip") {
+		return gzip.NewReader(r)
+	} else {
+		return io.NopCloser(r), nil
+	}
+}
+
+// clearDirectory removes every child of the directory at p if it exists.
+func clearDirectory(root filesystem.Directory, p string) error {
+	ent, err := filesystem.OpenPath(root, p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	dir, ok := ent.File.(filesystem.MutableDirectory)
+	if !ok {
+		return nil
+	}
+
+	children, err := dir.Readdir()
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		if err := dir.Unlink(child.Name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func addLayerEntry(root filesystem.MutableDirectory, name string, ent layerEntry) error {
+	hdr := ent.hdr
+
+	var file filesystem.MutableFile
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		// A directory replaces anything that isn't a directory but keeps the contents of an existing one.
+		if existing, err := filesystem.OpenPath(root, name); err == nil {
+			if _, ok := existing.File.(filesystem.Directory); !ok {
+				if err := filesystem.Unlink(root, name); err != nil {
+					return err
+				}
+			}
+		}
+
+		dir, err := filesystem.Mkdir(root, name)
+		if err != nil {
+			return err
+		}
+
+		file = dir
+	case tar.TypeReg:
+		file = filesystem.NewMemoryFile(filesystem.TypeRegular)
+		if err := file.Overwrite(ent.contents); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		file = filesystem.NewSymlink(hdr.Linkname)
+	case tar.TypeLink:
+		link, err := filesystem.NewHardLink(hdr.Linkname)
+		if err != nil {
+			return err
+		}
+
+		file = link
+	case tar.TypeChar, tar.TypeBlock:
+		kind := filesystem.TypeCharDevice
+		if hdr.Typeflag == tar.TypeBlock {
+			kind = filesystem.TypeBlockDevice
+		}
+
+		dev, err := filesystem.NewDeviceNode(kind, hdr.Devmajor, hdr.Devminor)
+		if err != nil {
+			return err
+		}
+
+		file = dev
+	default:
+		slog.Debug("skipping unsupported layer entry", "name", name, "type", hdr.Typeflag)
+		return nil
+	}
+
+	if err := file.Chmod(hdr.FileInfo().Mode()); err != nil {
+		return err
+	}
+	if err := file.Chown(hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	if err := file.Chtimes(hdr.ModTime); err != nil {
+		return err
+	}
+
+	if hdr.Typeflag == tar.TypeDir {
+		return nil
+	}
+
+	// Files in upper layers replace the ones in lower layers.
+	if err := filesystem.Unlink(root, name); err != nil {
+		return err
+	}
+
+	return filesystem.CreateChild(root, name, file)
+}
+
+// applyLayer extracts a layer tar on top of root. Whiteout files remove entries from the
+// layers below and are not extracted themselves.
+func applyLayer(root filesystem.MutableDirectory, r io.Reader) error {
+	var entries []layerEntry
+
+	reader := tar.NewReader(r)
+
+	for {
+		hdr, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		var contents []byte
+		if hdr.Typeflag == tar.TypeReg {
+			contents, err = io.ReadAll(reader)
+			if err != nil {
+				return err
+			}
+		}
+
+		entries = append(entries, layerEntry{hdr: hdr, contents: contents})
+	}
+
+	// Whiteouts only apply to lower layers so they are handled before anything in this layer is added.
+	for _, ent := range entries {
+		name := path.Clean("/" + ent.hdr.Name)
+		dir, base := path.Split(name)
+
+		if base == whiteoutOpaque {
+			if err := clearDirectory(root, dir); err != nil {
+				return fmt.Errorf("failed to apply opaque whiteout %s: %w", name, err)
+			}
+		} else if strings.HasPrefix(base, filesystem.WhiteoutPrefix) {
+			if err := filesystem.Unlink(root, path.Join(dir, strings.TrimPrefix(base, filesystem.WhiteoutPrefix))); err != nil {
+				return fmt.Errorf("failed to apply whiteout %s: %w", name, err)
+			}
+		}
+	}
+
+	for _, ent := range entries {
+		name := path.Clean("/" + ent.hdr.Name)
+
+		if name == "/" || strings.HasPrefix(path.Base(name), filesystem.WhiteoutPrefix) {
+			continue
+		}
+
+		if err := addLayerEntry(root, name, ent); err != nil {
+			return fmt.Errorf("failed to extract %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
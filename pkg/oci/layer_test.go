@@ -0,0 +1,91 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io/fs"
+	"testing"
+
+	"github.com/tinyrange/tinyrange/pkg/filesystem"
+)
+
+// makeLayer writes a layer tar. Names ending in / are directories and everything else
+// is a regular file containing its own name.
+func makeLayer(t *testing.T, names ...string) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	w := tar.NewWriter(&buf)
+
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(name))}
+		if name[len(name)-1] == '/' {
+			hdr = &tar.Header{Name: name, Mode: 0755, Typeflag: tar.TypeDir}
+		}
+
+		if err := w.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := w.Write([]byte(name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &buf
+}
+
+func TestApplyLayerWhiteouts(t *testing.T) {
+	root := filesystem.NewMemoryDirectory()
+
+	if err := applyLayer(root, makeLayer(t,
+		"etc/",
+		"etc/removed",
+		"etc/kept",
+		"opt/",
+		"opt/dir/",
+		"opt/dir/old",
+		"opt/dir/nested/",
+		"opt/dir/nested/file",
+	)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := applyLayer(root, makeLayer(t,
+		"etc/.wh.removed",
+		"etc/.wh.missing",
+		"opt/dir/",
+		"opt/dir/.wh..wh..opq",
+		"opt/dir/new",
+	)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"etc/kept", "opt/dir/new"} {
+		if _, err := filesystem.OpenPath(root, name); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+
+	// Whiteouts remove entries from lower layers and aren't extracted themselves.
+	for _, name := range []string{
+		"etc/removed",
+		"etc/.wh.removed",
+		"etc/.wh.missing",
+		"opt/dir/old",
+		"opt/dir/nested",
+		"opt/dir/.wh..wh..opq",
+	} {
+		if _, err := filesystem.OpenPath(root, name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: expected it not to exist, got %v", name, err)
+		}
+	}
+}
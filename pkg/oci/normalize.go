@@ -0,0 +1,72 @@
+package oci
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/tinyrange/tinyrange/pkg/filesystem"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// openArchive decompresses a gzip or zstd compressed tar based on its contents.
+func openArchive(r io.Reader) (io.ReadCloser, error) {
+	buf := bufio.NewReader(r)
+
+	magic, err := buf.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	mediaType := ""
+	if bytes.HasPrefix(magic, gzipMagic) {
+		mediaType = "gzip"
+	} else if bytes.HasPrefix(magic, zstdMagic) {
+		mediaType = "+zstd"
+	}
+
+	return openLayer(buf, mediaType)
+}
+
+type NormalizeOptions struct {
+	// Set the owner of every entry to Uid and Gid.
+	SetOwner bool
+	Uid      int
+	Gid      int
+}
+
+// NormalizeRoot extracts each tar archive in layers on top of the ones before it and writes
+// the result to w as a single tar archive in a canonical form. Whiteouts are applied and
+// removed, entries are sorted by name, modification times are zeroed, only numeric owners
+// are kept, and every path to the same file after the first is written as a hard link to it.
+// Archives can be gzip or zstd compressed.
+func NormalizeRoot(w io.Writer, layers []io.Reader, opts NormalizeOptions) error {
+	root := filesystem.NewMemoryDirectory()
+
+	for i, layer := range layers {
+		r, err := openArchive(layer)
+		if err != nil {
+			return fmt.Errorf("failed to open archive %d: %w", i+1, err)
+		}
+
+		err = applyLayer(root, r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("failed to extract archive %d: %w", i+1, err)
+		}
+	}
+
+	return writeDirectoryTar(w, root, root, "", tarOptions{
+		hardLinks: true,
+		zeroTimes: true,
+		setOwner:  opts.SetOwner,
+		uid:       opts.Uid,
+		gid:       opts.Gid,
+		skipRoot:  true,
+	})
+}
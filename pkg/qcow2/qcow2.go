@@ -0,0 +1,208 @@
+// Package qcow2 writes raw disk images as qcow2 (version 2) images.
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	clusterBits = 16
+	clusterSize = 1 << clusterBits
+
+	// Each table is a single cluster of 64 bit entries except refcount blocks which use 16 bit entries.
+	l2Entries       = clusterSize / 8
+	refcountEntries = clusterSize / 2
+
+	headerSize = 72
+
+	// Set on L1 and L2 entries when the refcount of the cluster is exactly 1.
+	flagCopied = 1 << 63
+)
+
+func divRoundUp(a int64, b int64) int64 {
+	return (a + b - 1) / b
+}
+
+// Write converts the raw disk image r of size bytes to a qcow2 image written to w.
+// Clusters which only contain zeros aren't allocated so sparse images stay small.
+// The image is written in a single pass so w doesn't need to support seeking.
+func Write(w io.Writer, r io.ReaderAt, size int64) error {
+	if size <= 0 {
+		return fmt.Errorf("invalid image size: %d", size)
+	}
+
+	guestClusters := divRoundUp(size, clusterSize)
+
+	buf := make([]byte, clusterSize)
+	zero := make([]byte, clusterSize)
+
+	readCluster := func(index int64) ([]byte, error) {
+		clear(buf)
+
+		length := min(clusterSize, size-index*clusterSize)
+
+		if _, err := r.ReadAt(buf[:length], index*clusterSize); err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		return buf, nil
+	}
+
+	// Find which clusters have data.
+	allocated := make([]bool, guestClusters)
+
+	var dataClusters int64
+
+	for i := range allocated {
+		cluster, err := readCluster(int64(i))
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(cluster, zero) {
+			allocated[i] = true
+			dataClusters += 1
+		}
+	}
+
+	l1Size := divRoundUp(guestClusters, l2Entries)
+
+	var l2Tables int64
+	for table := int64(0); table < l1Size; table++ {
+		end := min((table+1)*l2Entries, guestClusters)
+
+		for i := table * l2Entries; i < end; i++ {
+			if allocated[i] {
+				l2Tables += 1
+				break
+			}
+		}
+	}
+
+	l1Clusters := divRoundUp(l1Size*8, clusterSize)
+
+	// The refcount blocks have to cover themselves so keep growing them until the layout is stable.
+	var (
+		refcountTableClusters int64 = 1
+		refcountBlocks        int64 = 1
+		totalClusters         int64
+	)
+
+	for {
+		totalClusters = 1 + refcountTableClusters + refcountBlocks + l1Clusters + l2Tables + dataClusters
+
+		blocks := divRoundUp(totalClusters, refcountEntries)
+		tableClusters := divRoundUp(blocks*8, clusterSize)
+
+		if blocks == refcountBlocks && tableClusters == refcountTableClusters {
+			break
+		}
+
+		refcountBlocks = blocks
+		refcountTableClusters = tableClusters
+	}
+
+	refcountTableOffset := int64(clusterSize)
+	refcountBlockOffset := refcountTableOffset + refcountTableClusters*clusterSize
+	l1Offset := refcountBlockOffset + refcountBlocks*clusterSize
+	l2Offset := l1Offset + l1Clusters*clusterSize
+	dataOffset := l2Offset + l2Tables*clusterSize
+
+	// Header
+	header := make([]byte, clusterSize)
+
+	copy(header[0:], []byte{'Q', 'F', 'I', 0xfb})
+	binary.BigEndian.PutUint32(header[4:], 2)
+	binary.BigEndian.PutUint32(header[20:], clusterBits)
+	binary.BigEndian.PutUint64(header[24:], uint64(size))
+	binary.BigEndian.PutUint32(header[36:], uint32(l1Size))
+	binary.BigEndian.PutUint64(header[40:], uint64(l1Offset))
+	binary.BigEndian.PutUint64(header[48:], uint64(refcountTableOffset))
+	binary.BigEndian.PutUint32(header[56:], uint32(refcountTableClusters))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	// Refcount table
+	refcountTable := make([]byte, refcountTableClusters*clusterSize)
+
+	for i := int64(0); i < refcountBlocks; i++ {
+		binary.BigEndian.PutUint64(refcountTable[i*8:], uint64(refcountBlockOffset+i*clusterSize))
+	}
+
+	if _, err := w.Write(refcountTable); err != nil {
+		return err
+	}
+
+	// Refcount blocks. Every cluster in the image is used exactly once.
+	refcounts := make([]byte, refcountBlocks*clusterSize)
+
+	for i := int64(0); i < totalClusters; i++ {
+		binary.BigEndian.PutUint16(refcounts[i*2:], 1)
+	}
+
+	if _, err := w.Write(refcounts); err != nil {
+		return err
+	}
+
+	// L1 and L2 tables
+	l1 := make([]byte, l1Clusters*clusterSize)
+	l2 := make([]byte, l2Tables*clusterSize)
+
+	nextTable := int64(0)
+	nextData := dataOffset
+
+	for table := int64(0); table < l1Size; table++ {
+		end := min((table+1)*l2Entries, guestClusters)
+
+		var entries []byte
+
+		for i := table * l2Entries; i < end; i++ {
+			if !allocated[i] {
+				continue
+			}
+
+			if entries == nil {
+				entries = l2[nextTable*clusterSize : (nextTable+1)*clusterSize]
+
+				binary.BigEndian.PutUint64(l1[table*8:], uint64(l2Offset+nextTable*clusterSize)|flagCopied)
+
+				nextTable += 1
+			}
+
+			binary.BigEndian.PutUint64(entries[(i-table*l2Entries)*8:], uint64(nextData)|flagCopied)
+
+			nextData += clusterSize
+		}
+	}
+
+	if _, err := w.Write(l1); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(l2); err != nil {
+		return err
+	}
+
+	// Data clusters in the same order they were assigned above.
+	for i, ok := range allocated {
+		if !ok {
+			continue
+		}
+
+		cluster, err := readCluster(int64(i))
+		if err != nil {
+			return err
+		}
+
+		if _, err := w.Write(cluster); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// readImage reads the guest contents of a qcow2 image written by Write using the
+// header and the L1 and L2 tables.
+func readImage(t *testing.T, image []byte) []byte {
+	t.Helper()
+
+	if !bytes.Equal(image[0:4], []byte{'Q', 'F', 'I', 0xfb}) {
+		t.Fatalf("bad magic: %x", image[0:4])
+	}
+
+	if version := binary.BigEndian.Uint32(image[4:]); version != 2 {
+		t.Fatalf("version = %d, want 2", version)
+	}
+
+	if bits := binary.BigEndian.Uint32(image[20:]); bits != clusterBits {
+		t.Fatalf("cluster bits = %d, want %d", bits, clusterBits)
+	}
+
+	size := int64(binary.BigEndian.Uint64(image[24:]))
+	l1Size := int64(binary.BigEndian.Uint32(image[36:]))
+	l1Offset := int64(binary.BigEndian.Uint64(image[40:]))
+
+	if l1Offset%clusterSize != 0 {
+		t.Fatalf("L1 table isn't cluster aligned: %d", l1Offset)
+	}
+
+	guest := make([]byte, size)
+
+	for table := int64(0); table < l1Size; table++ {
+		l1Entry := binary.BigEndian.Uint64(image[l1Offset+table*8:])
+		if l1Entry == 0 {
+			continue
+		}
+
+		if l1Entry&flagCopied == 0 {
+			t.Fatalf("L1 entry %d is missing the copied flag", table)
+		}
+
+		l2Offset := int64(l1Entry &^ flagCopied)
+
+		for i := int64(0); i < l2Entries; i++ {
+			l2Entry := binary.BigEndian.Uint64(image[l2Offset+i*8:])
+			if l2Entry == 0 {
+				continue
+			}
+
+			if l2Entry&flagCopied == 0 {
+				t.Fatalf("L2 entry %d/%d is missing the copied flag", table, i)
+			}
+
+			dataOffset := int64(l2Entry &^ flagCopied)
+			guestOffset := (table*l2Entries + i) * clusterSize
+
+			if guestOffset >= size {
+				t.Fatalf("L2 entry %d/%d is past the end of the image", table, i)
+			}
+
+			copy(guest[guestOffset:], image[dataOffset:dataOffset+clusterSize])
+		}
+	}
+
+	return guest
+}
+
+func TestWriteRoundTrip(t *testing.T) {
+	// Spans two L2 tables and doesn't end on a cluster boundary.
+	size := int64(l2Entries+3)*clusterSize + 1234
+
+	raw := make([]byte, size)
+
+	// Data in the first cluster, a cluster in the second L2 table, and the partial last cluster.
+	// Everything else is left sparse.
+	for _, offset := range []int64{0, 100, int64(l2Entries+1) * clusterSize, size - 1} {
+		raw[offset] = byte(offset%251) + 1
+	}
+
+	var image bytes.Buffer
+	if err := Write(&image, bytes.NewReader(raw), size); err != nil {
+		t.Fatal(err)
+	}
+
+	if image.Len()%clusterSize != 0 {
+		t.Errorf("image size %d isn't a multiple of the cluster size", image.Len())
+	}
+
+	// Header, refcount table and block, L1 table, two L2 tables, and three data clusters.
+	if want := 9 * clusterSize; image.Len() != want {
+		t.Errorf("image size = %d, want %d", image.Len(), want)
+	}
+
+	if !bytes.Equal(readImage(t, image.Bytes()), raw) {
+		t.Fatal("guest contents don't match the raw image")
+	}
+}
+
+func TestWriteInvalidSize(t *testing.T) {
+	if err := Write(&bytes.Buffer{}, bytes.NewReader(nil), 0); err == nil {
+		t.Fatal("expected an error for an empty image")
+	}
+}
@@ -0,0 +1,112 @@
+package tinyrange
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/tinyrange/tinyrange/pkg/config"
+)
+
+// The address of the host services (DNS and HTTP) on the virtual network. The guest can always reach it.
+// Other addresses on the virtual network like 10.42.0.100 (the host loopback) have to be allowed.
+var hostServicesAddr = netip.MustParseAddr("10.42.0.1")
+
+// outboundAllowlist restricts the names the guest can resolve and the addresses it can connect to.
+// Addresses returned when resolving an allowed name are allowed as well.
+type outboundAllowlist struct {
+	domains  []string
+	prefixes []netip.Prefix
+
+	mtx      sync.Mutex
+	resolved map[netip.Addr]bool
+}
+
+func newOutboundAllowlist(domains []string, cidrs []string) (*outboundAllowlist, error) {
+	allow := &outboundAllowlist{resolved: make(map[netip.Addr]bool)}
+
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.Trim(strings.TrimSpace(domain), "."))
+		if domain == "" {
+			return nil, fmt.Errorf("allowed domain can not be empty")
+		}
+
+		allow.domains = append(allow.domains, domain)
+	}
+
+	for _, cidr := range cidrs {
+		prefix, err := config.ParseAllowedCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+
+		allow.prefixes = append(allow.prefixes, prefix)
+	}
+
+	return allow, nil
+}
+
+// allowName reports if name or one of its parent domains is allowed.
+func (a *outboundAllowlist) allowName(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	for _, domain := range a.domains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addResolved allows connections to an address returned for a allowed name.
+func (a *outboundAllowlist) addResolved(ip string) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	a.resolved[addr.Unmap()] = true
+}
+
+// allowHost reports if the host can fetch from a URL with host on behalf of the guest.
+// Addresses have to be in a allowed CIDR.
+func (a *outboundAllowlist) allowHost(host string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return a.allowName(host)
+	}
+
+	addr = addr.Unmap()
+
+	for _, prefix := range a.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *outboundAllowlist) allowAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	if addr == hostServicesAddr {
+		return true
+	}
+
+	for _, prefix := range a.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	return a.resolved[addr]
+}
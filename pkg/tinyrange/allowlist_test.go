@@ -0,0 +1,88 @@
+package tinyrange
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestOutboundAllowlist(t *testing.T) {
+	allow, err := newOutboundAllowlist([]string{" Example.com. "}, []string{"192.168.1.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		want bool
+	}{
+		{"example.com", true},
+		{"EXAMPLE.COM.", true},
+		{"pkg.example.com", true},
+		{"badexample.com", false},
+		{"example.com.evil.net", false},
+		{"example.org", false},
+	} {
+		if got := allow.allowName(test.name); got != test.want {
+			t.Errorf("allowName(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	allow.addResolved("93.184.215.14")
+	allow.addResolved("not an address")
+
+	for _, test := range []struct {
+		addr string
+		want bool
+	}{
+		// The host services are always reachable.
+		{"10.42.0.1", true},
+		// The host loopback and the rest of the virtual network aren't.
+		{"10.42.0.100", false},
+		{"10.42.0.2", false},
+		{"192.168.1.20", true},
+		{"::ffff:192.168.1.20", true},
+		{"192.168.2.20", false},
+		// Addresses of allowed names are allowed once they're resolved.
+		{"93.184.215.14", true},
+		{"93.184.215.15", false},
+	} {
+		if got := allow.allowAddr(netip.MustParseAddr(test.addr)); got != test.want {
+			t.Errorf("allowAddr(%s) = %v, want %v", test.addr, got, test.want)
+		}
+	}
+
+	for _, test := range []struct {
+		host string
+		want bool
+	}{
+		{"pkg.example.com", true},
+		{"example.org", false},
+		{"192.168.1.20", true},
+		// Resolved addresses only apply to guest connections, not host fetches.
+		{"93.184.215.14", false},
+		{"10.42.0.1", false},
+	} {
+		if got := allow.allowHost(test.host); got != test.want {
+			t.Errorf("allowHost(%q) = %v, want %v", test.host, got, test.want)
+		}
+	}
+}
+
+func TestOutboundAllowlistHostLoopback(t *testing.T) {
+	allow, err := newOutboundAllowlist(nil, []string{"10.42.0.100/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !allow.allowAddr(netip.MustParseAddr("10.42.0.100")) {
+		t.Fatalf("the host loopback is denied even though a allowed CIDR includes it")
+	}
+
+	if _, err := newOutboundAllowlist([]string{"  "}, nil); err == nil {
+		t.Fatalf("accepted a empty domain")
+	}
+
+	if _, err := newOutboundAllowlist(nil, []string{"not a cidr"}); err == nil {
+		t.Fatalf("accepted a invalid CIDR")
+	}
+}
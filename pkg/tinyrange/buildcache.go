@@ -0,0 +1,176 @@
+package tinyrange
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinyrange/tinyrange/pkg/database"
+)
+
+// The prefix of definition files written for define.fetch_http.
+var fetchHttpDefinitionPrefix = []byte(`{"TypeName":"FetchHttpBuildDefinition",`)
+
+type cachedDownload struct {
+	hash    string
+	modTime time.Time
+}
+
+// buildCacheServer serves downloads cached in the host build directory to the guest
+// read-only. Guests request http://host.internal/cache/<scheme>/<rest> for a file
+// downloaded from <scheme>://<rest>, for example /cache/mirror/alpine/v3.20/main/x86_64/APKINDEX.tar.gz.
+type buildCacheServer struct {
+	dir string
+	db  *database.PackageDatabase
+
+	once  sync.Once
+	files map[string]cachedDownload
+}
+
+func newBuildCacheServer(dir string) *buildCacheServer {
+	// Only downloads stored with --chunked-cache have chunk manifests so anything restored
+	// from them is released again when the server is closed.
+	db := database.New(dir)
+	db.ChunkedCache = true
+
+	return &buildCacheServer{dir: dir, db: db}
+}
+
+// Close releases downloads restored from the chunked cache while the server was running.
+func (c *buildCacheServer) Close() error {
+	return c.db.ReleaseChunkedOutputs()
+}
+
+// index reads the definition of every cached download. The build directory is only
+// scanned once so files downloaded while the virtual machine is running aren't served.
+func (c *buildCacheServer) index() {
+	c.files = make(map[string]cachedDownload)
+
+	ents, err := os.ReadDir(c.dir)
+	if err != nil {
+		slog.Warn("build cache: failed to read build directory", "dir", c.dir, "error", err)
+		return
+	}
+
+	for _, ent := range ents {
+		if !strings.HasSuffix(ent.Name(), ".def") {
+			continue
+		}
+
+		defFilename := filepath.Join(c.dir, ent.Name())
+
+		url, err := readFetchHttpUrl(defFilename)
+		if err != nil {
+			slog.Debug("build cache: failed to read definition", "filename", defFilename, "error", err)
+			continue
+		} else if url == "" {
+			continue
+		}
+
+		hash := strings.TrimSuffix(ent.Name(), ".def")
+
+		// Downloads released by the chunked cache are restored when they're requested. Until
+		// then the manifest is used since it's written alongside the download.
+		info, err := os.Stat(filepath.Join(c.dir, hash+".bin"))
+		if err != nil {
+			info, err = os.Stat(filepath.Join(c.dir, hash+".chunks"))
+			if err != nil {
+				continue
+			}
+		}
+
+		// The same URL can be downloaded with different expiry times so use the newest copy.
+		if existing, ok := c.files[url]; ok && existing.modTime.After(info.ModTime()) {
+			continue
+		}
+
+		c.files[url] = cachedDownload{hash: hash, modTime: info.ModTime()}
+	}
+
+	slog.Debug("build cache: indexed downloads", "dir", c.dir, "count", len(c.files))
+}
+
+// readFetchHttpUrl returns the URL from a FetchHttpBuildDefinition definition file or "" if
+// the file is a different kind of definition.
+func readFetchHttpUrl(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	prefix := make([]byte, len(fetchHttpDefinitionPrefix))
+	if _, err := io.ReadFull(f, prefix); err != nil || !bytes.Equal(prefix, fetchHttpDefinitionPrefix) {
+		return "", nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	var def struct {
+		Params struct {
+			Url string
+		}
+	}
+
+	if err := json.NewDecoder(f).Decode(&def); err != nil {
+		return "", err
+	}
+
+	return def.Params.Url, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (c *buildCacheServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "only GET and HEAD are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	scheme, rest, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/cache/"), "/")
+	if !ok || rest == "" {
+		http.Error(w, "expected /cache/<scheme>/<path>", http.StatusBadRequest)
+		return
+	}
+
+	c.once.Do(c.index)
+
+	ent, ok := c.files[scheme+"://"+rest]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	filename, err := c.db.ResultFilename(ent.hash)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+var (
+	_ http.Handler = &buildCacheServer{}
+)
@@ -0,0 +1,129 @@
+package tinyrange
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+
+	"github.com/tinyrange/tinyrange/pkg/config"
+	"github.com/tinyrange/tinyrange/pkg/filesystem/ext4"
+	gonbd "github.com/tinyrange/tinyrange/third_party/go-nbd"
+	nbdBackend "github.com/tinyrange/tinyrange/third_party/go-nbd/backend"
+	"github.com/tinyrange/vm"
+)
+
+type fileBackend struct {
+	f *os.File
+}
+
+// ReadAt implements backend.Backend.
+func (f *fileBackend) ReadAt(p []byte, off int64) (n int, err error) {
+	n, err = f.f.ReadAt(p, off)
+	if errors.Is(err, io.EOF) {
+		// Reads past the end of the file are zeros.
+		clear(p[n:])
+		return len(p), nil
+	}
+
+	return
+}
+
+// WriteAt implements backend.Backend.
+func (f *fileBackend) WriteAt(p []byte, off int64) (n int, err error) {
+	return f.f.WriteAt(p, off)
+}
+
+// Size implements backend.Backend.
+func (f *fileBackend) Size() (int64, error) {
+	info, err := f.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+// Sync implements backend.Backend.
+func (f *fileBackend) Sync() error {
+	return f.f.Sync()
+}
+
+var (
+	_ nbdBackend.Backend = &fileBackend{}
+)
+
+// serveNbd exports backend on each connection accepted from listener until the listener is closed.
+func serveNbd(listener net.Listener, backend nbdBackend.Backend) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		go func(conn net.Conn) {
+			slog.Debug("got nbd connection", "remote", conn.RemoteAddr().String())
+			err := gonbd.Handle(conn, []gonbd.Export{{
+				Name:        "",
+				Description: "",
+				Backend:     backend,
+			}}, &gonbd.Options{
+				ReadOnly:           false,
+				MinimumBlockSize:   1024,
+				PreferredBlockSize: 4096,
+				MaximumBlockSize:   32*1024*1024 - 1,
+			})
+			if err != nil {
+				slog.Warn("nbd server failed to handle", "error", err)
+			}
+		}(conn)
+	}
+}
+
+// openDataDisk creates the backend for a data disk.
+// Disks with a source image are attached directly so writes persist in the image. The image is
+// extended to the requested size if it's smaller. Disks without a source are a empty ext4
+// filesystem held in memory and discarded when the virtual machine exits.
+func (tr *TinyRange) openDataDisk(disk config.DataDisk) (nbdBackend.Backend, io.Closer, error) {
+	size := int64(disk.Size) * 1024 * 1024
+
+	if disk.Source != "" {
+		f, err := os.OpenFile(tr.cfg.Resolve(disk.Source), os.O_RDWR, 0)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open data disk: %w", err)
+		}
+
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+
+		if info.Size() < size {
+			if err := f.Truncate(size); err != nil {
+				f.Close()
+				return nil, nil, fmt.Errorf("failed to resize data disk: %w", err)
+			}
+		}
+
+		return &fileBackend{f: f}, f, nil
+	}
+
+	if size == 0 {
+		return nil, nil, fmt.Errorf("data disks without a source need a size")
+	}
+
+	vmem := vm.NewVirtualMemory(size, 4096)
+
+	if _, err := ext4.CreateExt4Filesystem(vmem, 0, size); err != nil {
+		return nil, nil, fmt.Errorf("failed to create data disk filesystem: %w", err)
+	}
+
+	backend := &vmBackend{vm: vmem}
+
+	return backend, backend, nil
+}
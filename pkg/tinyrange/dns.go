@@ -3,6 +3,7 @@ package tinyrange
 import (
 	"fmt"
 	"log/slog"
+	"strings"
 
 	"github.com/miekg/dns"
 )
@@ -10,12 +11,38 @@ import (
 type dnsServer struct {
 	server    *dns.Server
 	dnsLookup func(name string) (string, error)
+	// If set only names it returns true for are resolved.
+	allowName func(name string) bool
+	// Maps reverse names (like 1.0.42.10.in-addr.arpa.) to the name PTR queries are answered with.
+	reverseNames map[string]string
+}
+
+// addReverseName answers PTR queries for ip with name.
+func (s *dnsServer) addReverseName(ip string, name string) error {
+	reverse, err := dns.ReverseAddr(ip)
+	if err != nil {
+		return err
+	}
+
+	if s.reverseNames == nil {
+		s.reverseNames = make(map[string]string)
+	}
+
+	s.reverseNames[reverse] = dns.Fqdn(name)
+
+	return nil
 }
 
 func (s *dnsServer) parseQuery(r *dns.Msg, m *dns.Msg) {
 	for _, q := range m.Question {
 		switch q.Qtype {
 		case dns.TypeA:
+			if s.allowName != nil && !s.allowName(q.Name) {
+				slog.Warn("denied DNS query", "name", q.Name)
+				m.SetRcode(r, dns.RcodeNameError)
+				return
+			}
+
 			ip, err := s.dnsLookup(q.Name)
 			if err != nil {
 				slog.Error("error resolving dns", "name", q.Name, "err", err)
@@ -33,6 +60,20 @@ func (s *dnsServer) parseQuery(r *dns.Msg, m *dns.Msg) {
 				m.SetRcode(r, dns.RcodeNameError)
 				return
 			}
+		case dns.TypePTR:
+			// Only addresses inside the virtual network are answered. Anything else
+			// gets a NXDOMAIN right away so guest software doesn't wait for a timeout.
+			name, ok := s.reverseNames[strings.ToLower(q.Name)]
+			if !ok {
+				slog.Debug("DNS PTR query for unknown address", "name", q.Name)
+				m.SetRcode(r, dns.RcodeNameError)
+				return
+			}
+
+			rr, err := dns.NewRR(fmt.Sprintf("%s PTR %s", q.Name, name))
+			if err == nil {
+				m.Answer = append(m.Answer, rr)
+			}
 		}
 	}
 }
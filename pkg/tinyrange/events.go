@@ -0,0 +1,120 @@
+package tinyrange
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// Lifecycle events written to the events socket.
+const (
+	EventBooting      = "booting"
+	EventSshReady     = "ssh-ready"
+	EventShuttingDown = "shutting-down"
+	EventRestarting   = "restarting"
+	EventExited       = "exited"
+)
+
+type lifecycleEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Name  string    `json:"name,omitempty"`
+
+	// Only set for exited events.
+	Code  *int   `json:"code,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// eventStream writes lifecycle events as JSON lines to a Unix socket that a
+// supervisor is listening on. A nil eventStream discards events.
+type eventStream struct {
+	mu   sync.Mutex
+	conn net.Conn
+	enc  *json.Encoder
+	name string
+}
+
+// openEventStream connects to the events socket at path. Every event is labelled with name
+// if it's set. Returns nil if path is "".
+func openEventStream(path string, name string) (*eventStream, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to events socket: %w", err)
+	}
+
+	return &eventStream{conn: conn, enc: json.NewEncoder(conn), name: name}, nil
+}
+
+func (s *eventStream) write(ev lifecycleEvent) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return
+	}
+
+	ev.Time = time.Now().UTC()
+	ev.Name = s.name
+
+	if err := s.enc.Encode(&ev); err != nil {
+		// Stop writing events once the supervisor goes away.
+		slog.Warn("failed to write event", "event", ev.Event, "error", err)
+
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *eventStream) Emit(event string) {
+	s.write(lifecycleEvent{Event: event})
+}
+
+// Exited writes the final event for the run. The exit code is the status of the
+// guest command or 0 on success and 1 on any other error.
+func (s *eventStream) Exited(err error) {
+	code := 0
+
+	var exitErr *ExitStatusError
+	if errors.As(err, &exitErr) {
+		code = exitErr.Status
+	} else if err != nil {
+		code = 1
+	}
+
+	ev := lifecycleEvent{Event: EventExited, Code: &code}
+	if err != nil && exitErr == nil {
+		ev.Error = err.Error()
+	}
+
+	s.write(ev)
+}
+
+func (s *eventStream) Close() error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+
+	return err
+}
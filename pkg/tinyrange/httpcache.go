@@ -0,0 +1,457 @@
+package tinyrange
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The longest a response without explicit freshness information is served without revalidation.
+const HTTP_CACHE_MAX_HEURISTIC = 24 * time.Hour
+
+// Headers copied from the upstream response when serving a cached entry.
+var httpCacheHeaders = []string{
+	"Content-Type",
+	"Content-Encoding",
+	"ETag",
+	"Last-Modified",
+}
+
+type httpCacheEntry struct {
+	URL     string      `json:"url"`
+	Header  http.Header `json:"header"`
+	Sha256  string      `json:"sha256"`
+	Expires time.Time   `json:"expires"`
+}
+
+func (ent *httpCacheEntry) fresh(now time.Time) bool {
+	return now.Before(ent.Expires)
+}
+
+// httpCache is a read-through cache for guest HTTP downloads. Guests request
+// http://host.internal/proxy/<scheme>/<host>/<path> and the response is stored
+// on disk so other virtual machines sharing the directory don't download it again.
+type httpCache struct {
+	dir    string
+	client *http.Client
+
+	locksMtx sync.Mutex
+	locks    map[string]*httpCacheLock
+
+	// If set only URLs with a host it returns true for are served, including after redirects.
+	allowHost func(host string) bool
+}
+
+// restrictHosts makes the cache refuse URLs and redirects to hosts allowHost returns false for.
+func (c *httpCache) restrictHosts(allowHost func(host string) bool) {
+	c.allowHost = allowHost
+
+	client := *c.client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if !allowHost(req.URL.Hostname()) {
+			return fmt.Errorf("redirect to %s is not allowed", req.URL.Host)
+		}
+
+		if len(via) >= 10 {
+			return fmt.Errorf("stopped after 10 redirects")
+		}
+
+		return nil
+	}
+	c.client = &client
+}
+
+func newHttpCache(dir string, client *http.Client) (*httpCache, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	return &httpCache{
+		dir:    dir,
+		client: client,
+		locks:  make(map[string]*httpCacheLock),
+	}, nil
+}
+
+// A lock for a single URL. It's removed from httpCache.locks once nothing holds or waits on it.
+type httpCacheLock struct {
+	mtx  sync.Mutex
+	refs int
+}
+
+// lock makes sure only a single request downloads each URL at a time.
+func (c *httpCache) lock(key string) func() {
+	c.locksMtx.Lock()
+	l, ok := c.locks[key]
+	if !ok {
+		l = &httpCacheLock{}
+		c.locks[key] = l
+	}
+	l.refs += 1
+	c.locksMtx.Unlock()
+
+	l.mtx.Lock()
+
+	return func() {
+		l.mtx.Unlock()
+
+		c.locksMtx.Lock()
+		l.refs -= 1
+		if l.refs == 0 {
+			delete(c.locks, key)
+		}
+		c.locksMtx.Unlock()
+	}
+}
+
+func (c *httpCache) filenames(key string) (string, string) {
+	return filepath.Join(c.dir, key+".json"), filepath.Join(c.dir, key+".bin")
+}
+
+func (c *httpCache) readEntry(key string) (*httpCacheEntry, error) {
+	metaFilename, _ := c.filenames(key)
+
+	contents, err := os.ReadFile(metaFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	var ent httpCacheEntry
+	if err := json.Unmarshal(contents, &ent); err != nil {
+		return nil, err
+	}
+
+	return &ent, nil
+}
+
+func (c *httpCache) writeEntry(key string, ent *httpCacheEntry) error {
+	metaFilename, _ := c.filenames(key)
+
+	contents, err := json.Marshal(ent)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a concurrent reader never sees a partial entry.
+	tmp := metaFilename + ".tmp"
+	if err := os.WriteFile(tmp, contents, os.FileMode(0644)); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, metaFilename)
+}
+
+// store writes the body of resp to the cache.
+func (c *httpCache) store(key string, url string, resp *http.Response, expires time.Time) (*httpCacheEntry, error) {
+	_, dataFilename := c.filenames(key)
+
+	tmp, err := os.CreateTemp(c.dir, key+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+
+	if _, err := io.Copy(io.MultiWriter(tmp, h), resp.Body); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(tmp.Name(), dataFilename); err != nil {
+		return nil, err
+	}
+
+	ent := &httpCacheEntry{
+		URL:     url,
+		Header:  make(http.Header),
+		Sha256:  hex.EncodeToString(h.Sum(nil)),
+		Expires: expires,
+	}
+
+	for _, name := range httpCacheHeaders {
+		if val := resp.Header.Get(name); val != "" {
+			ent.Header.Set(name, val)
+		}
+	}
+
+	if err := c.writeEntry(key, ent); err != nil {
+		return nil, err
+	}
+
+	return ent, nil
+}
+
+// The response to a proxied request decided on while holding the lock for it's URL.
+// Either a cached entry with it's data file already open or a upstream response that isn't cached.
+type httpCacheResult struct {
+	ent    *httpCacheEntry
+	f      *os.File
+	status string
+
+	resp *http.Response
+}
+
+func (res *httpCacheResult) Close() error {
+	if res.f != nil {
+		return res.f.Close()
+	}
+
+	return res.resp.Body.Close()
+}
+
+// A error with the status code it's returned to the guest with.
+type httpCacheError struct {
+	code int
+	err  error
+}
+
+func (e *httpCacheError) Error() string { return e.err.Error() }
+
+// openEntry opens the data file of ent. An open file can still be read after
+// the lock is released even if another request replaces the entry.
+func (c *httpCache) openEntry(key string, ent *httpCacheEntry, status string) (*httpCacheResult, error) {
+	_, dataFilename := c.filenames(key)
+
+	f, err := os.Open(dataFilename)
+	if err != nil {
+		return nil, &httpCacheError{code: http.StatusInternalServerError, err: err}
+	}
+
+	return &httpCacheResult{ent: ent, f: f, status: status}, nil
+}
+
+func (c *httpCache) serveEntry(w http.ResponseWriter, r *http.Request, ent *httpCacheEntry, f *os.File, status string) {
+	for name, values := range ent.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("X-Cache", status)
+	w.Header().Set("X-Content-Sha256", ent.Sha256)
+
+	lastModified, _ := http.ParseTime(ent.Header.Get("Last-Modified"))
+
+	http.ServeContent(w, r, "", lastModified, f)
+}
+
+// parseCacheControl parses a Cache-Control header into a map of directives.
+func parseCacheControl(header string) map[string]string {
+	ret := make(map[string]string)
+
+	for _, directive := range strings.Split(header, ",") {
+		directive = strings.TrimSpace(directive)
+		if directive == "" {
+			continue
+		}
+
+		key, value, _ := strings.Cut(directive, "=")
+
+		ret[strings.ToLower(key)] = strings.Trim(value, "\"")
+	}
+
+	return ret
+}
+
+// cachePolicy returns if a response can be stored and when it should be revalidated.
+func cachePolicy(header http.Header, now time.Time) (bool, time.Time) {
+	cc := parseCacheControl(header.Get("Cache-Control"))
+
+	if _, ok := cc["no-store"]; ok {
+		return false, time.Time{}
+	}
+	if _, ok := cc["private"]; ok {
+		return false, time.Time{}
+	}
+	if _, ok := cc["no-cache"]; ok {
+		return true, now
+	}
+
+	// The cache is shared between virtual machines so s-maxage takes priority.
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if val, ok := cc[name]; ok {
+			seconds, err := strconv.Atoi(val)
+			if err != nil {
+				return true, now
+			}
+
+			return true, now.Add(time.Duration(seconds) * time.Second)
+		}
+	}
+
+	if expires := header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return true, now
+		}
+
+		return true, t
+	}
+
+	// Without explicit freshness use the common heuristic of 10% of the time since the last modification.
+	if lastModified, err := http.ParseTime(header.Get("Last-Modified")); err == nil && lastModified.Before(now) {
+		return true, now.Add(min(now.Sub(lastModified)/10, HTTP_CACHE_MAX_HEURISTIC))
+	}
+
+	return true, now
+}
+
+// ServeHTTP implements http.Handler.
+func (c *httpCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "only GET and HEAD are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	scheme, rest, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/proxy/"), "/")
+	if !ok || (scheme != "http" && scheme != "https") || rest == "" {
+		http.Error(w, "expected /proxy/<http|https>/<host>/<path>", http.StatusBadRequest)
+		return
+	}
+
+	url := scheme + "://" + rest
+	if r.URL.RawQuery != "" {
+		url += "?" + r.URL.RawQuery
+	}
+
+	if c.allowHost != nil {
+		host, _, _ := strings.Cut(rest, "/")
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if !c.allowHost(strings.Trim(host, "[]")) {
+			slog.Warn("denied proxied request", "url", url)
+			http.Error(w, "the host is not allowed", http.StatusForbidden)
+			return
+		}
+	}
+
+	sum := sha256.Sum256([]byte(url))
+	key := hex.EncodeToString(sum[:])
+
+	res, err := c.fetch(r, key, url)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if cacheErr, ok := err.(*httpCacheError); ok {
+			code = cacheErr.code
+		}
+
+		http.Error(w, err.Error(), code)
+		return
+	}
+	defer res.Close()
+
+	if res.resp == nil {
+		c.serveEntry(w, r, res.ent, res.f, res.status)
+		return
+	}
+
+	for name, values := range res.resp.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("X-Cache", "BYPASS")
+	w.WriteHeader(res.resp.StatusCode)
+
+	if r.Method != http.MethodHead {
+		if _, err := io.Copy(w, res.resp.Body); err != nil {
+			slog.Debug("http cache: failed to copy response", "url", url, "error", err)
+		}
+	}
+}
+
+// fetch downloads or revalidates url if there isn't a fresh entry for it in the cache.
+// The lock for the URL is only held while deciding on the response so other requests
+// for it don't wait for the guest to finish reading it.
+func (c *httpCache) fetch(r *http.Request, key string, url string) (*httpCacheResult, error) {
+	unlock := c.lock(key)
+	defer unlock()
+
+	now := time.Now()
+
+	ent, err := c.readEntry(key)
+	if err != nil {
+		ent = nil
+	}
+
+	if ent != nil && ent.fresh(now) {
+		return c.openEntry(key, ent, "HIT")
+	}
+
+	// The download continues even if the guest disconnects so the result can be cached.
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, &httpCacheError{code: http.StatusBadRequest, err: err}
+	}
+
+	if ua := r.Header.Get("User-Agent"); ua != "" {
+		req.Header.Set("User-Agent", ua)
+	}
+
+	if ent != nil {
+		if etag := ent.Header.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := ent.Header.Get("Last-Modified"); lastModified != "" {
+			req.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		if ent != nil {
+			slog.Warn("http cache: serving stale response", "url", url, "error", err)
+			return c.openEntry(key, ent, "STALE")
+		}
+
+		return nil, &httpCacheError{code: http.StatusBadGateway, err: err}
+	}
+
+	if resp.StatusCode == http.StatusNotModified && ent != nil {
+		resp.Body.Close()
+
+		if _, expires := cachePolicy(resp.Header, now); expires.After(ent.Expires) {
+			ent.Expires = expires
+		}
+
+		if err := c.writeEntry(key, ent); err != nil {
+			slog.Warn("http cache: failed to update entry", "url", url, "error", err)
+		}
+
+		return c.openEntry(key, ent, "REVALIDATED")
+	}
+
+	cacheable, expires := cachePolicy(resp.Header, now)
+
+	// Responses that aren't cached are streamed to the guest once the lock is released.
+	if resp.StatusCode != http.StatusOK || !cacheable {
+		return &httpCacheResult{resp: resp}, nil
+	}
+	defer resp.Body.Close()
+
+	ent, err = c.store(key, url, resp, expires)
+	if err != nil {
+		return nil, &httpCacheError{code: http.StatusBadGateway, err: fmt.Errorf("failed to cache response: %s", err)}
+	}
+
+	slog.Debug("http cache: stored", "url", url, "sha256", ent.Sha256)
+
+	return c.openEntry(key, ent, "MISS")
+}
+
+var (
+	_ http.Handler = &httpCache{}
+)
@@ -0,0 +1,154 @@
+package tinyrange
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCachePolicy(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		name      string
+		header    http.Header
+		cacheable bool
+		expires   time.Time
+	}{
+		{"no headers", http.Header{}, true, now},
+		{"no-store", http.Header{"Cache-Control": {"max-age=60, no-store"}}, false, time.Time{}},
+		{"private", http.Header{"Cache-Control": {"private, max-age=60"}}, false, time.Time{}},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache"}}, true, now},
+		{"max-age", http.Header{"Cache-Control": {"public, max-age=60"}}, true, now.Add(time.Minute)},
+		{"s-maxage", http.Header{"Cache-Control": {"max-age=60, s-maxage=3600"}}, true, now.Add(time.Hour)},
+		{"quoted", http.Header{"Cache-Control": {`max-age="60"`}}, true, now.Add(time.Minute)},
+		{"bad max-age", http.Header{"Cache-Control": {"max-age=soon"}}, true, now},
+		{"expires", http.Header{"Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, true, now.Add(time.Hour)},
+		{"bad expires", http.Header{"Expires": {"0"}}, true, now},
+		{"max-age over expires", http.Header{
+			"Cache-Control": {"max-age=60"},
+			"Expires":       {now.Add(time.Hour).Format(http.TimeFormat)},
+		}, true, now.Add(time.Minute)},
+		{"last-modified", http.Header{"Last-Modified": {now.Add(-10 * time.Hour).Format(http.TimeFormat)}}, true, now.Add(time.Hour)},
+		{"old last-modified", http.Header{"Last-Modified": {now.Add(-1000 * time.Hour).Format(http.TimeFormat)}}, true, now.Add(HTTP_CACHE_MAX_HEURISTIC)},
+		{"future last-modified", http.Header{"Last-Modified": {now.Add(time.Hour).Format(http.TimeFormat)}}, true, now},
+	} {
+		cacheable, expires := cachePolicy(test.header, now)
+		if cacheable != test.cacheable || !expires.Equal(test.expires) {
+			t.Errorf("%s: cachePolicy() = %v, %s, want %v, %s", test.name, cacheable, expires, test.cacheable, test.expires)
+		}
+	}
+}
+
+func TestHttpCache(t *testing.T) {
+	requests := make(map[string]int)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path] += 1
+
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=3600")
+		case "/revalidate":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		}
+
+		io.WriteString(w, "contents of "+r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	cache, err := newHttpCache(t.TempDir(), upstream.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	get := func(path string) (string, string) {
+		t.Helper()
+
+		rec := httptest.NewRecorder()
+		cache.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/proxy/http/"+host+path, nil))
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s returned %d: %s", path, rec.Code, rec.Body.String())
+		}
+
+		if body := rec.Body.String(); body != "contents of "+path {
+			t.Fatalf("GET %s returned %q", path, body)
+		}
+
+		return rec.Header().Get("X-Cache"), rec.Header().Get("X-Content-Sha256")
+	}
+
+	for _, test := range []struct {
+		path     string
+		statuses []string
+		requests int
+	}{
+		{"/fresh", []string{"MISS", "HIT", "HIT"}, 1},
+		{"/revalidate", []string{"MISS", "REVALIDATED", "REVALIDATED"}, 3},
+		{"/no-store", []string{"BYPASS", "BYPASS"}, 2},
+	} {
+		for i, want := range test.statuses {
+			if status, _ := get(test.path); status != want {
+				t.Errorf("request %d for %s: X-Cache = %s, want %s", i, test.path, status, want)
+			}
+		}
+
+		if requests[test.path] != test.requests {
+			t.Errorf("%s was requested upstream %d times, want %d", test.path, requests[test.path], test.requests)
+		}
+	}
+
+	// Stale entries are still served if the upstream server goes away.
+	upstream.Close()
+
+	if status, sha := get("/revalidate"); status != "STALE" || sha == "" {
+		t.Errorf("X-Cache = %s with sha256 %q after the upstream closed, want STALE", status, sha)
+	}
+
+	if len(cache.locks) != 0 {
+		t.Errorf("%d URL locks were kept after every request finished", len(cache.locks))
+	}
+}
+
+func TestHttpCacheRestrictHosts(t *testing.T) {
+	cache, err := newHttpCache(t.TempDir(), http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache.restrictHosts(func(host string) bool { return host == "allowed.example" })
+
+	for _, path := range []string{
+		"/proxy/http/denied.example/file",
+		"/proxy/https/denied.example:8443/file",
+		"/proxy/http/allowed.example.denied.example/file",
+	} {
+		rec := httptest.NewRecorder()
+		cache.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("GET %s returned %d, want %d", path, rec.Code, http.StatusForbidden)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	cache.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/proxy/ftp/allowed.example/file", nil))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("GET with a unsupported scheme returned %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
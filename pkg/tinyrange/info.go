@@ -0,0 +1,57 @@
+package tinyrange
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/tinyrange/tinyrange/pkg/netstack"
+	"golang.org/x/crypto/ssh"
+)
+
+// runSshInfo waits for the SSH server in the guest then prints how to connect to it through
+// the forwarded address listen. The key file is printed instead of the password if it's set.
+// It keeps the virtual machine running until TinyRange is interrupted or the virtual machine exits.
+func runSshInfo(ns *netstack.NetStack, address string, listen net.Addr, username string, auth []ssh.AuthMethod, password string, keyFile string, ready func(), exited <-chan error) error {
+	client := dialSsh(ns, address, &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	client.Close()
+
+	ready()
+
+	host, port, err := net.SplitHostPort(listen.String())
+	if err != nil {
+		return err
+	}
+
+	// The host key changes every boot so don't save it to known_hosts.
+	fmt.Printf("The virtual machine is ready. Connect with:\n\n")
+	if keyFile != "" {
+		fmt.Printf("  ssh -p %s -i %s -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null %s@%s\n\n", port, keyFile, username, host)
+		fmt.Printf("Host:     %s\nPort:     %s\nUsername: %s\nKey:      %s\n\n", host, port, username, keyFile)
+	} else {
+		fmt.Printf("  ssh -p %s -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null %s@%s\n\n", port, username, host)
+		fmt.Printf("Host:     %s\nPort:     %s\nUsername: %s\nPassword: %s\n\n", host, port, username, password)
+	}
+	fmt.Printf("Press Ctrl+C to shut down the virtual machine.\n")
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	select {
+	case <-sigs:
+		return nil
+	case err := <-exited:
+		if err != nil {
+			return fmt.Errorf("virtual machine exited: %w", err)
+		}
+
+		return nil
+	}
+}
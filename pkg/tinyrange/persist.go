@@ -0,0 +1,289 @@
+package tinyrange
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tinyrange/tinyrange/pkg/common"
+	"github.com/tinyrange/tinyrange/pkg/filesystem/ext4"
+	initExec "github.com/tinyrange/tinyrange/pkg/init"
+	nbdBackend "github.com/tinyrange/tinyrange/third_party/go-nbd/backend"
+)
+
+// The persistent overlay file has a fixed size header followed by a bitmap of
+// dirty blocks then the block data. Blocks that have never been written are
+// read from the base image so the file stays sparse.
+var persistMagic = [8]byte{'T', 'R', 'P', 'E', 'R', 'S', 'T', '1'}
+
+const (
+	persistHeaderSize = 4096
+	persistBlockSize  = 4096
+)
+
+type persistHeader struct {
+	Magic     [8]byte
+	BlockSize int64
+	Size      int64
+	BaseHash  [32]byte
+}
+
+type persistBackend struct {
+	mtx        sync.Mutex
+	base       nbdBackend.Backend
+	f          *os.File
+	size       int64
+	dirty      []byte
+	dataOffset int64
+}
+
+func (p *persistBackend) isDirty(block int64) bool {
+	return p.dirty[block/8]&(1<<(block%8)) != 0
+}
+
+func (p *persistBackend) markDirty(block int64) error {
+	p.dirty[block/8] |= 1 << (block % 8)
+
+	_, err := p.f.WriteAt(p.dirty[block/8:block/8+1], persistHeaderSize+block/8)
+	return err
+}
+
+// ReadAt implements backend.Backend.
+func (p *persistBackend) ReadAt(b []byte, off int64) (n int, err error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	for n < len(b) {
+		pos := off + int64(n)
+		block := pos / persistBlockSize
+		blockOff := pos % persistBlockSize
+		end := min(len(b), n+int(persistBlockSize-blockOff))
+
+		if p.isDirty(block) {
+			_, err = p.f.ReadAt(b[n:end], p.dataOffset+pos)
+		} else {
+			_, err = p.base.ReadAt(b[n:end], pos)
+		}
+		if err != nil {
+			return n, err
+		}
+
+		n = end
+	}
+
+	return n, nil
+}
+
+// WriteAt implements backend.Backend.
+func (p *persistBackend) WriteAt(b []byte, off int64) (n int, err error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	for n < len(b) {
+		pos := off + int64(n)
+		block := pos / persistBlockSize
+		blockOff := pos % persistBlockSize
+		end := min(len(b), n+int(persistBlockSize-blockOff))
+
+		if !p.isDirty(block) {
+			// Copy the rest of the block from the base image before the first write.
+			if blockOff != 0 || end-n != persistBlockSize {
+				buf := make([]byte, persistBlockSize)
+
+				if _, err := p.base.ReadAt(buf, block*persistBlockSize); err != nil {
+					return n, err
+				}
+
+				if _, err := p.f.WriteAt(buf, p.dataOffset+block*persistBlockSize); err != nil {
+					return n, err
+				}
+			}
+
+			if err := p.markDirty(block); err != nil {
+				return n, err
+			}
+		}
+
+		if _, err := p.f.WriteAt(b[n:end], p.dataOffset+pos); err != nil {
+			return n, err
+		}
+
+		n = end
+	}
+
+	return n, nil
+}
+
+// Size implements backend.Backend.
+func (p *persistBackend) Size() (int64, error) {
+	return p.size, nil
+}
+
+// Sync implements backend.Backend.
+func (p *persistBackend) Sync() error {
+	return p.f.Sync()
+}
+
+func (p *persistBackend) Close() error {
+	return p.f.Close()
+}
+
+var (
+	_ nbdBackend.Backend = &persistBackend{}
+)
+
+// persistBaseHash identifies the inputs used to build the base image so a
+// overlay isn't applied to a different root filesystem. The base has to be built
+// with makePersistBaseDeterministic so the same inputs give the same image.
+func (tr *TinyRange) persistBaseHash(size int64) ([32]byte, error) {
+	fragments, err := json.Marshal(tr.cfg.RootFsFragments)
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	h := sha256.New()
+
+	h.Write(fragments)
+	binary.Write(h, binary.LittleEndian, size)
+
+	// The fragments only name host files so their contents are part of the hash too.
+	for _, frag := range tr.cfg.RootFsFragments {
+		filename := ""
+
+		if frag.LocalFile != nil {
+			filename = tr.cfg.Resolve(frag.LocalFile.HostFilename)
+		} else if frag.Archive != nil && tr.streamingServer == "" {
+			filename = tr.cfg.Resolve(frag.Archive.HostFilename)
+		} else if builtin := frag.Builtin; builtin != nil {
+			switch builtin.Name {
+			case "init":
+				exec, err := initExec.GetInitExecutable(builtin.Architecture)
+				if err != nil {
+					return [32]byte{}, err
+				}
+
+				h.Write(exec)
+			case "init.star":
+				h.Write(initExec.INIT_SCRIPT)
+			case "tinyrange":
+				filename, err = os.Executable()
+			case "tinyrange_qemu.star":
+				filename, err = common.GetAdjacentExecutable("tinyrange_qemu.star")
+			}
+			if err != nil {
+				return [32]byte{}, err
+			}
+		}
+
+		if filename == "" {
+			continue
+		}
+
+		f, err := os.Open(filename)
+		if err != nil {
+			return [32]byte{}, err
+		}
+
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return [32]byte{}, fmt.Errorf("failed to hash %s: %w", filename, err)
+		}
+	}
+
+	return [32]byte(h.Sum(nil)), nil
+}
+
+// makePersistBaseDeterministic replaces the random UUID and creation times in a new base
+// image so rebuilding it from the same inputs gives the same blocks.
+func makePersistBaseDeterministic(fs *ext4.Ext4Filesystem, baseHash [32]byte) error {
+	return fs.MakeDeterministic(uuid.UUID(baseHash[:16]), time.Unix(0, 0))
+}
+
+// openPersistBackend opens (or creates) a copy-on-write overlay over base in filename.
+// The base is never written to.
+func openPersistBackend(filename string, base nbdBackend.Backend, baseHash [32]byte) (*persistBackend, error) {
+	size, err := base.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := (size + persistBlockSize - 1) / persistBlockSize
+	bitmapSize := (blocks + 7) / 8
+	dataOffset := persistHeaderSize + (bitmapSize+persistBlockSize-1)/persistBlockSize*persistBlockSize
+
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, os.FileMode(0644))
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	expected := persistHeader{
+		Magic:     persistMagic,
+		BlockSize: persistBlockSize,
+		Size:      size,
+		BaseHash:  baseHash,
+	}
+
+	dirty := make([]byte, bitmapSize)
+
+	if info.Size() == 0 {
+		buf := new(bytes.Buffer)
+		if err := binary.Write(buf, binary.LittleEndian, &expected); err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		if _, err := f.WriteAt(buf.Bytes(), 0); err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		if err := f.Truncate(dataOffset + size); err != nil {
+			f.Close()
+			return nil, err
+		}
+	} else {
+		var header persistHeader
+		if err := binary.Read(f, binary.LittleEndian, &header); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to read persist header: %w", err)
+		}
+
+		if header.Magic != persistMagic {
+			f.Close()
+			return nil, fmt.Errorf("%s is not a persistent disk image", filename)
+		}
+
+		if header != expected {
+			f.Close()
+			return nil, errors.New("persistent disk image was created with a different root filesystem, remove it to start over")
+		}
+
+		if _, err := f.ReadAt(dirty, persistHeaderSize); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to read persist bitmap: %w", err)
+		}
+	}
+
+	return &persistBackend{
+		base:       base,
+		f:          f,
+		size:       size,
+		dirty:      dirty,
+		dataOffset: dataOffset,
+	}, nil
+}
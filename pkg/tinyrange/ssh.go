@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/tinyrange/tinyrange/pkg/config"
 	"github.com/tinyrange/tinyrange/pkg/netstack"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/term"
@@ -98,15 +99,20 @@ func getFd(reader io.Reader) (fd int, ok bool) {
 	return fd, term.IsTerminal(fd)
 }
 
-func connectOverSsh(ns *netstack.NetStack, address string, username string, password string) error {
-	config := &ssh.ClientConfig{
-		User: username,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(password),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
+// ExitStatusError is returned when a command run by the exec or ssh interaction exits with a non-zero status.
+type ExitStatusError struct {
+	Status int
+}
 
+func (e *ExitStatusError) Error() string {
+	return fmt.Sprintf("command exited with status %d", e.Status)
+}
+
+// ExitCode returns the status so the host process can exit with the same code.
+func (e *ExitStatusError) ExitCode() int { return e.Status }
+
+// dialSsh connects to the SSH server in the guest retrying until it's started.
+func dialSsh(ns *netstack.NetStack, address string, config *ssh.ClientConfig) *ssh.Client {
 	var (
 		conn  net.Conn
 		c     ssh.Conn
@@ -142,7 +148,53 @@ func connectOverSsh(ns *netstack.NetStack, address string, username string, pass
 		break
 	}
 
-	client := ssh.NewClient(c, chans, reqs)
+	return ssh.NewClient(c, chans, reqs)
+}
+
+// sshAuthMethods returns how the host authenticates with the guest SSH server. If a key is set
+// it's used instead of the password, and the password is only tried as well if it was set.
+func sshAuthMethods(cfg config.TinyRangeConfig) ([]ssh.AuthMethod, error) {
+	if cfg.SshKey == "" {
+		_, password := cfg.SshCredentials()
+
+		return []ssh.AuthMethod{ssh.Password(password)}, nil
+	}
+
+	contents, err := os.ReadFile(cfg.Resolve(cfg.SshKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH key: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(contents)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH key %s: %w", cfg.SshKey, err)
+	}
+
+	ret := []ssh.AuthMethod{ssh.PublicKeys(signer)}
+
+	if cfg.SshPassword != "" {
+		ret = append(ret, ssh.Password(cfg.SshPassword))
+	}
+
+	return ret, nil
+}
+
+// keepAliveCommand is run in the guest after the session ends when keep alive is enabled.
+// Init runs the guest's shell for it, including the builtin shell with --fallback-shell.
+const keepAliveCommand = "interactive"
+
+// connectOverSsh starts a interactive session in the guest. ready is called once the SSH server accepts the connection.
+// If command is empty the guest's default command is run, otherwise command is run with a terminal.
+// A non-zero exit status from the guest is returned as a *ExitStatusError.
+func connectOverSsh(ns *netstack.NetStack, address string, username string, auth []ssh.AuthMethod, command string, ready func()) error {
+	client := dialSsh(ns, address, &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		BannerCallback:  ssh.BannerDisplayStderr(),
+	})
+
+	ready()
 
 	session, err := client.NewSession()
 	if err != nil {
@@ -197,12 +249,25 @@ func connectOverSsh(ns *netstack.NetStack, address string, username string, pass
 	session.Stdout = os.Stdout
 	session.Stderr = os.Stderr
 
-	if err := session.Shell(); err != nil {
-		return fmt.Errorf("failed to start shell: %v", err)
+	if command == "" {
+		if err := session.Shell(); err != nil {
+			return fmt.Errorf("failed to start shell: %v", err)
+		}
+	} else {
+		if err := session.Start(command); err != nil {
+			return fmt.Errorf("failed to start command: %v", err)
+		}
 	}
 
+	// Set before closeExit is sent if the session exits with a non-zero status.
+	exitStatus := 0
+
 	go func() {
-		if err := session.Wait(); err != nil {
+		var exitErr *ssh.ExitError
+
+		if err := session.Wait(); errors.As(err, &exitErr) {
+			exitStatus = exitErr.ExitStatus()
+		} else if err != nil {
 			if errors.Is(err, &ssh.ExitMissingError{}) {
 				slog.Debug("failed to wait", "error", err)
 			} else {
@@ -215,6 +280,10 @@ func connectOverSsh(ns *netstack.NetStack, address string, username string, pass
 
 	switch <-close {
 	case closeExit:
+		if exitStatus != 0 {
+			return &ExitStatusError{Status: exitStatus}
+		}
+
 		return nil
 	case closeRestart:
 		return ErrRestart
@@ -223,6 +292,61 @@ func connectOverSsh(ns *netstack.NetStack, address string, username string, pass
 	return nil
 }
 
+// execOverSsh runs command in the guest without a PTY so stdout and stderr stay separate.
+// It returns the exit status of the command. ready is called once the SSH server accepts the connection.
+func execOverSsh(ns *netstack.NetStack, address string, username string, auth []ssh.AuthMethod, command string, env []string, ready func()) (int, error) {
+	client := dialSsh(ns, address, &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	defer client.Close()
+
+	ready()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return 0, fmt.Errorf("failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+
+		if err := session.Setenv(k, v); err != nil {
+			return 0, fmt.Errorf("failed to set %s: %v", k, err)
+		}
+	}
+
+	// Copy stdin separately so Wait doesn't block on a terminal that is never closed.
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return 0, fmt.Errorf("failed to pipe stdin: %v", err)
+	}
+
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	if err := session.Start(command); err != nil {
+		return 0, fmt.Errorf("failed to start command: %v", err)
+	}
+
+	go func() {
+		_, _ = io.Copy(stdin, os.Stdin)
+		stdin.Close()
+	}()
+
+	var exitErr *ssh.ExitError
+
+	if err := session.Wait(); errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return 0, nil
+}
+
 type webSocketWriter struct {
 	underlyingStream *websocket.Conn
 	recorder         io.WriteCloser
@@ -261,13 +385,25 @@ var (
 	_ io.WriteCloser = &webSocketWriter{}
 )
 
-func newWebSocketSSH(ws *websocket.Conn, ns *netstack.NetStack, address string, username string, password string) error {
+type webSshInput struct {
+	Resize bool   `json:"resize"`
+	Rows   int    `json:"rows"`
+	Cols   int    `json:"cols"`
+	Input  string `json:"input"`
+}
+
+func newWebSocketSSH(ws *websocket.Conn, ns *netstack.NetStack, address string, username string, auth []ssh.AuthMethod) error {
+	// The banner is received during the handshake but can only be shown once the terminal is attached.
+	var banner string
+
 	config := &ssh.ClientConfig{
-		User: username,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(password),
-		},
+		User:            username,
+		Auth:            auth,
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		BannerCallback: func(message string) error {
+			banner = message
+			return nil
+		},
 	}
 
 	var (
@@ -309,7 +445,24 @@ func newWebSocketSSH(ws *websocket.Conn, ns *netstack.NetStack, address string,
 	}
 	defer session.Close()
 
-	if err := session.RequestPty("xterm-256color", 25, 80, ssh.TerminalModes{
+	// The client sends it's size as soon as the websocket opens so the PTY can
+	// be created with the correct size.
+	rows, cols := 25, 80
+
+	var initialInput string
+
+	var firstEv webSshInput
+	if err := ws.ReadJSON(&firstEv); err != nil {
+		return fmt.Errorf("failed to read json: %v", err)
+	}
+
+	if firstEv.Resize && firstEv.Rows > 0 && firstEv.Cols > 0 {
+		rows, cols = firstEv.Rows, firstEv.Cols
+	} else if !firstEv.Resize {
+		initialInput = firstEv.Input
+	}
+
+	if err := session.RequestPty("xterm-256color", rows, cols, ssh.TerminalModes{
 		ssh.ECHO:          0,     // disable echoing
 		ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
 		ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
@@ -331,9 +484,21 @@ func newWebSocketSSH(ws *websocket.Conn, ns *netstack.NetStack, address string,
 		return fmt.Errorf("failed to start shell: %v", err)
 	}
 
+	if initialInput != "" {
+		if _, err := stdin.Write([]byte(initialInput)); err != nil {
+			return fmt.Errorf("failed to write to stdin: %v", err)
+		}
+	}
+
 	wsWriter := &webSocketWriter{underlyingStream: ws}
 	defer wsWriter.Close()
 
+	if banner != "" {
+		if _, err := wsWriter.Write([]byte(strings.ReplaceAll(banner, "\n", "\r\n"))); err != nil {
+			return fmt.Errorf("failed to write banner: %v", err)
+		}
+	}
+
 	go func() {
 		for {
 			// Pipe output to the websocket
@@ -354,12 +519,7 @@ func newWebSocketSSH(ws *websocket.Conn, ns *netstack.NetStack, address string,
 	}()
 
 	for {
-		var inputEv struct {
-			Resize bool   `json:"resize"`
-			Rows   int    `json:"rows"`
-			Cols   int    `json:"cols"`
-			Input  string `json:"input"`
-		}
+		var inputEv webSshInput
 		// Get input from the websocket
 		err := ws.ReadJSON(&inputEv)
 		if err != nil {
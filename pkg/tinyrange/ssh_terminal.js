@@ -3,8 +3,7 @@ function url(s) {
   var l = window.location;
   return (
     (l.protocol === "https:" ? "wss://" : "ws://") +
-    l.hostname +
-    (l.port != 80 && l.port != 443 ? ":" + l.port : "") +
+    l.host +
     l.pathname +
     s
   );
@@ -37,14 +36,14 @@ ws.addEventListener("message", (ev) => {
   }
   const out = JSON.parse(ev.data).output;
   term.write(atob(out));
-
-  if (first) {
-    ws.send(JSON.stringify({ resize: true, cols: term.cols, rows: term.rows }));
-    first = false;
-  }
+  first = false;
 });
 
 ws.addEventListener("open", (ev) => {
+  // The server waits for the initial size before creating the terminal.
+  fitAddon.fit();
+  ws.send(JSON.stringify({ resize: true, cols: term.cols, rows: term.rows }));
+
   term.writeln("Connecting, Please Wait.");
 });
 
@@ -3,6 +3,7 @@ package tinyrange
 import (
 	"context"
 	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -10,9 +11,13 @@ import (
 	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"path"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -21,10 +26,11 @@ import (
 	"github.com/tinyrange/tinyrange/pkg/filesystem"
 	"github.com/tinyrange/tinyrange/pkg/filesystem/ext4"
 	initExec "github.com/tinyrange/tinyrange/pkg/init"
+	"github.com/tinyrange/tinyrange/pkg/metrics"
 	"github.com/tinyrange/tinyrange/pkg/netstack"
 	_ "github.com/tinyrange/tinyrange/pkg/platform"
 	virtualMachine "github.com/tinyrange/tinyrange/pkg/vm"
-	gonbd "github.com/tinyrange/tinyrange/third_party/go-nbd"
+	nbdBackend "github.com/tinyrange/tinyrange/third_party/go-nbd/backend"
 	"github.com/tinyrange/vm"
 )
 
@@ -48,6 +54,8 @@ func (vm *vmBackend) ReadAt(p []byte, off int64) (n int, err error) {
 		return 0, nil
 	}
 
+	metrics.BlockDeviceReadBytes.Add(int64(n))
+
 	return
 }
 
@@ -59,6 +67,8 @@ func (vm *vmBackend) WriteAt(p []byte, off int64) (n int, err error) {
 		return 0, nil
 	}
 
+	metrics.BlockDeviceWriteBytes.Add(int64(n))
+
 	return
 }
 
@@ -72,6 +82,10 @@ func (*vmBackend) Sync() error {
 	return nil
 }
 
+// ErrRestartVM is returned by runWithConfig when the guest asks for the virtual machine
+// to be recreated from the config.
+var ErrRestartVM = errors.New("guest requested a restart")
+
 type TinyRange struct {
 	buildDir           string
 	cfg                config.TinyRangeConfig
@@ -82,6 +96,8 @@ type TinyRange struct {
 	streamingServer    string
 	client             *http.Client
 	deferredFilesystem []func() error
+	restartRequested   atomic.Bool
+	events             *eventStream
 }
 
 func (tr *TinyRange) fragmentToFilesystem(frag config.Fragment, dir filesystem.MutableDirectory) error {
@@ -219,7 +235,27 @@ func (tr *TinyRange) fragmentToFilesystem(frag config.Fragment, dir filesystem.M
 			var file filesystem.MutableFile
 
 			if name != "/" {
-				if filesystem.Exists(dir, name) {
+				if ark.Layer {
+					// Layers remove the files deleted by their command and replace the ones it changed.
+					if base := path.Base(name); strings.HasPrefix(base, filesystem.WhiteoutPrefix) {
+						target := path.Join(path.Dir(name), strings.TrimPrefix(base, filesystem.WhiteoutPrefix))
+
+						if err := filesystem.Unlink(dir, target); err != nil {
+							return fmt.Errorf("failed to remove %s: %w", target, err)
+						}
+
+						continue
+					}
+
+					// Existing directories are kept so the files inside them aren't lost.
+					if existing, err := filesystem.OpenPath(dir, name); err == nil {
+						if _, isDir := existing.File.(filesystem.Directory); !isDir || ent.Typeflag() != filesystem.TypeDirectory {
+							if err := filesystem.Unlink(dir, name); err != nil {
+								return fmt.Errorf("failed to replace %s: %w", name, err)
+							}
+						}
+					}
+				} else if filesystem.Exists(dir, name) {
 					continue
 				}
 
@@ -262,6 +298,17 @@ func (tr *TinyRange) fragmentToFilesystem(frag config.Fragment, dir filesystem.M
 					if err := filesystem.CreateChild(dir, name, link); err != nil {
 						return err
 					}
+				case filesystem.TypeCharDevice, filesystem.TypeBlockDevice:
+					node, err := filesystem.NewDeviceNode(ent.Typeflag(), ent.Devmajor(), ent.Devminor())
+					if err != nil {
+						return err
+					}
+
+					file = node
+
+					if err := filesystem.CreateChild(dir, name, node); err != nil {
+						return err
+					}
 				case filesystem.TypeRegular:
 					// slog.Info("reg", "name", name)
 					file, err = filesystem.NewOverlayFile(ent)
@@ -294,7 +341,23 @@ func (tr *TinyRange) fragmentToFilesystem(frag config.Fragment, dir filesystem.M
 	}
 }
 
-// Recurse into an filesystem.Directory and put all it's contents into a ext4 filesystem.
+// storageTooSmall reports the root filesystem running out of space with a suggested storage size.
+// The suggestion leaves room for filesystem metadata and guest writes on top of the files.
+func storageTooSmall(fsSize int64, totalSize int64, err error) error {
+	currentMb := fsSize / 1024 / 1024
+
+	// Round up to a multiple of 128mb to match the automatic resize.
+	neededMb := (totalSize*2/1024/1024 + 127) / 128 * 128
+	if neededMb <= currentMb {
+		neededMb = (currentMb*2 + 127) / 128 * 128
+	}
+
+	return fmt.Errorf(
+		"storage size %d MB is too small for %d MB of files, needs at least %d MB (try --storage %dM): %w",
+		currentMb, totalSize/1024/1024, neededMb, neededMb, err,
+	)
+}
+
 func (tr *TinyRange) filesystemToExt4(dir filesystem.Directory, fs *ext4.Ext4Filesystem, name string) error {
 	ents, err := dir.Readdir()
 	if err != nil {
@@ -364,6 +427,21 @@ func (tr *TinyRange) filesystemToExt4(dir filesystem.Directory, fs *ext4.Ext4Fil
 			if err := fs.Symlink(name, target); err != nil {
 				return fmt.Errorf("failed to make symlink: %w", err)
 			}
+		case filesystem.TypeCharDevice, filesystem.TypeBlockDevice:
+			major, minor, err := filesystem.GetDevice(ent.File)
+			if err != nil {
+				return fmt.Errorf("failed to get device: %w", err)
+			}
+
+			// Chmod may have replaced the type bits so use the kind to pick the device type.
+			mode := goFs.ModeDevice
+			if info.Kind() == filesystem.TypeCharDevice {
+				mode |= goFs.ModeCharDevice
+			}
+
+			if err := fs.Mknod(name, mode|info.Mode().Perm(), uint32(major), uint32(minor)); err != nil {
+				return fmt.Errorf("failed to make device node %s: %w", name, err)
+			}
 		case filesystem.TypeRegular:
 			f, err := ent.File.Open()
 			if err != nil {
@@ -398,11 +476,42 @@ func (tr *TinyRange) filesystemToExt4(dir filesystem.Directory, fs *ext4.Ext4Fil
 	return nil
 }
 
+// proxyForwarded copies data between a host connection and a guest connection and records how much
+// was sent each way. Idle connections are closed if a timeout is configured.
+func (tr *TinyRange) proxyForwarded(guestConn net.Conn, hostConn net.Conn) error {
+	stats, err := common.ProxyWithOptions(guestConn, hostConn, common.ProxyOptions{
+		BufferSize:  4096,
+		IdleTimeout: tr.cfg.ForwardIdleTimeout,
+	})
+
+	metrics.ForwardedToGuest.Add(stats.ClientToServer)
+	metrics.ForwardedFromGuest.Add(stats.ServerToClient)
+
+	if errors.Is(err, common.ErrProxyIdle) {
+		metrics.ForwardIdleClosed.Inc()
+
+		slog.Debug("closed idle forwarded connection", "timeout", tr.cfg.ForwardIdleTimeout)
+
+		return nil
+	}
+
+	return err
+}
+
 func (tr *TinyRange) runWithConfig() error {
+	// Each run builds its own filesystem so drop the work queued by a previous run.
+	tr.deferredFilesystem = nil
+
 	if tr.cfg.StorageSize == 0 || tr.cfg.CPUCores == 0 || tr.cfg.MemoryMB == 0 {
 		return fmt.Errorf("invalid config")
 	}
 
+	for _, arg := range tr.cfg.KernelArgs {
+		if err := config.ValidateKernelArg(arg); err != nil {
+			return err
+		}
+	}
+
 	if tr.cfg.Debug {
 		slog.Warn("enabling hypervisor debug mode")
 		tr.debug = true
@@ -415,13 +524,19 @@ func (tr *TinyRange) runWithConfig() error {
 
 	start := time.Now()
 
-	var exportedPorts []int
+	var (
+		exportedPorts   []int
+		execEnvironment []string
+	)
 
 	root := filesystem.NewMemoryDirectory()
 
 	for _, frag := range tr.cfg.RootFsFragments {
 		if port := frag.ExportPort; port != nil {
 			exportedPorts = append(exportedPorts, port.Port)
+		} else if env := frag.Environment; env != nil {
+			// Environment fragments are only passed to the host for the exec interaction.
+			execEnvironment = append(execEnvironment, env.Variables...)
 		} else {
 			if err := tr.fragmentToFilesystem(frag, root); err != nil {
 				return fmt.Errorf("failed to extract fragment to filesystem: %w", err)
@@ -436,7 +551,7 @@ func (tr *TinyRange) runWithConfig() error {
 		return fmt.Errorf("could not compute total size")
 	}
 
-	fsSize := int64(tr.cfg.StorageSize * 1024 * 1024)
+	fsSize := int64(tr.cfg.StorageSize) * 1024 * 1024
 
 	if int64(float64(totalSize)*1.5) > fsSize {
 		targetSize := int64(float64(totalSize)*1.5) / 128 / 1024 / 1024
@@ -446,6 +561,14 @@ func (tr *TinyRange) runWithConfig() error {
 		fsSize = targetSize * 128 * 1024 * 1024
 	}
 
+	// The filesystem is held in memory until the virtual machine exits. Builds in this process
+	// (like exporting a filesystem for --write-vagrant) count towards the build memory limit.
+	release, err := common.AcquireBuildMemory(context.Background(), fsSize/1024/1024)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	start = time.Now()
 
 	vmem := vm.NewVirtualMemory(fsSize, 4096)
@@ -455,12 +578,33 @@ func (tr *TinyRange) runWithConfig() error {
 		return fmt.Errorf("failed to create ext4 filesystem: %w", err)
 	}
 
+	var baseHash [32]byte
+
+	if tr.cfg.PersistFilename != "" {
+		baseHash, err = tr.persistBaseHash(fsSize)
+		if err != nil {
+			return fmt.Errorf("failed to hash the persistent disk base: %w", err)
+		}
+
+		if err := makePersistBaseDeterministic(fs, baseHash); err != nil {
+			return err
+		}
+	}
+
 	if err := tr.filesystemToExt4(root, fs, "/"); err != nil {
+		if errors.Is(err, ext4.ErrNoSpace) {
+			return storageTooSmall(fsSize, totalSize, err)
+		}
+
 		return fmt.Errorf("failed to convert filesystem to ext4: %w", err)
 	}
 
 	for _, deferred := range tr.deferredFilesystem {
 		if err := deferred(); err != nil {
+			if errors.Is(err, ext4.ErrNoSpace) {
+				return storageTooSmall(fsSize, totalSize, err)
+			}
+
 			return err
 		}
 	}
@@ -485,6 +629,20 @@ func (tr *TinyRange) runWithConfig() error {
 		return nil
 	}
 
+	var rootBackend nbdBackend.Backend = &vmBackend{vm: vmem}
+
+	if tr.cfg.PersistFilename != "" {
+		persist, err := openPersistBackend(tr.cfg.Resolve(tr.cfg.PersistFilename), rootBackend, baseHash)
+		if err != nil {
+			return fmt.Errorf("failed to open persistent disk: %w", err)
+		}
+		defer persist.Close()
+
+		slog.Debug("persisting guest writes", "filename", tr.cfg.PersistFilename)
+
+		rootBackend = persist
+	}
+
 	if tr.listenNbd != "" {
 		listener, err := net.Listen("tcp", tr.listenNbd)
 		if err != nil {
@@ -493,33 +651,7 @@ func (tr *TinyRange) runWithConfig() error {
 
 		slog.Info("nbd listening on", "addr", listener.Addr().String())
 
-		backend := &vmBackend{vm: vmem}
-
-		for {
-			conn, err := listener.Accept()
-			if errors.Is(err, net.ErrClosed) {
-				return nil
-			} else if err != nil {
-				return err
-			}
-
-			go func(conn net.Conn) {
-				slog.Debug("got nbd connection", "remote", conn.RemoteAddr().String())
-				err = gonbd.Handle(conn, []gonbd.Export{{
-					Name:        "",
-					Description: "",
-					Backend:     backend,
-				}}, &gonbd.Options{
-					ReadOnly:           false,
-					MinimumBlockSize:   1024,
-					PreferredBlockSize: uint32(backend.PreferredBlockSize()),
-					MaximumBlockSize:   32*1024*1024 - 1,
-				})
-				if err != nil {
-					slog.Warn("nbd server failed to handle", "error", err)
-				}
-			}(conn)
-		}
+		return serveNbd(listener, rootBackend)
 	}
 
 	start = time.Now()
@@ -528,39 +660,54 @@ func (tr *TinyRange) runWithConfig() error {
 	if err != nil {
 		return fmt.Errorf("failed to listen: %v", err)
 	}
-
-	backend := &vmBackend{vm: vmem}
+	defer listener.Close()
 
 	go func() {
-		for {
-			conn, err := listener.Accept()
-			if errors.Is(err, net.ErrClosed) {
-				return
-			} else if err != nil {
+		if err := serveNbd(listener, rootBackend); err != nil {
+			slog.Error("nbd server failed to accept", "error", err)
+		}
+	}()
+
+	// Each data disk is exported on it's own NBD server. They are attached after the root
+	// device in the order they are declared so the first data disk is /dev/vdb.
+	var dataDisks []string
+
+	for i, disk := range tr.cfg.DataDisks {
+		backend, closer, err := tr.openDataDisk(disk)
+		if err != nil {
+			return fmt.Errorf("failed to open data disk %d: %w", i, err)
+		}
+		defer closer.Close()
+
+		diskListener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return fmt.Errorf("failed to listen: %v", err)
+		}
+		defer diskListener.Close()
+
+		go func() {
+			if err := serveNbd(diskListener, backend); err != nil {
 				slog.Error("nbd server failed to accept", "error", err)
-				return
 			}
+		}()
 
-			go func(conn net.Conn) {
-				slog.Debug("got nbd connection", "remote", conn.RemoteAddr().String())
-				err = gonbd.Handle(conn, []gonbd.Export{{
-					Name:        "",
-					Description: "",
-					Backend:     backend,
-				}}, &gonbd.Options{
-					ReadOnly:           false,
-					MinimumBlockSize:   1024,
-					PreferredBlockSize: uint32(backend.PreferredBlockSize()),
-					MaximumBlockSize:   32*1024*1024 - 1,
-				})
-				if err != nil {
-					slog.Warn("nbd server failed to handle", "error", err)
-				}
-			}(conn)
-		}
-	}()
+		dataDisks = append(dataDisks, "nbd://"+diskListener.Addr().String())
+	}
 
 	ns := netstack.New()
+	defer ns.Close()
+
+	var allowlist *outboundAllowlist
+	if len(tr.cfg.AllowDomains) > 0 || len(tr.cfg.AllowCIDRs) > 0 {
+		allowlist, err = newOutboundAllowlist(tr.cfg.AllowDomains, tr.cfg.AllowCIDRs)
+		if err != nil {
+			return err
+		}
+
+		ns.SetOutboundFilter(func(addr netip.Addr, port uint16) bool {
+			return allowlist.allowAddr(addr)
+		})
+	}
 
 	// out, err := os.Create("local/network.pcap")
 	// if err != nil {
@@ -570,29 +717,59 @@ func (tr *TinyRange) runWithConfig() error {
 
 	// ns.OpenPacketCapture(out)
 
-	factory, err := virtualMachine.LoadVirtualMachineFactory(tr.buildDir, tr.cfg.Resolve(tr.cfg.HypervisorScript))
+	hvScript := tr.cfg.Resolve(tr.cfg.HypervisorScript)
+	if tr.cfg.HypervisorScript == "" {
+		hvScript, err = common.GetAdjacentExecutable("tinyrange_qemu.star")
+		if err != nil {
+			return fmt.Errorf("could not find default hypervisor tinyrange_qemu.star: %w", err)
+		}
+	}
+
+	factory, err := virtualMachine.LoadVirtualMachineFactory(tr.buildDir, hvScript)
 	if err != nil {
 		return fmt.Errorf("failed to load virtual machine factory: %w", err)
 	}
 
+	kernelArgs := tr.cfg.KernelArgs
+
+	// Tell init to fetch the secrets from the host.
+	if len(tr.cfg.Secrets) > 0 {
+		kernelArgs = append(slices.Clone(kernelArgs), "tinyrange.secrets=on")
+	}
+
+	// The SSH password and authorized keys are fetched the same way so they aren't stored in /init.json.
+	if tr.cfg.SshPassword != "" || tr.cfg.SshAuthorizedKeys != "" {
+		kernelArgs = append(slices.Clone(kernelArgs), "tinyrange.ssh_credentials=on")
+	}
+
 	virtualMachine, err := factory.Create(
 		tr.cfg.CPUCores,
-		tr.cfg.MemoryMB,
+		int(tr.cfg.MemoryMB),
 		tr.cfg.Architecture,
 		tr.cfg.Resolve(tr.cfg.KernelFilename),
 		tr.cfg.Resolve(tr.cfg.InitFilesystemFilename),
 		"nbd://"+listener.Addr().String(),
 		tr.cfg.Interaction,
+		dataDisks,
+		kernelArgs,
+		tr.cfg.HypervisorArgs,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to make virtual machine: %w", err)
 	}
 
+	virtualMachine.SetResourceLimits(tr.cfg.ResourceLimits)
+
 	nic, err := ns.AttachNetworkInterface()
 	if err != nil {
 		return fmt.Errorf("failed to attach network interface: %w", err)
 	}
 
+	// Set by the internal HTTP server if the guest init fails. The virtual machine is shut
+	// down and the failure is returned once the interaction has finished.
+	initFailed := make(chan error, 1)
+	var initFailing atomic.Bool
+
 	// Create internal HTTP server.
 	{
 		listen, err := ns.ListenInternal("tcp", ":80")
@@ -607,19 +784,126 @@ func (tr *TinyRange) runWithConfig() error {
 			io.CopyN(w, rand.Reader, 4096*1024*1024)
 		})
 
+		// The guest init reports failures here so they are visible without --debug.
+		mux.HandleFunc("POST /init_failure", func(w http.ResponseWriter, r *http.Request) {
+			var failure config.InitFailure
+
+			if err := json.NewDecoder(r.Body).Decode(&failure); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+
+			if failure.Stack != "" {
+				fmt.Fprintf(os.Stderr, "%s\n", failure.Stack)
+			}
+
+			if !initFailing.Swap(true) {
+				initFailed <- fmt.Errorf("guest init failed (%s): %s", failure.Phase, failure.Message)
+
+				go virtualMachine.Shutdown()
+			}
+		})
+
+		if tr.cfg.HttpCacheDirectory != "" {
+			cache, err := newHttpCache(tr.cfg.Resolve(tr.cfg.HttpCacheDirectory), tr.client)
+			if err != nil {
+				return fmt.Errorf("failed to create http cache: %w", err)
+			}
+
+			// The host makes the request so the guest allowlist has to be checked here too.
+			if allowlist != nil {
+				cache.restrictHosts(allowlist.allowHost)
+			}
+
+			mux.Handle("/proxy/", cache)
+		}
+
+		if tr.cfg.ShareCacheDirectory != "" {
+			buildCache := newBuildCacheServer(tr.cfg.Resolve(tr.cfg.ShareCacheDirectory))
+			defer buildCache.Close()
+
+			mux.Handle("/cache/", buildCache)
+		}
+
+		if len(tr.cfg.Secrets) > 0 {
+			var secretsFetched atomic.Bool
+
+			// Secrets are only handed out once so they can't be read after init has written them.
+			mux.HandleFunc("GET /secrets", func(w http.ResponseWriter, r *http.Request) {
+				if secretsFetched.Swap(true) {
+					http.Error(w, "secrets have already been fetched", http.StatusGone)
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+
+				if err := json.NewEncoder(w).Encode(tr.cfg.Secrets); err != nil {
+					slog.Error("failed to write secrets", "err", err)
+				}
+			})
+		}
+
+		if tr.cfg.SshPassword != "" || tr.cfg.SshAuthorizedKeys != "" {
+			var credentialsFetched atomic.Bool
+
+			// Like secrets the credentials are only handed out once.
+			mux.HandleFunc("GET /ssh_credentials", func(w http.ResponseWriter, r *http.Request) {
+				if credentialsFetched.Swap(true) {
+					http.Error(w, "ssh credentials have already been fetched", http.StatusGone)
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+
+				credentials := config.SshServerCredentials{
+					Password:       tr.cfg.SshPassword,
+					AuthorizedKeys: tr.cfg.SshAuthorizedKeys,
+				}
+
+				if err := json.NewEncoder(w).Encode(&credentials); err != nil {
+					slog.Error("failed to write ssh credentials", "err", err)
+				}
+			})
+		}
+
+		// The guest can ask for the virtual machine to be recreated from the config using `/init -restart`.
+		mux.HandleFunc("POST /restart", func(w http.ResponseWriter, r *http.Request) {
+			if interaction != "ssh" && interaction != "vnc" && interaction != "serial" {
+				http.Error(w, "restart is not supported with "+interaction, http.StatusNotImplemented)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+
+			tr.restartRequested.Store(true)
+
+			go virtualMachine.Shutdown()
+		})
+
+		server := &http.Server{Handler: mux}
+		defer server.Close()
+
 		go func() {
-			slog.Error("failed to serve", "err", http.Serve(listen, mux))
+			err := server.Serve(listen)
+			if !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("failed to serve", "err", err)
+			}
 		}()
 	}
 
 	// Create DNS server.
 	{
+		internalHosts := map[string]string{
+			"tinyrange.":     "10.42.0.2",
+			"host.internal.": "10.42.0.1",
+		}
+
 		dnsServer := &dnsServer{
 			dnsLookup: func(name string) (string, error) {
-				if name == "tinyrange." {
-					return "10.42.0.2", nil
-				} else if name == "host.internal." {
-					return "10.42.0.1", nil
+				if ip, ok := internalHosts[name]; ok {
+					return ip, nil
 				}
 
 				slog.Debug("doing DNS lookup", "name", name)
@@ -630,9 +914,28 @@ func (tr *TinyRange) runWithConfig() error {
 					return "", err
 				}
 
+				if allowlist != nil {
+					allowlist.addResolved(addr.IP.String())
+				}
+
 				return string(addr.IP.String()), nil
 			},
 		}
+		if allowlist != nil {
+			dnsServer.allowName = func(name string) bool {
+				if _, ok := internalHosts[name]; ok {
+					return true
+				}
+
+				return allowlist.allowName(name)
+			}
+		}
+		for name, ip := range internalHosts {
+			if err := dnsServer.addReverseName(ip, name); err != nil {
+				return fmt.Errorf("failed to add reverse DNS name: %w", err)
+			}
+		}
+
 		dnsMux := dns.NewServeMux()
 
 		dnsMux.HandleFunc(".", dnsServer.handleDnsRequest)
@@ -648,6 +951,7 @@ func (tr *TinyRange) runWithConfig() error {
 			Handler:    dnsMux,
 			PacketConn: packetConn,
 		}
+		defer dnsServer.server.Shutdown()
 
 		go func() {
 			err := dnsServer.server.ActivateAndServe()
@@ -657,17 +961,39 @@ func (tr *TinyRange) runWithConfig() error {
 		}()
 	}
 
-	// Create forwarder for SSH connection.
+	sshGuestAddress := net.JoinHostPort("10.42.0.2", strconv.Itoa(tr.cfg.SshGuestPort()))
+
+	sshForwardAddress := ""
 	if tr.forwardSsh {
-		sshListen, err := net.Listen("tcp", "localhost:2222")
+		sshForwardAddress = "localhost:2222"
+	}
+
+	// The info interaction forwards SSH (to info,<address> if it's given) and prints how to connect.
+	if interaction == "info" || strings.HasPrefix(interaction, "info,") {
+		sshForwardAddress = "localhost:2222"
+		if address, ok := strings.CutPrefix(interaction, "info,"); ok && address != "" {
+			sshForwardAddress = address
+		}
+	}
+
+	var sshListenAddress net.Addr
+
+	// Create forwarder for SSH connection.
+	if sshForwardAddress != "" {
+		sshListen, err := net.Listen("tcp", sshForwardAddress)
 		if err != nil {
 			return err
 		}
+		defer sshListen.Close()
+
+		sshListenAddress = sshListen.Addr()
 
 		go func() {
 			for {
 				conn, err := sshListen.Accept()
-				if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				} else if err != nil {
 					slog.Error("failed to accept", "err", err)
 					return
 				}
@@ -675,14 +1001,14 @@ func (tr *TinyRange) runWithConfig() error {
 				go func() {
 					defer conn.Close()
 
-					clientConn, err := ns.DialInternalContext(context.Background(), "tcp", "10.42.0.2:2222")
+					clientConn, err := ns.DialInternalContext(context.Background(), "tcp", sshGuestAddress)
 					if err != nil {
 						slog.Error("failed to dial vm ssh", "err", err)
 						return
 					}
 					defer clientConn.Close()
 
-					if err := common.Proxy(clientConn, conn, 4096); err != nil {
+					if err := tr.proxyForwarded(clientConn, conn); err != nil {
 						slog.Error("failed to proxy ssh connection", "err", err)
 						return
 					}
@@ -696,11 +1022,14 @@ func (tr *TinyRange) runWithConfig() error {
 		if err != nil {
 			return err
 		}
+		defer portListen.Close()
 
 		go func() {
 			for {
 				conn, err := portListen.Accept()
-				if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				} else if err != nil {
 					slog.Error("failed to accept", "err", err)
 					return
 				}
@@ -715,7 +1044,7 @@ func (tr *TinyRange) runWithConfig() error {
 					}
 					defer clientConn.Close()
 
-					if err := common.Proxy(clientConn, conn, 4096); err != nil {
+					if err := tr.proxyForwarded(clientConn, conn); err != nil {
 						slog.Error("failed to proxy connection", "err", err)
 						return
 					}
@@ -726,51 +1055,140 @@ func (tr *TinyRange) runWithConfig() error {
 
 	slog.Debug("starting virtual machine", "took", time.Since(start))
 
-	if interaction == "ssh" || interaction == "vnc" {
-		go func() {
-			if err := virtualMachine.Run(nic, tr.debug); err != nil {
-				slog.Error("failed to run virtual machine", "err", err)
-				os.Exit(1)
+	tr.events.Emit(EventBooting)
+
+	sshUsername, sshPassword := tr.cfg.SshCredentials()
+
+	sshAuth, err := sshAuthMethods(tr.cfg)
+	if err != nil {
+		return err
+	}
+
+	sshReady := func() { tr.events.Emit(EventSshReady) }
+
+	// The virtual machine exits with an error when it's killed for a restart or a failed init.
+	stopping := func() bool { return tr.restartRequested.Load() || initFailing.Load() }
+
+	interact := func() error {
+		if interaction == "ssh" || interaction == "vnc" {
+			go func() {
+				if err := virtualMachine.Run(nic, tr.debug); err != nil && !stopping() {
+					slog.Error("failed to run virtual machine", "err", err)
+					os.Exit(1)
+				}
+			}()
+			defer virtualMachine.Shutdown()
+			defer tr.events.Emit(EventShuttingDown)
+
+			// return nil
+
+			if interaction == "vnc" {
+				go runVncClient(ns, "10.42.0.2:5901")
 			}
-		}()
-		defer virtualMachine.Shutdown()
 
-		// return nil
+			command := ""
 
-		if interaction == "vnc" {
-			go runVncClient(ns, "10.42.0.2:5901")
-		}
+			// Start a loop so SSH can be restarted when requested by the user.
+			for {
+				err := connectOverSsh(ns, sshGuestAddress, sshUsername, sshAuth, command, sshReady)
+
+				var exitErr *ExitStatusError
+				if tr.restartRequested.Load() {
+					return ErrRestartVM
+				} else if err == ErrRestart {
+					continue
+				} else if err != nil && !errors.As(err, &exitErr) {
+					return fmt.Errorf("failed to connect over ssh: %w", err)
+				}
+
+				if tr.cfg.KeepAlive && command == "" {
+					fmt.Fprintf(os.Stderr, "The command exited. The virtual machine is still running, exit this shell to shut it down.\n")
+
+					command = keepAliveCommand
+					sshReady = func() {}
+
+					continue
+				}
+
+				// The exit status of the session is passed to the caller.
+				return err
+			}
+		} else if interaction == "exec" {
+			go func() {
+				if err := virtualMachine.Run(nic, tr.debug); err != nil && !stopping() {
+					slog.Error("failed to run virtual machine", "err", err)
+					os.Exit(1)
+				}
+			}()
+			defer virtualMachine.Shutdown()
+			defer tr.events.Emit(EventShuttingDown)
+
+			status, err := execOverSsh(ns, sshGuestAddress, sshUsername, sshAuth, tr.cfg.ExecCommand, execEnvironment, sshReady)
+			if err != nil {
+				return fmt.Errorf("failed to exec over ssh: %w", err)
+			}
+
+			if status != 0 {
+				return &ExitStatusError{Status: status}
+			}
 
-		// Start a loop so SSH can be restarted when requested by the user.
-		for {
-			err = connectOverSsh(ns, "10.42.0.2:2222", "root", "insecurepassword")
-			if err == ErrRestart {
-				continue
+			return nil
+		} else if interaction == "serial" {
+			if err := virtualMachine.Run(nic, true); tr.restartRequested.Load() {
+				return ErrRestartVM
 			} else if err != nil {
-				return fmt.Errorf("failed to connect over ssh: %w", err)
+				return err
 			}
+			defer virtualMachine.Shutdown()
+			defer tr.events.Emit(EventShuttingDown)
 
 			return nil
+		} else if strings.HasPrefix(interaction, "webssh") {
+			go func() {
+				if err := virtualMachine.Run(nic, tr.debug); err != nil && !stopping() {
+					slog.Error("failed to run virtual machine", "err", err)
+					os.Exit(1)
+				}
+			}()
+			defer virtualMachine.Shutdown()
+			defer tr.events.Emit(EventShuttingDown)
+
+			tlsOpts := common.TLSOptions{TLS: tr.cfg.WebTLS, CertFile: tr.cfg.Resolve(tr.cfg.WebTLSCert), KeyFile: tr.cfg.Resolve(tr.cfg.WebTLSKey)}
+
+			return runWebSsh(ns, sshGuestAddress, sshUsername, sshAuth, strings.TrimPrefix(interaction, "webssh,"), tlsOpts)
+		} else if interaction == "info" || strings.HasPrefix(interaction, "info,") {
+			exited := make(chan error, 1)
+
+			go func() {
+				exited <- virtualMachine.Run(nic, tr.debug)
+			}()
+			defer virtualMachine.Shutdown()
+			defer tr.events.Emit(EventShuttingDown)
+
+			return runSshInfo(ns, sshGuestAddress, sshListenAddress, sshUsername, sshAuth, sshPassword, tr.cfg.Resolve(tr.cfg.SshKey), sshReady, exited)
+		} else {
+			return fmt.Errorf("unknown interaction: %s", interaction)
 		}
-	} else if interaction == "serial" {
-		if err := virtualMachine.Run(nic, true); err != nil {
-			return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- interact() }()
+
+	select {
+	case err := <-done:
+		if initFailing.Load() {
+			return <-initFailed
 		}
-		defer virtualMachine.Shutdown()
 
-		return nil
-	} else if strings.HasPrefix(interaction, "webssh") {
-		go func() {
-			if err := virtualMachine.Run(nic, tr.debug); err != nil {
-				slog.Error("failed to run virtual machine", "err", err)
-				os.Exit(1)
-			}
-		}()
-		defer virtualMachine.Shutdown()
+		return err
+	case err := <-initFailed:
+		// Give the interaction a chance to clean up now the virtual machine is shutting down.
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
 
-		return runWebSsh(ns, "10.42.0.2:2222", "root", "insecurepassword", strings.TrimPrefix(interaction, "webssh,"))
-	} else {
-		return fmt.Errorf("unknown interaction: %s", interaction)
+		return err
 	}
 }
 
@@ -783,7 +1201,22 @@ func RunWithConfig(
 	listenNbd string,
 	streamingServer string,
 ) error {
+	if cfg.Name != "" {
+		// Label every log line so several virtual machines can be told apart.
+		slog.SetDefault(slog.Default().With("vm", cfg.Name))
+	}
+
+	events, err := openEventStream(cfg.EventsSocket, cfg.Name)
+	if err != nil {
+		return err
+	}
+	defer events.Close()
+
+	metrics.ActiveVMs.Inc()
+	defer metrics.ActiveVMs.Dec()
+
 	tr := &TinyRange{
+		events:           events,
 		buildDir:         buildDir,
 		cfg:              cfg,
 		debug:            debug,
@@ -794,5 +1227,20 @@ func RunWithConfig(
 		client:           http.DefaultClient,
 	}
 
-	return tr.runWithConfig()
+	for {
+		err := tr.runWithConfig()
+		if err == ErrRestartVM {
+			slog.Info("restarting virtual machine")
+
+			tr.events.Emit(EventRestarting)
+
+			tr.restartRequested.Store(false)
+
+			continue
+		}
+
+		tr.events.Exited(err)
+
+		return err
+	}
 }
@@ -1,23 +1,89 @@
 package tinyrange
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
+	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
+	"path"
 	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/tinyrange/tinyrange/pkg/browser/browser"
+	"github.com/tinyrange/tinyrange/pkg/common"
 	"github.com/tinyrange/tinyrange/pkg/htm"
 	"github.com/tinyrange/tinyrange/pkg/htm/bootstrap"
 	"github.com/tinyrange/tinyrange/pkg/htm/html"
 	"github.com/tinyrange/tinyrange/pkg/netstack"
+	"golang.org/x/crypto/ssh"
 )
 
 //go:embed ssh_static/*
 var ssh_static embed.FS
 
+// A static asset served under a name containing a hash of its contents.
+type staticAsset struct {
+	name     string
+	contents []byte
+}
+
+// fingerprinted assets keyed by their hashed URL path relative to the page.
+var sshStaticAssets = make(map[string]staticAsset)
+
+// original filenames mapped to their hashed URL path relative to the page.
+var sshStaticPaths = make(map[string]string)
+
+func init() {
+	ents, err := ssh_static.ReadDir("ssh_static")
+	if err != nil {
+		panic(err)
+	}
+
+	for _, ent := range ents {
+		contents, err := ssh_static.ReadFile(path.Join("ssh_static", ent.Name()))
+		if err != nil {
+			panic(err)
+		}
+
+		sum := sha256.Sum256(contents)
+
+		// xterm.min.js becomes xterm.<hash>.min.js
+		// The path is relative so the page still works behind a proxy that serves it under a prefix.
+		base, ext, _ := strings.Cut(ent.Name(), ".")
+		urlPath := fmt.Sprintf("ssh_static/%s.%s.%s", base, hex.EncodeToString(sum[:])[:16], ext)
+
+		sshStaticAssets[urlPath] = staticAsset{name: ent.Name(), contents: contents}
+		sshStaticPaths[ent.Name()] = urlPath
+	}
+}
+
+func sshStaticPath(name string) string {
+	urlPath, ok := sshStaticPaths[name]
+	if !ok {
+		panic("unknown static asset: " + name)
+	}
+
+	return urlPath
+}
+
+func serveSshStatic(w http.ResponseWriter, r *http.Request) {
+	asset, ok := sshStaticAssets[strings.TrimPrefix(r.URL.Path, "/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	// The content hash is part of the filename so the asset never changes.
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+
+	http.ServeContent(w, r, asset.name, time.Time{}, bytes.NewReader(asset.contents))
+}
+
 //go:embed ssh_terminal.js
 var sshJsRaw string
 
@@ -57,9 +123,9 @@ margin-bottom: 1rem;
 	)
 
 	interaction := htm.Group{
-		html.JavaScriptSrc("./ssh_static/xterm.min.js"),
-		html.LinkCSS("./ssh_static/xterm.css"),
-		html.JavaScriptSrc("./ssh_static/xterm-addon-fit.min.js"),
+		html.JavaScriptSrc(sshStaticPath("xterm.min.js")),
+		html.LinkCSS(sshStaticPath("xterm.css")),
+		html.JavaScriptSrc(sshStaticPath("xterm-addon-fit.min.js")),
 		bootstrap.Button(bootstrap.ButtonColorDark, html.Text("Toggle Fill Screen"), html.Id("fillScreen")),
 		html.Div(html.Id("terminal")),
 		SSH_CSS,
@@ -91,7 +157,7 @@ margin-bottom: 1rem;
 
 var upgrader = websocket.Upgrader{}
 
-func runWebSsh(ns *netstack.NetStack, address string, username string, password string, args string) error {
+func runWebSsh(ns *netstack.NetStack, address string, username string, auth []ssh.AuthMethod, args string, tlsOpts common.TLSOptions) error {
 	host, arg, _ := strings.Cut(args, ",")
 
 	minimal := arg == "minimal"
@@ -104,7 +170,7 @@ func runWebSsh(ns *netstack.NetStack, address string, username string, password
 		}
 	})
 
-	mux.Handle("/ssh_static/", http.FileServer(http.FS(ssh_static)))
+	mux.HandleFunc("/ssh_static/", serveSshStatic)
 
 	mux.HandleFunc("/spawn", func(w http.ResponseWriter, r *http.Request) {
 		ws, err := upgrader.Upgrade(w, r, nil)
@@ -113,7 +179,7 @@ func runWebSsh(ns *netstack.NetStack, address string, username string, password
 			return
 		}
 
-		if err := newWebSocketSSH(ws, ns, address, username, password); err != nil {
+		if err := newWebSocketSSH(ws, ns, address, username, auth); err != nil {
 			slog.Warn("failed to create SSH connection", "error", err)
 			return
 		}
@@ -124,15 +190,17 @@ func runWebSsh(ns *netstack.NetStack, address string, username string, password
 		return err
 	}
 
+	url := tlsOpts.Scheme() + "://" + listener.Addr().String()
+
 	if arg == "nobrowser" || arg == "minimal" {
 
 	} else {
-		if err := browser.Open("http://" + listener.Addr().String()); err != nil {
+		if err := browser.Open(url); err != nil {
 			return err
 		}
 	}
 
-	slog.Info("listening", "address", "http://"+listener.Addr().String())
+	slog.Info("listening", "address", url)
 
-	return http.Serve(listener, mux)
+	return common.ServeHTTP(listener, mux, tlsOpts)
 }
@@ -1,15 +1,19 @@
 package trweb
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"slices"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/agnivade/levenshtein"
 	"github.com/tinyrange/tinyrange/pkg/common"
 	"github.com/tinyrange/tinyrange/pkg/config"
 	"github.com/tinyrange/tinyrange/pkg/database"
@@ -18,13 +22,27 @@ import (
 	"github.com/tinyrange/tinyrange/pkg/htm/html"
 	"github.com/tinyrange/tinyrange/pkg/htm/htmx"
 	"github.com/tinyrange/tinyrange/pkg/login"
+	"github.com/tinyrange/tinyrange/pkg/metrics"
 )
 
+// runningVM is a virtual machine started from the web interface.
+type runningVM struct {
+	cmd      *exec.Cmd
+	name     string
+	template string
+	started  time.Time
+}
+
 type WebApplication struct {
 	mux           *http.ServeMux
 	db            *database.PackageDatabase
 	webSshAddress string
-	runningCmd    *exec.Cmd
+	tlsOpts       common.TLSOptions
+
+	mtx         sync.Mutex
+	cancelBuild context.CancelFunc
+	buildErr    error
+	running     *runningVM
 }
 
 func (app *WebApplication) pageLayout(body ...htm.Fragment) htm.Fragment {
@@ -62,12 +80,30 @@ func (app *WebApplication) serveFragment(w http.ResponseWriter, r *http.Request,
 }
 
 func (app *WebApplication) serveIndex(w http.ResponseWriter, r *http.Request) {
-	if app.runningCmd != nil {
+	app.mtx.Lock()
+	building := app.cancelBuild != nil
+	running := app.running != nil
+	buildErr := app.buildErr
+	app.buildErr = nil
+	app.mtx.Unlock()
+
+	if building {
+		http.Redirect(w, r, "/building", http.StatusFound)
+		return
+	}
+
+	if running {
 		http.Redirect(w, r, "/run", http.StatusFound)
 		return
 	}
 
+	var errorAlert htm.Fragment = htm.Group{}
+	if buildErr != nil {
+		errorAlert = bootstrap.Alert(bootstrap.AlertColorDanger, html.Textf("Build failed: %s", buildErr))
+	}
+
 	app.serveFragment(w, r, app.pageLayout(
+		errorAlert,
 		html.Form(
 			html.Id("start-form"),
 			html.FormTarget("POST", "/start"),
@@ -76,6 +112,11 @@ func (app *WebApplication) serveIndex(w http.ResponseWriter, r *http.Request) {
 				Options: []string{"alpine@3.20"},
 				Value:   "alpine@3.20",
 			}),
+			bootstrap.FormField("Name", "name", html.FormOptions{
+				Kind:        html.FormFieldText,
+				Placeholder: "Optional",
+				Value:       "",
+			}),
 			html.Div(html.Id("package_list")),
 			bootstrap.FormField("Add Package", "query",
 				html.FormOptions{
@@ -95,34 +136,78 @@ func (app *WebApplication) serveIndex(w http.ResponseWriter, r *http.Request) {
 	))
 }
 
+func (app *WebApplication) serveBuilding(w http.ResponseWriter, r *http.Request) {
+	app.mtx.Lock()
+	building := app.cancelBuild != nil
+	app.mtx.Unlock()
+
+	if !building {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	app.serveFragment(w, r, app.pageLayout(
+		htm.NewHtmlFragment("meta", htm.Attr("http-equiv", "refresh"), htm.Attr("content", "1")),
+		bootstrap.Alert(bootstrap.AlertColorInfo, html.Text("Building...")),
+		html.Form(
+			html.FormTarget("POST", "/cancel"),
+			bootstrap.SubmitButton("Cancel", bootstrap.ButtonColorDanger),
+		),
+	))
+}
+
 func (app *WebApplication) serveRun(w http.ResponseWriter, r *http.Request) {
-	if app.runningCmd == nil {
+	app.mtx.Lock()
+	running := app.running
+	app.mtx.Unlock()
+
+	if running == nil {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
 
+	var heading htm.Fragment = htm.Group{}
+	if running.name != "" {
+		heading = html.H4(html.Textf("Running %s", running.name))
+	}
+
 	app.serveFragment(w, r, app.pageLayout(
+		heading,
+		html.Div(html.Textf(
+			"Started %s from %s (pid %d)",
+			running.started.Format(time.DateTime), running.template, running.cmd.Process.Pid,
+		)),
 		html.Form(
 			html.FormTarget("POST", "/stop"),
 			bootstrap.SubmitButton("Stop", bootstrap.ButtonColorDanger),
 		),
-		htm.NewHtmlFragment("iframe", htm.Attr("src", "http://"+app.webSshAddress)),
+		htm.NewHtmlFragment("iframe", htm.Attr("src", app.tlsOpts.Scheme()+"://"+app.webSshAddress)),
 	))
 }
 
-func (app *WebApplication) runTemplate(filename string) error {
+// runTemplate starts a virtual machine from the template in filename labelled with name.
+func (app *WebApplication) runTemplate(filename string, name string) (*runningVM, error) {
 	exe, err := os.Executable()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	app.runningCmd = exec.Command(exe, "run-vm", filename)
+	cmd := exec.Command(exe, "run-vm", filename)
 
-	if err := app.runningCmd.Start(); err != nil {
-		return err
+	env, err := metrics.ChildEnvironment()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
 	}
 
-	return nil
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &runningVM{cmd: cmd, name: name, template: filename, started: time.Now()}, nil
 }
 
 func (app *WebApplication) getConfig(r *http.Request) (login.Config, error) {
@@ -133,8 +218,13 @@ func (app *WebApplication) getConfig(r *http.Request) (login.Config, error) {
 		MemorySize:  1024,
 		StorageSize: 1024,
 		WebSSH:      fmt.Sprintf("%s,minimal", app.webSshAddress),
+		WebTLS:      app.tlsOpts.TLS,
+		WebTLSCert:  app.tlsOpts.CertFile,
+		WebTLSKey:   app.tlsOpts.KeyFile,
 	}
 
+	config.Name = strings.TrimSpace(r.Form.Get("name"))
+
 	addPackages := r.Form["add_package"]
 
 	if len(addPackages) > 0 {
@@ -159,32 +249,116 @@ func (app *WebApplication) handleStart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	templateFilename, err := config.MakeTemplate(app.db)
+	app.mtx.Lock()
+	if app.cancelBuild != nil {
+		app.mtx.Unlock()
+		http.Error(w, "A build is already running", http.StatusConflict)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	app.cancelBuild = cancel
+	app.buildErr = nil
+	app.mtx.Unlock()
+
+	go app.build(ctx, cancel, config)
+
+	http.Redirect(w, r, "/building", http.StatusFound)
+}
+
+// build makes the template for config and starts the virtual machine.
+// It runs in the background so the build can be cancelled from the UI.
+func (app *WebApplication) build(ctx context.Context, cancel context.CancelFunc, config login.Config) {
+	defer cancel()
+
+	// The lock isn't held while building or starting the virtual machine so the UI stays responsive.
+	// cancelBuild stays set until the end so no other build can start in the meantime.
+	running, err := app.buildAndRun(ctx, config)
+
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+
+	app.cancelBuild = nil
+
+	if ctx.Err() != nil {
+		// The build may have been cancelled after the virtual machine was started so stop it
+		// rather than losing track of the process.
+		if running != nil {
+			slog.Info("stopping cancelled virtual machine", "name", running.name)
+
+			if err := running.cmd.Process.Kill(); err != nil {
+				slog.Error("Failed to kill process", "error", err, "name", running.name)
+			}
+		}
+
+		return
+	}
+
 	if err != nil {
-		slog.Error("Failed to get template filename", "error", err)
-		http.Error(w, "Failed to get template filename", http.StatusInternalServerError)
+		app.buildErr = err
 		return
 	}
 
+	app.running = running
+}
+
+// buildAndRun makes the template for config and runs it.
+func (app *WebApplication) buildAndRun(ctx context.Context, config login.Config) (*runningVM, error) {
+	templateFilename, err := config.MakeTemplateContext(ctx, app.db)
+
+	if ctx.Err() != nil {
+		slog.Info("build cancelled")
+
+		if err := app.db.RemovePartialOutputs(ctx); err != nil {
+			slog.Warn("Failed to remove partial build outputs", "error", err)
+		}
+
+		return nil, ctx.Err()
+	}
+
+	if err != nil {
+		slog.Error("Failed to get template filename", "error", err)
+		return nil, err
+	}
+
+	// Don't start the virtual machine if the build was cancelled while it was finishing.
+	if err := ctx.Err(); err != nil {
+		slog.Info("build cancelled")
+		return nil, err
+	}
+
 	slog.Info("running template", "filename", templateFilename)
 
-	if err := app.runTemplate(templateFilename); err != nil {
+	running, err := app.runTemplate(templateFilename, config.Name)
+	if err != nil {
 		slog.Error("Failed to run template", "error", err)
-		http.Error(w, "Failed to run template", http.StatusInternalServerError)
-		return
+		return nil, err
+	}
+
+	return running, nil
+}
+
+func (app *WebApplication) handleCancel(w http.ResponseWriter, r *http.Request) {
+	app.mtx.Lock()
+	if app.cancelBuild != nil {
+		app.cancelBuild()
 	}
+	app.mtx.Unlock()
 
-	http.Redirect(w, r, "/run", http.StatusFound)
+	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 func (app *WebApplication) handleStop(w http.ResponseWriter, r *http.Request) {
-	if app.runningCmd != nil {
-		if err := app.runningCmd.Process.Kill(); err != nil {
-			slog.Error("Failed to kill process", "error", err)
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+
+	if app.running != nil {
+		if err := app.running.cmd.Process.Kill(); err != nil {
+			slog.Error("Failed to kill process", "error", err, "name", app.running.name)
 			http.Error(w, "Failed to kill process", http.StatusInternalServerError)
 			return
 		}
-		app.runningCmd = nil
+		app.running = nil
 	}
 
 	http.Redirect(w, r, "/", http.StatusFound)
@@ -195,6 +369,12 @@ func (app *WebApplication) handlePackageResults(w http.ResponseWriter, r *http.R
 	query := r.URL.Query().Get("query")
 	existing := r.URL.Query()["add_package"]
 
+	ranking, err := database.ParseSearchRanking(r.URL.Query().Get("ranking"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	if builder == "" {
 		http.Error(w, "Missing builder", http.StatusBadRequest)
 		return
@@ -208,24 +388,7 @@ func (app *WebApplication) handlePackageResults(w http.ResponseWriter, r *http.R
 
 	ctx := app.db.NewBuildContext(nil)
 
-	b, err := app.db.GetContainerBuilder(ctx, builder, config.HostArchitecture)
-	if err != nil {
-		slog.Error("Failed to get container builder", "error", err)
-		http.Error(w, "Failed to get container builder", http.StatusInternalServerError)
-		return
-	}
-
-	q, err := common.ParsePackageQuery(query)
-	if err != nil {
-		slog.Error("Failed to parse package query", "error", err)
-		http.Error(w, "Failed to parse package query", http.StatusInternalServerError)
-		return
-	}
-
-	q.MatchDirect = true
-	q.MatchPartialName = true
-
-	results, err := b.Search(q)
+	results, err := app.db.SearchPackageNames(ctx, builder, config.HostArchitecture, query, ranking)
 	if err != nil {
 		slog.Error("Failed to search", "error", err)
 		http.Error(w, "Failed to search", http.StatusInternalServerError)
@@ -237,27 +400,14 @@ func (app *WebApplication) handlePackageResults(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	existingMap := make(map[string]struct{})
-
-	for _, pkg := range existing {
-		existingMap[pkg] = struct{}{}
-	}
-
 	var resultStrings []string
 
 	for _, result := range results {
-		if _, ok := existingMap[result.Name.String()]; ok {
+		if slices.Contains(existing, result) {
 			continue
 		}
 
-		resultStrings = append(resultStrings, result.Name.String())
-	}
-
-	// sort using levenshtein distance
-	if len(resultStrings) > 1 {
-		slices.SortFunc(resultStrings, func(a, b string) int {
-			return levenshtein.ComputeDistance(a, query) - levenshtein.ComputeDistance(b, query)
-		})
+		resultStrings = append(resultStrings, result)
 	}
 
 	var rendered htm.Group
@@ -319,15 +469,54 @@ func (app *WebApplication) handleAddPackage(w http.ResponseWriter, r *http.Reque
 
 func (app *WebApplication) Run(listen string) error {
 	app.mux.HandleFunc("GET /", app.serveIndex)
+	app.mux.HandleFunc("GET /building", app.serveBuilding)
 	app.mux.HandleFunc("GET /run", app.serveRun)
 	app.mux.HandleFunc("POST /start", app.handleStart)
+	app.mux.HandleFunc("POST /cancel", app.handleCancel)
 	app.mux.HandleFunc("POST /stop", app.handleStop)
 	app.mux.HandleFunc("GET /package_results", app.handlePackageResults)
 	app.mux.HandleFunc("GET /add_package", app.handleAddPackage)
 
-	slog.Info("Listening", "listen", "http://"+listen)
+	if err := app.tlsOpts.Validate(); err != nil {
+		return err
+	}
+
+	if app.tlsOpts.Enabled() && app.tlsOpts.CertFile == "" {
+		// Write the self-signed certificate to disk so the web interface of the virtual machine uses the same one.
+		dir, err := os.MkdirTemp("", "tinyrange-web-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+
+		app.tlsOpts.CertFile = filepath.Join(dir, "cert.pem")
+		app.tlsOpts.KeyFile = filepath.Join(dir, "key.pem")
+
+		host, _, err := net.SplitHostPort(listen)
+		if err != nil {
+			return err
+		}
+
+		if err := common.WriteSelfSignedCertificate(app.tlsOpts.CertFile, app.tlsOpts.KeyFile, host); err != nil {
+			return err
+		}
+
+		slog.Warn("using a self-signed certificate, your browser will ask you to trust it", "cert", app.tlsOpts.CertFile)
+	}
+
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Listening", "listen", app.tlsOpts.Scheme()+"://"+listen)
+
+	return common.ServeHTTP(listener, app.mux, app.tlsOpts)
+}
 
-	return http.ListenAndServe(listen, app.mux)
+// SetTLS serves the web interface and the terminal of the virtual machine over HTTPS.
+func (app *WebApplication) SetTLS(opts common.TLSOptions) {
+	app.tlsOpts = opts
 }
 
 func New(db *database.PackageDatabase) *WebApplication {
@@ -0,0 +1,86 @@
+//go:build linux
+
+package vm
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// The parent cgroup for hypervisor processes. Requires cgroup v2 and write access
+// (either running as root or a delegated subtree).
+const cgroupParent = "/sys/fs/cgroup/tinyrange"
+
+// Memory allowed on top of the guest RAM for the hypervisor itself.
+const cgroupMemoryOverheadMb = 256
+
+// The period used for the cpu.max quota.
+const cgroupCpuPeriod = 100000
+
+func writeCgroupFile(dir string, name string, value string) error {
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(value), os.FileMode(0644)); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// applyResourceLimits creates a cgroup limiting the hypervisor to the CPU cores and memory
+// allocated to the guest and arranges for cmd to be started inside it. The returned
+// function removes the cgroup and must be called after the process exits.
+func (vm *VirtualMachine) applyResourceLimits(cmd *exec.Cmd) (func(), error) {
+	if err := os.MkdirAll(cgroupParent, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup (cgroup v2 with write access to %s is required): %w", cgroupParent, err)
+	}
+
+	if err := writeCgroupFile(cgroupParent, "cgroup.subtree_control", "+cpu +memory"); err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp(cgroupParent, "vm-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cgroup: %w", err)
+	}
+
+	cleanup := func() {
+		if err := os.Remove(dir); err != nil {
+			slog.Warn("failed to remove cgroup", "dir", dir, "err", err)
+		}
+	}
+
+	if err := writeCgroupFile(dir, "cpu.max", fmt.Sprintf("%d %d", vm.cpuCores*cgroupCpuPeriod, cgroupCpuPeriod)); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	memoryLimit := int64(vm.memoryMb+cgroupMemoryOverheadMb) * 1024 * 1024
+
+	if err := writeCgroupFile(dir, "memory.max", strconv.FormatInt(memoryLimit, 10)); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	fd, err := syscall.Open(dir, syscall.O_DIRECTORY|syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		cleanup()
+		return nil, fmt.Errorf("failed to open cgroup: %w", err)
+	}
+
+	// Start the process directly in the cgroup so it never runs without limits.
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		UseCgroupFD: true,
+		CgroupFD:    fd,
+	}
+
+	slog.Debug("limiting hypervisor resources", "cgroup", dir, "cpu_cores", vm.cpuCores, "memory_limit", memoryLimit)
+
+	return func() {
+		syscall.Close(fd)
+		cleanup()
+	}, nil
+}
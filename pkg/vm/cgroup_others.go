@@ -0,0 +1,14 @@
+//go:build !linux
+
+package vm
+
+import (
+	"log/slog"
+	"os/exec"
+)
+
+func (vm *VirtualMachine) applyResourceLimits(cmd *exec.Cmd) (func(), error) {
+	slog.Warn("resource limits are only supported on linux, running the hypervisor without them")
+
+	return func() {}, nil
+}
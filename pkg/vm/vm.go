@@ -48,6 +48,10 @@ type VirtualMachine struct {
 	initrd       string
 	diskImage    string
 	interaction  string
+	dataDisks    []string
+	kernelArgs   []string
+	extraArgs    []string
+	limits       bool
 	nic          *netstack.NetworkInterface
 	cmd          *exec.Cmd
 	mtx          sync.Mutex
@@ -66,11 +70,25 @@ func (vm *VirtualMachine) runExecutable(exe *vmmFactoryExecutable, bindOutput bo
 		vm.cmd.Stdin = os.Stdin
 	}
 
+	if vm.limits {
+		cleanup, err := vm.applyResourceLimits(vm.cmd)
+		if err != nil {
+			vm.mtx.Unlock()
+			return fmt.Errorf("failed to apply resource limits: %w", err)
+		}
+		defer cleanup()
+	}
+
 	vm.mtx.Unlock()
 
 	return vm.cmd.Run()
 }
 
+// SetResourceLimits limits the hypervisor process to the CPU cores and memory allocated to the guest.
+func (vm *VirtualMachine) SetResourceLimits(enabled bool) {
+	vm.limits = enabled
+}
+
 func (vm *VirtualMachine) Shutdown() error {
 	vm.mtx.Lock()
 	defer vm.mtx.Unlock()
@@ -139,6 +157,24 @@ func (vm *VirtualMachine) Attr(name string) (starlark.Value, error) {
 		return starlark.String(runtime.GOOS), nil
 	} else if name == "interaction" {
 		return starlark.String(vm.interaction), nil
+	} else if name == "data_disks" {
+		var disks []starlark.Value
+		for _, disk := range vm.dataDisks {
+			disks = append(disks, starlark.String(disk))
+		}
+		return starlark.NewList(disks), nil
+	} else if name == "kernel_args" {
+		var kernelArgs []starlark.Value
+		for _, arg := range vm.kernelArgs {
+			kernelArgs = append(kernelArgs, starlark.String(arg))
+		}
+		return starlark.NewList(kernelArgs), nil
+	} else if name == "hypervisor_args" {
+		var args []starlark.Value
+		for _, arg := range vm.extraArgs {
+			args = append(args, starlark.String(arg))
+		}
+		return starlark.NewList(args), nil
 	} else {
 		return nil, nil
 	}
@@ -159,6 +195,9 @@ func (vm *VirtualMachine) AttrNames() []string {
 		"accelerate",
 		"verbose",
 		"os",
+		"data_disks",
+		"kernel_args",
+		"hypervisor_args",
 	}
 }
 
@@ -387,6 +426,9 @@ func (factory *VirtualMachineFactory) Create(
 	initrd string,
 	diskImage string,
 	interaction string,
+	dataDisks []string,
+	kernelArgs []string,
+	extraArgs []string,
 ) (*VirtualMachine, error) {
 	return &VirtualMachine{
 		factory:      factory,
@@ -397,6 +439,9 @@ func (factory *VirtualMachineFactory) Create(
 		initrd:       initrd,
 		diskImage:    diskImage,
 		interaction:  interaction,
+		dataDisks:    dataDisks,
+		kernelArgs:   kernelArgs,
+		extraArgs:    extraArgs,
 	}, nil
 }
 